@@ -0,0 +1,106 @@
+package rbtree
+
+import "sync"
+
+// ================= 容量受限的树 =================
+
+// 超出容量时淘汰哪一端的条目
+type EvictPolicy int
+
+const (
+	// 淘汰最小的 key
+	EvictMin EvictPolicy = iota
+	// 淘汰最大的 key
+	EvictMax
+)
+
+// BoundedRBTree 是容量受限的有序树，可用作有序缓存：插入新 key 时若已满，
+// 先按淘汰策略删除最小或最大的条目再插入。淘汰与插入在同一次加锁内完成，Len 始终不超过 maxSize。
+type BoundedRBTree struct {
+	tree    *RBTree
+	mu      sync.RWMutex
+	maxSize int
+	policy  EvictPolicy
+	onEvict func(key int, value interface{})
+}
+
+// BoundedRBTree 构造选项
+type BoundedOption func(*BoundedRBTree)
+
+// 设置淘汰回调。回调在释放锁之后调用，可以安全地访问树本身
+func WithOnEvict(fn func(key int, value interface{})) BoundedOption {
+	return func(b *BoundedRBTree) {
+		b.onEvict = fn
+	}
+}
+
+// 创建容量为 maxSize 的树，maxSize <= 0 时视为 1
+func NewBoundedRBTree(maxSize int, policy EvictPolicy, opts ...BoundedOption) *BoundedRBTree {
+	b := &BoundedRBTree{tree: NewRBTree(newArena()), maxSize: max(maxSize, 1), policy: policy}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// 插入或更新 key。更新已有 key 不会触发淘汰
+func (b *BoundedRBTree) Insert(key int, value interface{}) {
+	b.mu.Lock()
+	var evictedKey int
+	var evictedVal interface{}
+	evicted := false
+	if _, exists := b.tree.Get(key); !exists && b.tree.size >= b.maxSize {
+		if b.policy == EvictMax {
+			evictedKey, evictedVal, evicted = b.tree.PopMax()
+		} else {
+			evictedKey, evictedVal, evicted = b.tree.PopMin()
+		}
+	}
+	b.tree.Insert(key, value)
+	b.mu.Unlock()
+	if evicted && b.onEvict != nil {
+		b.onEvict(evictedKey, evictedVal)
+	}
+}
+
+func (b *BoundedRBTree) Get(key int) (interface{}, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.tree.Get(key)
+}
+
+func (b *BoundedRBTree) Delete(key int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tree.Delete(key)
+}
+
+func (b *BoundedRBTree) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.tree.size
+}
+
+// 容量上限
+func (b *BoundedRBTree) Cap() int {
+	return b.maxSize
+}
+
+func (b *BoundedRBTree) Min() (int, interface{}, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.tree.Min()
+}
+
+func (b *BoundedRBTree) Max() (int, interface{}, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.tree.Max()
+}
+
+// 按升序遍历 [start, end]，遍历期间持有读锁
+func (b *BoundedRBTree) Range(start, end int, fn func(key int, value interface{}) bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	b.tree.Range(start, end, fn)
+}
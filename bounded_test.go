@@ -0,0 +1,71 @@
+package rbtree
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestBoundedRBTree(t *testing.T) {
+	var evicted []int
+	b := NewBoundedRBTree(3, EvictMin, WithOnEvict(func(k int, v interface{}) {
+		if v.(int) != k*10 {
+			t.Errorf("evicted value for %d: got %v", k, v)
+		}
+		evicted = append(evicted, k)
+	}))
+	for _, k := range []int{5, 1, 3} {
+		b.Insert(k, k*10)
+	}
+	// 更新已有 key 不淘汰
+	b.Insert(3, 30)
+	if len(evicted) != 0 || b.Len() != 3 {
+		t.Fatalf("update should not evict: evicted=%v Len=%d", evicted, b.Len())
+	}
+	b.Insert(4, 40)
+	b.Insert(9, 90)
+	if len(evicted) != 2 || evicted[0] != 1 || evicted[1] != 3 {
+		t.Fatalf("EvictMin evicted %v, want [1 3]", evicted)
+	}
+	if k, _, _ := b.Min(); k != 4 || b.Len() != 3 {
+		t.Fatalf("after evictions: Min=%d Len=%d, want 4 and 3", k, b.Len())
+	}
+
+	evicted = nil
+	b = NewBoundedRBTree(2, EvictMax, WithOnEvict(func(k int, _ interface{}) { evicted = append(evicted, k) }))
+	b.Insert(1, 10)
+	b.Insert(2, 20)
+	b.Insert(0, 0)
+	if len(evicted) != 1 || evicted[0] != 2 {
+		t.Fatalf("EvictMax evicted %v, want [2]", evicted)
+	}
+	if _, ok := b.Get(2); ok {
+		t.Fatalf("evicted key 2 still present")
+	}
+}
+
+// 并发插入时 Len 始终不超过容量
+func TestBoundedRBTreeConcurrent(t *testing.T) {
+	const capacity = 100
+	b := NewBoundedRBTree(capacity, EvictMin)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 5000; i++ {
+				b.Insert(w*5000+i, i)
+				if n := b.Len(); n > capacity {
+					t.Errorf("Len %d exceeds capacity %d", n, capacity)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if b.Len() != capacity {
+		t.Fatalf("final Len: got %d, want %d", b.Len(), capacity)
+	}
+	if err := b.tree.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+}
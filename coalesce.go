@@ -0,0 +1,134 @@
+package rbtree
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ================= 写合并缓冲 =================
+
+// 缓冲中某个 key 的最终操作
+type pendingOp struct {
+	value   interface{}
+	deleted bool
+}
+
+// CoalescingWriter 在 PersistentManager 前加一层内存写缓冲：
+// 同一个 key 的多次更新在缓冲中合并为一次（后写覆盖前写，删除抵消之前的写入），
+// 到达数量阈值、定时器触发或显式 Flush 时才写入树和 WAL，从而减少热点 key 的 WAL 体积。
+type CoalescingWriter struct {
+	pm         *PersistentManager
+	mu         sync.Mutex
+	pending    map[int]pendingOp
+	maxPending int
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// 创建写合并缓冲。maxPending > 0 时缓冲的 key 数达到该值自动 Flush；
+// interval > 0 时启动后台定时 Flush，需调用 Close 停止。
+func NewCoalescingWriter(pm *PersistentManager, maxPending int, interval time.Duration) *CoalescingWriter {
+	cw := &CoalescingWriter{
+		pm:         pm,
+		pending:    make(map[int]pendingOp),
+		maxPending: maxPending,
+	}
+	if interval > 0 {
+		cw.stop = make(chan struct{})
+		cw.done = make(chan struct{})
+		go cw.loop(interval)
+	}
+	return cw
+}
+
+func (cw *CoalescingWriter) loop(interval time.Duration) {
+	defer close(cw.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cw.stop:
+			return
+		case <-ticker.C:
+			cw.Flush()
+		}
+	}
+}
+
+// 缓冲一次写入
+func (cw *CoalescingWriter) Put(key int, value interface{}) error {
+	return cw.add(key, pendingOp{value: value})
+}
+
+// 缓冲一次删除，会抵消此前缓冲的写入
+func (cw *CoalescingWriter) Delete(key int) error {
+	return cw.add(key, pendingOp{deleted: true})
+}
+
+func (cw *CoalescingWriter) add(key int, op pendingOp) error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	cw.pending[key] = op
+	if cw.maxPending > 0 && len(cw.pending) >= cw.maxPending {
+		return cw.flushLocked()
+	}
+	return nil
+}
+
+// 读取时优先返回缓冲中尚未落盘的值
+func (cw *CoalescingWriter) Get(key int) (interface{}, bool) {
+	cw.mu.Lock()
+	op, ok := cw.pending[key]
+	cw.mu.Unlock()
+	if ok {
+		if op.deleted {
+			return nil, false
+		}
+		return op.value, true
+	}
+	return cw.pm.Get(key)
+}
+
+// 把缓冲中每个 key 的最终操作按 key 升序写入树和 WAL
+func (cw *CoalescingWriter) Flush() error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	return cw.flushLocked()
+}
+
+func (cw *CoalescingWriter) flushLocked() error {
+	keys := make([]int, 0, len(cw.pending))
+	for k := range cw.pending {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	for _, k := range keys {
+		op := cw.pending[k]
+		var err error
+		if op.deleted {
+			err = cw.pm.Delete(k)
+		} else {
+			err = cw.pm.Insert(k, op.value)
+		}
+		if err != nil {
+			// 未写入的操作保留在缓冲中，等待下次 Flush
+			return err
+		}
+		delete(cw.pending, k)
+	}
+	return nil
+}
+
+// 停止后台定时 Flush 并写入剩余缓冲；可重复或并发调用
+func (cw *CoalescingWriter) Close() error {
+	cw.closeOnce.Do(func() {
+		if cw.stop != nil {
+			close(cw.stop)
+			<-cw.done
+		}
+	})
+	return cw.Flush()
+}
@@ -0,0 +1,144 @@
+package rbtree
+
+import (
+	"bufio"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 统计 WAL 文件中修改树的记录数（不含序号标记）
+func countWALRecords(t *testing.T, walPath string) int {
+	f, err := os.Open(walPath)
+	if err != nil {
+		t.Fatalf("open WAL failed: %v", err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	n := 0
+	var offset int64
+	for {
+		var op walOp
+		size, err := readWALRecord(r, offset, &op)
+		if err != nil {
+			return n
+		}
+		offset += size
+		if op.Op != opSeqMark {
+			n++
+		}
+	}
+}
+
+func TestCoalescingWriter(t *testing.T) {
+	const walFile = "test_coalesce_wal.log"
+	defer os.Remove(walFile)
+
+	tree := NewShardedRBTreeOpt(0)
+	pm, err := NewPersistentManager(tree, walFile)
+	if err != nil {
+		t.Fatalf("NewPersistentManager failed: %v", err)
+	}
+	cw := NewCoalescingWriter(pm, 0, 0)
+
+	for i := 0; i < 100; i++ {
+		if err := cw.Put(1, i); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	// Flush 前树中还没有，但缓冲可读
+	if _, ok := tree.Get(1); ok {
+		t.Fatalf("key 1 should not reach the tree before Flush")
+	}
+	if v, ok := cw.Get(1); !ok || v.(int) != 99 {
+		t.Fatalf("buffered Get: got %v (ok=%v), want 99", v, ok)
+	}
+	if err := cw.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if v, ok := tree.Get(1); !ok || v.(int) != 99 {
+		t.Fatalf("after Flush: got %v (ok=%v), want 99", v, ok)
+	}
+	if n := countWALRecords(t, walFile); n != 1 {
+		t.Fatalf("WAL records after coalesced flush: got %d, want 1", n)
+	}
+
+	// 删除抵消之前的写入
+	cw.Put(2, "a")
+	cw.Put(2, "b")
+	cw.Delete(2)
+	cw.Delete(1)
+	if err := cw.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if _, ok := tree.Get(1); ok {
+		t.Fatalf("key 1 should be deleted")
+	}
+	if _, ok := tree.Get(2); ok {
+		t.Fatalf("key 2 should be deleted")
+	}
+	if n := countWALRecords(t, walFile); n != 3 {
+		t.Fatalf("WAL records: got %d, want 3", n)
+	}
+}
+
+func TestCoalescingWriterThresholdAndTimer(t *testing.T) {
+	const walFile = "test_coalesce_timer_wal.log"
+	defer os.Remove(walFile)
+
+	tree := NewShardedRBTreeOpt(0)
+	pm, err := NewPersistentManager(tree, walFile)
+	if err != nil {
+		t.Fatalf("NewPersistentManager failed: %v", err)
+	}
+
+	// 数量阈值触发
+	cw := NewCoalescingWriter(pm, 10, 0)
+	for i := 0; i < 10; i++ {
+		cw.Put(i, i)
+	}
+	if _, ok := tree.Get(9); !ok {
+		t.Fatalf("reaching maxPending should flush")
+	}
+
+	// 定时触发
+	cw = NewCoalescingWriter(pm, 0, 5*time.Millisecond)
+	defer cw.Close()
+	cw.Put(100, "timer")
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := tree.Get(100); ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timer should flush buffered writes")
+}
+
+func TestCoalescingWriterConcurrentClose(t *testing.T) {
+	const walFile = "test_coalesce_close_wal.log"
+	defer os.Remove(walFile)
+
+	pm, err := NewPersistentManager(NewShardedRBTreeOpt(0), walFile)
+	if err != nil {
+		t.Fatalf("NewPersistentManager failed: %v", err)
+	}
+	cw := NewCoalescingWriter(pm, 0, time.Millisecond)
+	cw.Put(1, "x")
+	// 并发重复 Close 不应重复关闭 stop 通道而 panic
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := cw.Close(); err != nil {
+				t.Errorf("Close failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if v, ok := pm.Get(1); !ok || v != "x" {
+		t.Fatalf("Close should flush buffered writes, got (%v, %v)", v, ok)
+	}
+}
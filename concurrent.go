@@ -0,0 +1,331 @@
+package rbtree
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// ================= 细粒度锁（lock coupling）红黑树 =================
+
+// ConcurrentRBTree 是第五种并发策略：每个节点自带互斥锁，操作沿路径逐个加锁（hand-over-hand），
+// 不相交子树上的操作可以真正并行。
+//
+//   - Get 从哨兵节点开始交替加锁：先锁子节点再释放父节点，任意时刻至多持有两把锁。
+//   - Insert 采用自顶向下的插入算法：下降途中提前变色并旋转，因此修复只涉及当前节点
+//     向上至多三层的窗口（曾祖父、祖父、父、当前），只需对窗口内的节点加锁，不需要自底向上回溯。
+//   - Delete 采用自顶向下的删除算法：下降途中把红色推向目标，窗口为祖父、父、当前节点，
+//     加上旋转涉及的兄弟节点及其子节点；找到的目标节点一直锁到最后用前驱替换为止。
+//
+// 所有锁都只在持有父节点锁时获取，因此加锁顺序始终自上而下，不会死锁。
+// 节点颜色只在持有其父节点锁时读写，子节点指针只在持有该节点锁时读写。
+type ConcurrentRBTree struct {
+	// 哨兵节点，head.link[1] 为根节点
+	head cnode
+	size atomic.Int64
+}
+
+type cnode struct {
+	mu    sync.Mutex
+	key   int
+	value interface{}
+	red   bool
+	link  [2]*cnode
+}
+
+func NewConcurrentRBTree() *ConcurrentRBTree {
+	return &ConcurrentRBTree{}
+}
+
+func isRed(n *cnode) bool {
+	return n != nil && n.red
+}
+
+// 以 root 为轴向 dir 方向单旋转，返回新的子树根
+func rotateSingle(root *cnode, dir int) *cnode {
+	save := root.link[1-dir]
+	root.link[1-dir] = save.link[dir]
+	save.link[dir] = root
+	root.red = true
+	save.red = false
+	return save
+}
+
+// 以 root 为轴向 dir 方向双旋转，返回新的子树根
+func rotateDouble(root *cnode, dir int) *cnode {
+	root.link[1-dir] = rotateSingle(root.link[1-dir], 1-dir)
+	return rotateSingle(root, dir)
+}
+
+func (c *ConcurrentRBTree) Get(key int) (interface{}, bool) {
+	c.head.mu.Lock()
+	n := c.head.link[1]
+	if n == nil {
+		c.head.mu.Unlock()
+		return nil, false
+	}
+	n.mu.Lock()
+	c.head.mu.Unlock()
+	for {
+		if key == n.key {
+			v := n.value
+			n.mu.Unlock()
+			return v, true
+		}
+		dir := 0
+		if n.key < key {
+			dir = 1
+		}
+		next := n.link[dir]
+		if next == nil {
+			n.mu.Unlock()
+			return nil, false
+		}
+		next.mu.Lock()
+		n.mu.Unlock()
+		n = next
+	}
+}
+
+func (c *ConcurrentRBTree) Insert(key int, value interface{}) {
+	// 窗口：t -> g -> p -> q，均已加锁；未知或不存在时为 nil
+	var t, g *cnode
+	p := &c.head
+	p.mu.Lock()
+	q := p.link[1]
+	if q == nil {
+		p.link[1] = &cnode{key: key, value: value}
+		c.size.Add(1)
+		p.mu.Unlock()
+		return
+	}
+	q.mu.Lock()
+	// qdir: p 到 q 的方向；pdir: g 到 p 的方向
+	qdir, pdir := 1, 0
+	inserted := false
+
+	for {
+		if q == nil {
+			q = &cnode{key: key, value: value, red: true}
+			q.mu.Lock()
+			p.link[qdir] = q
+			inserted = true
+		} else if isRed(q.link[0]) && isRed(q.link[1]) {
+			// 变色：把红色向上推
+			q.red = true
+			q.link[0].red = false
+			q.link[1].red = false
+			if p == &c.head {
+				q.red = false
+			}
+		}
+
+		// 修复连续红节点。根节点始终为黑，因此此时 g 和 t 一定已知
+		if isRed(q) && isRed(p) {
+			dir2 := 0
+			if t.link[1] == g {
+				dir2 = 1
+			}
+			if q == p.link[pdir] {
+				// 单旋转后 p 成为子树根：窗口变为 t -> p -> q
+				t.link[dir2] = rotateSingle(g, 1-pdir)
+				g.mu.Unlock()
+				g, t = t, nil
+				pdir = dir2
+			} else {
+				// 双旋转后 q 成为子树根：窗口变为 t -> q
+				t.link[dir2] = rotateDouble(g, 1-pdir)
+				g.mu.Unlock()
+				p.mu.Unlock()
+				p, g, t = t, nil, nil
+				qdir = dir2
+			}
+		}
+
+		if inserted {
+			break
+		}
+		if q.key == key {
+			q.value = value
+			break
+		}
+
+		// 下降一层，释放窗口顶端
+		nextDir := 0
+		if q.key < key {
+			nextDir = 1
+		}
+		if t != nil {
+			t.mu.Unlock()
+		}
+		t, g, p = g, p, q
+		pdir, qdir = qdir, nextDir
+		q = p.link[qdir]
+		if q != nil {
+			q.mu.Lock()
+		}
+	}
+
+	for _, n := range [4]*cnode{t, g, p, q} {
+		if n != nil {
+			n.mu.Unlock()
+		}
+	}
+	if inserted {
+		c.size.Add(1)
+	}
+}
+
+// Delete 使用自顶向下删除：下降途中把红色推向目标，最后用前驱替换找到的节点并摘除前驱。
+// 只对窗口内的节点加锁，根节点在持有哨兵锁时保持黑色。
+func (c *ConcurrentRBTree) Delete(key int) {
+	head := &c.head
+	head.mu.Lock()
+	if head.link[1] == nil {
+		head.mu.Unlock()
+		return
+	}
+
+	// held 为当前持有锁的节点
+	held := []*cnode{head}
+	lock := func(n *cnode) {
+		n.mu.Lock()
+		held = append(held, n)
+	}
+	var g, p *cnode
+	var f *cnode // 找到的节点
+	q := head
+	dir := 1
+	for q.link[dir] != nil {
+		last := dir
+		next := q.link[dir]
+		lock(next)
+		g, p, q = p, q, next
+		held = unlockExcept(held, g, p, q, f)
+		dir = 0
+		if q.key < key {
+			dir = 1
+		}
+		if q.key == key {
+			f = q
+		}
+
+		// 把红色向下推
+		if !isRed(q) && !isRed(q.link[dir]) {
+			if r := q.link[1-dir]; isRed(r) {
+				lock(r)
+				p.link[last] = rotateSingle(q, dir)
+				p = p.link[last]
+			} else if s := p.link[1-last]; s != nil {
+				lock(s)
+				if !isRed(s.link[1-last]) && !isRed(s.link[last]) {
+					p.red = false
+					s.red = true
+					q.red = true
+				} else {
+					dir2 := 0
+					if g.link[1] == p {
+						dir2 = 1
+					}
+					if isRed(s.link[last]) {
+						lock(s.link[last])
+						g.link[dir2] = rotateDouble(p, last)
+					} else if isRed(s.link[1-last]) {
+						g.link[dir2] = rotateSingle(p, last)
+					}
+					q.red = true
+					g.link[dir2].red = g != head
+					g.link[dir2].link[0].red = false
+					g.link[dir2].link[1].red = false
+				}
+			}
+		}
+	}
+
+	if f != nil {
+		// 用前驱（或自身）替换后摘除 q
+		f.key, f.value = q.key, q.value
+		child := q.link[0]
+		if child == nil {
+			child = q.link[1]
+		}
+		if p.link[1] == q {
+			p.link[1] = child
+		} else {
+			p.link[0] = child
+		}
+		if p == head && child != nil {
+			child.red = false
+		}
+		c.size.Add(-1)
+	}
+	unlockExcept(held)
+}
+
+// 释放 held 中除 keep 以外的节点锁，返回仍持有的节点
+func unlockExcept(held []*cnode, keep ...*cnode) []*cnode {
+	out := held[:0]
+	for _, n := range held {
+		kept := false
+		for _, k := range keep {
+			if n == k {
+				kept = true
+				break
+			}
+		}
+		if kept {
+			out = append(out, n)
+		} else {
+			n.mu.Unlock()
+		}
+	}
+	return out
+}
+
+// 区间遍历 [start, end]，闭区间，按 key 升序；fn 返回 false 时立即停止。
+// 先自上而下锁住区间涉及的全部节点（只在持有父节点锁时给子节点加锁，与其他操作的加锁顺序一致），
+// 持锁期间完成遍历，因此 fn 看到的是一致快照；遍历期间触及这些节点的写操作会被阻塞
+func (c *ConcurrentRBTree) Range(start, end int, fn func(key int, value interface{}) bool) {
+	head := &c.head
+	head.mu.Lock()
+	held := []*cnode{head}
+	for i := 0; i < len(held); i++ {
+		n := held[i]
+		for dir, child := range n.link {
+			if child == nil {
+				continue
+			}
+			// 区间之外的子树不必加锁
+			if n != head && (dir == 0 && n.key <= start || dir == 1 && n.key >= end) {
+				continue
+			}
+			child.mu.Lock()
+			held = append(held, child)
+		}
+	}
+	defer unlockExcept(held)
+
+	var walk func(n *cnode) bool
+	walk = func(n *cnode) bool {
+		if n == nil {
+			return true
+		}
+		if n.key > start && !walk(n.link[0]) {
+			return false
+		}
+		if n.key >= start && n.key <= end {
+			if !fn(n.key, n.value) {
+				return false
+			}
+		}
+		if n.key < end {
+			return walk(n.link[1])
+		}
+		return true
+	}
+	walk(head.link[1])
+}
+
+// 元素个数
+func (c *ConcurrentRBTree) Len() int {
+	return int(c.size.Load())
+}
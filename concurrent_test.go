@@ -0,0 +1,216 @@
+package rbtree
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// ----------------- 工具：ConcurrentRBTree 性质检查 -----------------
+// 返回 black-height，并检查 BST 顺序与红黑性质
+func validateCNode(t *testing.T, n *cnode, lo, hi int, hasLo, hasHi bool) int {
+	if n == nil {
+		return 1
+	}
+	if (hasLo && n.key <= lo) || (hasHi && n.key >= hi) {
+		t.Fatalf("BST order violated at key %d", n.key)
+	}
+	if n.red && (isRed(n.link[0]) || isRed(n.link[1])) {
+		t.Fatalf("red node %d has red child", n.key)
+	}
+	lbh := validateCNode(t, n.link[0], lo, n.key, hasLo, true)
+	rbh := validateCNode(t, n.link[1], n.key, hi, true, hasHi)
+	if lbh != rbh {
+		t.Fatalf("black-height mismatch at key %d: %d vs %d", n.key, lbh, rbh)
+	}
+	if !n.red {
+		return lbh + 1
+	}
+	return lbh
+}
+
+func checkConcurrentRB(t *testing.T, c *ConcurrentRBTree) {
+	root := c.head.link[1]
+	if root != nil && root.red {
+		t.Fatalf("root must be black")
+	}
+	validateCNode(t, root, 0, 0, false, false)
+}
+
+// 中序收集所有条目
+func collectCNodes(n *cnode, out map[int]interface{}) {
+	if n == nil {
+		return
+	}
+	collectCNodes(n.link[0], out)
+	out[n.key] = n.value
+	collectCNodes(n.link[1], out)
+}
+
+// ----------------- 功能性测试 -----------------
+func TestConcurrentRBTreeSequential(t *testing.T) {
+	c := NewConcurrentRBTree()
+	ref := make(map[int]int)
+	r := rand.New(rand.NewSource(3))
+	for i := 0; i < 20000; i++ {
+		k := r.Intn(500)
+		switch r.Intn(3) {
+		case 0, 1:
+			c.Insert(k, i)
+			ref[k] = i
+		case 2:
+			c.Delete(k)
+			delete(ref, k)
+		}
+		if i%97 == 0 {
+			checkConcurrentRB(t, c)
+		}
+	}
+	checkConcurrentRB(t, c)
+	if c.Len() != len(ref) {
+		t.Fatalf("Len: got %d, want %d", c.Len(), len(ref))
+	}
+	for k := 0; k < 500; k++ {
+		v, ok := c.Get(k)
+		want, wok := ref[k]
+		if ok != wok || (ok && v.(int) != want) {
+			t.Fatalf("Get(%d): got %v (ok=%v), want %v (ok=%v)", k, v, ok, want, wok)
+		}
+	}
+
+	// 顺序插入与全部删除
+	c = NewConcurrentRBTree()
+	for i := 0; i < 1000; i++ {
+		c.Insert(i, i)
+	}
+	checkConcurrentRB(t, c)
+	for i := 0; i < 1000; i++ {
+		c.Delete(i)
+		if i%50 == 0 {
+			checkConcurrentRB(t, c)
+		}
+	}
+	if c.Len() != 0 || c.head.link[1] != nil {
+		t.Fatalf("tree should be empty, Len=%d", c.Len())
+	}
+}
+
+// ----------------- 并发压力测试（建议配合 -race） -----------------
+func TestConcurrentRBTreeStress(t *testing.T) {
+	c := NewConcurrentRBTree()
+	G := 8
+	keySpace := 4096
+	ops := 20000
+	refs := make([]map[int]int, G)
+
+	var wg sync.WaitGroup
+	for g := 0; g < G; g++ {
+		refs[g] = make(map[int]int)
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(g)))
+			ref := refs[g]
+			for i := 0; i < ops; i++ {
+				// 每个 goroutine 只操作 key ≡ g (mod G)，key 彼此交错，共享同一条路径
+				k := r.Intn(keySpace/G)*G + g
+				switch r.Intn(10) {
+				case 0, 1, 2, 3, 4:
+					c.Insert(k, i)
+					ref[k] = i
+				case 5, 6:
+					c.Delete(k)
+					delete(ref, k)
+				default:
+					v, ok := c.Get(k)
+					want, wok := ref[k]
+					if ok != wok || (ok && v.(int) != want) {
+						t.Errorf("goroutine %d Get(%d): got %v (ok=%v), want %v (ok=%v)", g, k, v, ok, want, wok)
+						return
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	checkConcurrentRB(t, c)
+	all := make(map[int]interface{})
+	collectCNodes(c.head.link[1], all)
+	total := 0
+	for _, ref := range refs {
+		total += len(ref)
+		for k, v := range ref {
+			if got, ok := all[k]; !ok || got.(int) != v {
+				t.Fatalf("key %d: got %v (ok=%v), want %d", k, got, ok, v)
+			}
+		}
+	}
+	if len(all) != total || c.Len() != total {
+		t.Fatalf("size mismatch: tree has %d (Len=%d), reference has %d", len(all), c.Len(), total)
+	}
+}
+
+// 并发删除使用节点锁：删除时用前驱替换节点不能让其他 key 短暂不可见
+func TestConcurrentRBTreeDeleteKeepsOtherKeysVisible(t *testing.T) {
+	c := NewConcurrentRBTree()
+	const keySpace = 3000
+	// 3 的倍数为常驻 key，始终存在
+	for k := 0; k < keySpace; k += 3 {
+		c.Insert(k, k)
+	}
+	done := make(chan struct{})
+	var writers, readers sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		writers.Add(1)
+		go func(g int) {
+			defer writers.Done()
+			r := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < 20000; i++ {
+				k := r.Intn(keySpace/3)*3 + 1 + r.Intn(2)
+				if r.Intn(2) == 0 {
+					c.Insert(k, k)
+				} else {
+					c.Delete(k)
+				}
+			}
+		}(g)
+	}
+	for g := 0; g < 4; g++ {
+		readers.Add(1)
+		go func(g int) {
+			defer readers.Done()
+			r := rand.New(rand.NewSource(int64(100 + g)))
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				k := r.Intn(keySpace/3) * 3
+				if v, ok := c.Get(k); !ok || v.(int) != k {
+					t.Errorf("resident key %d: got %v (ok=%v)", k, v, ok)
+					return
+				}
+			}
+		}(g)
+	}
+	writers.Wait()
+	close(done)
+	readers.Wait()
+
+	checkConcurrentRB(t, c)
+	all := make(map[int]interface{})
+	collectCNodes(c.head.link[1], all)
+	if len(all) != c.Len() {
+		t.Fatalf("Len %d, tree holds %d entries", c.Len(), len(all))
+	}
+	for k := 0; k < keySpace; k += 3 {
+		if _, ok := all[k]; !ok {
+			t.Fatalf("resident key %d lost", k)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package rbtree
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// ================= 调试输出 =================
+
+// 树结构的 JSON 表示，空子节点输出为 null
+type structureNode struct {
+	Key   int            `json:"key"`
+	Red   bool           `json:"red"`
+	Left  *structureNode `json:"left"`
+	Right *structureNode `json:"right"`
+}
+
+func toStructure(n *node) *structureNode {
+	if n == nil {
+		return nil
+	}
+	return &structureNode{
+		Key:   n.key,
+		Red:   n.color == red,
+		Left:  toStructure(n.left),
+		Right: toStructure(n.right),
+	}
+}
+
+// StructureJSON 以递归 JSON 输出树的真实形状（含颜色），便于前端可视化。
+// 与按 key 排序输出条目不同，这里保留了节点间的父子关系，空树输出 null。
+func (t *RBTree) StructureJSON() ([]byte, error) {
+	return json.Marshal(toStructure(t.root))
+}
+
+// Dump 按 key 升序每行输出一个条目，便于用 grep/awk 排查问题。
+// format 为 nil 时使用 "key\tvalue" 格式；行尾的换行由 Dump 添加。
+func (t *RBTree) Dump(w io.Writer, format func(key int, value interface{}) string) error {
+	if format == nil {
+		format = func(key int, value interface{}) string {
+			return fmt.Sprintf("%d\t%v", key, value)
+		}
+	}
+	bw := bufio.NewWriter(w)
+	var err error
+	t.forEach(func(k int, v interface{}) bool {
+		if _, err = bw.WriteString(format(k, v)); err != nil {
+			return false
+		}
+		err = bw.WriteByte('\n')
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// WriteDOT 以 Graphviz DOT 格式输出树的形状：红节点填充红色、黑节点填充黑色，
+// 标签为 key 和子树大小，空子节点画成小的黑色 nil 方框。仅用于诊断，例如
+// `dot -Tsvg tree.dot -o tree.svg`。返回写入 w 时遇到的第一个错误
+func (t *RBTree) WriteDOT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph rbtree {")
+	fmt.Fprintln(bw, "\tnode [style=filled, fontcolor=white, fontname=\"Helvetica\"];")
+	nils := 0
+	child := func(parent, c *node) {
+		if c != nil {
+			fmt.Fprintf(bw, "\t\"%d\" -> \"%d\";\n", parent.key, c.key)
+			return
+		}
+		fmt.Fprintf(bw, "\tnil%d [label=\"nil\", shape=box, width=0.3, height=0.2, fontsize=8, fillcolor=black];\n", nils)
+		fmt.Fprintf(bw, "\t\"%d\" -> nil%d;\n", parent.key, nils)
+		nils++
+	}
+	var walk func(n *node)
+	walk = func(n *node) {
+		fill := "black"
+		if n.color == red {
+			fill = "red"
+		}
+		fmt.Fprintf(bw, "\t\"%d\" [label=\"%d\\nsize=%d\", fillcolor=%s];\n", n.key, n.key, n.size, fill)
+		child(n, n.left)
+		child(n, n.right)
+		if n.left != nil {
+			walk(n.left)
+		}
+		if n.right != nil {
+			walk(n.right)
+		}
+	}
+	if t.root != nil {
+		walk(t.root)
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+// ================= 操作日志 =================
+
+// 操作日志中记录的结构变化类型
+type OpKind byte
+
+const (
+	// 插入了新节点（覆盖已有 key 的值不改变结构，不记录）
+	OpInsert OpKind = iota + 1
+	// 摘除了一个节点
+	OpDelete
+)
+
+// 一次结构变化
+type Op struct {
+	Kind OpKind
+	Key  int
+}
+
+// EnableOpLog 开始记录树的每一次结构变化（新节点插入、节点摘除），已开启时保留已有记录。
+// 记录发生在节点层面，因此 Insert、Delete 之外的 GetOrInsert、DeleteMin、DeleteRange、Clear 等也会被记录；
+// 开启后 Merge、InsertEntries 不再整体重建，以保证 ReplayOps 能得到完全相同的形状。
+// 未开启时每次变化只多一次 nil 判断
+func (t *RBTree) EnableOpLog() {
+	if t.ops == nil {
+		t.ops = make([]Op, 0, 64)
+	}
+}
+
+// 返回已记录的操作日志副本
+func (t *RBTree) OpLog() []Op {
+	return append([]Op(nil), t.ops...)
+}
+
+// ReplayOps 在新树上依次重放 ops 并返回该树，value 均为 nil。
+// 配合 Validate 可以逐步缩短一段导致损坏的操作序列
+func ReplayOps(a *arena, ops []Op) *RBTree {
+	t := NewRBTree(a)
+	for _, op := range ops {
+		switch op.Kind {
+		case OpInsert:
+			t.Insert(op.Key, nil)
+		case OpDelete:
+			t.Delete(op.Key)
+		}
+	}
+	return t
+}
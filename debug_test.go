@@ -0,0 +1,178 @@
+package rbtree
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// ----------------- 结构 JSON 测试 -----------------
+func TestRBTreeStructureJSON(t *testing.T) {
+	tree := NewRBTree(newArena())
+	data, err := tree.StructureJSON()
+	if err != nil || string(data) != "null" {
+		t.Fatalf("StructureJSON on empty tree: got %s (err=%v), want null", data, err)
+	}
+
+	// 插入 1,2,3 后旋转为：2(黑) -> 1(红), 3(红)
+	for i := 1; i <= 3; i++ {
+		tree.Insert(i, i)
+	}
+	// 再插入 4 触发变色：2(黑) -> 1(黑), 3(黑) -> 右 4(红)
+	tree.Insert(4, 4)
+
+	data, err = tree.StructureJSON()
+	if err != nil {
+		t.Fatalf("StructureJSON failed: %v", err)
+	}
+	want := `{"key":2,"red":false,` +
+		`"left":{"key":1,"red":false,"left":null,"right":null},` +
+		`"right":{"key":3,"red":false,"left":null,` +
+		`"right":{"key":4,"red":true,"left":null,"right":null}}}`
+	if string(data) != want {
+		t.Fatalf("StructureJSON:\n got %s\nwant %s", data, want)
+	}
+
+	// 能被还原为同样的结构
+	var s structureNode
+	if err := json.Unmarshal(data, &s); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if s.Key != 2 || s.Red || s.Left.Key != 1 || s.Right.Right.Key != 4 || !s.Right.Right.Red || s.Left.Left != nil {
+		t.Fatalf("unexpected decoded structure: %+v", s)
+	}
+}
+
+// ----------------- 文本导出测试 -----------------
+func TestRBTreeDump(t *testing.T) {
+	tree := NewRBTree(newArena())
+	for _, k := range []int{5, -3, 12, 0} {
+		tree.Insert(k, fmt.Sprintf("v%d", k))
+	}
+
+	var buf bytes.Buffer
+	if err := tree.Dump(&buf, nil); err != nil {
+		t.Fatalf("Dump failed: %v", err)
+	}
+	want := "-3\tv-3\n0\tv0\n5\tv5\n12\tv12\n"
+	if buf.String() != want {
+		t.Fatalf("Dump default format:\n got %q\nwant %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	err := tree.Dump(&buf, func(k int, v interface{}) string {
+		return fmt.Sprintf("key=%d value=%v", k, v)
+	})
+	if err != nil {
+		t.Fatalf("Dump failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 4 || lines[0] != "key=-3 value=v-3" || lines[3] != "key=12 value=v12" {
+		t.Fatalf("Dump custom format: got %q", lines)
+	}
+
+	// 写入错误会被返回
+	if err := tree.Dump(errWriter{}, nil); err == nil {
+		t.Fatalf("Dump should report writer errors")
+	}
+}
+
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestRBTreeWriteDOT(t *testing.T) {
+	var buf bytes.Buffer
+	empty := NewRBTree(newArena())
+	if err := empty.WriteDOT(&buf); err != nil {
+		t.Fatalf("WriteDOT failed: %v", err)
+	}
+	if strings.Contains(buf.String(), "->") || !strings.HasSuffix(buf.String(), "}\n") {
+		t.Fatalf("empty tree DOT: %q", buf.String())
+	}
+
+	tree := NewRBTree(newArena())
+	for _, k := range []int{10, -5, 20, 30} {
+		tree.Insert(k, nil)
+	}
+	buf.Reset()
+	if err := tree.WriteDOT(&buf); err != nil {
+		t.Fatalf("WriteDOT failed: %v", err)
+	}
+	out := buf.String()
+	// 插入 30 后 -5、20 变黑，30 为红
+	for _, want := range []string{
+		`"10" [label="10\nsize=4", fillcolor=black];`,
+		`"30" [label="30\nsize=1", fillcolor=red];`,
+		`"10" -> "-5";`,
+		`"20" -> "30";`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("DOT output missing %q:\n%s", want, out)
+		}
+	}
+	// 4 个节点共有 5 个空子节点
+	if n := strings.Count(out, `[label="nil"`); n != 5 {
+		t.Fatalf("DOT output has %d nil boxes, want 5:\n%s", n, out)
+	}
+	if strings.Count(out, "->") != 8 {
+		t.Fatalf("DOT output should have 3 tree edges and 5 nil edges:\n%s", out)
+	}
+
+	if err := tree.WriteDOT(errWriter{}); err == nil {
+		t.Fatalf("WriteDOT should report writer errors")
+	}
+}
+
+func TestRBTreeOpLogReplay(t *testing.T) {
+	tree := NewRBTree(newArena())
+	tree.Insert(1, nil)
+	if ops := tree.OpLog(); len(ops) != 0 {
+		t.Fatalf("op log should be off by default, got %v", ops)
+	}
+
+	tree.EnableOpLog()
+	r := rand.New(rand.NewSource(9))
+	for i := 0; i < 3000; i++ {
+		k := r.Intn(500)
+		switch r.Intn(6) {
+		case 0, 1:
+			tree.Insert(k, i)
+		case 2:
+			tree.Delete(k)
+		case 3:
+			tree.GetOrInsert(k, i)
+		case 4:
+			tree.DeleteMin()
+		case 5:
+			small := NewRBTree(newArena())
+			small.Insert(k, i)
+			small.Insert(k+1, i)
+			tree.Merge(small)
+		}
+	}
+	ops := tree.OpLog()
+	// 开启日志前已有 key 1，重放时作为第一条插入
+	replayed := ReplayOps(newArena(), append([]Op{{Kind: OpInsert, Key: 1}}, ops...))
+	if err := replayed.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := tree.StructureJSON()
+	got, _ := replayed.StructureJSON()
+	if !bytes.Equal(got, want) {
+		t.Fatalf("replayed tree shape differs from the original")
+	}
+
+	tree.Clear()
+	ops = tree.OpLog()
+	replayed = ReplayOps(newArena(), append([]Op{{Kind: OpInsert, Key: 1}}, ops...))
+	if replayed.Len() != 0 {
+		t.Fatalf("replaying a Clear should leave an empty tree, Len=%d", replayed.Len())
+	}
+}
@@ -0,0 +1,620 @@
+package rbtree
+
+import "sync"
+
+// ================= 节点与红黑树结构核心 =================
+
+type gnode[K, V any] struct {
+	key    K
+	value  V
+	color  color
+	left   *gnode[K, V]
+	right  *gnode[K, V]
+	parent *gnode[K, V]
+	// 以该节点为根的子树中的节点数（顺序统计）
+	size int
+	// 该 key 的重数，只有 RBTree 的 DupCount 策略下会大于 1
+	count int
+}
+
+func getSize[K, V any](n *gnode[K, V]) int {
+	if n == nil {
+		return 0
+	}
+	return n.size
+}
+
+func getColor[K, V any](n *gnode[K, V]) color {
+	if n == nil {
+		return black
+	}
+	return n.color
+}
+
+// rbCore 是 RBTree 与 GenericRBTree 共用的红黑树结构算法：旋转、挂接新节点后的修复、摘除节点后的修复，
+// 并在其中维护每个节点的子树大小。它不比较 key，查找与下降由外层按各自的顺序完成。
+type rbCore[K, V any] struct {
+	root *gnode[K, V]
+}
+
+func (t *rbCore[K, V]) minimum(x *gnode[K, V]) *gnode[K, V] {
+	for x.left != nil {
+		x = x.left
+	}
+	return x
+}
+
+func (t *rbCore[K, V]) maximum(x *gnode[K, V]) *gnode[K, V] {
+	for x.right != nil {
+		x = x.right
+	}
+	return x
+}
+
+// 把新节点 z 挂到 parent 的左（left 为 true）或右子节点上（parent 为 nil 时作为根），更新祖先的子树大小并修复
+func (t *rbCore[K, V]) attach(parent, z *gnode[K, V], left bool) {
+	z.parent = parent
+	if parent == nil {
+		t.root = z
+	} else if left {
+		parent.left = z
+	} else {
+		parent.right = z
+	}
+	for p := parent; p != nil; p = p.parent {
+		p.size++
+	}
+	t.insertFixup(z)
+}
+
+// 从树中摘除节点 z 并修复，不释放 z
+func (t *rbCore[K, V]) unlink(z *gnode[K, V]) {
+	y := z
+	yOrigColor := y.color
+	var x *gnode[K, V]
+	var xParent *gnode[K, V]
+
+	// 被物理摘除的是 z（至多一个孩子）或其后继 y，先更新其祖先的子树大小
+	removed := z
+	if z.left != nil && z.right != nil {
+		removed = t.minimum(z.right)
+	}
+	for p := removed.parent; p != nil; p = p.parent {
+		p.size--
+	}
+
+	if z.left == nil {
+		x = z.right
+		xParent = z.parent
+		t.transplant(z, z.right)
+	} else if z.right == nil {
+		x = z.left
+		xParent = z.parent
+		t.transplant(z, z.left)
+	} else {
+		y = t.minimum(z.right)
+		yOrigColor = y.color
+		x = y.right
+		if y.parent == z {
+			xParent = y
+		} else {
+			t.transplant(y, y.right)
+			y.right = z.right
+			y.right.parent = y
+			xParent = y.parent
+		}
+		t.transplant(z, y)
+		y.left = z.left
+		y.left.parent = y
+		y.color = z.color
+		y.size = z.size
+	}
+	if yOrigColor == black {
+		t.deleteFixup(x, xParent)
+	}
+}
+
+func (t *rbCore[K, V]) transplant(u, v *gnode[K, V]) {
+	if u.parent == nil {
+		t.root = v
+	} else if u == u.parent.left {
+		u.parent.left = v
+	} else {
+		u.parent.right = v
+	}
+	if v != nil {
+		v.parent = u.parent
+	}
+}
+
+func (t *rbCore[K, V]) rotateLeft(x *gnode[K, V]) {
+	y := x.right
+	x.right = y.left
+	if y.left != nil {
+		y.left.parent = x
+	}
+	y.parent = x.parent
+	if x.parent == nil {
+		t.root = y
+	} else if x == x.parent.left {
+		x.parent.left = y
+	} else {
+		x.parent.right = y
+	}
+	y.left = x
+	x.parent = y
+	y.size = x.size
+	x.size = getSize(x.left) + getSize(x.right) + 1
+}
+
+func (t *rbCore[K, V]) rotateRight(x *gnode[K, V]) {
+	y := x.left
+	x.left = y.right
+	if y.right != nil {
+		y.right.parent = x
+	}
+	y.parent = x.parent
+	if x.parent == nil {
+		t.root = y
+	} else if x == x.parent.right {
+		x.parent.right = y
+	} else {
+		x.parent.left = y
+	}
+	y.right = x
+	x.parent = y
+	y.size = x.size
+	x.size = getSize(x.left) + getSize(x.right) + 1
+}
+
+func (t *rbCore[K, V]) insertFixup(z *gnode[K, V]) {
+	for z.parent != nil && z.parent.color == red {
+		if z.parent == z.parent.parent.left {
+			y := z.parent.parent.right
+			if getColor(y) == red {
+				z.parent.color = black
+				y.color = black
+				z.parent.parent.color = red
+				z = z.parent.parent
+			} else {
+				if z == z.parent.right {
+					z = z.parent
+					t.rotateLeft(z)
+				}
+				z.parent.color = black
+				z.parent.parent.color = red
+				t.rotateRight(z.parent.parent)
+			}
+		} else {
+			y := z.parent.parent.left
+			if getColor(y) == red {
+				z.parent.color = black
+				y.color = black
+				z.parent.parent.color = red
+				z = z.parent.parent
+			} else {
+				if z == z.parent.left {
+					z = z.parent
+					t.rotateRight(z)
+				}
+				z.parent.color = black
+				z.parent.parent.color = red
+				t.rotateLeft(z.parent.parent)
+			}
+		}
+	}
+	t.root.color = black
+}
+
+func (t *rbCore[K, V]) deleteFixup(x, parent *gnode[K, V]) {
+	for x != t.root && getColor(x) == black {
+		if parent == nil {
+			break
+		}
+		if x == parent.left {
+			w := parent.right
+			if getColor(w) == red {
+				w.color = black
+				parent.color = red
+				t.rotateLeft(parent)
+				w = parent.right
+			}
+			if getColor(w.left) == black && getColor(w.right) == black {
+				w.color = red
+				x = parent
+				parent = x.parent
+			} else {
+				if getColor(w.right) == black {
+					if w.left != nil {
+						w.left.color = black
+					}
+					w.color = red
+					t.rotateRight(w)
+					w = parent.right
+				}
+				w.color = parent.color
+				parent.color = black
+				if w.right != nil {
+					w.right.color = black
+				}
+				t.rotateLeft(parent)
+				x = t.root
+				break
+			}
+		} else {
+			w := parent.left
+			if getColor(w) == red {
+				w.color = black
+				parent.color = red
+				t.rotateRight(parent)
+				w = parent.left
+			}
+			if getColor(w.right) == black && getColor(w.left) == black {
+				w.color = red
+				x = parent
+				parent = x.parent
+			} else {
+				if getColor(w.left) == black {
+					if w.right != nil {
+						w.right.color = black
+					}
+					w.color = red
+					t.rotateLeft(w)
+					w = parent.left
+				}
+				w.color = parent.color
+				parent.color = black
+				if w.left != nil {
+					w.left.color = black
+				}
+				t.rotateRight(parent)
+				x = t.root
+				break
+			}
+		}
+	}
+	if x != nil {
+		x.color = black
+	}
+}
+
+// 把整棵树按 toLeft 划分为两棵红黑树：toLeft 为 true 的节点在左树，其余在右树。
+// toLeft 须对中序序列单调（一段 true 之后全为 false）。沿一条路径下降，每层用 join 拼回一侧，
+// 不逐个摘除节点；join 需要的黑高每次沿左链计算，整体 O(log² n)。
+// 返回的两棵树根均为黑色、父指针为空，t.root 置为 nil，节点的子树大小保持正确
+func (t *rbCore[K, V]) split(toLeft func(n *gnode[K, V]) bool) (l, r *gnode[K, V]) {
+	l, r = splitTree(t.root, toLeft)
+	t.root = nil
+	for _, n := range [2]*gnode[K, V]{l, r} {
+		if n != nil {
+			n.parent, n.color = nil, black
+		}
+	}
+	return l, r
+}
+
+func splitTree[K, V any](n *gnode[K, V], toLeft func(n *gnode[K, V]) bool) (l, r *gnode[K, V]) {
+	if n == nil {
+		return nil, nil
+	}
+	left, right := n.left, n.right
+	if toLeft(n) {
+		rl, rr := splitTree(right, toLeft)
+		return joinTree(left, n, rl), rr
+	}
+	ll, lr := splitTree(left, toLeft)
+	return ll, joinTree(lr, n, right)
+}
+
+// 以 k 为中间节点拼接 l 和 r（l 中的 key 都在 k 之前，r 中的都在 k 之后），返回新子树的根（可能为红色）
+func joinTree[K, V any](l, k, r *gnode[K, V]) *gnode[K, V] {
+	hl, hr := blackHeight(l), blackHeight(r)
+	var root *gnode[K, V]
+	switch {
+	case hl > hr:
+		root = joinRight(l, hl, k, r, hr)
+		if getColor(root) == red && getColor(root.right) == red {
+			root.color = black
+		}
+	case hl < hr:
+		root = joinLeft(l, hl, k, r, hr)
+		if getColor(root) == red && getColor(root.left) == red {
+			root.color = black
+		}
+	default:
+		k.color = black
+		if getColor(l) == black && getColor(r) == black {
+			k.color = red
+		}
+		root = setChildren(k, l, r)
+	}
+	root.parent = nil
+	return root
+}
+
+// 沿 l 的右链下降到黑高与 r 相同的黑色节点处挂接 k，回溯时修复连续的红节点
+func joinRight[K, V any](l *gnode[K, V], hl int, k, r *gnode[K, V], hr int) *gnode[K, V] {
+	if hl == hr && getColor(l) == black {
+		k.color = red
+		return setChildren(k, l, r)
+	}
+	h := hl
+	if l.color == black {
+		h--
+	}
+	setChildren(l, l.left, joinRight(l.right, h, k, r, hr))
+	if l.color == black && getColor(l.right) == red && getColor(l.right.right) == red {
+		l.right.right.color = black
+		return rotateSubtree(l, true)
+	}
+	return l
+}
+
+// joinRight 的镜像：沿 r 的左链下降
+func joinLeft[K, V any](l *gnode[K, V], hl int, k, r *gnode[K, V], hr int) *gnode[K, V] {
+	if hl == hr && getColor(r) == black {
+		k.color = red
+		return setChildren(k, l, r)
+	}
+	h := hr
+	if r.color == black {
+		h--
+	}
+	setChildren(r, joinLeft(l, hl, k, r.left, h), r.right)
+	if r.color == black && getColor(r.left) == red && getColor(r.left.left) == red {
+		r.left.left.color = black
+		return rotateSubtree(r, false)
+	}
+	return r
+}
+
+// 子树的黑高：从根到空节点路径上的黑色节点数（含根，空树为 0）
+func blackHeight[K, V any](n *gnode[K, V]) int {
+	h := 0
+	for ; n != nil; n = n.left {
+		if n.color == black {
+			h++
+		}
+	}
+	return h
+}
+
+// 设置 n 的左右孩子及其父指针，并重新计算 n 的子树大小
+func setChildren[K, V any](n, left, right *gnode[K, V]) *gnode[K, V] {
+	n.left, n.right = left, right
+	if left != nil {
+		left.parent = n
+	}
+	if right != nil {
+		right.parent = n
+	}
+	n.size = getSize(left) + getSize(right) + 1
+	return n
+}
+
+// 不依赖整棵树的旋转：left 为 true 时左旋，返回新的子树根（其父指针由调用方设置）
+func rotateSubtree[K, V any](x *gnode[K, V], left bool) *gnode[K, V] {
+	if left {
+		y := x.right
+		setChildren(x, x.left, y.left)
+		return setChildren(y, x, y.right)
+	}
+	y := x.left
+	setChildren(x, y.right, x.right)
+	return setChildren(y, y.left, x)
+}
+
+// ================= 泛型红黑树 =================
+
+// GenericRBTree 是以任意类型为 key 的红黑树，key 的顺序完全由构造时传入的 less 决定：
+// less(a, b) 与 less(b, a) 都为 false 的两个 key 视为相等，插入相等的 key 会原地更新值。
+// less 只会以树中实际存在的 key 和调用方传入的 key 调用，不会传入空节点。
+// 结构算法与 RBTree 共用 rbCore。
+type GenericRBTree[K, V any] struct {
+	rbCore[K, V]
+	less  func(a, b K) bool
+	arena *arena
+	size  int
+}
+
+// 在 arena 中区分不同泛型实例化的节点池
+type gnodePoolKey[K, V any] struct{}
+
+// 返回 arena 中 gnode[K, V] 的节点池，同一 arena 上相同类型的树共享一个池
+func genericPool[K, V any](a *arena) *sync.Pool {
+	if p, ok := a.generic.Load(gnodePoolKey[K, V]{}); ok {
+		return p.(*sync.Pool)
+	}
+	p, _ := a.generic.LoadOrStore(gnodePoolKey[K, V]{}, &sync.Pool{
+		New: func() interface{} { return new(gnode[K, V]) },
+	})
+	return p.(*sync.Pool)
+}
+
+// 创建以 less 排序的泛型红黑树；a 为 nil 时节点直接分配，不做复用
+func NewGenericRBTree[K, V any](less func(a, b K) bool, a *arena) *GenericRBTree[K, V] {
+	return &GenericRBTree[K, V]{less: less, arena: a}
+}
+
+// IntKeyRBTree 是 key 为 int 的泛型红黑树，value 以 V 类型直接存放在节点中。
+// RBTree 的 value 是 interface{}，每次 Insert 都要把值装箱；只存一种值类型时用它可以避免这部分分配，
+// 配合 arena 复用节点后，插入路径上不再产生堆分配。
+type IntKeyRBTree[V any] = GenericRBTree[int, V]
+
+func intLess(a, b int) bool { return a < b }
+
+// 创建 key 为 int、value 类型为 V 的红黑树；a 为 nil 时节点直接分配，不做复用
+func NewIntKeyRBTree[V any](a *arena) *IntKeyRBTree[V] {
+	return NewGenericRBTree[int, V](intLess, a)
+}
+
+func (t *GenericRBTree[K, V]) newNode(key K, value V) *gnode[K, V] {
+	var n *gnode[K, V]
+	if t.arena != nil {
+		n = genericPool[K, V](t.arena).Get().(*gnode[K, V])
+	} else {
+		n = new(gnode[K, V])
+	}
+	n.key, n.value = key, value
+	n.left, n.right, n.parent = nil, nil, nil
+	n.color = red
+	n.size, n.count = 1, 1
+	return n
+}
+
+func (t *GenericRBTree[K, V]) freeNode(n *gnode[K, V]) {
+	if t.arena == nil {
+		return
+	}
+	// 清空 key/value，避免池中节点持有用户数据
+	var zk K
+	var zv V
+	n.key, n.value = zk, zv
+	n.left, n.right, n.parent = nil, nil, nil
+	genericPool[K, V](t.arena).Put(n)
+}
+
+// 元素个数
+func (t *GenericRBTree[K, V]) Len() int {
+	return t.size
+}
+
+func (t *GenericRBTree[K, V]) search(key K) *gnode[K, V] {
+	x := t.root
+	for x != nil {
+		if t.less(key, x.key) {
+			x = x.left
+		} else if t.less(x.key, key) {
+			x = x.right
+		} else {
+			return x
+		}
+	}
+	return nil
+}
+
+func (t *GenericRBTree[K, V]) Get(key K) (V, bool) {
+	if x := t.search(key); x != nil {
+		return x.value, true
+	}
+	var zero V
+	return zero, false
+}
+
+func (t *GenericRBTree[K, V]) Insert(key K, value V) {
+	var y *gnode[K, V]
+	x := t.root
+	left := false
+	for x != nil {
+		y = x
+		if t.less(key, x.key) {
+			x, left = x.left, true
+		} else if t.less(x.key, key) {
+			x, left = x.right, false
+		} else {
+			x.value = value
+			return
+		}
+	}
+	z := t.newNode(key, value)
+	t.size++
+	t.attach(y, z, left)
+}
+
+func (t *GenericRBTree[K, V]) Delete(key K) {
+	if z := t.search(key); z != nil {
+		t.deleteNode(z)
+	}
+}
+
+// 获取最小 key
+func (t *GenericRBTree[K, V]) Min() (K, V, bool) {
+	if t.root == nil {
+		var zk K
+		var zv V
+		return zk, zv, false
+	}
+	x := t.minimum(t.root)
+	return x.key, x.value, true
+}
+
+// 获取最大 key
+func (t *GenericRBTree[K, V]) Max() (K, V, bool) {
+	if t.root == nil {
+		var zk K
+		var zv V
+		return zk, zv, false
+	}
+	x := t.maximum(t.root)
+	return x.key, x.value, true
+}
+
+// 获取 key 的前驱（小于 key 的最大 key）
+func (t *GenericRBTree[K, V]) Prev(key K) (K, V, bool) {
+	x := t.root
+	var prev *gnode[K, V]
+	for x != nil {
+		if t.less(x.key, key) {
+			prev = x
+			x = x.right
+		} else {
+			x = x.left
+		}
+	}
+	if prev == nil {
+		var zk K
+		var zv V
+		return zk, zv, false
+	}
+	return prev.key, prev.value, true
+}
+
+// 获取 key 的后继（大于 key 的最小 key）
+func (t *GenericRBTree[K, V]) Next(key K) (K, V, bool) {
+	x := t.root
+	var next *gnode[K, V]
+	for x != nil {
+		if t.less(key, x.key) {
+			next = x
+			x = x.left
+		} else {
+			x = x.right
+		}
+	}
+	if next == nil {
+		var zk K
+		var zv V
+		return zk, zv, false
+	}
+	return next.key, next.value, true
+}
+
+// 按升序访问 [start, end] 内的 key，fn 返回 false 时停止
+func (t *GenericRBTree[K, V]) Range(start, end K, fn func(key K, value V) bool) {
+	var walk func(n *gnode[K, V]) bool
+	walk = func(n *gnode[K, V]) bool {
+		if n == nil {
+			return true
+		}
+		// n.key > start 时左子树可能有区间内的 key
+		if t.less(start, n.key) && !walk(n.left) {
+			return false
+		}
+		if !t.less(n.key, start) && !t.less(end, n.key) {
+			if !fn(n.key, n.value) {
+				return false
+			}
+		}
+		if t.less(n.key, end) {
+			return walk(n.right)
+		}
+		return true
+	}
+	walk(t.root)
+}
+
+func (t *GenericRBTree[K, V]) deleteNode(z *gnode[K, V]) {
+	t.unlink(z)
+	t.size--
+	t.freeNode(z)
+}
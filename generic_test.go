@@ -0,0 +1,223 @@
+package rbtree
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// 检查泛型树的红黑性质、parent 指针、子树大小与 key 顺序，返回黑高
+func checkGenericNode[K, V any](t *testing.T, tree *GenericRBTree[K, V], n *gnode[K, V]) int {
+	if n == nil {
+		return 1
+	}
+	if n.size != getSize(n.left)+getSize(n.right)+1 {
+		t.Fatalf("subtree size of %v is %d, want %d", n.key, n.size, getSize(n.left)+getSize(n.right)+1)
+	}
+	for _, c := range [2]*gnode[K, V]{n.left, n.right} {
+		if c != nil && c.parent != n {
+			t.Fatalf("child of %v has wrong parent", n.key)
+		}
+		if n.color == red && getColor(c) == red {
+			t.Fatalf("red node %v has a red child", n.key)
+		}
+	}
+	if n.left != nil && !tree.less(n.left.key, n.key) {
+		t.Fatalf("left child %v not less than %v", n.left.key, n.key)
+	}
+	if n.right != nil && !tree.less(n.key, n.right.key) {
+		t.Fatalf("right child %v not greater than %v", n.right.key, n.key)
+	}
+	l := checkGenericNode(t, tree, n.left)
+	r := checkGenericNode(t, tree, n.right)
+	if l != r {
+		t.Fatalf("black height mismatch at %v: %d vs %d", n.key, l, r)
+	}
+	if n.color == black {
+		l++
+	}
+	return l
+}
+
+func checkGenericTree[K, V any](t *testing.T, tree *GenericRBTree[K, V]) {
+	if tree.root == nil {
+		return
+	}
+	if tree.root.color != black || tree.root.parent != nil {
+		t.Fatalf("root must be black with nil parent")
+	}
+	checkGenericNode(t, tree, tree.root)
+	if tree.root.size != tree.Len() {
+		t.Fatalf("root subtree size %d, Len %d", tree.root.size, tree.Len())
+	}
+}
+
+func TestGenericRBTreeStringKeys(t *testing.T) {
+	tree := NewGenericRBTree[string, int](func(a, b string) bool { return a < b }, newArena())
+
+	// 空树上的操作不会调用比较函数访问空节点
+	if _, _, ok := tree.Min(); ok {
+		t.Fatalf("Min on empty tree should return false")
+	}
+	if _, _, ok := tree.Next("a"); ok {
+		t.Fatalf("Next on empty tree should return false")
+	}
+	tree.Delete("missing")
+	tree.Range("a", "z", func(string, int) bool {
+		t.Fatalf("Range on empty tree should not call fn")
+		return true
+	})
+
+	words := strings.Fields("pear apple fig banana cherry grape kiwi lemon mango date")
+	for i, w := range words {
+		tree.Insert(w, i)
+	}
+	// 相等的 key 原地更新
+	tree.Insert("fig", 100)
+	if tree.Len() != len(words) {
+		t.Fatalf("Len: got %d, want %d", tree.Len(), len(words))
+	}
+	if v, ok := tree.Get("fig"); !ok || v != 100 {
+		t.Fatalf("Get(fig) after update: got %d (ok=%v), want 100", v, ok)
+	}
+	checkGenericTree(t, tree)
+
+	if k, _, _ := tree.Min(); k != "apple" {
+		t.Fatalf("Min: got %q, want apple", k)
+	}
+	if k, _, _ := tree.Max(); k != "pear" {
+		t.Fatalf("Max: got %q, want pear", k)
+	}
+	if k, _, ok := tree.Prev("cherry"); !ok || k != "banana" {
+		t.Fatalf("Prev(cherry): got %q (ok=%v), want banana", k, ok)
+	}
+	if k, _, ok := tree.Next("d"); !ok || k != "date" {
+		t.Fatalf("Next(d): got %q (ok=%v), want date", k, ok)
+	}
+	if _, _, ok := tree.Next("pear"); ok {
+		t.Fatalf("Next(pear) should return false")
+	}
+
+	var got []string
+	tree.Range("banana", "grape", func(k string, _ int) bool {
+		got = append(got, k)
+		return true
+	})
+	if strings.Join(got, " ") != "banana cherry date fig grape" {
+		t.Fatalf("Range(banana, grape): got %v", got)
+	}
+	got = got[:0]
+	tree.Range("a", "z", func(k string, _ int) bool {
+		got = append(got, k)
+		return len(got) < 3
+	})
+	if strings.Join(got, " ") != "apple banana cherry" {
+		t.Fatalf("Range with early stop: got %v", got)
+	}
+}
+
+func TestGenericRBTreeRandomOps(t *testing.T) {
+	type point struct{ x, y int }
+	less := func(a, b point) bool {
+		if a.x != b.x {
+			return a.x < b.x
+		}
+		return a.y < b.y
+	}
+	for _, a := range []*arena{newArena(), nil} {
+		tree := NewGenericRBTree[point, int](less, a)
+		ref := make(map[point]int)
+		r := rand.New(rand.NewSource(7))
+		for i := 0; i < 20000; i++ {
+			p := point{r.Intn(50), r.Intn(50)}
+			if r.Intn(3) == 0 {
+				tree.Delete(p)
+				delete(ref, p)
+			} else {
+				tree.Insert(p, i)
+				ref[p] = i
+			}
+			if i%2000 == 0 {
+				checkGenericTree(t, tree)
+			}
+		}
+		checkGenericTree(t, tree)
+		if tree.Len() != len(ref) {
+			t.Fatalf("Len: got %d, want %d", tree.Len(), len(ref))
+		}
+		for p, want := range ref {
+			if v, ok := tree.Get(p); !ok || v != want {
+				t.Fatalf("Get(%v): got %d (ok=%v), want %d", p, v, ok, want)
+			}
+		}
+		var keys []point
+		for p := range ref {
+			keys = append(keys, p)
+		}
+		sort.Slice(keys, func(i, j int) bool { return less(keys[i], keys[j]) })
+		i := 0
+		tree.Range(point{-1, 0}, point{100, 0}, func(p point, _ int) bool {
+			if p != keys[i] {
+				t.Fatalf("Range order: position %d got %v, want %v", i, p, keys[i])
+			}
+			i++
+			return true
+		})
+		if i != len(keys) {
+			t.Fatalf("Range visited %d keys, want %d", i, len(keys))
+		}
+	}
+}
+
+func TestIntKeyRBTreeNoBoxing(t *testing.T) {
+	tree := NewIntKeyRBTree[int](newArena())
+	for i := 0; i < 1000; i++ {
+		tree.Insert(i, i)
+	}
+	checkGenericTree(t, tree)
+	// 覆盖已有 key 不分配节点，剩下的只有值本身的开销：泛型版本为 0，装箱版本每次至少 1
+	v := 1 << 20
+	if n := testing.AllocsPerRun(100, func() { v++; tree.Insert(v%1000, v) }); n != 0 {
+		t.Fatalf("IntKeyRBTree.Insert over an existing key: %v allocs/op, want 0", n)
+	}
+	boxed := NewRBTree(newArena())
+	for i := 0; i < 1000; i++ {
+		boxed.Insert(i, i)
+	}
+	if n := testing.AllocsPerRun(100, func() { v++; boxed.Insert(v%1000, v) }); n < 1 {
+		t.Fatalf("RBTree.Insert over an existing key: %v allocs/op, expected the value to be boxed", n)
+	}
+}
+
+// 插入路径的分配对比：每轮删除一个 key 再以新值插回，节点经由 arena 复用，
+// 装箱版本每次插入仍要为 interface{} 分配，泛型版本为 0 allocs/op
+func BenchmarkIntValueInsert(b *testing.B) {
+	const N = 1 << 12
+	b.Run("Boxed", func(b *testing.B) {
+		tree := NewRBTree(newArena())
+		for i := 0; i < N; i++ {
+			tree.Insert(i, i)
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			k := i & (N - 1)
+			tree.Delete(k)
+			tree.Insert(k, i+N)
+		}
+	})
+	b.Run("Typed", func(b *testing.B) {
+		tree := NewIntKeyRBTree[int](newArena())
+		for i := 0; i < N; i++ {
+			tree.Insert(i, i)
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			k := i & (N - 1)
+			tree.Delete(k)
+			tree.Insert(k, i+N)
+		}
+	})
+}
@@ -0,0 +1,120 @@
+package rbtree
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// ================= 二级值索引 =================
+
+// IndexedTree 在任意 Tree 外维护一个 value -> key 集合的二级索引，支持按值反查 key。
+// 所有写入都经由 IndexedTree 的锁，索引在覆盖写和删除后始终与树保持一致；
+// 直接修改底层树会使索引失效。不可比较（不能作 map key）的 value 单独记录，查询时线性比较。
+type IndexedTree struct {
+	tree       Tree
+	mu         sync.RWMutex
+	index      map[interface{}]map[int]struct{}
+	unhashable map[int]interface{}
+}
+
+// 包装一棵树并为其已有内容建立索引
+func NewIndexedTree(tree Tree) *IndexedTree {
+	w := &IndexedTree{
+		tree:       tree,
+		index:      make(map[interface{}]map[int]struct{}),
+		unhashable: make(map[int]interface{}),
+	}
+	for k, v := range ExportAll(tree) {
+		w.addIndex(k, v)
+	}
+	return w
+}
+
+// 判断 v 能否作为 map key。按值检查而不是只看类型：
+// 类型可比较的结构体或数组里如果有 interface 字段装着切片等不可比较的值，哈希时仍会 panic
+func hashable(v interface{}) bool {
+	return v == nil || reflect.ValueOf(v).Comparable()
+}
+
+func (w *IndexedTree) addIndex(key int, value interface{}) {
+	if !hashable(value) {
+		w.unhashable[key] = value
+		return
+	}
+	keys, ok := w.index[value]
+	if !ok {
+		keys = make(map[int]struct{})
+		w.index[value] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+func (w *IndexedTree) removeIndex(key int, value interface{}) {
+	if !hashable(value) {
+		delete(w.unhashable, key)
+		return
+	}
+	if keys, ok := w.index[value]; ok {
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(w.index, value)
+		}
+	}
+}
+
+func (w *IndexedTree) Insert(key int, value interface{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if old, ok := w.tree.Get(key); ok {
+		w.removeIndex(key, old)
+	}
+	w.tree.Insert(key, value)
+	w.addIndex(key, value)
+}
+
+func (w *IndexedTree) Get(key int) (interface{}, bool) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.tree.Get(key)
+}
+
+func (w *IndexedTree) Delete(key int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if old, ok := w.tree.Get(key); ok {
+		w.removeIndex(key, old)
+		w.tree.Delete(key)
+	}
+}
+
+// KeysForValue 按升序返回 value 等于 v 的所有 key。
+// eq 为 nil 时直接按 map 查找（v 需可比较）；否则对索引中每个不同的 value 调用 eq 比较，
+// 复杂度与不同 value 的个数成正比，而不是与元素个数成正比。
+func (w *IndexedTree) KeysForValue(v interface{}, eq func(a, b interface{}) bool) []int {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	var out []int
+	if eq == nil {
+		if hashable(v) {
+			for k := range w.index[v] {
+				out = append(out, k)
+			}
+		}
+	} else {
+		for val, keys := range w.index {
+			if eq(val, v) {
+				for k := range keys {
+					out = append(out, k)
+				}
+			}
+		}
+		for k, val := range w.unhashable {
+			if eq(val, v) {
+				out = append(out, k)
+			}
+		}
+	}
+	sort.Ints(out)
+	return out
+}
@@ -0,0 +1,86 @@
+package rbtree
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// ----------------- 二级值索引测试 -----------------
+func TestIndexedTree(t *testing.T) {
+	base := NewShardedRBTreeOpt(4)
+	base.Insert(100, "pre")
+	w := NewIndexedTree(base)
+
+	// 已有数据也被索引
+	if got := w.KeysForValue("pre", nil); fmt.Sprint(got) != "[100]" {
+		t.Fatalf("KeysForValue for pre-existing data: got %v", got)
+	}
+
+	for i := 0; i < 30; i++ {
+		w.Insert(i, fmt.Sprintf("v%d", i%3))
+	}
+	check := func(v string, want []int) {
+		t.Helper()
+		got := w.KeysForValue(v, nil)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("KeysForValue(%q): got %v, want %v", v, got, want)
+		}
+		// 与树的真实状态一致
+		var brute []int
+		for k := 0; k <= 100; k++ {
+			if val, ok := w.Get(k); ok && val == v {
+				brute = append(brute, k)
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(brute) {
+			t.Fatalf("KeysForValue(%q) = %v disagrees with tree state %v", v, got, brute)
+		}
+	}
+	check("v0", []int{0, 3, 6, 9, 12, 15, 18, 21, 24, 27})
+
+	// 覆盖写移动 key 到新的 value
+	w.Insert(3, "v1")
+	w.Insert(6, "v0")
+	check("v0", []int{0, 6, 9, 12, 15, 18, 21, 24, 27})
+	check("v1", []int{1, 3, 4, 7, 10, 13, 16, 19, 22, 25, 28})
+
+	// 删除
+	for k := 0; k < 30; k += 2 {
+		w.Delete(k)
+	}
+	w.Delete(1000)
+	check("v0", []int{9, 15, 21, 27})
+	check("v2", []int{5, 11, 17, 23, 29})
+	check("missing", nil)
+
+	// 自定义比较与不可比较的 value
+	w.Insert(50, []int{1, 2})
+	w.Insert(51, []int{1, 2})
+	w.Insert(52, []int{3})
+	if got := w.KeysForValue([]int{1, 2}, reflect.DeepEqual); fmt.Sprint(got) != "[50 51]" {
+		t.Fatalf("KeysForValue with eq for unhashable values: got %v", got)
+	}
+	if got := w.KeysForValue([]int{1, 2}, nil); got != nil {
+		t.Fatalf("KeysForValue without eq for unhashable value: got %v, want nil", got)
+	}
+	w.Insert(51, "v2")
+	w.Delete(50)
+	if got := w.KeysForValue([]int{1, 2}, reflect.DeepEqual); got != nil {
+		t.Fatalf("KeysForValue after overwrite/delete: got %v, want nil", got)
+	}
+	check("v2", []int{5, 11, 17, 23, 29, 51})
+
+	// 类型可比较但动态值不可比较（interface 字段里装着切片）时走线性比较，而不是 panic
+	type box struct{ v interface{} }
+	w.Insert(60, box{[]int{1}})
+	w.Insert(61, [1]interface{}{[]int{1}})
+	if got := w.KeysForValue(box{[]int{1}}, reflect.DeepEqual); fmt.Sprint(got) != "[60]" {
+		t.Fatalf("KeysForValue for struct holding a slice: got %v", got)
+	}
+	w.Delete(60)
+	w.Delete(61)
+	if got := w.KeysForValue(box{[]int{1}}, reflect.DeepEqual); got != nil {
+		t.Fatalf("KeysForValue after delete: got %v, want nil", got)
+	}
+}
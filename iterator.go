@@ -0,0 +1,254 @@
+package rbtree
+
+// ================= 快照迭代器 =================
+
+// SliceIterator 在一份有序的 key/value 拷贝上做前向迭代。
+// 拷贝在创建时一次性完成，之后的迭代不持有任何锁，
+// 因此它反映的是创建时刻（point-in-time）的树状态，
+// 迭代期间的并发写入既不会被阻塞，也不会被观察到。
+type SliceIterator struct {
+	keys   []int
+	values []interface{}
+	pos    int
+}
+
+func newSliceIterator(keys []int, values []interface{}) *SliceIterator {
+	return &SliceIterator{keys: keys, values: values, pos: -1}
+}
+
+// 前进到下一个元素，没有更多元素时返回 false
+func (it *SliceIterator) Next() bool {
+	if it.pos+1 >= len(it.keys) {
+		it.pos = len(it.keys)
+		return false
+	}
+	it.pos++
+	return true
+}
+
+// 当前元素的 key
+func (it *SliceIterator) Key() int {
+	return it.keys[it.pos]
+}
+
+// 当前元素的 value
+func (it *SliceIterator) Value() interface{} {
+	return it.values[it.pos]
+}
+
+// 快照中的元素个数
+func (it *SliceIterator) Len() int {
+	return len(it.keys)
+}
+
+// ================= 并发封装迭代器 =================
+
+// Iterator 在读锁下把整棵树按 key 升序拷贝到切片中，随即释放读锁，
+// 之后的迭代完全无锁。返回的迭代器是创建时刻的快照。
+func (s *ShardedRBTreeRW) Iterator() *SliceIterator {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var keys []int
+	var values []interface{}
+	s.tree.forEach(func(k int, v interface{}) bool {
+		keys = append(keys, k)
+		values = append(values, v)
+		return true
+	})
+	return newSliceIterator(keys, values)
+}
+
+// ================= 树迭代器 =================
+
+// Iterator 是 RBTree 上的双向迭代器，通过 Next / Prev 逐个访问元素。
+// 沿 parent 指针求后继，不物化元素也不维护栈，迭代本身不分配内存。
+// 迭代期间修改树会使迭代器失效。
+type Iterator struct {
+	tree *RBTree
+	cur  *node
+	// 下一次 Next 返回的节点
+	next *node
+	// Reset 时回到的起点：seeked 为 false 表示回到 Min
+	seekKey int
+	seeked  bool
+	// 剩余可返回的元素个数，< 0 表示不限；limit 为 Reset 时恢复的初值
+	remaining int
+	limit     int
+}
+
+// 创建定位在最小元素之前的迭代器
+func (t *RBTree) Iterator() *Iterator {
+	it := &Iterator{tree: t, limit: -1}
+	it.Reset()
+	return it
+}
+
+// IteratorRank 返回按 0 起始的中序排名遍历 [fromRank, toRank) 的迭代器：
+// 用顺序统计定位起点后逐个前进，排名被截断到 [0, Len]。
+func (t *RBTree) IteratorRank(fromRank, toRank int) *Iterator {
+	fromRank = clampRank(fromRank, t.size)
+	toRank = clampRank(toRank, t.size)
+	limit := toRank - fromRank
+	if limit < 0 {
+		limit = 0
+	}
+	it := &Iterator{tree: t, limit: limit}
+	if n := t.nodeAt(fromRank); n != nil {
+		it.seekKey, it.seeked = n.key, true
+	}
+	it.Reset()
+	return it
+}
+
+func clampRank(r, n int) int {
+	if r < 0 {
+		return 0
+	}
+	if r > n {
+		return n
+	}
+	return r
+}
+
+// 中序后继：有右子树时取右子树最小节点，否则向上找到第一个从左侧到达的祖先
+func successor(n *node) *node {
+	if n.right != nil {
+		n = n.right
+		for n.left != nil {
+			n = n.left
+		}
+		return n
+	}
+	p := n.parent
+	for p != nil && n == p.right {
+		n, p = p, p.parent
+	}
+	return p
+}
+
+// 中序前驱，与 successor 对称
+func predecessor(n *node) *node {
+	if n.left != nil {
+		n = n.left
+		for n.right != nil {
+			n = n.right
+		}
+		return n
+	}
+	p := n.parent
+	for p != nil && n == p.left {
+		n, p = p, p.parent
+	}
+	return p
+}
+
+// Seek 把迭代器定位到第一个 >= key 的元素之前，随后的 Next 返回该元素
+func (it *Iterator) Seek(key int) {
+	it.seekKey, it.seeked = key, true
+	it.cur = nil
+	it.remaining = it.limit
+	it.next = it.tree.ceiling(key)
+}
+
+// Reset 把迭代器重新定位到起点（Min 或最近一次 Seek 的位置）
+func (it *Iterator) Reset() {
+	if it.seeked {
+		it.Seek(it.seekKey)
+		return
+	}
+	it.cur = nil
+	it.remaining = it.limit
+	it.next = nil
+	if it.tree.root != nil {
+		it.next = it.tree.minimum(it.tree.root)
+	}
+}
+
+// 前进到下一个元素，没有更多元素时返回 false
+func (it *Iterator) Next() bool {
+	if it.next == nil || it.remaining == 0 {
+		it.cur = nil
+		return false
+	}
+	if it.remaining > 0 {
+		it.remaining--
+	}
+	it.cur = it.next
+	it.next = successor(it.cur)
+	return true
+}
+
+// 后退到上一个元素，越过第一个元素时返回 false，此后 Next 从最小元素重新开始。
+// 位于某个元素上时移到它的中序前驱；刚 Seek 或 Reset 之后移到定位点之前的最后一个元素
+// （Seek 的 key 不存在时即小于它的最大 key）；Next 返回 false 之后移到最后返回的元素，走到末尾时即 Max。
+// Prev 不检查 IteratorRank 的起点，终点保持不变
+func (it *Iterator) Prev() bool {
+	var p *node
+	switch {
+	case it.cur != nil:
+		p = predecessor(it.cur)
+		// 离开的元素之后可以再次被 Next 返回
+		if it.remaining >= 0 {
+			it.remaining++
+		}
+	case it.next != nil:
+		p = predecessor(it.next)
+	case it.tree.root != nil:
+		p = it.tree.maximum(it.tree.root)
+	}
+	if p == nil {
+		it.cur, it.next = nil, nil
+		if it.tree.root != nil {
+			it.next = it.tree.minimum(it.tree.root)
+		}
+		return false
+	}
+	it.cur = p
+	it.next = successor(p)
+	return true
+}
+
+// 当前元素的 key
+func (it *Iterator) Key() int {
+	return it.cur.key
+}
+
+// 当前元素的 value
+func (it *Iterator) Value() interface{} {
+	return it.cur.value
+}
+
+// GetSorted 批量查询升序排列的 keys，结果与输入一一对应。
+// 利用输入有序，用迭代器与 key 列表同步前进，整体 O(n+m)，而不是每个 key 都从根下降；
+// 输入中出现逆序的 key 时退化为普通 Get，结果仍然正确。
+func (t *RBTree) GetSorted(keys []int) []struct {
+	Value interface{}
+	Found bool
+} {
+	res := make([]struct {
+		Value interface{}
+		Found bool
+	}, len(keys))
+	if len(keys) == 0 {
+		return res
+	}
+	it := t.Iterator()
+	it.Seek(keys[0])
+	valid := it.Next()
+	// last 是最近一次按归并方式处理的 key，迭代器已越过所有小于它的元素
+	last := keys[0]
+	for i, k := range keys {
+		if k < last {
+			res[i].Value, res[i].Found = t.Get(k)
+			continue
+		}
+		last = k
+		for valid && it.Key() < k {
+			valid = it.Next()
+		}
+		if valid && it.Key() == k {
+			res[i].Value, res[i].Found = it.Value(), true
+		}
+	}
+	return res
+}
@@ -0,0 +1,384 @@
+package rbtree
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// ----------------- 快照迭代器测试 -----------------
+func TestShardedRBTreeRWIterator(t *testing.T) {
+	tree := &ShardedRBTreeRW{tree: NewRBTree(newArena())}
+	N := 100
+	for i := N - 1; i >= 0; i-- {
+		tree.Insert(i, i*10)
+	}
+
+	it := tree.Iterator()
+	if it.Len() != N {
+		t.Fatalf("Iterator Len: got %d, want %d", it.Len(), N)
+	}
+
+	expect := 0
+	for it.Next() {
+		// 迭代过程中写入不应被阻塞
+		done := make(chan struct{})
+		go func(k int) {
+			tree.Insert(N+k, k)
+			tree.Delete(k)
+			close(done)
+		}(expect)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("writer blocked during iteration at key %d", expect)
+		}
+
+		// 迭代器只反映创建时刻的状态
+		if it.Key() != expect || it.Value().(int) != expect*10 {
+			t.Fatalf("Iterator: got %d->%v, want %d->%d", it.Key(), it.Value(), expect, expect*10)
+		}
+		expect++
+	}
+	if expect != N {
+		t.Fatalf("Iterator visited %d entries, want %d", expect, N)
+	}
+	if it.Next() {
+		t.Fatalf("Next after exhaustion should return false")
+	}
+
+	// 写入确实生效
+	for i := 0; i < N; i++ {
+		if _, ok := tree.Get(i); ok {
+			t.Fatalf("expected key %d deleted by concurrent writer", i)
+		}
+		if _, ok := tree.Get(N + i); !ok {
+			t.Fatalf("expected key %d inserted by concurrent writer", N+i)
+		}
+	}
+}
+
+// ----------------- 树迭代器测试 -----------------
+func TestRBTreeIteratorReset(t *testing.T) {
+	tree := NewRBTree(newArena())
+	N := 1000
+	for i := 0; i < N; i++ {
+		tree.Insert(i*2, i)
+	}
+
+	it := tree.Iterator()
+	collect := func() []int {
+		var keys []int
+		for it.Next() {
+			keys = append(keys, it.Key())
+		}
+		return keys
+	}
+	first := collect()
+	if len(first) != N || !isSorted(first) {
+		t.Fatalf("Iterator: got %d sorted=%v, want %d sorted keys", len(first), isSorted(first), N)
+	}
+	it.Reset()
+	second := collect()
+	if fmt.Sprint(first) != fmt.Sprint(second) {
+		t.Fatalf("Iterator after Reset yields different output")
+	}
+
+	// Reset 回到最近一次 Seek 的位置
+	it.Seek(501)
+	if !it.Next() || it.Key() != 502 || it.Value().(int) != 251 {
+		t.Fatalf("Seek(501): expected 502->251")
+	}
+	it.Reset()
+	if !it.Next() || it.Key() != 502 {
+		t.Fatalf("Reset after Seek should return to 502")
+	}
+
+	// 完整迭代 + Reset 不产生新的分配
+	allocs := testing.AllocsPerRun(100, func() {
+		it.Reset()
+		for it.Next() {
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("Reset + full iteration allocated %v times per run, want 0", allocs)
+	}
+}
+
+func TestRBTreeIteratorSuccessorWalk(t *testing.T) {
+	tree := NewRBTree(newArena())
+	if it := tree.Iterator(); it.Next() {
+		t.Fatalf("Next on empty tree should return false")
+	}
+	empty := tree.Iterator()
+	empty.Seek(10)
+	if empty.Next() {
+		t.Fatalf("Next after Seek on empty tree should return false")
+	}
+
+	// 随机插入删除后，后继遍历与中序遍历一致
+	r := rand.New(rand.NewSource(11))
+	for i := 0; i < 5000; i++ {
+		k := r.Intn(2000)
+		if r.Intn(3) == 0 {
+			tree.Delete(k)
+		} else {
+			tree.Insert(k, k)
+		}
+	}
+	var want []int
+	inorder(tree.root, &want)
+	var got []int
+	for it := tree.Iterator(); it.Next(); {
+		got = append(got, it.Key())
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("iterator order differs from in-order traversal")
+	}
+
+	// 两个游标交错前进互不影响
+	a, b := tree.Iterator(), tree.Iterator()
+	b.Seek(want[len(want)/2])
+	for i := 0; i < 10; i++ {
+		if !a.Next() || !b.Next() {
+			t.Fatalf("interleaved cursors ended early")
+		}
+		if a.Key() != want[i] || b.Key() != want[len(want)/2+i] {
+			t.Fatalf("interleaved step %d: got (%d, %d), want (%d, %d)", i, a.Key(), b.Key(), want[i], want[len(want)/2+i])
+		}
+	}
+
+	// Seek 到最大 key 之后没有元素
+	a.Seek(want[len(want)-1] + 1)
+	if a.Next() {
+		t.Fatalf("Seek past max: Next should return false, got %d", a.Key())
+	}
+}
+
+func TestRBTreeIteratorPrev(t *testing.T) {
+	tree := NewRBTree(newArena())
+	if it := tree.Iterator(); it.Prev() {
+		t.Fatalf("Prev on empty tree should return false")
+	}
+	for i := 1; i <= 100; i++ {
+		tree.Insert(i*10, i)
+	}
+	it := tree.Iterator()
+
+	// Seek 到不存在的 key 后 Prev 落在小于它的最大 key 上
+	it.Seek(255)
+	if !it.Prev() || it.Key() != 250 {
+		t.Fatalf("Prev after Seek(255): want 250")
+	}
+	// Seek 到存在的 key 后 Prev 同样落在它之前
+	it.Seek(300)
+	if !it.Prev() || it.Key() != 290 {
+		t.Fatalf("Prev after Seek(300): want 290")
+	}
+	// 在匹配项两侧来回移动
+	it.Seek(500)
+	if !it.Next() || it.Key() != 500 || !it.Prev() || it.Key() != 490 || !it.Next() || it.Key() != 500 || !it.Next() || it.Key() != 510 {
+		t.Fatalf("Next/Prev around 500 moved to the wrong elements")
+	}
+
+	// 越过第一个元素返回 false 而不 panic，之后 Next 从 Min 开始
+	it.Seek(10)
+	if it.Prev() || it.Prev() {
+		t.Fatalf("Prev before the first element should return false")
+	}
+	if !it.Next() || it.Key() != 10 {
+		t.Fatalf("Next after stepping past the beginning should return Min")
+	}
+	if it.Prev() {
+		t.Fatalf("Prev from Min should return false, got %d", it.Key())
+	}
+
+	// Seek 越过 Max 后 Prev 得到 Max；走到末尾后逐个后退得到完整的降序序列
+	it.Seek(5000)
+	if !it.Prev() || it.Key() != 1000 {
+		t.Fatalf("Prev after Seek past Max: want 1000")
+	}
+	it.Reset()
+	for it.Next() {
+	}
+	var got []int
+	for it.Prev() {
+		got = append(got, it.Key())
+	}
+	if len(got) != 100 || got[0] != 1000 || got[99] != 10 {
+		t.Fatalf("backward walk from the end: %d keys, first %v", len(got), got[:min(len(got), 3)])
+	}
+
+	// 有界迭代器：后退之后再前进仍停在原来的终点
+	w := tree.IteratorRank(10, 15)
+	for w.Next() {
+	}
+	if !w.Prev() || w.Key() != 150 || !w.Prev() || w.Key() != 140 {
+		t.Fatalf("Prev on a rank window should step back from the last element")
+	}
+	var tail []int
+	for w.Next() {
+		tail = append(tail, w.Key())
+	}
+	if fmt.Sprint(tail) != "[150]" {
+		t.Fatalf("Next after Prev on a rank window: got %v, want [150]", tail)
+	}
+}
+
+// ----------------- 相邻窗口遍历测试 -----------------
+func TestRBTreeRangeWindows(t *testing.T) {
+	tree := NewRBTree(newArena())
+	for i := 0; i < 100; i++ {
+		tree.Insert(i*i, i)
+	}
+
+	var diffs []int
+	calls := 0
+	tree.RangeWindows(100, 400, func(prev, cur, next *Entry) bool {
+		if calls == 0 && prev != nil {
+			t.Fatalf("first window should have nil prev, got %v", prev.Key)
+		}
+		if prev != nil {
+			diffs = append(diffs, cur.Key-prev.Key)
+		}
+		if next != nil && next.Key <= cur.Key {
+			t.Fatalf("next %d not after cur %d", next.Key, cur.Key)
+		}
+		if cur.Key == 400 && next != nil {
+			t.Fatalf("last window should have nil next, got %v", next.Key)
+		}
+		calls++
+		return true
+	})
+	// 区间内为 10^2..20^2，相邻差为 2i+1
+	if calls != 11 {
+		t.Fatalf("RangeWindows calls: got %d, want 11", calls)
+	}
+	for i, d := range diffs {
+		if want := 2*(10+i) + 1; d != want {
+			t.Fatalf("diff %d: got %d, want %d", i, d, want)
+		}
+	}
+
+	// 单元素区间 prev/next 均为 nil
+	tree.RangeWindows(49, 49, func(prev, cur, next *Entry) bool {
+		if prev != nil || next != nil || cur.Key != 49 || cur.Value.(int) != 7 {
+			t.Fatalf("single-entry window: got prev=%v cur=%v next=%v", prev, cur, next)
+		}
+		return true
+	})
+
+	// 提前终止
+	calls = 0
+	tree.RangeWindows(0, 10000, func(prev, cur, next *Entry) bool {
+		calls++
+		return calls < 3
+	})
+	if calls != 3 {
+		t.Fatalf("RangeWindows early stop: got %d calls, want 3", calls)
+	}
+}
+
+// ----------------- 按排名迭代测试 -----------------
+func TestRBTreeIteratorRank(t *testing.T) {
+	tree := NewRBTree(newArena())
+	for i := 0; i < 100; i++ {
+		tree.Insert(i*3, i)
+	}
+	collect := func(it *Iterator) []int {
+		var keys []int
+		for it.Next() {
+			keys = append(keys, it.Key())
+		}
+		return keys
+	}
+
+	it := tree.IteratorRank(10, 20)
+	got := collect(it)
+	if len(got) != 10 {
+		t.Fatalf("IteratorRank(10, 20) yielded %d entries, want 10", len(got))
+	}
+	for i, k := range got {
+		// 第 11~20 小的 key
+		if k != (10+i)*3 {
+			t.Fatalf("IteratorRank(10, 20) entry %d: got %d, want %d", i, k, (10+i)*3)
+		}
+	}
+	it.Reset()
+	if again := collect(it); fmt.Sprint(again) != fmt.Sprint(got) {
+		t.Fatalf("IteratorRank after Reset: got %v, want %v", again, got)
+	}
+
+	// 排名截断
+	if got := collect(tree.IteratorRank(-5, 3)); fmt.Sprint(got) != "[0 3 6]" {
+		t.Fatalf("IteratorRank(-5, 3): got %v", got)
+	}
+	if got := collect(tree.IteratorRank(97, 1000)); fmt.Sprint(got) != "[291 294 297]" {
+		t.Fatalf("IteratorRank(97, 1000): got %v", got)
+	}
+	if got := collect(tree.IteratorRank(50, 50)); len(got) != 0 {
+		t.Fatalf("IteratorRank(50, 50): got %v, want empty", got)
+	}
+	if got := collect(tree.IteratorRank(60, 40)); len(got) != 0 {
+		t.Fatalf("IteratorRank(60, 40): got %v, want empty", got)
+	}
+	if got := collect(tree.IteratorRank(100, 200)); len(got) != 0 {
+		t.Fatalf("IteratorRank past the end: got %v, want empty", got)
+	}
+}
+
+// ----------------- 有序批量查询测试 -----------------
+func TestRBTreeGetSorted(t *testing.T) {
+	tree := NewRBTree(newArena())
+	for i := 0; i < 1000; i += 2 {
+		tree.Insert(i, i*10)
+	}
+	keys := []int{-5, 0, 1, 2, 2, 499, 500, 998, 999, 5000}
+	got := tree.GetSorted(keys)
+	if len(got) != len(keys) {
+		t.Fatalf("GetSorted returned %d results, want %d", len(got), len(keys))
+	}
+	for i, k := range keys {
+		v, ok := tree.Get(k)
+		if got[i].Found != ok || got[i].Value != v {
+			t.Fatalf("GetSorted key %d: got (%v, %v), want (%v, %v)", k, got[i].Value, got[i].Found, v, ok)
+		}
+	}
+
+	// 逆序输入也能得到正确结果
+	unsorted := []int{10, 4, 7, 8, 3}
+	for i, r := range tree.GetSorted(unsorted) {
+		v, ok := tree.Get(unsorted[i])
+		if r.Found != ok || r.Value != v {
+			t.Fatalf("GetSorted unsorted key %d: got (%v, %v), want (%v, %v)", unsorted[i], r.Value, r.Found, v, ok)
+		}
+	}
+	if len(tree.GetSorted(nil)) != 0 {
+		t.Fatalf("GetSorted(nil) should return an empty result")
+	}
+}
+
+func BenchmarkRBTreeGetSorted(b *testing.B) {
+	const N = 200000
+	tree := NewRBTree(newArena())
+	for i := 0; i < N; i++ {
+		tree.Insert(i, i)
+	}
+	keys := make([]int, 0, N/2)
+	for i := 0; i < N; i += 2 {
+		keys = append(keys, i)
+	}
+	b.Run("GetSorted", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tree.GetSorted(keys)
+		}
+	})
+	b.Run("GetLoop", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, k := range keys {
+				tree.Get(k)
+			}
+		}
+	})
+}
@@ -2,9 +2,23 @@ package rbtree
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 )
 
 type Tree interface {
@@ -19,6 +33,9 @@ type walOpType byte
 const (
 	opInsert walOpType = 1
 	opDelete walOpType = 2
+	// 序号标记：不修改树，只携带截断或轮转 WAL 时的当前序号，
+	// 使 WAL 中已没有其他记录时重启后的序号仍能接着增长
+	opSeqMark walOpType = 3
 )
 
 // WAL 操作记录
@@ -26,53 +43,398 @@ type walOp struct {
 	Op    walOpType
 	Key   int
 	Value interface{}
+	// 单调递增的序号，从 1 开始；没有序号的旧记录解码为 0
+	Seq uint64
+}
+
+// 每条 WAL 记录的帧头：4 字节大端 payload 长度 + 4 字节 payload 的 CRC32（IEEE），
+// payload 为独立 Encoder 写出的 gob 编码 walOp
+const walHeaderSize = 8
+
+// 单条记录 payload 的长度上限，超过时视为长度字段损坏
+const maxWALRecordSize = 64 << 20
+
+// 记录在文件末尾不完整（进程在写入中途被杀），重放应在此正常结束
+var errWALTornTail = errors.New("rbtree: torn WAL tail")
+
+// 按帧格式写出一条记录
+func encodeWALRecord(w io.Writer, op *walOp) error {
+	var payload bytes.Buffer
+	payload.Write(make([]byte, walHeaderSize))
+	if err := gob.NewEncoder(&payload).Encode(op); err != nil {
+		return err
+	}
+	buf := payload.Bytes()
+	body := buf[walHeaderSize:]
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(body))
+	_, err := w.Write(buf)
+	return err
+}
+
+// 读取并校验 offset 处的一条记录，返回记录占用的字节数。
+// 在记录边界处读到末尾返回 io.EOF；末尾记录不完整或校验失败返回 errWALTornTail；
+// 中间记录校验失败或无法解码时返回带 offset 的错误，同时返回该记录占用的字节数以便调用方跳过它
+// （长度字段损坏时无法定位下一条记录，返回 0）。声明的长度越过文件末尾、而其后仍有完整记录时，
+// 同样视为中间记录的长度字段损坏。
+func readWALRecord(r *bufio.Reader, offset int64, op *walOp) (int64, error) {
+	var hdr [walHeaderSize]byte
+	if n, err := io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.EOF && n == 0 {
+			return 0, io.EOF
+		}
+		return 0, errWALTornTail
+	}
+	size := binary.BigEndian.Uint32(hdr[0:4])
+	if size > maxWALRecordSize {
+		if _, err := r.Peek(1); err == io.EOF {
+			return 0, errWALTornTail
+		}
+		return 0, fmt.Errorf("rbtree: WAL record at offset %d: invalid length %d", offset, size)
+	}
+	body := make([]byte, size)
+	if n, err := io.ReadFull(r, body); err != nil {
+		// 只有这条记录确实是文件中的最后一条时才是写入中途被杀；
+		// 长度字段损坏时声明的长度会越过后面完整的记录，此时必须报错而不是当作正常结束
+		if containsWALRecord(body[:n]) {
+			return 0, fmt.Errorf("rbtree: WAL record at offset %d: length %d runs past end of file", offset, size)
+		}
+		return 0, errWALTornTail
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(hdr[4:8]) {
+		if _, err := r.Peek(1); err == io.EOF {
+			return 0, errWALTornTail
+		}
+		return walHeaderSize + int64(size), fmt.Errorf("rbtree: WAL record at offset %d: checksum mismatch", offset)
+	}
+	if err := gob.NewDecoder(bytes.NewReader(body)).Decode(op); err != nil {
+		return walHeaderSize + int64(size), fmt.Errorf("rbtree: WAL record at offset %d: %w", offset, err)
+	}
+	return walHeaderSize + int64(size), nil
+}
+
+// 报告 b 中是否从某个位置起包含一条完整且校验通过的记录
+func containsWALRecord(b []byte) bool {
+	for i := 0; i+walHeaderSize <= len(b); i++ {
+		size := int(binary.BigEndian.Uint32(b[i : i+4]))
+		// 空 payload 的 CRC 为 0，全零的字节会被误认为记录，而合法记录的 payload 不会为空
+		if size == 0 || size > len(b)-i-walHeaderSize {
+			continue
+		}
+		body := b[i+walHeaderSize : i+walHeaderSize+size]
+		if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(b[i+4:i+8]) {
+			continue
+		}
+		var op walOp
+		if gob.NewDecoder(bytes.NewReader(body)).Decode(&op) == nil {
+			return true
+		}
+	}
+	return false
 }
 
 // 持久化管理器
 type PersistentManager struct {
-	tree Tree
-	mu   sync.Mutex
-	wal  *os.File
-	w    *bufio.Writer
+	tree    Tree
+	mu      sync.Mutex
+	wal     *os.File
+	w       *bufio.Writer
+	walPath string
+
+	// 后台自动快照
+	autoMu   sync.Mutex
+	autoStop chan struct{}
+	autoDone chan struct{}
+	autoErrs chan error
+
+	// 串行化 FlushSnapshot：并发的刷写会共用临时文件，且各自按调用时的 WAL 大小截断。
+	// 与 mu 分开，编码快照期间不阻塞写入
+	snapMu sync.Mutex
+
+	// WAL 落盘策略；SyncInterval 时由后台 goroutine 定期 fsync
+	syncPolicy   SyncPolicy
+	syncInterval time.Duration
+	syncStop     chan struct{}
+	syncDone     chan struct{}
+	syncErr      error // 后台 fsync 最近一次失败的错误，由 Close 返回，受 mu 保护
+	stopSync     sync.Once
+	closed       bool // 受 mu 保护
+
+	// 整树快照的压缩方式
+	compression Compression
+
+	// WAL 分段：segmentSize > 0 时活动段超过该字节数后轮转到下一段，segment 为活动段序号
+	segmentSize int64
+	segment     int
+
+	// 增量快照：seq 为最近一条 WAL 记录的序号，snapSeq 为最近一次快照对应的序号，
+	// dirty 为此后修改过的 key。hasBase 在本管理器保存过带序号的快照后才为 true，之前不记录 dirty
+	seq     uint64
+	snapSeq uint64
+	dirty   map[int]struct{}
+	hasBase bool
+	snapGen uint64
+}
+
+// 快照压缩方式。加载时按魔数自动识别，无需指定
+type Compression int
+
+const (
+	CompressionNone Compression = iota
+	CompressionGzip
+)
+
+// gzip 流的魔数
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// WAL 落盘策略
+type SyncPolicy int
+
+const (
+	// 每次写入只 Flush 到操作系统，不 fsync（默认）
+	SyncNever SyncPolicy = iota
+	// 每次写入 Flush 后立即 fsync，掉电也不会丢失已返回的写入
+	SyncEveryWrite
+	// 后台按固定间隔 fsync，掉电最多丢失一个间隔内的写入
+	SyncInterval
+)
+
+// 默认的后台 fsync 间隔
+const defaultSyncInterval = 100 * time.Millisecond
+
+// PersistentManager 构造选项
+type PersistOption func(*PersistentManager)
+
+// 设置 WAL 落盘策略；interval 只对 SyncInterval 生效，<= 0 时使用默认的 100ms
+func WithSyncPolicy(policy SyncPolicy, interval time.Duration) PersistOption {
+	return func(pm *PersistentManager) {
+		pm.syncPolicy = policy
+		if interval > 0 {
+			pm.syncInterval = interval
+		}
+	}
+}
+
+// 设置 SaveSnapshot/WriteSnapshot/FlushSnapshot 写出的快照的压缩方式
+func WithSnapshotCompression(c Compression) PersistOption {
+	return func(pm *PersistentManager) {
+		pm.compression = c
+	}
+}
+
+// 启用 WAL 分段：活动段超过 size 字节后关闭并轮转到 walPath.000002、walPath.000003……，
+// 第一段为 walPath.000001。size <= 0 时不分段，所有记录写入 walPath
+func WithWALSegmentSize(size int64) PersistOption {
+	return func(pm *PersistentManager) {
+		pm.segmentSize = size
+	}
 }
 
 // 创建持久化管理器，tree为目标树，walPath为WAL日志路径
-func NewPersistentManager(tree Tree, walPath string) (*PersistentManager, error) {
-	wal, err := os.OpenFile(walPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+func NewPersistentManager(tree Tree, walPath string, opts ...PersistOption) (*PersistentManager, error) {
+	pm := &PersistentManager{
+		tree:         tree,
+		walPath:      walPath,
+		autoErrs:     make(chan error, autoSnapshotErrBuf),
+		syncInterval: defaultSyncInterval,
+		dirty:        make(map[int]struct{}),
+	}
+	for _, opt := range opts {
+		opt(pm)
+	}
+	// 序号接着已有 WAL 中最大的序号继续；截断或轮转 WAL 时会写入序号标记，快照之后的序号不会从头开始
+	seq, err := maxWALSeq(walPath)
 	if err != nil {
 		return nil, err
 	}
-	return &PersistentManager{
-		tree: tree,
-		wal:  wal,
-		w:    bufio.NewWriter(wal),
-	}, nil
+	pm.seq = seq
+	path := walPath
+	if pm.segmentSize > 0 {
+		seq, err := openSegment(walPath)
+		if err != nil {
+			return nil, err
+		}
+		pm.segment = seq
+		path = segmentPath(walPath, seq)
+	}
+	wal, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	pm.wal = wal
+	pm.w = bufio.NewWriter(wal)
+	if pm.syncPolicy == SyncInterval {
+		pm.syncStop = make(chan struct{})
+		pm.syncDone = make(chan struct{})
+		go pm.syncLoop()
+	}
+	return pm, nil
+}
+
+// 后台定期 fsync WAL
+func (pm *PersistentManager) syncLoop() {
+	defer close(pm.syncDone)
+	ticker := time.NewTicker(pm.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pm.syncStop:
+			return
+		case <-ticker.C:
+			pm.mu.Lock()
+			if err := pm.wal.Sync(); err != nil {
+				pm.syncErr = err
+			}
+			pm.mu.Unlock()
+		}
+	}
+}
+
+// Close 关闭后写入返回的错误
+var ErrClosed = errors.New("rbtree: persistent manager is closed")
+
+// Close 停止后台 fsync 和自动快照，把缓冲中的 WAL 刷盘并 fsync 后关闭文件。
+// 返回最终落盘的错误，或后台 fsync 期间最近一次的错误。重复或并发调用返回 nil。
+// 之后的写入不修改树，返回 ErrClosed。
+func (pm *PersistentManager) Close() error {
+	pm.StopAutoSnapshot()
+	// syncLoop 需要 pm.mu，不能在持有 mu 时等待它退出
+	pm.stopSync.Do(func() {
+		if pm.syncStop != nil {
+			close(pm.syncStop)
+			<-pm.syncDone
+		}
+	})
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if pm.closed {
+		return nil
+	}
+	pm.closed = true
+	err := pm.w.Flush()
+	if serr := pm.wal.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := pm.wal.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = pm.syncErr
+	}
+	return err
 }
 
 // 插入并写WAL
 func (pm *PersistentManager) Insert(key int, value interface{}) error {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
-	pm.tree.Insert(key, value)
-	op := walOp{Op: opInsert, Key: key, Value: value}
-	enc := gob.NewEncoder(pm.w)
-	if err := enc.Encode(&op); err != nil {
-		return err
+	if pm.closed {
+		return ErrClosed
 	}
-	return pm.w.Flush()
+	pm.tree.Insert(key, value)
+	return pm.appendWAL(&walOp{Op: opInsert, Key: key, Value: value})
 }
 
 // 删除并写WAL
 func (pm *PersistentManager) Delete(key int) error {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
+	if pm.closed {
+		return ErrClosed
+	}
 	pm.tree.Delete(key)
-	op := walOp{Op: opDelete, Key: key}
-	enc := gob.NewEncoder(pm.w)
-	if err := enc.Encode(&op); err != nil {
+	return pm.appendWAL(&walOp{Op: opDelete, Key: key})
+}
+
+// 批量插入（group commit）：先把所有记录编码到内存，编码失败时树和 WAL 都不受影响；
+// 之后更新树并一次性写入、Flush（以及按策略 fsync）。写入中途失败只会在 WAL 末尾留下
+// 不完整的记录，重放时会被忽略，之前的记录仍可重放。
+func (pm *PersistentManager) InsertBatch(entries []Entry) error {
+	ops := make([]walOp, len(entries))
+	for i, e := range entries {
+		ops[i] = walOp{Op: opInsert, Key: e.Key, Value: e.Value}
+	}
+	return pm.applyBatch(ops)
+}
+
+// 批量删除，写入方式同 InsertBatch
+func (pm *PersistentManager) DeleteBatch(keys []int) error {
+	ops := make([]walOp, len(keys))
+	for i, k := range keys {
+		ops[i] = walOp{Op: opDelete, Key: k}
+	}
+	return pm.applyBatch(ops)
+}
+
+func (pm *PersistentManager) applyBatch(ops []walOp) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if pm.closed {
+		return ErrClosed
+	}
+	// 序号需要按写入 WAL 的顺序分配，因此在锁内编码
+	var buf bytes.Buffer
+	for i := range ops {
+		ops[i].Seq = pm.seq + uint64(i) + 1
+		if err := encodeWALRecord(&buf, &ops[i]); err != nil {
+			return err
+		}
+	}
+	pm.seq += uint64(len(ops))
+	for _, op := range ops {
+		pm.markDirty(op.Key)
+		switch op.Op {
+		case opInsert:
+			pm.tree.Insert(op.Key, op.Value)
+		case opDelete:
+			pm.tree.Delete(op.Key)
+		}
+	}
+	if _, err := pm.w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return pm.flushWAL()
+}
+
+// 写入一条 WAL 记录并刷盘，调用方需持有 pm.mu
+func (pm *PersistentManager) appendWAL(op *walOp) error {
+	op.Seq = pm.seq + 1
+	if err := encodeWALRecord(pm.w, op); err != nil {
+		return err
+	}
+	pm.seq++
+	pm.markDirty(op.Key)
+	return pm.flushWAL()
+}
+
+// 记录 key 在上一次快照之后被修改过；还没有快照作为增量基准时不需要记录。调用方需持有 pm.mu
+func (pm *PersistentManager) markDirty(key int) {
+	if pm.hasBase {
+		pm.dirty[key] = struct{}{}
+	}
+}
+
+// 刷出缓冲的记录，按策略 fsync；分段时活动段超过大小上限则轮转。调用方需持有 pm.mu
+func (pm *PersistentManager) flushWAL() error {
+	if err := pm.w.Flush(); err != nil {
+		return err
+	}
+	if pm.syncPolicy == SyncEveryWrite {
+		if err := pm.wal.Sync(); err != nil {
+			return err
+		}
+	}
+	if pm.segmentSize <= 0 {
+		return nil
+	}
+	info, err := pm.wal.Stat()
+	if err != nil {
 		return err
 	}
-	return pm.w.Flush()
+	if info.Size() < pm.segmentSize {
+		return nil
+	}
+	return pm.rotateWAL()
 }
 
 // 查询直接透传
@@ -82,116 +444,1253 @@ func (pm *PersistentManager) Get(key int) (interface{}, bool) {
 
 // 保存快照
 func (pm *PersistentManager) SaveSnapshot(snapshotPath string) error {
-	pm.mu.Lock()
-	defer pm.mu.Unlock()
 	f, err := os.Create(snapshotPath)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	enc := gob.NewEncoder(f)
-	data := ExportAll(pm.tree)
-	return enc.Encode(data)
+	if err := pm.WriteSnapshot(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
-// 从快照和WAL恢复
-func LoadFromSnapshotAndWAL(tree Tree, snapshotPath, walPath string) error {
-	// 1. 加载快照
-	if _, err := os.Stat(snapshotPath); err == nil {
-		f, err := os.Open(snapshotPath)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-		dec := gob.NewDecoder(f)
-		var data map[int]interface{}
-		if err := dec.Decode(&data); err != nil {
-			return err
-		}
-		ImportAll(tree, data)
-	}
-	// 2. 重放WAL（同原实现）
-	if _, err := os.Stat(walPath); err == nil {
-		wal, err := os.Open(walPath)
-		if err != nil {
-			return err
-		}
-		defer wal.Close()
-		dec := gob.NewDecoder(wal)
-		for {
-			var op walOp
-			if err := dec.Decode(&op); err != nil {
-				break
-			}
-			switch op.Op {
-			case opInsert:
-				tree.Insert(op.Key, op.Value)
-			case opDelete:
-				tree.Delete(op.Key)
-			}
-		}
+// 把快照写入任意 io.Writer（管道、对象存储上传流、压缩流等），不会关闭 w，由调用方负责
+func (pm *PersistentManager) WriteSnapshot(w io.Writer) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	m := pm.beginSnapshot()
+	if err := writeStream(w, pm.tree, pm.compression, m.seq); err != nil {
+		pm.abortSnapshot(m)
+		return err
 	}
 	return nil
 }
 
-// 清理WAL（快照后可调用）
-func (pm *PersistentManager) TruncateWAL(walPath string) error {
+// 按压缩方式把 tree 以流式格式写入 w，seq 为快照对应的 WAL 序号
+func writeStream(w io.Writer, tree Tree, c Compression, seq uint64) error {
+	if c != CompressionGzip {
+		return exportStream(tree, w, seq)
+	}
+	zw := gzip.NewWriter(w)
+	if err := exportStream(tree, zw, seq); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// SaveSnapshotConsistent 保存所有分片在同一时刻的一致视图：同时锁住全部分片，
+// 逐个 Clone 后立即释放，再在锁外编码写盘。与 SaveSnapshot 相比写入只在克隆期间短暂阻塞，
+// 代价是编码期间额外占用一份树大小的内存。快照先写临时文件再原子替换。
+func (pm *PersistentManager) SaveSnapshotConsistent(snapshotPath string) error {
 	pm.mu.Lock()
-	defer pm.mu.Unlock()
-	pm.wal.Close()
-	if err := os.Truncate(walPath, 0); err != nil {
+	view, release := cloneTree(pm.tree)
+	m := pm.beginSnapshot()
+	pm.mu.Unlock()
+	defer release()
+	if err := writeStreamFile(snapshotPath, view, pm.compression, m.seq); err != nil {
+		pm.mu.Lock()
+		pm.abortSnapshot(m)
+		pm.mu.Unlock()
 		return err
 	}
-	// 重新打开 WAL 文件和 bufio.Writer
-	wal, err := os.OpenFile(walPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	return nil
+}
+
+// 以流式格式原子地写入快照文件
+func writeStreamFile(snapshotPath string, tree Tree, c Compression, seq uint64) error {
+	tmp := snapshotPath + ".tmp"
+	f, err := os.Create(tmp)
 	if err != nil {
 		return err
 	}
-	pm.wal = wal
-	pm.w = bufio.NewWriter(wal)
-	return nil
+	if err := writeStream(f, tree, c, seq); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, snapshotPath)
 }
 
-// 导出所有 key-value（快照用）
-func ExportAll(tree Tree) map[int]interface{} {
-	result := make(map[int]interface{})
-	// 适配不同实现
+// 返回 tree 的时间点副本，以及用完后把副本节点归还 arena 的 release。
+// 分片实现同时持有所有分片的读锁完成克隆，保证跨分片一致；
+// 不基于 RBTree 的实现（LockFree、NodeLock）经 forEachEntry 逐条复制到一棵新树中。
+func cloneTree(tree Tree) (Tree, func()) {
 	switch t := tree.(type) {
 	case *ShardedRBTreeOpt:
-		for _, sh := range t.shards {
-			sh.mu.RLock()
-			sh.tree.Range(-1<<31, 1<<31-1, func(k int, v interface{}) bool {
-				result[k] = v
-				return true
-			})
-			sh.mu.RUnlock()
+		view := &ShardedRBTreeOpt{normalize: t.normalize, hash: t.hash}
+		t.withAllShardsRLocked(func() {
+			src := t.shards()
+			shards := make([]*shard, len(src))
+			for i, sh := range src {
+				shards[i] = &shard{tree: sh.tree.Clone()}
+			}
+			view.table.Store(&shards)
+		})
+		return view, func() {
+			for _, sh := range view.shards() {
+				sh.tree.Clear()
+			}
 		}
 	case *ShardedRBTreeRW:
 		t.mu.RLock()
-		t.tree.Range(-1<<31, 1<<31-1, func(k int, v interface{}) bool {
-			result[k] = v
-			return true
-		})
+		c := t.tree.Clone()
 		t.mu.RUnlock()
+		return &ShardedRBTreeRW{tree: c}, c.Clear
 	case *ShardedRBTreePath:
 		t.mu.Lock()
-		t.tree.Range(-1<<31, 1<<31-1, func(k int, v interface{}) bool {
-			result[k] = v
-			return true
-		})
+		c := t.tree.Clone()
 		t.mu.Unlock()
-	case *ShardedRBTreeLF:
-		t.data.Range(func(key, value interface{}) bool {
-			result[key.(int)] = value
-			return true
-		})
+		return &ShardedRBTreeRW{tree: c}, c.Clear
 	}
-	return result
+	c := NewRBTree(newArena())
+	forEachEntry(tree, func(k int, v interface{}) bool {
+		c.Insert(k, v)
+		return true
+	})
+	return &ShardedRBTreeRW{tree: c}, func() {}
 }
 
-// 从快照数据恢复
-func ImportAll(tree Tree, data map[int]interface{}) {
-	for k, v := range data {
-		tree.Insert(k, v)
+// 流式快照的魔数，之后是单个 gob 流：按 key 升序的若干 snapshotRecord，以 End 为 true 的记录结尾。
+// 这是没有版本头的旧格式，读取时仍然支持，下个版本移除
+var streamMagic = []byte("RBSNAPS\n")
+
+// 带版本头的流式快照：魔数、2 字节大端格式版本、2 字节大端长度加值类型提示，之后与旧格式的 gob 流相同。
+// 值类型提示是写出时第一个条目的 %T（空树为空串），只用于在解码失败时给出更明确的错误
+var snapshotMagic = []byte("RBSNAPV\n")
+
+// 当前写出的快照格式版本
+const snapshotFormatVersion = 1
+
+// 快照头中的格式版本不被支持（通常是由更新的版本写出的）
+var ErrUnsupportedSnapshotVersion = errors.New("rbtree: unsupported snapshot version")
+
+// 写出快照头，值类型提示取 tree 中第一个条目的值类型
+func writeSnapshotHeader(w io.Writer, tree Tree) error {
+	hint := ""
+	forEachEntry(tree, func(_ int, v interface{}) bool {
+		hint = fmt.Sprintf("%T", v)
+		return false
+	})
+	if len(hint) > math.MaxUint16 {
+		hint = hint[:math.MaxUint16]
+	}
+	buf := make([]byte, 0, len(snapshotMagic)+4+len(hint))
+	buf = append(buf, snapshotMagic...)
+	buf = binary.BigEndian.AppendUint16(buf, snapshotFormatVersion)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(hint)))
+	buf = append(buf, hint...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// 读取魔数之后的快照头，返回值类型提示；版本不受支持时返回 ErrUnsupportedSnapshotVersion
+func readSnapshotHeader(r io.Reader) (string, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return "", fmt.Errorf("rbtree: read snapshot header: %w", err)
+	}
+	if v := binary.BigEndian.Uint16(hdr[:2]); v == 0 || v > snapshotFormatVersion {
+		return "", fmt.Errorf("%w %d", ErrUnsupportedSnapshotVersion, v)
+	}
+	hint := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	if _, err := io.ReadFull(r, hint); err != nil {
+		return "", fmt.Errorf("rbtree: read snapshot header: %w", err)
+	}
+	return string(hint), nil
+}
+
+type snapshotRecord struct {
+	Key   int
+	Value interface{}
+	End   bool
+	// 只在结束记录中设置：快照对应的 WAL 序号，未知时为 0
+	Seq uint64
+}
+
+// ExportStream 按 key 升序逐条编码 tree 的条目写入 w，不像 ExportAll 那样先物化整个 map，
+// 额外内存为 O(1)。不会关闭 w。没有 Range 的 Tree 实现按其自身的遍历顺序写出。
+func ExportStream(tree Tree, w io.Writer) error {
+	return exportStream(tree, w, 0)
+}
+
+func exportStream(tree Tree, w io.Writer, seq uint64) error {
+	if err := writeSnapshotHeader(w, tree); err != nil {
+		return err
+	}
+	enc := gob.NewEncoder(w)
+	var rec snapshotRecord
+	var err error
+	write := func(k int, v interface{}) bool {
+		rec.Key, rec.Value = k, v
+		err = enc.Encode(&rec)
+		return err == nil
+	}
+	if r, ok := tree.(interface {
+		Range(start, end int, fn func(key int, value interface{}) bool)
+	}); ok {
+		r.Range(math.MinInt, math.MaxInt, write)
+	} else {
+		forEachEntry(tree, write)
+	}
+	if err != nil {
+		return err
+	}
+	return enc.Encode(&snapshotRecord{End: true, Seq: seq})
+}
+
+// 读取 ExportStream 写出的条目（快照头之后的部分）并逐条插入 tree，返回结束记录中的序号
+func importStream(tree Tree, r io.Reader) (uint64, error) {
+	dec := gob.NewDecoder(r)
+	for {
+		var rec snapshotRecord
+		if err := dec.Decode(&rec); err != nil {
+			if err == io.EOF {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if rec.End {
+			return rec.Seq, nil
+		}
+		tree.Insert(rec.Key, rec.Value)
+	}
+}
+
+// 从任意 io.Reader 读取快照并导入 tree，不会关闭 r。
+// 按魔数识别 gzip 压缩和流式格式；快照头中的版本不受支持时返回 ErrUnsupportedSnapshotVersion。
+// 没有版本头的流式快照和未压缩的、整 map 编码的旧快照照常读取。
+func LoadSnapshot(tree Tree, r io.Reader) error {
+	_, err := loadSnapshot(tree, r)
+	return err
+}
+
+// 同 LoadSnapshot，并返回快照对应的 WAL 序号；不带序号的快照返回 0
+func loadSnapshot(tree Tree, r io.Reader) (uint64, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return 0, err
+		}
+		defer zr.Close()
+		br = bufio.NewReader(zr)
+	}
+	if magic, _ := br.Peek(len(snapshotMagic)); bytes.Equal(magic, snapshotMagic) {
+		br.Discard(len(snapshotMagic))
+		hint, err := readSnapshotHeader(br)
+		if err != nil {
+			return 0, err
+		}
+		seq, err := importStream(tree, br)
+		if err != nil && hint != "" {
+			err = fmt.Errorf("rbtree: decode snapshot written with %s values: %w", hint, err)
+		}
+		return seq, err
 	}
+	if magic, _ := br.Peek(len(streamMagic)); bytes.Equal(magic, streamMagic) {
+		br.Discard(len(streamMagic))
+		return importStream(tree, br)
+	}
+	var data map[int]interface{}
+	if err := gob.NewDecoder(br).Decode(&data); err != nil {
+		return 0, err
+	}
+	ImportAll(tree, data)
+	return 0, nil
+}
+
+// 快照的编码格式，所有整树快照的写入都经由这里
+func encodeSnapshot(w io.Writer, data map[int]interface{}, c Compression) error {
+	if c != CompressionGzip {
+		return gob.NewEncoder(w).Encode(data)
+	}
+	zw := gzip.NewWriter(w)
+	if err := gob.NewEncoder(zw).Encode(data); err != nil {
+		zw.Close()
+		return err
+	}
+	// 只关闭 gzip 流以写出尾部，不关闭底层 w
+	return zw.Close()
+}
+
+// 从快照和WAL恢复
+func LoadFromSnapshotAndWAL(tree Tree, snapshotPath, walPath string) error {
+	return LoadFromSnapshotAndWALThrottled(tree, snapshotPath, walPath, 0)
+}
+
+// 从快照和WAL恢复，WAL 重放速率限制为每秒 opsPerSec 条，避免在资源紧张的节点上恢复时占满 CPU。
+// opsPerSec <= 0 表示不限速。
+func LoadFromSnapshotAndWALThrottled(tree Tree, snapshotPath, walPath string, opsPerSec int) error {
+	return LoadFromSnapshotAndWALWithOptions(tree, snapshotPath, walPath, ReplayOptions{OpsPerSec: opsPerSec})
+}
+
+// LoadFromSnapshotAndWALWithOptions 的选项，零值与 LoadFromSnapshotAndWAL 的行为相同
+type ReplayOptions struct {
+	// 每重放 ProgressEvery 条 WAL 记录调用一次，重放成功结束时再调用一次；参数为累计重放的条数（跨分段累计）
+	OnProgress func(recordsReplayed int)
+	// OnProgress 的调用间隔（条数），<= 0 时为 defaultProgressEvery
+	ProgressEvery int
+	// WAL 中间的某条记录校验失败或无法解码时调用，offset 为该记录在所在文件中的字节偏移。
+	// 返回 true 跳过该记录继续重放，返回 false 中止并返回该错误；为 nil 时中止。
+	// 长度字段损坏（超过上限，或越过文件末尾而其后仍有完整记录）时无法定位下一条记录，即使返回 true 也会中止。
+	// 文件末尾不完整的记录是崩溃留下的正常残留，视为重放结束，不会回调
+	OnError func(offset int64, err error) bool
+	// 每秒最多重放的记录数，<= 0 表示不限速
+	OpsPerSec int
+}
+
+// ReplayOptions.ProgressEvery 的默认值
+const defaultProgressEvery = 10000
+
+// 从快照和WAL恢复，通过 opts 获得重放进度并决定如何处理损坏的 WAL 记录。
+// 快照带有 WAL 序号时跳过序号不大于它的记录：这些记录已包含在快照中，
+// 写完快照、截断 WAL 之前崩溃时不会被重复应用
+func LoadFromSnapshotAndWALWithOptions(tree Tree, snapshotPath, walPath string, opts ReplayOptions) error {
+	// 1. 加载快照
+	var seq uint64
+	if _, err := os.Stat(snapshotPath); err == nil {
+		f, err := os.Open(snapshotPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if seq, err = loadSnapshot(tree, f); err != nil {
+			return err
+		}
+	}
+	// 2. 重放WAL
+	rp := &walReplay{tree: tree, after: seq, opts: opts}
+	if opts.OpsPerSec > 0 && opts.OpsPerSec <= int(time.Second) {
+		ticker := time.NewTicker(time.Second / time.Duration(opts.OpsPerSec))
+		defer ticker.Stop()
+		rp.tick = ticker.C
+	}
+	if err := replayWALFiles(rp, walPath); err != nil {
+		return err
+	}
+	if opts.OnProgress != nil {
+		opts.OnProgress(rp.total)
+	}
+	return nil
+}
+
+// 一次 WAL 重放的参数，以及跨文件累计的重放条数
+type walReplay struct {
+	tree Tree
+	// 非 nil 时每条记录前等待一次，用于限速
+	tick <-chan time.Time
+	// 跳过序号在 (0, after] 内的记录（已包含在快照中）
+	after uint64
+	opts  ReplayOptions
+	total int
+}
+
+// 先重放未分段的 walPath，再按序号重放各分段
+func replayWALFiles(rp *walReplay, walPath string) error {
+	files, err := walFiles(walPath)
+	if err != nil {
+		return err
+	}
+	for _, path := range files {
+		wal, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		// 崩溃留下的不完整尾部记录会被忽略（轮转前崩溃的旧段同样如此）；中间记录损坏时返回错误
+		_, err = rp.apply(wal)
+		wal.Close()
+		if err != nil {
+			if path != walPath {
+				err = fmt.Errorf("%s: %w", filepath.Base(path), err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// 从任意 io.Reader（网络流、内嵌资源等）解码 WAL 记录并应用到 tree，返回应用的记录数。
+// 读到流末尾时返回 nil，末尾不完整的记录视为中途中断的写入而忽略；
+// 中间记录校验失败时返回已应用的条数和带字节偏移的错误。
+func ApplyWALRecords(tree Tree, r io.Reader) (int, error) {
+	return applyWAL(tree, r, nil)
+}
+
+// 逐条解码并应用 WAL 记录；tick 非 nil 时每条记录前等待一次，用于限速
+func applyWAL(tree Tree, r io.Reader, tick <-chan time.Time) (int, error) {
+	return applyWALAfter(tree, r, tick, 0)
+}
+
+// 同 applyWAL，但跳过序号在 (0, after] 内的记录
+func applyWALAfter(tree Tree, r io.Reader, tick <-chan time.Time, after uint64) (int, error) {
+	return (&walReplay{tree: tree, tick: tick, after: after}).apply(r)
+}
+
+// 重放 r 中的一个 WAL 文件，返回本文件中应用的记录数
+func (rp *walReplay) apply(r io.Reader) (int, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	every := rp.opts.ProgressEvery
+	if every <= 0 {
+		every = defaultProgressEvery
+	}
+	applied := 0
+	var offset int64
+	for {
+		var op walOp
+		n, err := readWALRecord(br, offset, &op)
+		if err == io.EOF || err == errWALTornTail {
+			return applied, nil
+		}
+		if err != nil {
+			if rp.opts.OnError == nil || !rp.opts.OnError(offset, err) || n == 0 {
+				return applied, err
+			}
+			offset += n
+			continue
+		}
+		offset += n
+		if op.Op == opSeqMark || (op.Seq != 0 && op.Seq <= rp.after) {
+			continue
+		}
+		if rp.tick != nil {
+			<-rp.tick
+		}
+		switch op.Op {
+		case opInsert:
+			rp.tree.Insert(op.Key, op.Value)
+		case opDelete:
+			rp.tree.Delete(op.Key)
+		}
+		applied++
+		rp.total++
+		if rp.opts.OnProgress != nil && rp.total%every == 0 {
+			rp.opts.OnProgress(rp.total)
+		}
+	}
+}
+
+// 清理WAL（快照后可调用）。分段时轮转到新段并删除之前的所有分段
+func (pm *PersistentManager) TruncateWAL(walPath string) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if pm.segmentSize > 0 {
+		if err := pm.rotateWAL(); err != nil {
+			return err
+		}
+		return RemoveWALSegments(pm.walPath, pm.segment)
+	}
+	pm.wal.Close()
+	if err := os.Truncate(walPath, 0); err != nil {
+		return err
+	}
+	// 重新打开 WAL 文件和 bufio.Writer
+	wal, err := os.OpenFile(walPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	pm.wal = wal
+	pm.w = bufio.NewWriter(wal)
+	return pm.writeSeqMark()
+}
+
+// 在 WAL 中写入一条只带当前序号的标记并落盘。截断 WAL 或轮转分段后调用：
+// 快照覆盖的记录被删除后，重启时 maxWALSeq 仍能从 WAL 中读到最大序号，序号不会从头开始。调用方需持有 pm.mu
+func (pm *PersistentManager) writeSeqMark() error {
+	if pm.seq == 0 {
+		return nil
+	}
+	if err := encodeWALRecord(pm.w, &walOp{Op: opSeqMark, Seq: pm.seq}); err != nil {
+		return err
+	}
+	if err := pm.w.Flush(); err != nil {
+		return err
+	}
+	return pm.wal.Sync()
+}
+
+// 导出所有 key-value（快照用）
+func ExportAll(tree Tree) map[int]interface{} {
+	result := make(map[int]interface{})
+	// 完整遍历而不是按 key 区间，int 的全部取值范围都会被导出
+	forEachEntry(tree, func(k int, v interface{}) bool {
+		result[k] = v
+		return true
+	})
+	return result
+}
+
+// 依次访问树中的所有 key-value，fn 返回 false 时停止。
+// 基于红黑树的实现在各自的锁内按升序访问（分片实现为逐分片升序，ShardedRBTreeOpt
+// 全程持有所有分片的读锁，ConcurrentRBTree 持有全部节点锁），sync.Map 实现顺序不定。
+func forEachEntry(tree Tree, fn func(k int, v interface{}) bool) {
+	switch t := tree.(type) {
+	case *ShardedRBTreeOpt:
+		t.withAllShardsRLocked(func() {
+			for _, sh := range t.shards() {
+				cont := true
+				sh.tree.forEach(func(k int, v interface{}) bool {
+					cont = fn(k, v)
+					return cont
+				})
+				if !cont {
+					return
+				}
+			}
+		})
+	case *ShardedRBTreeRW:
+		t.mu.RLock()
+		defer t.mu.RUnlock()
+		t.tree.forEach(fn)
+	case *ShardedRBTreePath:
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.tree.forEach(fn)
+	case *ShardedRBTreeLF:
+		t.data.Range(func(key, value interface{}) bool {
+			return fn(key.(int), lfUnwrap(value))
+		})
+	case *ConcurrentRBTree:
+		t.Range(math.MinInt, math.MaxInt, fn)
+	case *RBTree:
+		t.forEach(fn)
+	}
+}
+
+// 按 key 排序的 int 键值对，用于对两个切片联合排序
+type intEntries struct {
+	keys   []int
+	values []int
+}
+
+func (e intEntries) Len() int           { return len(e.keys) }
+func (e intEntries) Less(i, j int) bool { return e.keys[i] < e.keys[j] }
+func (e intEntries) Swap(i, j int) {
+	e.keys[i], e.keys[j] = e.keys[j], e.keys[i]
+	e.values[i], e.values[j] = e.values[j], e.values[i]
+}
+
+// ExportIntValues 在所有 value 都是 int 时，把条目按 key 升序导出到两个基本类型切片中，
+// 避免 ExportAll 对每个条目做 interface 装箱；存在非 int 的 value 时返回 ok=false。
+func ExportIntValues(tree Tree) (keys []int, values []int, ok bool) {
+	ok = true
+	forEachEntry(tree, func(k int, v interface{}) bool {
+		iv, isInt := v.(int)
+		if !isInt {
+			ok = false
+			return false
+		}
+		keys = append(keys, k)
+		values = append(values, iv)
+		return true
+	})
+	if !ok {
+		return nil, nil, false
+	}
+	e := intEntries{keys: keys, values: values}
+	if !sort.IsSorted(e) {
+		sort.Sort(e)
+	}
+	return keys, values, true
+}
+
+// ConvertTree 把 src 的全部条目导入由 dstCtor 新建的树并返回，用于在运行时切换实现（如 LF 与 Opt 互转）。
+// src 本身不受影响。
+func ConvertTree(src Tree, dstCtor func() Tree) Tree {
+	dst := dstCtor()
+	ImportAll(dst, ExportAll(src))
+	return dst
+}
+
+// 按 key 升序导出所有条目
+func sortedEntries(tree Tree) []Entry {
+	var entries []Entry
+	forEachEntry(tree, func(k int, v interface{}) bool {
+		entries = append(entries, Entry{Key: k, Value: v})
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries
+}
+
+// VerifyRestore 按 key 升序逐条比较两棵树（可以是不同的实现），
+// 返回是否一致以及第一个不一致的 key（只存在于一侧或 value 不同，一致时为 -1）。
+// value 使用 reflect.DeepEqual 比较，适合在提升备库前校验恢复结果。
+func VerifyRestore(source, restored Tree) (equal bool, firstDiffKey int) {
+	a, b := sortedEntries(source), sortedEntries(restored)
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i].Key < b[j].Key:
+			return false, a[i].Key
+		case a[i].Key > b[j].Key:
+			return false, b[j].Key
+		case !reflect.DeepEqual(a[i].Value, b[j].Value):
+			return false, a[i].Key
+		}
+		i++
+		j++
+	}
+	if i < len(a) {
+		return false, a[i].Key
+	}
+	if j < len(b) {
+		return false, b[j].Key
+	}
+	return true, -1
+}
+
+// 从快照数据恢复
+func ImportAll(tree Tree, data map[int]interface{}) {
+	for k, v := range data {
+		tree.Insert(k, v)
+	}
+}
+
+// ================= 非阻塞快照 =================
+
+// FlushSnapshot 保存快照并丢弃已被快照覆盖的 WAL 前缀。
+// 只在克隆树和截断 WAL 时短暂持有锁，编码和写盘期间不阻塞写入。
+// 快照先写临时文件再原子替换，并带有对应的 WAL 序号，可作为增量快照的基准；
+// LoadFromSnapshotAndWAL 恢复时跳过序号不大于快照序号的记录，因此任意时刻崩溃都可以正确恢复。
+// 并发调用依次执行，后一次在前一次截断 WAL 之后才开始。
+func (pm *PersistentManager) FlushSnapshot(snapshotPath string) error {
+	pm.snapMu.Lock()
+	defer pm.snapMu.Unlock()
+	if pm.segmentSize > 0 {
+		seq, err := pm.Checkpoint(snapshotPath)
+		if err != nil {
+			return err
+		}
+		return RemoveWALSegments(pm.walPath, seq)
+	}
+	pm.mu.Lock()
+	info, err := pm.wal.Stat()
+	if err != nil {
+		pm.mu.Unlock()
+		return err
+	}
+	view, release := cloneTree(pm.tree)
+	m := pm.beginSnapshot()
+	pm.mu.Unlock()
+	defer release()
+
+	if err := writeStreamFile(snapshotPath, view, pm.compression, m.seq); err != nil {
+		pm.mu.Lock()
+		pm.abortSnapshot(m)
+		pm.mu.Unlock()
+		return err
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return pm.dropWALPrefix(info.Size())
+}
+
+// 丢弃 WAL 中 offset 之前的记录，保留之后追加的部分。调用方需持有 pm.mu。
+func (pm *PersistentManager) dropWALPrefix(offset int64) error {
+	if err := pm.w.Flush(); err != nil {
+		return err
+	}
+	src, err := os.Open(pm.walPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if _, err := src.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	tmp := pm.walPath + ".tmp"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	pm.wal.Close()
+	if err := os.Rename(tmp, pm.walPath); err != nil {
+		return err
+	}
+	wal, err := os.OpenFile(pm.walPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	pm.wal = wal
+	pm.w = bufio.NewWriter(wal)
+	return pm.writeSeqMark()
+}
+
+// ================= WAL 分段 =================
+
+// 分段未启用时 Checkpoint 返回的错误
+var ErrWALNotSegmented = errors.New("rbtree: WAL segmentation is not enabled")
+
+// 第 seq 个分段的文件名
+func segmentPath(walPath string, seq int) string {
+	return fmt.Sprintf("%s.%06d", walPath, seq)
+}
+
+// WALSegments 按序号升序返回 walPath 的所有分段序号
+func WALSegments(walPath string) ([]int, error) {
+	entries, err := os.ReadDir(filepath.Dir(walPath))
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(walPath) + "."
+	var seqs []int
+	for _, e := range entries {
+		name := e.Name()
+		if len(name) != len(prefix)+6 || name[:len(prefix)] != prefix {
+			continue
+		}
+		seq, err := strconv.Atoi(name[len(prefix):])
+		if err == nil && seq > 0 && segmentPath(walPath, seq) == filepath.Join(filepath.Dir(walPath), name) {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Ints(seqs)
+	return seqs, nil
+}
+
+// 按重放顺序返回需要重放的 WAL 文件：存在时先是未分段的 walPath，然后是各分段
+func walFiles(walPath string) ([]string, error) {
+	var files []string
+	if _, err := os.Stat(walPath); err == nil {
+		files = append(files, walPath)
+	}
+	seqs, err := WALSegments(walPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, seq := range seqs {
+		files = append(files, segmentPath(walPath, seq))
+	}
+	return files, nil
+}
+
+// 选择打开时追加写入的分段：没有分段时为 1；最后一段完整时继续追加；
+// 最后一段末尾有崩溃留下的不完整记录时从下一段开始，避免新记录接在残缺的记录之后
+func openSegment(walPath string) (int, error) {
+	seqs, err := WALSegments(walPath)
+	if err != nil {
+		return 0, err
+	}
+	if len(seqs) == 0 {
+		return 1, nil
+	}
+	last := seqs[len(seqs)-1]
+	f, err := os.Open(segmentPath(walPath, last))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	var offset int64
+	for {
+		var op walOp
+		n, err := readWALRecord(br, offset, &op)
+		if err == io.EOF {
+			return last, nil
+		}
+		if err != nil {
+			return last + 1, nil
+		}
+		offset += n
+	}
+}
+
+// 刷盘并关闭活动段，打开下一段。旧段先 fsync 再创建新段，
+// 崩溃时至多在活动段末尾留下一条不完整的记录。调用方需持有 pm.mu
+func (pm *PersistentManager) rotateWAL() error {
+	if err := pm.w.Flush(); err != nil {
+		return err
+	}
+	if err := pm.wal.Sync(); err != nil {
+		return err
+	}
+	if err := pm.wal.Close(); err != nil {
+		return err
+	}
+	wal, err := os.OpenFile(segmentPath(pm.walPath, pm.segment+1), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	pm.segment++
+	pm.wal = wal
+	pm.w = bufio.NewWriter(wal)
+	return pm.writeSeqMark()
+}
+
+// Checkpoint 轮转到新的分段并保存此刻的一致快照（方式同 SaveSnapshotConsistent），
+// 返回新段的序号 seq：序号小于 seq 的分段中的记录都已包含在快照中，
+// 可以在快照写入成功后用 RemoveWALSegments(walPath, seq) 删除。
+func (pm *PersistentManager) Checkpoint(snapshotPath string) (int, error) {
+	if pm.segmentSize <= 0 {
+		return 0, ErrWALNotSegmented
+	}
+	pm.mu.Lock()
+	if err := pm.rotateWAL(); err != nil {
+		pm.mu.Unlock()
+		return 0, err
+	}
+	seq := pm.segment
+	view, release := cloneTree(pm.tree)
+	m := pm.beginSnapshot()
+	pm.mu.Unlock()
+	defer release()
+	if err := writeStreamFile(snapshotPath, view, pm.compression, m.seq); err != nil {
+		pm.mu.Lock()
+		pm.abortSnapshot(m)
+		pm.mu.Unlock()
+		return 0, err
+	}
+	return seq, nil
+}
+
+// RemoveWALSegments 删除 walPath 中序号小于 seq 的分段，即已被 Checkpoint 返回 seq 的快照完全覆盖的分段
+func RemoveWALSegments(walPath string, seq int) error {
+	seqs, err := WALSegments(walPath)
+	if err != nil {
+		return err
+	}
+	for _, s := range seqs {
+		if s >= seq {
+			break
+		}
+		if err := os.Remove(segmentPath(walPath, s)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ================= 增量快照 =================
+
+// 本管理器还没有保存过带序号的全量快照时，SaveIncrementalSnapshot 返回的错误
+var ErrNoBaseSnapshot = errors.New("rbtree: incremental snapshot requires a prior full snapshot")
+
+// 增量快照文件：FromSeq 之后到 ToSeq 为止修改过的 key 在 ToSeq 时刻的状态
+type incrementalSnapshot struct {
+	FromSeq uint64
+	ToSeq   uint64
+	Entries []incrementalEntry
+}
+
+type incrementalEntry struct {
+	Key     int
+	Value   interface{}
+	Deleted bool
+}
+
+// 快照开始时的增量跟踪状态，快照写入失败时用于恢复
+type snapshotMark struct {
+	gen      uint64
+	seq      uint64
+	prevSeq  uint64
+	prevBase bool
+	dirty    map[int]struct{}
+}
+
+// 开始一次快照：以当前序号为新的基准，之前的脏 key 集合换成空集合。调用方需持有 pm.mu
+func (pm *PersistentManager) beginSnapshot() snapshotMark {
+	pm.snapGen++
+	m := snapshotMark{gen: pm.snapGen, seq: pm.seq, prevSeq: pm.snapSeq, prevBase: pm.hasBase, dirty: pm.dirty}
+	pm.dirty = make(map[int]struct{})
+	pm.snapSeq, pm.hasBase = pm.seq, true
+	return m
+}
+
+// 快照写入失败：把开始前的脏 key 并回当前集合，基准恢复为上一次快照。
+// 期间已有新的快照开始时不做处理。调用方需持有 pm.mu
+func (pm *PersistentManager) abortSnapshot(m snapshotMark) {
+	if pm.snapGen != m.gen {
+		return
+	}
+	pm.snapSeq, pm.hasBase = m.prevSeq, m.prevBase
+	if !pm.hasBase {
+		// 没有可用的基准，快照期间记录的 key 也不再需要
+		pm.dirty = make(map[int]struct{})
+		return
+	}
+	for k := range m.dirty {
+		pm.dirty[k] = struct{}{}
+	}
+}
+
+// SaveIncrementalSnapshot 只保存上一次快照（全量或增量）之后修改过的 key 在此刻的状态，
+// 删除的 key 记为删除。恢复时在对应的全量快照之上按顺序应用各增量，见 LoadFromIncrementalSnapshots。
+// 本管理器还没有保存过全量快照（SaveSnapshot、WriteSnapshot、SaveSnapshotConsistent、FlushSnapshot 或 Checkpoint）
+// 时返回 ErrNoBaseSnapshot。
+func (pm *PersistentManager) SaveIncrementalSnapshot(snapshotPath string) error {
+	pm.mu.Lock()
+	if !pm.hasBase {
+		pm.mu.Unlock()
+		return ErrNoBaseSnapshot
+	}
+	inc := incrementalSnapshot{FromSeq: pm.snapSeq, ToSeq: pm.seq, Entries: make([]incrementalEntry, 0, len(pm.dirty))}
+	for k := range pm.dirty {
+		v, ok := pm.tree.Get(k)
+		inc.Entries = append(inc.Entries, incrementalEntry{Key: k, Value: v, Deleted: !ok})
+	}
+	m := pm.beginSnapshot()
+	pm.mu.Unlock()
+
+	sort.Slice(inc.Entries, func(i, j int) bool { return inc.Entries[i].Key < inc.Entries[j].Key })
+	if err := writeGobFile(snapshotPath, &inc); err != nil {
+		pm.mu.Lock()
+		pm.abortSnapshot(m)
+		pm.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// LoadFromIncrementalSnapshots 依次加载全量快照 basePath、按保存顺序排列的增量快照 incrementPaths，
+// 再重放 WAL 中比最后一个快照更新的记录。相邻快照的序号必须衔接，否则返回错误。
+func LoadFromIncrementalSnapshots(tree Tree, basePath string, incrementPaths []string, walPath string) error {
+	f, err := os.Open(basePath)
+	if err != nil {
+		return err
+	}
+	seq, err := loadSnapshot(tree, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	for _, path := range incrementPaths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		var inc incrementalSnapshot
+		err = gob.NewDecoder(f).Decode(&inc)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("rbtree: decode incremental snapshot %s: %w", path, err)
+		}
+		if inc.FromSeq != seq {
+			return fmt.Errorf("rbtree: incremental snapshot %s starts at seq %d, want %d", path, inc.FromSeq, seq)
+		}
+		for _, e := range inc.Entries {
+			if e.Deleted {
+				tree.Delete(e.Key)
+			} else {
+				tree.Insert(e.Key, e.Value)
+			}
+		}
+		seq = inc.ToSeq
+	}
+	return replayWALFiles(&walReplay{tree: tree, after: seq}, walPath)
+}
+
+// 已有 WAL（含各分段）中最大的记录序号（含序号标记）；没有 WAL 时为 0
+func maxWALSeq(walPath string) (uint64, error) {
+	files, err := walFiles(walPath)
+	if err != nil {
+		return 0, err
+	}
+	var seq uint64
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			return 0, err
+		}
+		br := bufio.NewReader(f)
+		var offset int64
+		for {
+			var op walOp
+			n, err := readWALRecord(br, offset, &op)
+			if err != nil {
+				break
+			}
+			offset += n
+			seq = max(seq, op.Seq)
+		}
+		f.Close()
+	}
+	return seq, nil
+}
+
+// ================= 后台自动快照 =================
+
+// 自动快照错误通道的缓冲大小，写满后丢弃新的错误
+const autoSnapshotErrBuf = 16
+
+// StartAutoSnapshot 启动后台定时快照：每隔 interval 加上 [0, jitter) 的随机抖动，
+// 调用 FlushSnapshot 保存快照并截断 WAL。抖动用于避免大量实例同时快照造成 IO 风暴。
+// 已在运行时会先停止旧的调度。快照失败的错误通过 AutoSnapshotErrors 获取。
+func (pm *PersistentManager) StartAutoSnapshot(interval, jitter time.Duration, snapshotPath string) {
+	pm.StopAutoSnapshot()
+	pm.autoMu.Lock()
+	defer pm.autoMu.Unlock()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	pm.autoStop, pm.autoDone = stop, done
+	go func() {
+		defer close(done)
+		for {
+			d := interval
+			if jitter > 0 {
+				d += time.Duration(rand.Int63n(int64(jitter)))
+			}
+			timer := time.NewTimer(d)
+			select {
+			case <-stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			if err := pm.FlushSnapshot(snapshotPath); err != nil {
+				select {
+				case pm.autoErrs <- err:
+				default:
+				}
+			}
+		}
+	}()
+}
+
+// StopAutoSnapshot 停止后台快照并等待正在进行的快照完成
+func (pm *PersistentManager) StopAutoSnapshot() {
+	pm.autoMu.Lock()
+	defer pm.autoMu.Unlock()
+	if pm.autoStop == nil {
+		return
+	}
+	close(pm.autoStop)
+	<-pm.autoDone
+	pm.autoStop, pm.autoDone = nil, nil
+}
+
+// 后台自动快照的错误通道
+func (pm *PersistentManager) AutoSnapshotErrors() <-chan error {
+	return pm.autoErrs
+}
+
+// ================= 分块快照 =================
+
+// 分块快照的清单，所有分块写完后最后写入
+type chunkManifest struct {
+	Chunks []string
+	Count  int
+}
+
+const chunkManifestName = "manifest.gob"
+
+// 在相应的锁内对基于红黑树的实现的每棵底层树调用 fn（分片实现逐分片调用，
+// ShardedRBTreeOpt 全程持有所有分片的读锁）。tree 不是基于红黑树的实现时返回 false。
+func withTrees(tree Tree, fn func(t *RBTree)) bool {
+	switch t := tree.(type) {
+	case *ShardedRBTreeOpt:
+		t.withAllShardsRLocked(func() {
+			for _, sh := range t.shards() {
+				fn(sh.tree)
+			}
+		})
+	case *ShardedRBTreeRW:
+		t.mu.RLock()
+		defer t.mu.RUnlock()
+		fn(t.tree)
+	case *ShardedRBTreePath:
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		fn(t.tree)
+	case *RBTree:
+		fn(t)
+	default:
+		return false
+	}
+	return true
+}
+
+// 按升序返回 key >= from 的至多 n 个条目
+func collectFrom(tree Tree, from, n int) []Entry {
+	entries := make([]Entry, 0, n)
+	trim := func() {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+		if len(entries) > n {
+			entries = entries[:n]
+		}
+	}
+	ok := withTrees(tree, func(t *RBTree) {
+		it := t.Iterator()
+		it.Seek(from)
+		for i := 0; i < n && it.Next(); i++ {
+			entries = append(entries, Entry{Key: it.Key(), Value: it.Value()})
+		}
+		trim()
+	})
+	if !ok {
+		forEachEntry(tree, func(k int, v interface{}) bool {
+			if k >= from {
+				entries = append(entries, Entry{Key: k, Value: v})
+				if len(entries) >= 2*n {
+					trim()
+				}
+			}
+			return true
+		})
+		trim()
+	}
+	return entries
+}
+
+// SaveSnapshotChunked 把树按 key 升序分块写入 dir：每个分块文件至多 chunkSize 个条目，
+// 全部写完后再写入清单文件。每次只在内存中保留一个分块，从而限制峰值内存和单个文件大小。
+// 整个过程持有 pm.mu，期间经由 pm 的写入会被阻塞。
+func (pm *PersistentManager) SaveSnapshotChunked(dir string, chunkSize int) error {
+	if chunkSize <= 0 {
+		return fmt.Errorf("rbtree: invalid chunk size %d", chunkSize)
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var manifest chunkManifest
+	from := math.MinInt
+	for {
+		entries := collectFrom(pm.tree, from, chunkSize)
+		if len(entries) == 0 {
+			break
+		}
+		name := fmt.Sprintf("chunk-%06d.gob", len(manifest.Chunks))
+		if err := writeGobFile(filepath.Join(dir, name), entries); err != nil {
+			return err
+		}
+		manifest.Chunks = append(manifest.Chunks, name)
+		manifest.Count += len(entries)
+		last := entries[len(entries)-1].Key
+		if len(entries) < chunkSize || last == math.MaxInt {
+			break
+		}
+		from = last + 1
+	}
+	return writeGobFile(filepath.Join(dir, chunkManifestName), &manifest)
+}
+
+// 原子地写入一个 gob 文件
+func writeGobFile(path string, v interface{}) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(v); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	// 先落盘再 rename，避免崩溃后留下已改名但内容不完整的文件
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadSnapshotChunked 按清单顺序读取 SaveSnapshotChunked 写出的分块并导入 tree
+func LoadSnapshotChunked(tree Tree, dir string) error {
+	f, err := os.Open(filepath.Join(dir, chunkManifestName))
+	if err != nil {
+		return err
+	}
+	var manifest chunkManifest
+	err = gob.NewDecoder(f).Decode(&manifest)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	for _, name := range manifest.Chunks {
+		cf, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		var entries []Entry
+		err = gob.NewDecoder(cf).Decode(&entries)
+		cf.Close()
+		if err != nil {
+			return fmt.Errorf("rbtree: decode chunk %s: %w", name, err)
+		}
+		for _, e := range entries {
+			tree.Insert(e.Key, e.Value)
+		}
+	}
+	return nil
+}
+
+// ================= 区间快照 =================
+
+// 按升序返回 [start, end] 内的所有条目
+func rangeEntries(tree Tree, start, end int) []Entry {
+	var entries []Entry
+	collect := func(k int, v interface{}) bool {
+		entries = append(entries, Entry{Key: k, Value: v})
+		return true
+	}
+	if !withTrees(tree, func(t *RBTree) { t.Range(start, end, collect) }) {
+		forEachEntry(tree, func(k int, v interface{}) bool {
+			if k >= start && k <= end {
+				collect(k, v)
+			}
+			return true
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries
+}
+
+// SaveRangeSnapshot 只把 [start, end] 内的条目按升序保存到 snapshotPath，
+// 用于对共享树中的某个租户或分区做局部备份
+func (pm *PersistentManager) SaveRangeSnapshot(snapshotPath string, start, end int) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return writeGobFile(snapshotPath, rangeEntries(pm.tree, start, end))
+}
+
+// LoadRangeSnapshot 把 SaveRangeSnapshot 保存的条目导入 tree
+func LoadRangeSnapshot(tree Tree, snapshotPath string) error {
+	f, err := os.Open(snapshotPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var entries []Entry
+	if err := gob.NewDecoder(f).Decode(&entries); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		tree.Insert(e.Key, e.Value)
+	}
+	return nil
 }
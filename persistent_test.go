@@ -1,9 +1,21 @@
 package rbtree
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func init() {
@@ -184,3 +196,1585 @@ func BenchmarkPersistentManager_Restore(b *testing.B) {
 		}
 	}
 }
+
+// N 次单条插入与一次 N 条的批量插入对比
+func BenchmarkPersistentManager_InsertBatch(b *testing.B) {
+	const N = 1000
+	entries := make([]Entry, N)
+	for k := range entries {
+		entries[k] = Entry{Key: k, Value: &testValue{V: k}}
+	}
+	b.Run("Single", func(b *testing.B) {
+		pm, err := NewPersistentManager(NewShardedRBTreeOpt(0), filepath.Join(b.TempDir(), "wal.log"))
+		if err != nil {
+			b.Fatalf("NewPersistentManager failed: %v", err)
+		}
+		defer pm.Close()
+		for i := 0; i < b.N; i++ {
+			for _, e := range entries {
+				if err := pm.Insert(e.Key, e.Value); err != nil {
+					b.Fatalf("Insert failed: %v", err)
+				}
+			}
+		}
+	})
+	b.Run("Batch", func(b *testing.B) {
+		pm, err := NewPersistentManager(NewShardedRBTreeOpt(0), filepath.Join(b.TempDir(), "wal.log"))
+		if err != nil {
+			b.Fatalf("NewPersistentManager failed: %v", err)
+		}
+		defer pm.Close()
+		for i := 0; i < b.N; i++ {
+			if err := pm.InsertBatch(entries); err != nil {
+				b.Fatalf("InsertBatch failed: %v", err)
+			}
+		}
+	})
+}
+
+func TestPersistentManager_WALReplay(t *testing.T) {
+	const walFile = "test_replay_wal.log"
+	defer os.Remove(walFile)
+
+	pm, err := NewPersistentManager(NewShardedRBTreeOpt(4), walFile)
+	if err != nil {
+		t.Fatalf("NewPersistentManager failed: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := pm.Insert(i, &testValue{V: i}); err != nil {
+			t.Fatalf("Insert WAL failed: %v", err)
+		}
+	}
+	for i := 0; i < 50; i += 2 {
+		if err := pm.Delete(i); err != nil {
+			t.Fatalf("Delete WAL failed: %v", err)
+		}
+	}
+
+	// 仅凭 WAL 恢复，每条记录都应被重放
+	tree := NewShardedRBTreeOpt(4)
+	if err := LoadFromSnapshotAndWAL(tree, "no_such_snapshot.gob", walFile); err != nil {
+		t.Fatalf("LoadFromSnapshotAndWAL failed: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		v, ok := tree.Get(i)
+		if i%2 == 0 {
+			if ok {
+				t.Fatalf("after replay: expected key %d deleted, but found %v", i, v)
+			}
+		} else if !ok || v.(*testValue).V != i {
+			t.Fatalf("after replay: expected key %d->%d, got %v (ok=%v)", i, i, v, ok)
+		}
+	}
+}
+
+func TestPersistentManager_AutoSnapshot(t *testing.T) {
+	const walFile = "test_auto_wal.log"
+	const snapFile = "test_auto_snapshot.gob"
+	defer os.Remove(walFile)
+	defer os.Remove(snapFile)
+
+	tree := NewShardedRBTreeOpt(0)
+	pm, err := NewPersistentManager(tree, walFile)
+	if err != nil {
+		t.Fatalf("NewPersistentManager failed: %v", err)
+	}
+	pm.StartAutoSnapshot(10*time.Millisecond, 5*time.Millisecond, snapFile)
+	defer pm.StopAutoSnapshot()
+
+	walSize := func() int64 {
+		info, err := os.Stat(walFile)
+		if err != nil {
+			t.Fatalf("stat WAL failed: %v", err)
+		}
+		return info.Size()
+	}
+	// 等待一个快照周期：WAL 被截断（只剩序号标记）且快照包含最新数据
+	waitCycle := func(round int) {
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if countWALRecords(t, walFile) == 0 {
+				restored := NewShardedRBTreeOpt(0)
+				if err := LoadFromSnapshotAndWAL(restored, snapFile, walFile); err == nil {
+					if _, ok := restored.Get(round*100 + 99); ok {
+						return
+					}
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("round %d: no snapshot cycle observed (wal size %d)", round, walSize())
+	}
+
+	for round := 0; round < 3; round++ {
+		for i := round * 100; i < round*100+100; i++ {
+			if err := pm.Insert(i, &testValue{V: i}); err != nil {
+				t.Fatalf("Insert WAL failed: %v", err)
+			}
+		}
+		waitCycle(round)
+	}
+	pm.StopAutoSnapshot()
+
+	select {
+	case err := <-pm.AutoSnapshotErrors():
+		t.Fatalf("auto snapshot error: %v", err)
+	default:
+	}
+
+	restored := NewShardedRBTreeOpt(0)
+	if err := LoadFromSnapshotAndWAL(restored, snapFile, walFile); err != nil {
+		t.Fatalf("LoadFromSnapshotAndWAL failed: %v", err)
+	}
+	for i := 0; i < 300; i++ {
+		v, ok := restored.Get(i)
+		if !ok || v.(*testValue).V != i {
+			t.Fatalf("after auto snapshot restore: expected key %d->%d, got %v (ok=%v)", i, i, v, ok)
+		}
+	}
+}
+
+// 写入与后台快照并发进行：快照和截断之间追加的 WAL 记录不能丢失
+func TestPersistentManager_AutoSnapshotConcurrentWrites(t *testing.T) {
+	dir := t.TempDir()
+	walFile := filepath.Join(dir, "wal.log")
+	snapFile := filepath.Join(dir, "snap.gob")
+
+	tree := NewShardedRBTreeOpt(8)
+	pm, err := NewPersistentManager(tree, walFile)
+	if err != nil {
+		t.Fatalf("NewPersistentManager failed: %v", err)
+	}
+	pm.StartAutoSnapshot(time.Millisecond, time.Millisecond, snapFile)
+
+	const writers, perWriter = 4, 2000
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				k := w*perWriter + i
+				if err := pm.Insert(k, &testValue{V: k}); err != nil {
+					t.Errorf("Insert(%d): %v", k, err)
+					return
+				}
+				// 删除一部分，覆盖删除记录跨越快照边界的情况
+				if k%5 == 0 {
+					if err := pm.Delete(k); err != nil {
+						t.Errorf("Delete(%d): %v", k, err)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	pm.StopAutoSnapshot()
+	select {
+	case err := <-pm.AutoSnapshotErrors():
+		t.Fatalf("auto snapshot error: %v", err)
+	default:
+	}
+	if err := pm.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	restored := NewShardedRBTreeOpt(8)
+	if err := LoadFromSnapshotAndWAL(restored, snapFile, walFile); err != nil {
+		t.Fatalf("LoadFromSnapshotAndWAL failed: %v", err)
+	}
+	if ok, diff := VerifyRestore(tree, restored); !ok {
+		t.Fatalf("restore differs from source at key %d", diff)
+	}
+	if got, want := restored.Len(), writers*perWriter*4/5; got != want {
+		t.Fatalf("restored Len: got %d, want %d", got, want)
+	}
+}
+
+// 两个刷写者与写入并发：FlushSnapshot 必须串行执行，否则会共用临时文件并按过期的偏移截断 WAL
+func TestFlushSnapshotConcurrentFlushers(t *testing.T) {
+	dir := t.TempDir()
+	walFile := filepath.Join(dir, "wal.log")
+	snapFile := filepath.Join(dir, "snap.gob")
+
+	tree := NewShardedRBTreeOpt(8)
+	pm, err := NewPersistentManager(tree, walFile)
+	if err != nil {
+		t.Fatalf("NewPersistentManager failed: %v", err)
+	}
+
+	const writers, perWriter = 4, 2000
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				k := w*perWriter + i
+				if err := pm.Insert(k, &testValue{V: k}); err != nil {
+					t.Errorf("Insert(%d): %v", k, err)
+					return
+				}
+			}
+		}(w)
+	}
+	stop := make(chan struct{})
+	var flushers sync.WaitGroup
+	for f := 0; f < 2; f++ {
+		flushers.Add(1)
+		go func() {
+			defer flushers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := pm.FlushSnapshot(snapFile); err != nil {
+					t.Errorf("FlushSnapshot: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	flushers.Wait()
+	if err := pm.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	restored := NewShardedRBTreeOpt(8)
+	if err := LoadFromSnapshotAndWAL(restored, snapFile, walFile); err != nil {
+		t.Fatalf("LoadFromSnapshotAndWAL failed: %v", err)
+	}
+	if ok, diff := VerifyRestore(tree, restored); !ok {
+		t.Fatalf("restore differs from source at key %d", diff)
+	}
+	if got, want := restored.Len(), writers*perWriter; got != want {
+		t.Fatalf("restored Len: got %d, want %d", got, want)
+	}
+}
+
+func TestExportIntValues(t *testing.T) {
+	impls := map[string]Tree{
+		"Optimized": NewShardedRBTreeOpt(8),
+		"RWLock":    &ShardedRBTreeRW{tree: NewRBTree(newArena())},
+		"PathLock":  &ShardedRBTreePath{tree: NewRBTree(newArena())},
+		"LockFree":  &ShardedRBTreeLF{},
+	}
+	for name, tree := range impls {
+		for i := 99; i >= 0; i-- {
+			tree.Insert(i, i*10)
+		}
+		keys, values, ok := ExportIntValues(tree)
+		if !ok || len(keys) != 100 || len(values) != 100 {
+			t.Fatalf("%s: ExportIntValues got %d/%d entries (ok=%v), want 100", name, len(keys), len(values), ok)
+		}
+		for i := range keys {
+			if keys[i] != i || values[i] != i*10 {
+				t.Fatalf("%s: entry %d: got %d->%d, want %d->%d", name, i, keys[i], values[i], i, i*10)
+			}
+		}
+
+		// 出现非 int value 时报告 ok=false
+		tree.Insert(50, "not an int")
+		if keys, values, ok := ExportIntValues(tree); ok || keys != nil || values != nil {
+			t.Fatalf("%s: ExportIntValues should report ok=false for non-int value", name)
+		}
+	}
+}
+
+func TestVerifyRestore(t *testing.T) {
+	const walFile = "test_verify_wal.log"
+	const snapFile = "test_verify_snapshot.gob"
+	defer os.Remove(walFile)
+	defer os.Remove(snapFile)
+
+	source := NewShardedRBTreeOpt(8)
+	pm, err := NewPersistentManager(source, walFile)
+	if err != nil {
+		t.Fatalf("NewPersistentManager failed: %v", err)
+	}
+	for i := 0; i < 200; i++ {
+		pm.Insert(i, &testValue{V: i})
+	}
+	if err := pm.SaveSnapshot(snapFile); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+	pm.Delete(7)
+
+	restored := NewShardedRBTreeOpt(4)
+	if err := LoadFromSnapshotAndWAL(restored, snapFile, walFile); err != nil {
+		t.Fatalf("LoadFromSnapshotAndWAL failed: %v", err)
+	}
+	if eq, k := VerifyRestore(source, restored); !eq || k != -1 {
+		t.Fatalf("VerifyRestore on restored copy: got (%v, %d), want (true, -1)", eq, k)
+	}
+
+	// 跨实现比较
+	rw := &ShardedRBTreeRW{tree: NewRBTree(newArena())}
+	ImportAll(rw, ExportAll(source))
+	if eq, _ := VerifyRestore(source, rw); !eq {
+		t.Fatalf("VerifyRestore across wrapper types should be equal")
+	}
+
+	// 值不同
+	restored.Insert(150, &testValue{V: -1})
+	if eq, k := VerifyRestore(source, restored); eq || k != 150 {
+		t.Fatalf("VerifyRestore with changed value: got (%v, %d), want (false, 150)", eq, k)
+	}
+	// 只存在于一侧，取最小的不一致 key
+	restored.Insert(7, &testValue{V: 7})
+	if eq, k := VerifyRestore(source, restored); eq || k != 7 {
+		t.Fatalf("VerifyRestore with extra key: got (%v, %d), want (false, 7)", eq, k)
+	}
+	source.Delete(3)
+	if eq, k := VerifyRestore(restored, source); eq || k != 3 {
+		t.Fatalf("VerifyRestore with missing key: got (%v, %d), want (false, 3)", eq, k)
+	}
+}
+
+func TestPersistentManager_SnapshotChunked(t *testing.T) {
+	const walFile = "test_chunked_wal.log"
+	const dir = "test_chunked_snapshot"
+	defer os.Remove(walFile)
+	defer os.RemoveAll(dir)
+
+	for name, tree := range map[string]Tree{
+		"Optimized": NewShardedRBTreeOpt(8),
+		"RWLock":    &ShardedRBTreeRW{tree: NewRBTree(newArena())},
+		"LockFree":  &ShardedRBTreeLF{},
+	} {
+		os.RemoveAll(dir)
+		pm, err := NewPersistentManager(tree, walFile)
+		if err != nil {
+			t.Fatalf("NewPersistentManager failed: %v", err)
+		}
+		N := 1050
+		for i := 0; i < N; i++ {
+			pm.Insert(i*7-3000, &testValue{V: i})
+		}
+		if err := pm.SaveSnapshotChunked(dir, 100); err != nil {
+			t.Fatalf("%s: SaveSnapshotChunked failed: %v", name, err)
+		}
+		chunks, _ := filepath.Glob(filepath.Join(dir, "chunk-*.gob"))
+		if len(chunks) != 11 {
+			t.Fatalf("%s: got %d chunk files, want 11", name, len(chunks))
+		}
+
+		restored := NewShardedRBTreeOpt(4)
+		if err := LoadSnapshotChunked(restored, dir); err != nil {
+			t.Fatalf("%s: LoadSnapshotChunked failed: %v", name, err)
+		}
+		if eq, k := VerifyRestore(tree, restored); !eq {
+			t.Fatalf("%s: chunked round-trip differs at key %d", name, k)
+		}
+		pm.TruncateWAL(walFile)
+	}
+}
+
+func TestConvertTree(t *testing.T) {
+	ctors := map[string]func() Tree{
+		"Optimized": func() Tree { return NewShardedRBTreeOpt(8) },
+		"RWLock":    func() Tree { return &ShardedRBTreeRW{tree: NewRBTree(newArena())} },
+		"PathLock":  func() Tree { return &ShardedRBTreePath{tree: NewRBTree(newArena())} },
+		"LockFree":  func() Tree { return &ShardedRBTreeLF{} },
+		"NodeLock":  func() Tree { return NewConcurrentRBTree() },
+	}
+	type ordered interface {
+		Min() (int, interface{}, bool)
+		Max() (int, interface{}, bool)
+		Range(start, end int, fn func(key int, value interface{}) bool)
+	}
+	for srcName, srcCtor := range ctors {
+		src := srcCtor()
+		for i := 0; i < 300; i++ {
+			src.Insert(i*3-100, i)
+		}
+		for dstName, dstCtor := range ctors {
+			dst := ConvertTree(src, dstCtor)
+			if eq, k := VerifyRestore(src, dst); !eq {
+				t.Fatalf("%s -> %s: contents differ at key %d", srcName, dstName, k)
+			}
+			o, ok := dst.(ordered)
+			if !ok {
+				continue
+			}
+			if k, v, _ := o.Min(); k != -100 || v.(int) != 0 {
+				t.Fatalf("%s -> %s: Min got %d->%v", srcName, dstName, k, v)
+			}
+			if k, v, _ := o.Max(); k != 797 || v.(int) != 299 {
+				t.Fatalf("%s -> %s: Max got %d->%v", srcName, dstName, k, v)
+			}
+			count := 0
+			o.Range(0, 99, func(k int, v interface{}) bool {
+				count++
+				return true
+			})
+			if count != 33 {
+				t.Fatalf("%s -> %s: Range(0, 99) visited %d, want 33", srcName, dstName, count)
+			}
+		}
+	}
+}
+
+func TestPersistentManager_RangeSnapshot(t *testing.T) {
+	const walFile = "test_range_wal.log"
+	const snapFile = "test_range_snapshot.gob"
+	defer os.Remove(walFile)
+	defer os.Remove(snapFile)
+
+	for name, tree := range map[string]Tree{
+		"Optimized": NewShardedRBTreeOpt(8),
+		"LockFree":  &ShardedRBTreeLF{},
+	} {
+		pm, err := NewPersistentManager(tree, walFile)
+		if err != nil {
+			t.Fatalf("NewPersistentManager failed: %v", err)
+		}
+		for i := 0; i < 500; i++ {
+			pm.Insert(i, &testValue{V: i})
+		}
+		if err := pm.SaveRangeSnapshot(snapFile, 100, 199); err != nil {
+			t.Fatalf("%s: SaveRangeSnapshot failed: %v", name, err)
+		}
+
+		restored := NewShardedRBTreeOpt(4)
+		if err := LoadRangeSnapshot(restored, snapFile); err != nil {
+			t.Fatalf("%s: LoadRangeSnapshot failed: %v", name, err)
+		}
+		for i := 0; i < 500; i++ {
+			v, ok := restored.Get(i)
+			if i >= 100 && i <= 199 {
+				if !ok || v.(*testValue).V != i {
+					t.Fatalf("%s: key %d: got %v (ok=%v), want %d", name, i, v, ok, i)
+				}
+			} else if ok {
+				t.Fatalf("%s: key %d outside range should not be restored", name, i)
+			}
+		}
+		pm.TruncateWAL(walFile)
+	}
+}
+
+func TestLoadFromSnapshotAndWALThrottled(t *testing.T) {
+	const walFile = "test_throttle_wal.log"
+	defer os.Remove(walFile)
+
+	pm, err := NewPersistentManager(NewShardedRBTreeOpt(4), walFile)
+	if err != nil {
+		t.Fatalf("NewPersistentManager failed: %v", err)
+	}
+	N := 30
+	for i := 0; i < N; i++ {
+		pm.Insert(i, &testValue{V: i})
+	}
+	pm.Delete(0)
+
+	opsPerSec := 200
+	tree := NewShardedRBTreeOpt(4)
+	start := time.Now()
+	if err := LoadFromSnapshotAndWALThrottled(tree, "no_such_snapshot.gob", walFile, opsPerSec); err != nil {
+		t.Fatalf("LoadFromSnapshotAndWALThrottled failed: %v", err)
+	}
+	elapsed := time.Since(start)
+	// N+1 条记录，至少需要约 (N+1)/opsPerSec 秒（留出计时误差）
+	if want := time.Duration(N+1) * time.Second / time.Duration(opsPerSec) * 9 / 10; elapsed < want {
+		t.Fatalf("throttled replay took %v, want at least %v", elapsed, want)
+	}
+	if _, ok := tree.Get(0); ok {
+		t.Fatalf("key 0 should be deleted after replay")
+	}
+	for i := 1; i < N; i++ {
+		if v, ok := tree.Get(i); !ok || v.(*testValue).V != i {
+			t.Fatalf("after throttled replay: expected key %d->%d, got %v (ok=%v)", i, i, v, ok)
+		}
+	}
+
+	// 不限速
+	tree = NewShardedRBTreeOpt(4)
+	if err := LoadFromSnapshotAndWALThrottled(tree, "no_such_snapshot.gob", walFile, 0); err != nil {
+		t.Fatalf("unthrottled replay failed: %v", err)
+	}
+	if _, ok := tree.Get(N - 1); !ok {
+		t.Fatalf("unthrottled replay missing key %d", N-1)
+	}
+}
+
+func TestApplyWALRecords(t *testing.T) {
+	// 与 PersistentManager 写出的帧格式一致
+	var buf bytes.Buffer
+	encode := func(op walOp) {
+		if err := encodeWALRecord(&buf, &op); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		encode(walOp{Op: opInsert, Key: i, Value: &testValue{V: i}})
+	}
+	for i := 0; i < 50; i += 5 {
+		encode(walOp{Op: opDelete, Key: i})
+	}
+	encode(walOp{Op: opInsert, Key: 1, Value: &testValue{V: -1}})
+
+	tree := NewShardedRBTreeOpt(4)
+	n, err := ApplyWALRecords(tree, bytes.NewReader(buf.Bytes()))
+	if err != nil || n != 61 {
+		t.Fatalf("ApplyWALRecords: got (%d, %v), want (61, nil)", n, err)
+	}
+	for i := 0; i < 50; i++ {
+		v, ok := tree.Get(i)
+		switch {
+		case i%5 == 0:
+			if ok {
+				t.Fatalf("key %d should have been deleted", i)
+			}
+		case i == 1:
+			if !ok || v.(*testValue).V != -1 {
+				t.Fatalf("key 1: got %v (ok=%v), want overwritten value", v, ok)
+			}
+		default:
+			if !ok || v.(*testValue).V != i {
+				t.Fatalf("key %d: got %v (ok=%v)", i, v, ok)
+			}
+		}
+	}
+
+	// 截断的尾部记录视为中断的写入：前面的记录照常应用，不返回错误
+	truncated := buf.Bytes()[:buf.Len()-3]
+	tree2 := NewShardedRBTreeOpt(4)
+	n, err = ApplyWALRecords(tree2, bytes.NewReader(truncated))
+	if err != nil || n != 60 {
+		t.Fatalf("truncated stream: got (%d, %v), want (60, nil)", n, err)
+	}
+	if v, ok := tree2.Get(1); !ok || v.(*testValue).V != 1 {
+		t.Fatalf("truncated stream key 1: got %v (ok=%v)", v, ok)
+	}
+}
+
+func TestWALChecksum(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "wal.log")
+	pm, err := NewPersistentManager(NewShardedRBTreeOpt(4), walPath)
+	if err != nil {
+		t.Fatalf("NewPersistentManager failed: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := pm.Insert(i, &testValue{V: i}); err != nil {
+			t.Fatalf("Insert: %v", err)
+		}
+	}
+	pm.wal.Close()
+	data, err := os.ReadFile(walPath)
+	if err != nil {
+		t.Fatalf("read WAL: %v", err)
+	}
+	// 第 5 条记录的起始偏移：依次跳过前面记录的帧头与 payload
+	offset := 0
+	for i := 0; i < 5; i++ {
+		offset += walHeaderSize + int(binary.BigEndian.Uint32(data[offset:]))
+	}
+
+	load := func(wal []byte) (Tree, error) {
+		p := filepath.Join(dir, "replay.log")
+		if err := os.WriteFile(p, wal, 0644); err != nil {
+			t.Fatalf("write WAL: %v", err)
+		}
+		tree := NewShardedRBTreeOpt(4)
+		return tree, LoadFromSnapshotAndWAL(tree, filepath.Join(dir, "missing.snap"), p)
+	}
+
+	// 最后一条记录只写了一半：正常结束，保留之前的 19 条
+	tree, err := load(data[:len(data)-5])
+	if err != nil {
+		t.Fatalf("torn tail should replay cleanly, got %v", err)
+	}
+	if _, ok := tree.Get(18); !ok {
+		t.Fatalf("records before the torn tail should be replayed")
+	}
+	if _, ok := tree.Get(19); ok {
+		t.Fatalf("torn final record should not be applied")
+	}
+
+	// 最后一条记录的 payload 损坏：同样视为中断的写入
+	corruptTail := append([]byte(nil), data...)
+	corruptTail[len(corruptTail)-2] ^= 0xff
+	if _, err := load(corruptTail); err != nil {
+		t.Fatalf("checksum mismatch in the final record should replay cleanly, got %v", err)
+	}
+
+	// 中间记录损坏：返回指明字节偏移的错误
+	corruptMid := append([]byte(nil), data...)
+	corruptMid[offset+walHeaderSize+3] ^= 0xff
+	_, err = load(corruptMid)
+	if err == nil {
+		t.Fatalf("checksum mismatch in the middle should return an error")
+	}
+	if want := fmt.Sprintf("offset %d", offset); !strings.Contains(err.Error(), want) {
+		t.Fatalf("error should identify %s, got %q", want, err)
+	}
+
+	// 中间记录的长度字段被改成未超上限、但越过文件末尾的值：不能当作中断的写入丢掉后面的记录
+	badLen := append([]byte(nil), data...)
+	binary.BigEndian.PutUint32(badLen[offset:], uint32(len(data)))
+	_, err = load(badLen)
+	if err == nil {
+		t.Fatalf("length past EOF in the middle should return an error")
+	}
+	if want := fmt.Sprintf("offset %d", offset); !strings.Contains(err.Error(), want) {
+		t.Fatalf("error should identify %s, got %q", want, err)
+	}
+	// 最后一条记录的长度字段越过末尾，后面没有完整记录：仍是中断的写入
+	last := offset
+	for next := offset; next < len(data); next += walHeaderSize + int(binary.BigEndian.Uint32(data[next:])) {
+		last = next
+	}
+	badTail := append([]byte(nil), data...)
+	binary.BigEndian.PutUint32(badTail[last:], uint32(len(data)))
+	if tree, err := load(badTail); err != nil {
+		t.Fatalf("length past EOF in the final record should replay cleanly, got %v", err)
+	} else if _, ok := tree.Get(18); !ok {
+		t.Fatalf("records before the final record should be replayed")
+	}
+}
+
+func TestLoadFromSnapshotAndWALWithOptions(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "wal.log")
+	pm, err := NewPersistentManager(NewShardedRBTreeOpt(4), walPath)
+	if err != nil {
+		t.Fatalf("NewPersistentManager failed: %v", err)
+	}
+	for i := 0; i < 25; i++ {
+		if err := pm.Insert(i, &testValue{V: i}); err != nil {
+			t.Fatalf("Insert: %v", err)
+		}
+	}
+	pm.Close()
+	data, err := os.ReadFile(walPath)
+	if err != nil {
+		t.Fatalf("read WAL: %v", err)
+	}
+	offset := 0
+	for i := 0; i < 7; i++ {
+		offset += walHeaderSize + int(binary.BigEndian.Uint32(data[offset:]))
+	}
+	load := func(wal []byte, opts ReplayOptions) (Tree, error) {
+		p := filepath.Join(dir, "replay.log")
+		if err := os.WriteFile(p, wal, 0644); err != nil {
+			t.Fatalf("write WAL: %v", err)
+		}
+		tree := NewShardedRBTreeOpt(4)
+		return tree, LoadFromSnapshotAndWALWithOptions(tree, filepath.Join(dir, "missing.snap"), p, opts)
+	}
+
+	// 进度按间隔回调，结束时再报告一次总数
+	var progress []int
+	if _, err := load(data, ReplayOptions{ProgressEvery: 10, OnProgress: func(n int) { progress = append(progress, n) }}); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(progress) != "[10 20 25]" {
+		t.Fatalf("progress callbacks: %v", progress)
+	}
+
+	// 中间记录损坏：OnError 收到该记录的偏移，返回 true 时跳过它继续
+	corrupt := append([]byte(nil), data...)
+	corrupt[offset+walHeaderSize+3] ^= 0xff
+	var badOffsets []int64
+	tree, err := load(corrupt, ReplayOptions{OnError: func(off int64, err error) bool {
+		badOffsets = append(badOffsets, off)
+		return true
+	}})
+	if err != nil {
+		t.Fatalf("skipping the bad record should finish cleanly, got %v", err)
+	}
+	if fmt.Sprint(badOffsets) != fmt.Sprint([]int64{int64(offset)}) {
+		t.Fatalf("OnError offsets: got %v, want [%d]", badOffsets, offset)
+	}
+	if _, ok := tree.Get(7); ok || tree.(*ShardedRBTreeOpt).Len() != 24 {
+		t.Fatalf("only the bad record should be skipped: Len=%d", tree.(*ShardedRBTreeOpt).Len())
+	}
+
+	// 返回 false 时中止，与未设置 OnError 相同，错误不会被当作正常结束
+	if _, err := load(corrupt, ReplayOptions{OnError: func(int64, error) bool { return false }}); err == nil {
+		t.Fatalf("OnError returning false should abort with an error")
+	}
+	if _, err := load(corrupt, ReplayOptions{}); err == nil {
+		t.Fatalf("a corrupt middle record without OnError should abort with an error")
+	}
+
+	// 长度字段损坏时无法跳过，即使 OnError 返回 true 也中止
+	badLen := append([]byte(nil), data...)
+	binary.BigEndian.PutUint32(badLen[offset:], maxWALRecordSize+1)
+	called := false
+	if _, err := load(badLen, ReplayOptions{OnError: func(int64, error) bool { called = true; return true }}); err == nil || !called {
+		t.Fatalf("corrupt length field: err=%v, OnError called=%v", err, called)
+	}
+
+	// 第 7 条记录的长度字段未超上限但越过文件末尾：同样交给 OnError，不能看起来像正常结束
+	pastEOF := append([]byte(nil), data...)
+	binary.BigEndian.PutUint32(pastEOF[offset:], uint32(len(data)))
+	badOffsets = nil
+	if _, err := load(pastEOF, ReplayOptions{OnError: func(off int64, err error) bool {
+		badOffsets = append(badOffsets, off)
+		return true
+	}}); err == nil {
+		t.Fatalf("length past EOF should abort with an error")
+	}
+	if fmt.Sprint(badOffsets) != fmt.Sprint([]int64{int64(offset)}) {
+		t.Fatalf("OnError offsets for length past EOF: got %v, want [%d]", badOffsets, offset)
+	}
+}
+
+func TestPersistentManagerSyncPolicy(t *testing.T) {
+	dir := t.TempDir()
+	policies := map[string]PersistOption{
+		"Default":    nil,
+		"Never":      WithSyncPolicy(SyncNever, 0),
+		"EveryWrite": WithSyncPolicy(SyncEveryWrite, 0),
+		"Interval":   WithSyncPolicy(SyncInterval, 5*time.Millisecond),
+	}
+	for name, opt := range policies {
+		walPath := filepath.Join(dir, name+".wal")
+		var opts []PersistOption
+		if opt != nil {
+			opts = append(opts, opt)
+		}
+		pm, err := NewPersistentManager(NewShardedRBTreeOpt(4), walPath, opts...)
+		if err != nil {
+			t.Fatalf("%s: NewPersistentManager failed: %v", name, err)
+		}
+		for i := 0; i < 50; i++ {
+			if err := pm.Insert(i, &testValue{V: i}); err != nil {
+				t.Fatalf("%s: Insert: %v", name, err)
+			}
+		}
+		if err := pm.Delete(7); err != nil {
+			t.Fatalf("%s: Delete: %v", name, err)
+		}
+		// 让后台 fsync 至少运行几轮
+		time.Sleep(20 * time.Millisecond)
+		if err := pm.Close(); err != nil {
+			t.Fatalf("%s: Close: %v", name, err)
+		}
+		// 重复与并发的 Close 都返回 nil，不会重复关闭后台 fsync 的通道
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := pm.Close(); err != nil {
+					t.Errorf("%s: repeated Close: %v", name, err)
+				}
+			}()
+		}
+		wg.Wait()
+		// 关闭后的写入不修改树
+		if err := pm.Insert(1000, &testValue{V: 1000}); err != ErrClosed {
+			t.Fatalf("%s: Insert after Close: got %v, want ErrClosed", name, err)
+		}
+		if err := pm.Delete(1); err != ErrClosed {
+			t.Fatalf("%s: Delete after Close: got %v, want ErrClosed", name, err)
+		}
+		if err := pm.InsertBatch([]Entry{{Key: 1001, Value: &testValue{}}}); err != ErrClosed {
+			t.Fatalf("%s: InsertBatch after Close: got %v, want ErrClosed", name, err)
+		}
+		if _, ok := pm.Get(1000); ok {
+			t.Fatalf("%s: Insert after Close modified the tree", name)
+		}
+		if _, ok := pm.Get(1); !ok {
+			t.Fatalf("%s: Delete after Close modified the tree", name)
+		}
+
+		restored := NewShardedRBTreeOpt(4)
+		if err := LoadFromSnapshotAndWAL(restored, filepath.Join(dir, "none.snap"), walPath); err != nil {
+			t.Fatalf("%s: restore: %v", name, err)
+		}
+		if restored.Len() != 49 {
+			t.Fatalf("%s: restored %d keys, want 49", name, restored.Len())
+		}
+		if _, ok := restored.Get(7); ok {
+			t.Fatalf("%s: deleted key 7 restored", name)
+		}
+	}
+}
+
+func TestPersistentManagerBatch(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "wal.log")
+	tree := NewShardedRBTreeOpt(4)
+	pm, err := NewPersistentManager(tree, walPath)
+	if err != nil {
+		t.Fatalf("NewPersistentManager failed: %v", err)
+	}
+	entries := make([]Entry, 100)
+	for i := range entries {
+		entries[i] = Entry{Key: i, Value: &testValue{V: i}}
+	}
+	if err := pm.InsertBatch(entries); err != nil {
+		t.Fatalf("InsertBatch: %v", err)
+	}
+	if err := pm.DeleteBatch([]int{3, 5, 7, 1000}); err != nil {
+		t.Fatalf("DeleteBatch: %v", err)
+	}
+
+	// 中途出现无法编码的值：整批失败，树和 WAL 都不变
+	bad := []Entry{{Key: 200, Value: &testValue{V: 200}}, {Key: 201, Value: func() {}}, {Key: 202, Value: &testValue{V: 202}}}
+	if err := pm.InsertBatch(bad); err == nil {
+		t.Fatalf("InsertBatch with an unencodable value should fail")
+	}
+	if _, ok := tree.Get(200); ok {
+		t.Fatalf("failed batch should not modify the tree")
+	}
+	if err := pm.Insert(300, &testValue{V: 300}); err != nil {
+		t.Fatalf("Insert after failed batch: %v", err)
+	}
+	if err := pm.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if n := countWALRecords(t, walPath); n != 105 {
+		t.Fatalf("WAL has %d records, want 105", n)
+	}
+
+	restored := NewShardedRBTreeOpt(4)
+	if err := LoadFromSnapshotAndWAL(restored, filepath.Join(dir, "none.snap"), walPath); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if ok, diff := VerifyRestore(tree, restored); !ok {
+		t.Fatalf("restored tree differs at key %d", diff)
+	}
+	if restored.Len() != 98 {
+		t.Fatalf("restored %d keys, want 98", restored.Len())
+	}
+}
+
+// 记录是否被关闭的 writer/reader，用于确认库不会关闭调用方的流
+type closeTracker struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (c *closeTracker) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestWriteLoadSnapshotStream(t *testing.T) {
+	tree := NewShardedRBTreeOpt(4)
+	pm, err := NewPersistentManager(tree, filepath.Join(t.TempDir(), "wal.log"))
+	if err != nil {
+		t.Fatalf("NewPersistentManager failed: %v", err)
+	}
+	defer pm.Close()
+	for i := 0; i < 500; i++ {
+		if err := pm.Insert(i, &testValue{V: i}); err != nil {
+			t.Fatalf("Insert: %v", err)
+		}
+	}
+
+	var buf closeTracker
+	if err := pm.WriteSnapshot(&buf); err != nil {
+		t.Fatalf("WriteSnapshot: %v", err)
+	}
+	if buf.closed {
+		t.Fatalf("WriteSnapshot must not close the caller's writer")
+	}
+	restored := NewShardedRBTreeOpt(4)
+	if err := LoadSnapshot(restored, &buf); err != nil {
+		t.Fatalf("LoadSnapshot: %v", err)
+	}
+	if buf.closed {
+		t.Fatalf("LoadSnapshot must not close the caller's reader")
+	}
+	if ok, diff := VerifyRestore(tree, restored); !ok {
+		t.Fatalf("restored snapshot differs at key %d", diff)
+	}
+
+	// 流式写出的快照与 SaveSnapshot 写出的文件可以互相读取
+	path := filepath.Join(t.TempDir(), "snap.gob")
+	if err := pm.SaveSnapshot(path); err != nil {
+		t.Fatalf("SaveSnapshot: %v", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open snapshot: %v", err)
+	}
+	defer f.Close()
+	fromFile := NewShardedRBTreeOpt(4)
+	if err := LoadSnapshot(fromFile, f); err != nil {
+		t.Fatalf("LoadSnapshot from file: %v", err)
+	}
+	if fromFile.Len() != 500 {
+		t.Fatalf("LoadSnapshot from file restored %d keys, want 500", fromFile.Len())
+	}
+	if err := LoadSnapshot(NewShardedRBTreeOpt(4), bytes.NewReader([]byte("garbage"))); err == nil {
+		t.Fatalf("LoadSnapshot should fail on invalid input")
+	}
+}
+
+func TestCompressedSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	tree := NewShardedRBTreeOpt(4)
+	pm, err := NewPersistentManager(tree, filepath.Join(dir, "wal.log"), WithSnapshotCompression(CompressionGzip))
+	if err != nil {
+		t.Fatalf("NewPersistentManager failed: %v", err)
+	}
+	defer pm.Close()
+	entries := make([]Entry, 5000)
+	for i := range entries {
+		entries[i] = Entry{Key: i, Value: &testValue{V: i % 7}}
+	}
+	if err := pm.InsertBatch(entries); err != nil {
+		t.Fatalf("InsertBatch: %v", err)
+	}
+
+	gzPath := filepath.Join(dir, "snap.gz")
+	if err := pm.SaveSnapshot(gzPath); err != nil {
+		t.Fatalf("SaveSnapshot: %v", err)
+	}
+	data, err := os.ReadFile(gzPath)
+	if err != nil || !bytes.HasPrefix(data, gzipMagic) {
+		t.Fatalf("snapshot should start with the gzip magic (err=%v)", err)
+	}
+	var plain bytes.Buffer
+	if err := encodeSnapshot(&plain, ExportAll(tree), CompressionNone); err != nil {
+		t.Fatalf("encode plain snapshot: %v", err)
+	}
+	if len(data) >= plain.Len() {
+		t.Fatalf("gzip snapshot (%d bytes) not smaller than plain (%d bytes)", len(data), plain.Len())
+	}
+
+	restored := NewShardedRBTreeOpt(4)
+	if err := LoadFromSnapshotAndWAL(restored, gzPath, filepath.Join(dir, "none.wal")); err != nil {
+		t.Fatalf("LoadFromSnapshotAndWAL: %v", err)
+	}
+	if ok, diff := VerifyRestore(tree, restored); !ok {
+		t.Fatalf("gzip snapshot restore differs at key %d", diff)
+	}
+
+	// 未压缩的旧快照仍可恢复
+	plainPath := filepath.Join(dir, "snap.gob")
+	if err := os.WriteFile(plainPath, plain.Bytes(), 0644); err != nil {
+		t.Fatalf("write plain snapshot: %v", err)
+	}
+	old := NewShardedRBTreeOpt(4)
+	if err := LoadFromSnapshotAndWAL(old, plainPath, filepath.Join(dir, "none.wal")); err != nil {
+		t.Fatalf("restore plain snapshot: %v", err)
+	}
+	if ok, diff := VerifyRestore(tree, old); !ok {
+		t.Fatalf("plain snapshot restore differs at key %d", diff)
+	}
+}
+
+func TestExportStream(t *testing.T) {
+	trees := map[string]Tree{
+		"RWLock":    &ShardedRBTreeRW{tree: NewRBTree(newArena())},
+		"LockFree":  &ShardedRBTreeLF{},
+		"Optimized": NewShardedRBTreeOpt(8),
+	}
+	for name, tree := range trees {
+		for _, k := range rand.New(rand.NewSource(1)).Perm(2000) {
+			tree.Insert(k-1000, &testValue{V: k})
+		}
+		var buf bytes.Buffer
+		if err := ExportStream(tree, &buf); err != nil {
+			t.Fatalf("%s ExportStream: %v", name, err)
+		}
+		data := buf.Bytes()
+
+		// 所有实现都按 key 升序写出
+		r := bytes.NewReader(data[len(snapshotMagic):])
+		if hint, err := readSnapshotHeader(r); err != nil || hint != "*rbtree.testValue" {
+			t.Fatalf("%s snapshot header: hint %q, err %v", name, hint, err)
+		}
+		dec := gob.NewDecoder(r)
+		prev := math.MinInt
+		for {
+			var rec snapshotRecord
+			if err := dec.Decode(&rec); err != nil {
+				t.Fatalf("%s decode: %v", name, err)
+			}
+			if rec.End {
+				break
+			}
+			if rec.Key <= prev {
+				t.Fatalf("%s stream not in ascending order: %d after %d", name, rec.Key, prev)
+			}
+			prev = rec.Key
+		}
+
+		restored := NewShardedRBTreeOpt(4)
+		if err := LoadSnapshot(restored, bytes.NewReader(data)); err != nil {
+			t.Fatalf("%s LoadSnapshot: %v", name, err)
+		}
+		if ok, diff := VerifyRestore(tree, restored); !ok {
+			t.Fatalf("%s stream restore differs at key %d", name, diff)
+		}
+		// 缺少结束记录的截断快照报错，而不是静默地少恢复数据
+		if err := LoadSnapshot(NewShardedRBTreeOpt(4), bytes.NewReader(data[:len(data)/2])); err == nil {
+			t.Fatalf("%s truncated stream should fail to load", name)
+		}
+	}
+}
+
+func TestSnapshotVersionHeader(t *testing.T) {
+	dir := t.TempDir()
+	walFile := filepath.Join(dir, "wal.log")
+	snapFile := filepath.Join(dir, "snap.gob")
+	pm, err := NewPersistentManager(&ShardedRBTreeRW{tree: NewRBTree(newArena())}, walFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pm.Close()
+	for i := 0; i < 50; i++ {
+		pm.Insert(i, &testValue{V: i})
+	}
+	if err := pm.SaveSnapshot(snapFile); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(snapFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, snapshotMagic) || binary.BigEndian.Uint16(data[len(snapshotMagic):]) != snapshotFormatVersion {
+		t.Fatalf("snapshot does not start with a version %d header: %q", snapshotFormatVersion, data[:16])
+	}
+	restored := NewShardedRBTreeOpt(4)
+	if err := LoadFromSnapshotAndWAL(restored, snapFile, filepath.Join(dir, "none.log")); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Len() != 50 {
+		t.Fatalf("restored %d entries, want 50", restored.Len())
+	}
+
+	// 更新的格式版本给出明确的错误，而不是 gob 解码错误
+	future := append([]byte(nil), data...)
+	binary.BigEndian.PutUint16(future[len(snapshotMagic):], 3)
+	if err := os.WriteFile(snapFile, future, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err = LoadFromSnapshotAndWAL(NewShardedRBTreeOpt(4), snapFile, filepath.Join(dir, "none.log"))
+	if !errors.Is(err, ErrUnsupportedSnapshotVersion) || !strings.Contains(err.Error(), "unsupported snapshot version 3") {
+		t.Fatalf("future snapshot version: got %v", err)
+	}
+
+	// 解码失败时错误里带上写出时的值类型
+	broken := append([]byte(nil), data[:len(data)-8]...)
+	broken = append(broken, bytes.Repeat([]byte{0xff}, 8)...)
+	err = LoadSnapshot(NewShardedRBTreeOpt(4), bytes.NewReader(broken))
+	if err == nil || !strings.Contains(err.Error(), "*rbtree.testValue") {
+		t.Fatalf("decode failure should mention the value type hint, got %v", err)
+	}
+
+	// 没有版本头的旧流式快照仍可读取
+	var legacy bytes.Buffer
+	legacy.Write(streamMagic)
+	enc := gob.NewEncoder(&legacy)
+	for i := 0; i < 3; i++ {
+		enc.Encode(&snapshotRecord{Key: i, Value: &testValue{V: i}})
+	}
+	enc.Encode(&snapshotRecord{End: true})
+	old := NewShardedRBTreeOpt(4)
+	if err := LoadSnapshot(old, &legacy); err != nil {
+		t.Fatalf("headerless stream snapshot: %v", err)
+	}
+	if v, ok := old.Get(2); !ok || v.(*testValue).V != 2 {
+		t.Fatalf("headerless stream snapshot restored Get(2)=%v", v)
+	}
+}
+
+// 整 map 导出与流式导出的分配对比
+func BenchmarkSnapshotExport(b *testing.B) {
+	const N = 1_000_000
+	tree := NewShardedRBTreeOpt(0)
+	for i := 0; i < N; i++ {
+		tree.Insert(i, i)
+	}
+	b.Run("Map", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := encodeSnapshot(io.Discard, ExportAll(tree), CompressionNone); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Stream", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := ExportStream(tree, io.Discard); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestSaveSnapshotConsistent(t *testing.T) {
+	dir := t.TempDir()
+	trees := map[string]func() Tree{
+		"RWLock":    func() Tree { return &ShardedRBTreeRW{tree: NewRBTree(newArena())} },
+		"PathLock":  func() Tree { return &ShardedRBTreePath{tree: NewRBTree(newArena())} },
+		"LockFree":  func() Tree { return &ShardedRBTreeLF{} },
+		"Optimized": func() Tree { return NewShardedRBTreeOptFunc(8, nil) },
+		"NodeLock":  func() Tree { return NewConcurrentRBTree() },
+	}
+	for name, ctor := range trees {
+		tree := ctor()
+		pm, err := NewPersistentManager(tree, filepath.Join(dir, name+".wal"), WithSnapshotCompression(CompressionGzip))
+		if err != nil {
+			t.Fatalf("%s NewPersistentManager: %v", name, err)
+		}
+		for i := 0; i < 3000; i++ {
+			pm.Insert(i, &testValue{V: i})
+		}
+
+		// 并发写入不会被阻塞到快照结束，快照只包含调用时刻的数据
+		path := filepath.Join(dir, name+".snap")
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 3000; i < 4000; i++ {
+				pm.Insert(i, &testValue{V: i})
+			}
+		}()
+		if err := pm.SaveSnapshotConsistent(path); err != nil {
+			t.Fatalf("%s SaveSnapshotConsistent: %v", name, err)
+		}
+		<-done
+
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("%s open snapshot: %v", name, err)
+		}
+		restored := ctor()
+		err = LoadSnapshot(restored, f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s LoadSnapshot: %v", name, err)
+		}
+		for i := 0; i < 3000; i++ {
+			if v, ok := restored.Get(i); !ok || v.(*testValue).V != i {
+				t.Fatalf("%s restored Get(%d) = %v (ok=%v)", name, i, v, ok)
+			}
+		}
+		// 并发写入的条目要么整体在快照之后，要么是连续的前缀
+		n := len(ExportAll(restored))
+		for i := 3000; i < n; i++ {
+			if _, ok := restored.Get(i); !ok {
+				t.Fatalf("%s snapshot is not a point-in-time view: missing %d of %d entries", name, i, n)
+			}
+		}
+		if err := pm.Close(); err != nil {
+			t.Fatalf("%s Close: %v", name, err)
+		}
+	}
+}
+
+// ConcurrentRBTree 没有树级锁，导出、快照与校验都要经由它自己的有序遍历
+func TestConcurrentRBTreePersistence(t *testing.T) {
+	dir := t.TempDir()
+	tree := NewConcurrentRBTree()
+	pm, err := NewPersistentManager(tree, filepath.Join(dir, "wal"))
+	if err != nil {
+		t.Fatalf("NewPersistentManager: %v", err)
+	}
+	defer pm.Close()
+	const N = 500
+	for i := 0; i < N; i++ {
+		if err := pm.Insert(i*2, &testValue{V: i}); err != nil {
+			t.Fatalf("Insert(%d): %v", i*2, err)
+		}
+	}
+	if n := len(ExportAll(tree)); n != N {
+		t.Fatalf("ExportAll returned %d entries, want %d", n, N)
+	}
+	var keys []int
+	tree.Range(100, 119, func(k int, _ interface{}) bool {
+		keys = append(keys, k)
+		return true
+	})
+	if want := []int{100, 102, 104, 106, 108, 110, 112, 114, 116, 118}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("Range(100, 119) = %v, want %v", keys, want)
+	}
+	if eq, k := VerifyRestore(tree, NewConcurrentRBTree()); eq || k != 0 {
+		t.Fatalf("VerifyRestore against an empty tree: got %v, %d", eq, k)
+	}
+	if got := NewIndexedTree(tree).KeysForValue(&testValue{V: 7}, reflect.DeepEqual); !reflect.DeepEqual(got, []int{14}) {
+		t.Fatalf("NewIndexedTree KeysForValue = %v, want [14]", got)
+	}
+
+	check := func(what string, load func(restored Tree) error) {
+		restored := NewConcurrentRBTree()
+		if err := load(restored); err != nil {
+			t.Fatalf("%s: %v", what, err)
+		}
+		if restored.Len() != N {
+			t.Fatalf("%s restored %d entries, want %d", what, restored.Len(), N)
+		}
+		if eq, k := VerifyRestore(tree, restored); !eq {
+			t.Fatalf("%s: restored tree differs at key %d", what, k)
+		}
+	}
+	snap := filepath.Join(dir, "snap")
+	if err := pm.SaveSnapshot(snap); err != nil {
+		t.Fatalf("SaveSnapshot: %v", err)
+	}
+	check("SaveSnapshot", func(restored Tree) error {
+		f, err := os.Open(snap)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return LoadSnapshot(restored, f)
+	})
+	flushed := filepath.Join(dir, "flushed")
+	if err := pm.FlushSnapshot(flushed); err != nil {
+		t.Fatalf("FlushSnapshot: %v", err)
+	}
+	check("FlushSnapshot", func(restored Tree) error {
+		return LoadFromSnapshotAndWAL(restored, flushed, filepath.Join(dir, "wal"))
+	})
+}
+
+func TestWALSegments(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "wal")
+	snapPath := filepath.Join(dir, "snap")
+
+	tree := NewShardedRBTreeOpt(4)
+	pm, err := NewPersistentManager(tree, walPath, WithWALSegmentSize(4<<10))
+	if err != nil {
+		t.Fatalf("NewPersistentManager failed: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := pm.Insert(i, &testValue{V: i}); err != nil {
+			t.Fatalf("Insert(%d): %v", i, err)
+		}
+	}
+	seqs, err := WALSegments(walPath)
+	if err != nil || len(seqs) < 3 || seqs[0] != 1 {
+		t.Fatalf("expected several segments starting at 1, got %v (err=%v)", seqs, err)
+	}
+	if _, err := os.Stat(walPath); !os.IsNotExist(err) {
+		t.Fatalf("unsegmented WAL file should not be created (err=%v)", err)
+	}
+	for i, s := range seqs {
+		if s != i+1 {
+			t.Fatalf("segments not contiguous: %v", seqs)
+		}
+	}
+
+	// 快照覆盖的分段可以删除，之后的写入仍可重放
+	seq, err := pm.Checkpoint(snapPath)
+	if err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+	for i := 0; i < 1000; i += 2 {
+		if err := pm.Delete(i); err != nil {
+			t.Fatalf("Delete(%d): %v", i, err)
+		}
+	}
+	if err := RemoveWALSegments(walPath, seq); err != nil {
+		t.Fatalf("RemoveWALSegments: %v", err)
+	}
+	if seqs, _ := WALSegments(walPath); len(seqs) == 0 || seqs[0] != seq {
+		t.Fatalf("after RemoveWALSegments(%d): segments %v", seq, seqs)
+	}
+	if err := pm.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	restored := NewShardedRBTreeOpt(4)
+	if err := LoadFromSnapshotAndWAL(restored, snapPath, walPath); err != nil {
+		t.Fatalf("LoadFromSnapshotAndWAL: %v", err)
+	}
+	if ok, diff := VerifyRestore(tree, restored); !ok {
+		t.Fatalf("restore differs at key %d", diff)
+	}
+
+	// 活动段末尾留下崩溃时的半条记录：重新打开后从新段开始写，旧段的残缺尾部在重放时被忽略
+	seqs, _ = WALSegments(walPath)
+	last := segmentPath(walPath, seqs[len(seqs)-1])
+	var rec bytes.Buffer
+	if err := encodeWALRecord(&rec, &walOp{Op: opInsert, Key: -1, Value: &testValue{V: -1}}); err != nil {
+		t.Fatalf("encode record: %v", err)
+	}
+	f, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("open last segment: %v", err)
+	}
+	f.Write(rec.Bytes()[:rec.Len()-3])
+	f.Close()
+
+	pm, err = NewPersistentManager(tree, walPath, WithWALSegmentSize(4<<10))
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if pm.segment != seqs[len(seqs)-1]+1 {
+		t.Fatalf("reopen after torn tail: active segment %d, want %d", pm.segment, seqs[len(seqs)-1]+1)
+	}
+	for i := 1000; i < 1100; i++ {
+		pm.Insert(i, &testValue{V: i})
+	}
+	if err := pm.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	restored = NewShardedRBTreeOpt(4)
+	if err := LoadFromSnapshotAndWAL(restored, snapPath, walPath); err != nil {
+		t.Fatalf("LoadFromSnapshotAndWAL after torn tail: %v", err)
+	}
+	if _, ok := restored.Get(-1); ok {
+		t.Fatalf("torn record should not be replayed")
+	}
+	if ok, diff := VerifyRestore(tree, restored); !ok {
+		t.Fatalf("restore after torn tail differs at key %d", diff)
+	}
+}
+
+// 超出 32 位范围的 key 在快照和恢复后不能丢失
+func TestSnapshotWideKeys(t *testing.T) {
+	keys := []int{1 << 40, -1<<31 - 1, 1 << 31, math.MaxInt, math.MinInt, 0}
+	impls := map[string]func() Tree{
+		"Optimized": func() Tree { return NewShardedRBTreeOpt(8) },
+		"RWLock":    func() Tree { return &ShardedRBTreeRW{tree: NewRBTree(newArena())} },
+		"PathLock":  func() Tree { return &ShardedRBTreePath{tree: NewRBTree(newArena())} },
+		"LockFree":  func() Tree { return &ShardedRBTreeLF{} },
+	}
+	dir := t.TempDir()
+	for name, ctor := range impls {
+		tree := ctor()
+		pm, err := NewPersistentManager(tree, filepath.Join(dir, name+".wal"))
+		if err != nil {
+			t.Fatalf("%s NewPersistentManager: %v", name, err)
+		}
+		for _, k := range keys {
+			pm.Insert(k, &testValue{V: k})
+		}
+		if got := len(ExportAll(tree)); got != len(keys) {
+			t.Fatalf("%s ExportAll: got %d entries, want %d", name, got, len(keys))
+		}
+		for _, save := range []func(string) error{pm.SaveSnapshot, pm.FlushSnapshot} {
+			path := filepath.Join(dir, name+".snap")
+			if err := save(path); err != nil {
+				t.Fatalf("%s save snapshot: %v", name, err)
+			}
+			restored := ctor()
+			if err := LoadFromSnapshotAndWAL(restored, path, filepath.Join(dir, "missing.wal")); err != nil {
+				t.Fatalf("%s restore: %v", name, err)
+			}
+			for _, k := range keys {
+				if v, ok := restored.Get(k); !ok || v.(*testValue).V != k {
+					t.Fatalf("%s key %d lost in snapshot: got %v (ok=%v)", name, k, v, ok)
+				}
+			}
+		}
+		pm.Close()
+	}
+}
+
+func TestIncrementalSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "wal.log")
+	base := filepath.Join(dir, "base.snap")
+	inc1 := filepath.Join(dir, "inc1.snap")
+	inc2 := filepath.Join(dir, "inc2.snap")
+
+	tree := NewShardedRBTreeOpt(4)
+	pm, err := NewPersistentManager(tree, walPath)
+	if err != nil {
+		t.Fatalf("NewPersistentManager failed: %v", err)
+	}
+	if err := pm.SaveIncrementalSnapshot(inc1); err != ErrNoBaseSnapshot {
+		t.Fatalf("incremental snapshot without base: got %v, want ErrNoBaseSnapshot", err)
+	}
+	for i := 0; i < 100; i++ {
+		pm.Insert(i, &testValue{V: i})
+	}
+	if err := pm.SaveSnapshot(base); err != nil {
+		t.Fatalf("SaveSnapshot: %v", err)
+	}
+
+	// 第一次增量：1 被更新，2、3 被删除
+	pm.Insert(1, &testValue{V: 1001})
+	pm.Delete(2)
+	pm.Delete(3)
+	if err := pm.SaveIncrementalSnapshot(inc1); err != nil {
+		t.Fatalf("SaveIncrementalSnapshot 1: %v", err)
+	}
+	// 第二次增量：2 重新插入，1 被删除，3 删除后重新插入再删除
+	pm.Insert(2, &testValue{V: 2002})
+	pm.Delete(1)
+	pm.Insert(3, &testValue{V: 3003})
+	pm.Delete(3)
+	pm.InsertBatch([]Entry{{Key: 4, Value: &testValue{V: 4004}}, {Key: 150, Value: &testValue{V: 150}}})
+	if err := pm.SaveIncrementalSnapshot(inc2); err != nil {
+		t.Fatalf("SaveIncrementalSnapshot 2: %v", err)
+	}
+	// 最后一个快照之后的 WAL 尾部
+	pm.Insert(2, &testValue{V: 3002})
+	pm.Delete(5)
+	pm.Insert(200, &testValue{V: 200})
+
+	for _, incs := range [][]string{{inc1, inc2}, {inc1}, nil} {
+		restored := NewShardedRBTreeOpt(4)
+		if err := LoadFromIncrementalSnapshots(restored, base, incs, walPath); err != nil {
+			t.Fatalf("LoadFromIncrementalSnapshots(%d increments): %v", len(incs), err)
+		}
+		if ok, diff := VerifyRestore(tree, restored); !ok {
+			t.Fatalf("restore with %d increments differs at key %d", len(incs), diff)
+		}
+	}
+	if err := LoadFromIncrementalSnapshots(NewShardedRBTreeOpt(4), base, []string{inc2}, walPath); err == nil {
+		t.Fatalf("skipping an increment should fail the sequence check")
+	}
+
+	// WAL 截断后由全量快照、全部增量和截断之后的尾部恢复
+	inc3 := filepath.Join(dir, "inc3.snap")
+	if err := pm.SaveIncrementalSnapshot(inc3); err != nil {
+		t.Fatalf("SaveIncrementalSnapshot 3: %v", err)
+	}
+	if err := pm.TruncateWAL(walPath); err != nil {
+		t.Fatalf("TruncateWAL: %v", err)
+	}
+	pm.Insert(2, &testValue{V: 4002})
+	pm.Delete(150)
+	if err := pm.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	restored := NewShardedRBTreeOpt(4)
+	if err := LoadFromIncrementalSnapshots(restored, base, []string{inc1, inc2, inc3}, walPath); err != nil {
+		t.Fatalf("LoadFromIncrementalSnapshots after truncate: %v", err)
+	}
+	if ok, diff := VerifyRestore(tree, restored); !ok {
+		t.Fatalf("restore after truncate differs at key %d", diff)
+	}
+
+	// 快照并截断 WAL 后重启：序号接着快照的序号增长，重启后的写入不会被当作快照前的旧记录跳过
+	reopen := func() *PersistentManager {
+		pm, err := NewPersistentManager(tree, walPath)
+		if err != nil {
+			t.Fatalf("reopen: %v", err)
+		}
+		return pm
+	}
+	base2 := filepath.Join(dir, "base2.snap")
+	pm = reopen()
+	if err := pm.SaveSnapshot(base2); err != nil {
+		t.Fatalf("SaveSnapshot: %v", err)
+	}
+	if err := pm.TruncateWAL(walPath); err != nil {
+		t.Fatalf("TruncateWAL: %v", err)
+	}
+	pm.Close()
+	pm = reopen()
+	pm.Insert(999, &testValue{V: 999})
+	if err := pm.SaveIncrementalSnapshot(inc1); err != ErrNoBaseSnapshot {
+		t.Fatalf("incremental snapshot after restart without base: got %v, want ErrNoBaseSnapshot", err)
+	}
+	pm.Close()
+	restored = NewShardedRBTreeOpt(4)
+	if err := LoadFromIncrementalSnapshots(restored, base2, nil, walPath); err != nil {
+		t.Fatalf("LoadFromIncrementalSnapshots after restart: %v", err)
+	}
+	if _, ok := restored.Get(999); !ok {
+		t.Fatalf("write after restart lost on restore")
+	}
+	if ok, diff := VerifyRestore(tree, restored); !ok {
+		t.Fatalf("restore after restart differs at key %d", diff)
+	}
+}
+
+func TestIncrementalSnapshotDirtyTracking(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "wal.log")
+	snap := filepath.Join(dir, "base.snap")
+	tree := NewShardedRBTreeOpt(4)
+	pm, err := NewPersistentManager(tree, walPath)
+	if err != nil {
+		t.Fatalf("NewPersistentManager failed: %v", err)
+	}
+	defer pm.Close()
+
+	// 没有基准快照时不记录脏 key
+	for i := 0; i < 10000; i++ {
+		pm.Insert(i, &testValue{V: i})
+	}
+	if n := len(pm.dirty); n != 0 {
+		t.Fatalf("dirty keys tracked without a base snapshot: %d", n)
+	}
+
+	// FlushSnapshot 同样是全量快照：清空脏 key 并作为之后增量的基准
+	if err := pm.FlushSnapshot(snap); err != nil {
+		t.Fatalf("FlushSnapshot: %v", err)
+	}
+	pm.Insert(1, &testValue{V: 1001})
+	pm.Delete(2)
+	if n := len(pm.dirty); n != 2 {
+		t.Fatalf("dirty keys after FlushSnapshot and 2 writes: got %d, want 2", n)
+	}
+	if err := pm.FlushSnapshot(snap); err != nil {
+		t.Fatalf("FlushSnapshot: %v", err)
+	}
+	if n := len(pm.dirty); n != 0 {
+		t.Fatalf("FlushSnapshot should reset dirty keys, got %d", n)
+	}
+
+	pm.Insert(3, &testValue{V: 3003})
+	inc := filepath.Join(dir, "inc.snap")
+	if err := pm.SaveIncrementalSnapshot(inc); err != nil {
+		t.Fatalf("SaveIncrementalSnapshot after FlushSnapshot: %v", err)
+	}
+	pm.Insert(4, &testValue{V: 4004})
+	restored := NewShardedRBTreeOpt(4)
+	if err := LoadFromIncrementalSnapshots(restored, snap, []string{inc}, walPath); err != nil {
+		t.Fatalf("LoadFromIncrementalSnapshots: %v", err)
+	}
+	if ok, diff := VerifyRestore(tree, restored); !ok {
+		t.Fatalf("restore from FlushSnapshot base differs at key %d", diff)
+	}
+}
+
+// 把每次 Insert 当作 Add 的树：值为 int64 增量，累加到已有值上。重复应用同一条记录会得到不同的结果
+type addTree struct{ *RBTree }
+
+func (t addTree) Insert(key int, value interface{}) {
+	cur, _ := t.RBTree.Get(key)
+	n, _ := cur.(int64)
+	t.RBTree.Insert(key, n+value.(int64))
+}
+
+// 快照已原子替换、WAL 前缀尚未丢弃时崩溃：恢复时只能重放快照之后的记录
+func TestFlushSnapshotCrashBeforeWALTruncate(t *testing.T) {
+	dir := t.TempDir()
+	walFile := filepath.Join(dir, "wal.log")
+	snapFile := filepath.Join(dir, "snap.gob")
+
+	// WAL 中的三条 Add 记录：前两条已包含在序号为 2 的快照中
+	var wal bytes.Buffer
+	for i, delta := range []int64{1, 2, 4} {
+		if err := encodeWALRecord(&wal, &walOp{Op: opInsert, Key: 7, Value: delta, Seq: uint64(i + 1)}); err != nil {
+			t.Fatalf("encodeWALRecord: %v", err)
+		}
+	}
+	if err := os.WriteFile(walFile, wal.Bytes(), 0644); err != nil {
+		t.Fatalf("write WAL: %v", err)
+	}
+	snap := addTree{NewRBTree(newArena())}
+	snap.Insert(7, int64(3))
+	if err := writeStreamFile(snapFile, snap, CompressionNone, 2); err != nil {
+		t.Fatalf("writeStreamFile: %v", err)
+	}
+
+	restored := addTree{NewRBTree(newArena())}
+	replayed := 0
+	opts := ReplayOptions{OnProgress: func(n int) { replayed = n }}
+	if err := LoadFromSnapshotAndWALWithOptions(restored, snapFile, walFile, opts); err != nil {
+		t.Fatalf("LoadFromSnapshotAndWALWithOptions: %v", err)
+	}
+	if v, _ := restored.Get(7); v != int64(7) {
+		t.Fatalf("restored value %v, want 7 (records covered by the snapshot were replayed again)", v)
+	}
+	if replayed != 1 {
+		t.Fatalf("replayed %d records, want 1", replayed)
+	}
+}
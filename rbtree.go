@@ -1,8 +1,17 @@
 package rbtree
 
 import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
 	"runtime"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type color bool
@@ -13,34 +22,54 @@ const (
 )
 
 // ================= 节点定义 =================
-type node struct {
-	key    int
-	value  interface{}
-	color  color
-	left   *node
-	right  *node
-	parent *node
-}
+
+// RBTree 的节点是泛型节点以 int 为 key、interface{} 为 value 的实例，结构算法见 generic.go 的 rbCore
+type node = gnode[int, interface{}]
 
 // ================= Arena 分配器 =================
 type arena struct {
-	pool sync.Pool
+	// pool 可被 Shrink 整体替换，因此用原子指针保存
+	pool atomic.Pointer[sync.Pool]
+	// pooled 估算当前池中可复用的节点数（GC 回收池内对象时会偏大）
+	pooled atomic.Int64
+	// allocated 为 newNode 总调用次数，created 为其中由池的 New 新建（未命中池）的次数，freed 为 freeNode 总调用次数
+	allocated atomic.Int64
+	created   atomic.Int64
+	freed     atomic.Int64
+	// 泛型树的节点池，按节点类型区分（见 genericPool）
+	generic sync.Map
 }
 
-func newArena() *arena {
-	return &arena{
-		pool: sync.Pool{
-			New: func() interface{} { return new(node) },
+func (a *arena) newNodePool() *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			a.created.Add(1)
+			return new(node)
 		},
 	}
 }
 
+func newArena() *arena {
+	a := &arena{}
+	a.pool.Store(a.newNodePool())
+	return a
+}
+
 func (a *arena) newNode(key int, value interface{}) *node {
-	n := a.pool.Get().(*node)
+	n := a.pool.Load().Get().(*node)
+	a.allocated.Add(1)
+	for {
+		p := a.pooled.Load()
+		if p <= 0 || a.pooled.CompareAndSwap(p, p-1) {
+			break
+		}
+	}
 	n.key = key
 	n.value = value
 	n.left, n.right, n.parent = nil, nil, nil
 	n.color = red
+	n.size = 1
+	n.count = 1
 	return n
 }
 
@@ -50,83 +79,125 @@ func (a *arena) freeNode(n *node) {
 	}
 	// 避免内存泄露
 	n.left, n.right, n.parent, n.value = nil, nil, nil, nil
-	a.pool.Put(n)
+	a.pool.Load().Put(n)
+	a.pooled.Add(1)
+	a.freed.Add(1)
+}
+
+// 丢弃整个节点池，让池中缓存的节点可以被 GC 立即回收
+func (a *arena) Shrink() {
+	a.pool.Store(a.newNodePool())
+	a.pooled.Store(0)
+	a.generic.Clear()
+}
+
+// Stats 返回 newNode 的总分配次数、其中从池中复用（而非新建）的次数，以及 freeNode 的总调用次数，
+// 用于观察 arena 的命中率：freed 远大于 pooledReuses 且仍有大量新建时，说明归还的节点在复用前已被 GC 回收
+func (a *arena) Stats() (allocated, pooledReuses, freed int64) {
+	// 先读 created：并发分配时 allocated 只会更大，保证 pooledReuses 不为负
+	created := a.created.Load()
+	allocated = a.allocated.Load()
+	return allocated, max(allocated-created, 0), a.freed.Load()
 }
 
 // ================= 红黑树 =================
+
+// 一个 key-value 条目
+type Entry = struct {
+	Key   int
+	Value interface{}
+}
+
+// RBTree 是 rbCore 的 int key 实例，在其上维护 arena、重复 key 策略、操作记录等
 type RBTree struct {
-	root  *node
+	rbCore[int, interface{}]
 	arena *arena
+	size  int
+	// 池中节点数与存活节点数之比超过该值时 MaybeCompact 会收缩 arena
+	compactRatio float64
+	dup          DupPolicy
+	// DupCount 策略下所有节点的 count-1 之和，Len 返回 size+extra
+	extra int
+	// 结构变化记录，EnableOpLog 之前为 nil（见 debug.go）
+	ops []Op
 }
 
-func NewRBTree(a *arena) *RBTree {
-	return &RBTree{arena: a}
-}
+// Insert 遇到已存在的 key 时的处理方式
+type DupPolicy int
 
-func getColor(n *node) color {
-	if n == nil {
-		return black
+const (
+	// 用新值覆盖旧值（默认）
+	DupOverwrite DupPolicy = iota
+	// 保留旧值，TryInsert 返回 false
+	DupReject
+	// 按多重集合计数：重数加一并存入新值，Delete 每次减一，减到 0 时才删除节点。
+	// Len 返回重数之和；Rank、Select、DeleteRange 等按节点（不同的 key）计
+	DupCount
+)
+
+// 默认的收缩阈值：池中节点超过存活节点的 4 倍
+const defaultCompactRatio = 4.0
+
+// RBTree 构造选项
+type Option func(*RBTree)
+
+// 设置 MaybeCompact 的收缩阈值（池中节点数 / 存活节点数），ratio <= 0 时使用默认值
+func WithCompactRatio(ratio float64) Option {
+	return func(t *RBTree) {
+		if ratio > 0 {
+			t.compactRatio = ratio
+		}
 	}
-	return n.color
 }
 
-func (t *RBTree) minimum(x *node) *node {
-	for x.left != nil {
-		x = x.left
+// 设置 Insert 遇到重复 key 时的策略，默认为 DupOverwrite。
+// 策略只影响 Insert、TryInsert、InsertEntries、Merge 与 Delete、DeleteAndReport；
+// GetOrInsert、Replace、Update 等按各自的语义处理已存在的 key
+func WithDupPolicy(p DupPolicy) Option {
+	return func(t *RBTree) {
+		t.dup = p
 	}
-	return x
 }
 
-func (t *RBTree) transplant(u, v *node) {
-	if u.parent == nil {
-		t.root = v
-	} else if u == u.parent.left {
-		u.parent.left = v
-	} else {
-		u.parent.right = v
-	}
-	if v != nil {
-		v.parent = u.parent
+func NewRBTree(a *arena, opts ...Option) *RBTree {
+	t := &RBTree{arena: a, compactRatio: defaultCompactRatio}
+	for _, opt := range opts {
+		opt(t)
 	}
+	return t
+}
+
+func (t *RBTree) Insert(key int, value interface{}) {
+	t.TryInsert(key, value)
 }
 
-func (t *RBTree) rotateLeft(x *node) {
-	y := x.right
-	x.right = y.left
-	if y.left != nil {
-		y.left.parent = x
+// 按树的 DupPolicy 插入，返回 value 是否被存入：只有 DupReject 策略下 key 已存在时返回 false
+func (t *RBTree) TryInsert(key int, value interface{}) bool {
+	n, inserted := t.locate(key, value)
+	if inserted {
+		return true
 	}
-	y.parent = x.parent
-	if x.parent == nil {
-		t.root = y
-	} else if x == x.parent.left {
-		x.parent.left = y
-	} else {
-		x.parent.right = y
+	switch t.dup {
+	case DupReject:
+		return false
+	case DupCount:
+		n.count++
+		t.extra++
 	}
-	y.left = x
-	x.parent = y
+	n.value = value
+	return true
 }
 
-func (t *RBTree) rotateRight(x *node) {
-	y := x.left
-	x.left = y.right
-	if y.right != nil {
-		y.right.parent = x
-	}
-	y.parent = x.parent
-	if x.parent == nil {
-		t.root = y
-	} else if x == x.parent.right {
-		x.parent.right = y
-	} else {
-		x.parent.left = y
+// 返回 key 的重数：不存在时为 0，DupCount 以外的策略下存在即为 1
+func (t *RBTree) Count(key int) int {
+	if n := t.search(key); n != nil {
+		return n.count
 	}
-	y.right = x
-	x.parent = y
+	return 0
 }
 
-func (t *RBTree) Insert(key int, value interface{}) {
+// 一次下降找到 key 所在节点；不存在时以 value 插入新节点。返回节点以及是否为新插入
+func (t *RBTree) locate(key int, value interface{}) (*node, bool) {
 	var y *node
 	x := t.root
 	for x != nil {
@@ -136,59 +207,129 @@ func (t *RBTree) Insert(key int, value interface{}) {
 		} else if key > x.key {
 			x = x.right
 		} else {
-			x.value = value
-			return
+			return x, false
 		}
 	}
 	z := t.arena.newNode(key, value)
-	z.parent = y
-	if y == nil {
-		t.root = z
-	} else if z.key < y.key {
-		y.left = z
+	t.size++
+	t.attach(y, z, y != nil && key < y.key)
+	if t.ops != nil {
+		t.ops = append(t.ops, Op{Kind: OpInsert, Key: key})
+	}
+	return z, true
+}
+
+// key 存在时返回已有的值和 true；否则插入 value 并返回 value 和 false。只下降一次
+func (t *RBTree) GetOrInsert(key int, value interface{}) (actual interface{}, loaded bool) {
+	n, inserted := t.locate(key, value)
+	return n.value, !inserted
+}
+
+// key 不存在时插入 value 并返回 true；已存在时保留原值并返回 false。只下降一次
+func (t *RBTree) InsertIfAbsent(key int, value interface{}) bool {
+	_, inserted := t.locate(key, value)
+	return inserted
+}
+
+// 存入 value 并返回被替换的旧值；key 原本不存在时插入 value，返回 nil 和 false。只下降一次
+func (t *RBTree) Replace(key int, value interface{}) (old interface{}, existed bool) {
+	n, inserted := t.locate(key, value)
+	if inserted {
+		return nil, false
+	}
+	old, n.value = n.value, value
+	return old, true
+}
+
+// Update 以 key 的当前值（不存在时 found 为 false）调用 fn：keep 为 true 时存入 newVal（key 不存在则插入），
+// keep 为 false 时删除该 key（key 不存在则什么也不做）
+func (t *RBTree) Update(key int, fn func(old interface{}, found bool) (newVal interface{}, keep bool)) {
+	x := t.search(key)
+	if x == nil {
+		if v, keep := fn(nil, false); keep {
+			t.locate(key, v)
+		}
+		return
+	}
+	v, keep := fn(x.value, true)
+	if keep {
+		x.value = v
 	} else {
-		y.right = z
+		t.deleteNode(x)
 	}
-	t.insertFixup(z)
 }
 
-func (t *RBTree) insertFixup(z *node) {
-	for z.parent != nil && z.parent.color == red {
-		if z.parent == z.parent.parent.left {
-			y := z.parent.parent.right
-			if getColor(y) == red {
-				z.parent.color = black
-				y.color = black
-				z.parent.parent.color = red
-				z = z.parent.parent
-			} else {
-				if z == z.parent.right {
-					z = z.parent
-					t.rotateLeft(z)
-				}
-				z.parent.color = black
-				z.parent.parent.color = red
-				t.rotateRight(z.parent.parent)
-			}
+// 返回 key 所在的节点，不存在时返回 nil
+func (t *RBTree) search(key int) *node {
+	x := t.root
+	for x != nil && x.key != key {
+		if key < x.key {
+			x = x.left
 		} else {
-			y := z.parent.parent.left
-			if getColor(y) == red {
-				z.parent.color = black
-				y.color = black
-				z.parent.parent.color = red
-				z = z.parent.parent
-			} else {
-				if z == z.parent.left {
-					z = z.parent
-					t.rotateRight(z)
-				}
-				z.parent.color = black
-				z.parent.parent.color = red
-				t.rotateLeft(z.parent.parent)
-			}
+			x = x.right
 		}
 	}
-	t.root.color = black
+	return x
+}
+
+// CompareAndSwap 在 eq(当前值, old) 为 true 时把 key 的值替换为 newVal 并返回 true。
+// key 不存在时返回 false，不会插入。eq 为 nil 时用 == 比较（要求值可比较）
+func (t *RBTree) CompareAndSwap(key int, old, newVal interface{}, eq func(a, b interface{}) bool) bool {
+	x := t.search(key)
+	if x == nil || !valuesEqual(x.value, old, eq) {
+		return false
+	}
+	x.value = newVal
+	return true
+}
+
+func valuesEqual(a, b interface{}, eq func(a, b interface{}) bool) bool {
+	if eq == nil {
+		return a == b
+	}
+	return eq(a, b)
+}
+
+// TryAdd 对非整数值调用时返回的错误
+var ErrNotInteger = errors.New("rbtree: value is not an integer")
+
+// 把 key 上的整数值加上 delta 并以 int64 存回，返回新值。
+// key 不存在时视为 0；已有的 int/int64 值会被扩展为 int64；
+// 已有值是其他类型时不做修改并返回 0，需要区分这种情况时用 TryAdd。
+func (t *RBTree) Add(key int, delta int64) int64 {
+	v, _ := t.TryAdd(key, delta)
+	return v
+}
+
+// 同 Add，但已有值不是整数时返回 ErrNotInteger（值保持不变）
+func (t *RBTree) TryAdd(key int, delta int64) (int64, error) {
+	var cur int64
+	if x := t.search(key); x != nil {
+		switch v := x.value.(type) {
+		case int64:
+			cur = v
+		case int:
+			cur = int64(v)
+		default:
+			return 0, ErrNotInteger
+		}
+		cur += delta
+		x.value = cur
+		return cur, nil
+	}
+	cur = delta
+	t.locate(key, cur)
+	return cur, nil
+}
+
+// 元素个数，插入新 key 和删除已有 key 时维护，O(1)
+func (t *RBTree) Len() int {
+	return t.size + t.extra
+}
+
+// 树是否为空
+func (t *RBTree) IsEmpty() bool {
+	return t.size == 0
 }
 
 func (t *RBTree) Get(key int) (interface{}, bool) {
@@ -219,113 +360,388 @@ func (t *RBTree) Delete(key int) {
 	if z == nil {
 		return
 	}
+	t.removeOne(z)
+}
 
-	y := z
-	yOrigColor := y.color
-	var x *node
-	var xParent *node
+// 删除 key 并返回被删除的值；key 不存在时树保持不变，返回 nil 和 false。
+// 被删除的节点照常归还给 arena；DupCount 策略下重数大于 1 时只减一
+func (t *RBTree) DeleteAndReport(key int) (value interface{}, deleted bool) {
+	z := t.search(key)
+	if z == nil {
+		return nil, false
+	}
+	value = z.value
+	t.removeOne(z)
+	return value, true
+}
 
-	if z.left == nil {
-		x = z.right
-		xParent = z.parent
-		t.transplant(z, z.right)
-	} else if z.right == nil {
-		x = z.left
-		xParent = z.parent
-		t.transplant(z, z.left)
-	} else {
-		y = t.minimum(z.right)
-		yOrigColor = y.color
-		x = y.right
-		if y.parent == z {
-			xParent = y
-		} else {
-			t.transplant(y, y.right)
-			y.right = z.right
-			y.right.parent = y
-			xParent = y.parent
-		}
-		t.transplant(z, y)
-		y.left = z.left
-		y.left.parent = y
-		y.color = z.color
+// 删除 z 的一份：重数大于 1（DupCount）时只减一，否则摘除节点
+func (t *RBTree) removeOne(z *node) {
+	if z.count > 1 {
+		z.count--
+		t.extra--
+		return
 	}
-	if yOrigColor == black {
-		t.deleteFixup(x, xParent)
+	t.deleteNode(z)
+}
+
+// 从树中摘除节点 z 并归还给 arena
+func (t *RBTree) deleteNode(z *node) {
+	t.unlink(z)
+	t.size--
+	t.extra -= z.count - 1
+	if t.ops != nil {
+		t.ops = append(t.ops, Op{Kind: OpDelete, Key: z.key})
 	}
 	t.arena.freeNode(z)
 }
 
-func (t *RBTree) deleteFixup(x *node, parent *node) {
-	for (x != t.root) && getColor(x) == black {
-		if parent == nil {
-			break
+// 删除所有小于 key 的条目，返回删除的个数。
+// 删除的条目较多时用 split 一次切下整侧再释放其节点，O(log² n + k)，不必逐个摘除再平衡；
+// 条目很少或开启了操作日志时逐个删除最小节点
+func (t *RBTree) DeleteBelow(key int) int {
+	k, _ := t.Rank(key)
+	if k == 0 {
+		return 0
+	}
+	if k <= bits.Len(uint(t.size)) || t.ops != nil {
+		for i := 0; i < k; i++ {
+			t.deleteNode(t.minimum(t.root))
 		}
-		if x == parent.left {
-			w := parent.right
-			if getColor(w) == red {
-				w.color = black
-				parent.color = red
-				t.rotateLeft(parent)
-				w = parent.right
-			}
-			if getColor(w.left) == black && getColor(w.right) == black {
-				w.color = red
-				x = parent
-				parent = x.parent
-			} else {
-				if getColor(w.right) == black {
-					if w.left != nil {
-						w.left.color = black
-					}
-					w.color = red
-					t.rotateRight(w)
-					w = parent.right
-				}
-				w.color = parent.color
-				parent.color = black
-				if w.right != nil {
-					w.right.color = black
-				}
-				t.rotateLeft(parent)
-				x = t.root
-				break
-			}
-		} else {
-			w := parent.left
-			if getColor(w) == red {
-				w.color = black
-				parent.color = red
-				t.rotateRight(parent)
-				w = parent.left
-			}
-			if getColor(w.right) == black && getColor(w.left) == black {
-				w.color = red
-				x = parent
-				parent = x.parent
-			} else {
-				if getColor(w.left) == black {
-					if w.right != nil {
-						w.right.color = black
-					}
-					w.color = red
-					t.rotateLeft(w)
-					w = parent.left
-				}
-				w.color = parent.color
-				parent.color = black
-				if w.left != nil {
-					w.left.color = black
-				}
-				t.rotateRight(parent)
-				x = t.root
-				break
+		return k
+	}
+	l, r := t.split(func(n *node) bool { return n.key < key })
+	t.root = r
+	t.dropSubtree(l)
+	return k
+}
+
+// 删除所有大于 key 的条目，返回删除的个数；策略同 DeleteBelow
+func (t *RBTree) DeleteAbove(key int) int {
+	rank, exists := t.Rank(key)
+	if exists {
+		rank++
+	}
+	k := t.size - rank
+	if k == 0 {
+		return 0
+	}
+	if k <= bits.Len(uint(t.size)) || t.ops != nil {
+		for i := 0; i < k; i++ {
+			t.deleteNode(t.maximum(t.root))
+		}
+		return k
+	}
+	l, r := t.split(func(n *node) bool { return n.key <= key })
+	t.root = l
+	t.dropSubtree(r)
+	return k
+}
+
+// 把已从树上切下的子树 n 的所有节点归还给 arena，并从 size 与 extra 中扣除
+func (t *RBTree) dropSubtree(n *node) {
+	if n == nil {
+		return
+	}
+	t.dropSubtree(n.left)
+	t.dropSubtree(n.right)
+	t.size--
+	t.extra -= n.count - 1
+	t.arena.freeNode(n)
+}
+
+// 清空树：后序遍历把所有节点归还给 arena 以便复用，树可以继续使用
+func (t *RBTree) Clear() {
+	if t.ops != nil {
+		t.forEach(func(k int, _ interface{}) bool {
+			t.ops = append(t.ops, Op{Kind: OpDelete, Key: k})
+			return true
+		})
+	}
+	var free func(n *node)
+	free = func(n *node) {
+		if n == nil {
+			return
+		}
+		free(n.left)
+		free(n.right)
+		t.arena.freeNode(n)
+	}
+	free(t.root)
+	t.root = nil
+	t.size, t.extra = 0, 0
+}
+
+// Clone 返回树的结构副本：节点从同一个 arena 分配，颜色和子树大小原样保留，无需重新平衡。
+// value 按引用共享，不做深拷贝。
+func (t *RBTree) Clone() *RBTree {
+	var clone func(n, parent *node) *node
+	clone = func(n, parent *node) *node {
+		if n == nil {
+			return nil
+		}
+		c := t.arena.newNode(n.key, n.value)
+		c.color, c.size, c.count, c.parent = n.color, n.size, n.count, parent
+		c.left = clone(n.left, c)
+		c.right = clone(n.right, c)
+		return c
+	}
+	return &RBTree{rbCore: rbCore[int, interface{}]{root: clone(t.root, nil)}, arena: t.arena, size: t.size, compactRatio: t.compactRatio, dup: t.dup, extra: t.extra}
+}
+
+// 删除 [start, end] 内的所有条目，返回删除的个数。
+// 从 ceiling(start) 出发沿后继一次走完区间，逐个摘除并归还给 arena；
+// deleteNode 只移动节点而不复制 key，因此事先取得的后继节点在删除后仍然有效。
+func (t *RBTree) DeleteRange(start, end int) int {
+	if start > end {
+		return 0
+	}
+	removed := 0
+	z := t.ceiling(start)
+	for z != nil && z.key <= end {
+		next := successor(z)
+		t.deleteNode(z)
+		removed++
+		z = next
+	}
+	return removed
+}
+
+// 删除并返回最小的条目，树为空时返回 false
+func (t *RBTree) PopMin() (int, interface{}, bool) {
+	if t.root == nil {
+		return 0, nil, false
+	}
+	return t.pop(t.minimum(t.root))
+}
+
+// 删除并返回最大的条目，树为空时返回 false
+func (t *RBTree) PopMax() (int, interface{}, bool) {
+	if t.root == nil {
+		return 0, nil, false
+	}
+	return t.pop(t.maximum(t.root))
+}
+
+// 删除最小的条目，树为空时无操作。直接沿左链找到最小节点摘除，不做按 key 的查找
+func (t *RBTree) DeleteMin() {
+	if t.root != nil {
+		t.deleteNode(t.minimum(t.root))
+	}
+}
+
+// 删除最大的条目，树为空时无操作
+func (t *RBTree) DeleteMax() {
+	if t.root != nil {
+		t.deleteNode(t.maximum(t.root))
+	}
+}
+
+// 摘除节点 z 并返回其 key/value（deleteNode 会清空归还的节点，需先取出）
+func (t *RBTree) pop(z *node) (int, interface{}, bool) {
+	key, value := z.key, z.value
+	t.deleteNode(z)
+	return key, value, true
+}
+
+// 按升序删除并返回最小的 n 个条目，n 超过元素个数时返回全部
+func (t *RBTree) PopMinN(n int) []Entry {
+	var out []Entry
+	for len(out) < n && t.root != nil {
+		z := t.minimum(t.root)
+		out = append(out, Entry{Key: z.key, Value: z.value})
+		t.deleteNode(z)
+	}
+	return out
+}
+
+// BulkLoad 由 keys/values 直接构建平衡的红黑树。keys 已严格升序时为 O(n)；
+// 否则先稳定排序并去重（重复的 key 以最后出现的值为准，与依次 Insert 的结果相同）。
+// values 短于 keys 时缺少的值为 nil。
+func BulkLoad(a *arena, keys []int, values []interface{}) *RBTree {
+	entries := make([]Entry, len(keys))
+	sorted := true
+	for i, k := range keys {
+		entries[i].Key = k
+		if i < len(values) {
+			entries[i].Value = values[i]
+		}
+		if i > 0 && keys[i-1] >= k {
+			sorted = false
+		}
+	}
+	if !sorted {
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+		// 相同 key 保持原有先后顺序，保留每段的最后一个
+		out := entries[:0]
+		for i, e := range entries {
+			if i+1 < len(entries) && entries[i+1].Key == e.Key {
+				continue
 			}
+			out = append(out, e)
+		}
+		entries = out
+	}
+	return buildBalanced(a, entries)
+}
+
+// InsertMany 依次插入 keys[i] -> values[i]，两个切片长度不同时返回错误且不做任何修改。
+// 重复的 key 以最后出现的值为准，与逐个 Insert 的结果相同
+func (t *RBTree) InsertMany(keys []int, values []interface{}) error {
+	if len(keys) != len(values) {
+		return fmt.Errorf("rbtree: InsertMany with %d keys and %d values", len(keys), len(values))
+	}
+	entries := make([]Entry, len(keys))
+	for i, k := range keys {
+		entries[i] = Entry{Key: k, Value: values[i]}
+	}
+	t.InsertEntries(entries)
+	return nil
+}
+
+// InsertEntries 依次插入所有条目。条目按 key 严格升序、策略为 DupOverwrite 且未开启操作日志时不逐个插入：
+// 空树直接平衡构建（O(n)），否则先构建平衡树再经 Merge 并入
+func (t *RBTree) InsertEntries(entries []Entry) {
+	sorted := t.dup == DupOverwrite && t.ops == nil
+	for i := 1; sorted && i < len(entries); i++ {
+		sorted = entries[i-1].Key < entries[i].Key
+	}
+	if !sorted {
+		for _, e := range entries {
+			t.Insert(e.Key, e.Value)
 		}
+		return
+	}
+	if len(entries) == 0 {
+		return
+	}
+	built := buildBalanced(t.arena, entries)
+	if t.size == 0 {
+		t.root, t.size = built.root, built.size
+		return
+	}
+	t.Merge(built)
+	built.Clear()
+}
+
+// Merge 把 other 的所有条目并入 t，key 冲突时以 other 的值为准，other 保持不变。
+// other 相对 t 较小时逐个 Insert（O(m log(n+m))）；否则归并两棵树的有序序列后整体重建（O(n+m)），
+// 原节点归还给 arena。t 的策略不是 DupOverwrite 或开启了操作日志时总是逐个 Insert，other 的每个 key 按一次插入计
+func (t *RBTree) Merge(other *RBTree) {
+	if other == t || other.size == 0 {
+		return
+	}
+	total := t.size + other.size
+	if other.size*bits.Len(uint(total)) < total || t.dup != DupOverwrite || t.ops != nil {
+		other.forEach(func(k int, v interface{}) bool {
+			t.Insert(k, v)
+			return true
+		})
+		return
+	}
+	entries := make([]Entry, 0, total)
+	a, b := t.Iterator(), other.Iterator()
+	okA, okB := a.Next(), b.Next()
+	for okA || okB {
+		switch {
+		case !okB || (okA && a.Key() < b.Key()):
+			entries = append(entries, Entry{Key: a.Key(), Value: a.Value()})
+			okA = a.Next()
+		case !okA || b.Key() < a.Key():
+			entries = append(entries, Entry{Key: b.Key(), Value: b.Value()})
+			okB = b.Next()
+		default:
+			entries = append(entries, Entry{Key: b.Key(), Value: b.Value()})
+			okA, okB = a.Next(), b.Next()
+		}
+	}
+	t.Clear()
+	merged := buildBalanced(t.arena, entries)
+	t.root, t.size = merged.root, merged.size
+}
+
+// 返回同时存在于 t 和 other 中的 key（升序），线性归并两个有序游标，O(n+m)
+func (t *RBTree) IntersectKeys(other *RBTree) []int {
+	var out []int
+	a, b := t.Iterator(), other.Iterator()
+	okA, okB := a.Next(), b.Next()
+	for okA && okB {
+		switch {
+		case a.Key() < b.Key():
+			okA = a.Next()
+		case b.Key() < a.Key():
+			okB = b.Next()
+		default:
+			out = append(out, a.Key())
+			okA, okB = a.Next(), b.Next()
+		}
+	}
+	return out
+}
+
+// 返回存在于 t 但不在 other 中的 key（升序），线性归并两个有序游标，O(n+m)
+func (t *RBTree) DifferenceKeys(other *RBTree) []int {
+	var out []int
+	a, b := t.Iterator(), other.Iterator()
+	okA, okB := a.Next(), b.Next()
+	for okA {
+		switch {
+		case !okB || a.Key() < b.Key():
+			out = append(out, a.Key())
+			okA = a.Next()
+		case b.Key() < a.Key():
+			okB = b.Next()
+		default:
+			okA, okB = a.Next(), b.Next()
+		}
+	}
+	return out
+}
+
+// 由按 key 严格升序的条目直接构建平衡的红黑树，O(n)。
+// 取中点递归建树，所有空叶子的深度相差至多 1，把最深一层的节点染红、其余染黑即满足红黑性质。
+func buildBalanced(a *arena, entries []Entry) *RBTree {
+	t := NewRBTree(a)
+	maxDepth := -1
+	for n := len(entries); n > 0; n >>= 1 {
+		maxDepth++
+	}
+	var build func(lo, hi, depth int, parent *node) *node
+	build = func(lo, hi, depth int, parent *node) *node {
+		if lo > hi {
+			return nil
+		}
+		mid := int(uint(lo+hi) >> 1)
+		n := a.newNode(entries[mid].Key, entries[mid].Value)
+		n.parent = parent
+		if depth != maxDepth {
+			n.color = black
+		}
+		n.left = build(lo, mid-1, depth+1, n)
+		n.right = build(mid+1, hi, depth+1, n)
+		n.size = hi - lo + 1
+		return n
+	}
+	t.root = build(0, len(entries)-1, 0, nil)
+	if t.root != nil {
+		t.root.color = black
+	}
+	t.size = len(entries)
+	return t
+}
+
+// 当池中节点数超过存活节点数的 compactRatio 倍时收缩 arena，返回是否发生了收缩。
+// 适用于树规模永久性缩小后尽快归还内存，而不必等待 GC 压力。
+func (t *RBTree) MaybeCompact() bool {
+	live := t.size
+	if live < 1 {
+		live = 1
 	}
-	if x != nil {
-		x.color = black
+	if float64(t.arena.pooled.Load()) <= t.compactRatio*float64(live) {
+		return false
 	}
+	t.arena.Shrink()
+	return true
 }
 
 // ================= 并发封装 =================
@@ -352,6 +768,67 @@ func (s *ShardedRBTreeRW) Delete(key int) {
 	s.tree.Delete(key)
 }
 
+func (s *ShardedRBTreeRW) DeleteAndReport(key int) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.DeleteAndReport(key)
+}
+
+func (s *ShardedRBTreeRW) GetOrInsert(key int, value interface{}) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.GetOrInsert(key, value)
+}
+
+func (s *ShardedRBTreeRW) InsertIfAbsent(key int, value interface{}) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.InsertIfAbsent(key, value)
+}
+
+func (s *ShardedRBTreeRW) Replace(key int, value interface{}) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Replace(key, value)
+}
+
+func (s *ShardedRBTreeRW) Update(key int, fn func(old interface{}, found bool) (interface{}, bool)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tree.Update(key, fn)
+}
+
+func (s *ShardedRBTreeRW) CompareAndSwap(key int, old, newVal interface{}, eq func(a, b interface{}) bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.CompareAndSwap(key, old, newVal, eq)
+}
+
+func (s *ShardedRBTreeRW) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tree.Clear()
+}
+
+func (s *ShardedRBTreeRW) PopMin() (int, interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.PopMin()
+}
+
+func (s *ShardedRBTreeRW) PopMax() (int, interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.PopMax()
+}
+
+// 元素个数
+func (s *ShardedRBTreeRW) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.Len()
+}
+
 // 2. 全局 PathLock
 type ShardedRBTreePath struct {
 	tree *RBTree
@@ -374,69 +851,882 @@ func (s *ShardedRBTreePath) Delete(key int) {
 	s.tree.Delete(key)
 }
 
+func (s *ShardedRBTreePath) DeleteAndReport(key int) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.DeleteAndReport(key)
+}
+
+func (s *ShardedRBTreePath) GetOrInsert(key int, value interface{}) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.GetOrInsert(key, value)
+}
+
+func (s *ShardedRBTreePath) InsertIfAbsent(key int, value interface{}) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.InsertIfAbsent(key, value)
+}
+
+func (s *ShardedRBTreePath) Replace(key int, value interface{}) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Replace(key, value)
+}
+
+func (s *ShardedRBTreePath) Update(key int, fn func(old interface{}, found bool) (interface{}, bool)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tree.Update(key, fn)
+}
+
+func (s *ShardedRBTreePath) CompareAndSwap(key int, old, newVal interface{}, eq func(a, b interface{}) bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.CompareAndSwap(key, old, newVal, eq)
+}
+
+func (s *ShardedRBTreePath) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tree.Clear()
+}
+
+func (s *ShardedRBTreePath) PopMin() (int, interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.PopMin()
+}
+
+func (s *ShardedRBTreePath) PopMax() (int, interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.PopMax()
+}
+
+// 元素个数
+func (s *ShardedRBTreePath) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Len()
+}
+
 // 3. LockFree sync.Map
 type ShardedRBTreeLF struct {
 	data sync.Map
+	// sync.Map 不提供元素个数，插入新 key 和删除已有 key 时维护计数
+	n atomic.Int64
+
+	// 有序操作用的 key 索引（只存 key 的红黑树），受 idxMu 保护。
+	// 写入不碰索引，只把 key 集合发生变化的 key 记入 pending；有序操作先把 pending 并入索引，
+	// 每个变化的 key 只需 O(log n)，不需要整体重建
+	idxMu   sync.Mutex
+	idx     *RBTree
+	pending sync.Map
+}
+
+// sync.Map 的 CompareAndSwap、CompareAndDelete 用 == 比较已存的值，值不可比较（切片、map 等）时会 panic。
+// 这类值装在 lfBox 中存入，比较时按指针比较；读取时再取出原值
+type lfBox struct{ v interface{} }
+
+func lfWrap(v interface{}) interface{} {
+	if hashable(v) {
+		return v
+	}
+	return &lfBox{v}
+}
+
+func lfUnwrap(v interface{}) interface{} {
+	if b, ok := v.(*lfBox); ok {
+		return b.v
+	}
+	return v
 }
 
 func (s *ShardedRBTreeLF) Insert(key int, value interface{}) {
-	s.data.Store(key, value)
+	if _, loaded := s.data.Swap(key, lfWrap(value)); !loaded {
+		s.keysChanged(key, 1)
+	}
 }
 func (s *ShardedRBTreeLF) Get(key int) (interface{}, bool) {
-	return s.data.Load(key)
+	v, ok := s.data.Load(key)
+	return lfUnwrap(v), ok
 }
 func (s *ShardedRBTreeLF) Delete(key int) {
-	s.data.Delete(key)
+	s.DeleteAndReport(key)
+}
+
+func (s *ShardedRBTreeLF) DeleteAndReport(key int) (interface{}, bool) {
+	value, loaded := s.data.LoadAndDelete(key)
+	if loaded {
+		s.keysChanged(key, -1)
+	}
+	return lfUnwrap(value), loaded
+}
+
+func (s *ShardedRBTreeLF) GetOrInsert(key int, value interface{}) (interface{}, bool) {
+	actual, loaded := s.data.LoadOrStore(key, lfWrap(value))
+	if !loaded {
+		s.keysChanged(key, 1)
+	}
+	return lfUnwrap(actual), loaded
+}
+
+func (s *ShardedRBTreeLF) InsertIfAbsent(key int, value interface{}) bool {
+	_, loaded := s.GetOrInsert(key, value)
+	return !loaded
+}
+
+// 基于 sync.Map.Swap，存入与取回旧值是同一个原子操作
+func (s *ShardedRBTreeLF) Replace(key int, value interface{}) (interface{}, bool) {
+	old, loaded := s.data.Swap(key, lfWrap(value))
+	if !loaded {
+		s.keysChanged(key, 1)
+	}
+	return lfUnwrap(old), loaded
+}
+
+// 通过 CAS 循环实现原子更新：并发修改同一 key 时 fn 可能被调用多次，只有最后一次的结果生效
+func (s *ShardedRBTreeLF) Update(key int, fn func(old interface{}, found bool) (interface{}, bool)) {
+	for {
+		raw, found := s.data.Load(key)
+		v, keep := fn(lfUnwrap(raw), found)
+		switch {
+		case !found && !keep:
+			return
+		case !found:
+			if _, loaded := s.data.LoadOrStore(key, lfWrap(v)); !loaded {
+				s.keysChanged(key, 1)
+				return
+			}
+		case keep:
+			if s.data.CompareAndSwap(key, raw, lfWrap(v)) {
+				return
+			}
+		default:
+			if s.data.CompareAndDelete(key, raw) {
+				s.keysChanged(key, -1)
+				return
+			}
+		}
+	}
+}
+
+// 读取当前值并用 eq 比较，再以 sync.Map 的 CompareAndSwap 换下读到的那个已存值；
+// 当前值在两步之间被并发修改时重试。传入 eq 时值不需要可比较
+func (s *ShardedRBTreeLF) CompareAndSwap(key int, old, newVal interface{}, eq func(a, b interface{}) bool) bool {
+	for {
+		raw, ok := s.data.Load(key)
+		if !ok || !valuesEqual(lfUnwrap(raw), old, eq) {
+			return false
+		}
+		if s.data.CompareAndSwap(key, raw, lfWrap(newVal)) {
+			return true
+		}
+	}
+}
+
+// 逐个删除所有 key；与并发写入交错时，Clear 之后写入的 key 可能保留
+func (s *ShardedRBTreeLF) Clear() {
+	s.data.Range(func(k, _ interface{}) bool {
+		s.Delete(k.(int))
+		return true
+	})
+}
+
+// 元素个数
+func (s *ShardedRBTreeLF) Len() int {
+	return int(s.n.Load())
+}
+
+// key 集合发生变化（插入新 key 或删除已有 key）：维护计数并把 key 记为待并入索引。
+// 必须在对 data 的修改完成之后调用
+func (s *ShardedRBTreeLF) keysChanged(key int, delta int64) {
+	s.n.Add(delta)
+	s.pending.Store(key, struct{}{})
+}
+
+// 把 pending 中的 key 并入索引后在 idxMu 内调用 fn。
+// 每个 key 先从 pending 移除再读取 data 决定在索引中插入还是删除：写入在修改 data 之后才记入 pending，
+// 因此调用开始前已完成的插入和删除一定反映在索引中；与之并发的写入会留在 pending 中等待下一次并入。
+// 只更新已有 key 的值不会记入 pending
+func (s *ShardedRBTreeLF) withIndex(fn func(idx *RBTree)) {
+	s.idxMu.Lock()
+	defer s.idxMu.Unlock()
+	if s.idx == nil {
+		s.idx = NewRBTree(newArena())
+	}
+	s.pending.Range(func(k, _ interface{}) bool {
+		s.pending.Delete(k)
+		key := k.(int)
+		if _, ok := s.data.Load(key); ok {
+			s.idx.Insert(key, nil)
+		} else {
+			s.idx.Delete(key)
+		}
+		return true
+	})
+	fn(s.idx)
+}
+
+// 以下有序操作基于 key 索引，值在访问时从 sync.Map 读取；索引中已被并发删除的 key 会被跳过。
+// 每一步只在 idxMu 内做一次 O(log n) 的索引查询，不在持锁时调用 fn
+
+// 从 step 给出的第一个 key 开始，沿 step 逐个查找仍存在于 data 中的 key
+func (s *ShardedRBTreeLF) seek(first func(idx *RBTree) (int, bool), step func(idx *RBTree, key int) (int, bool)) (int, interface{}, bool) {
+	var k int
+	var ok bool
+	s.withIndex(func(idx *RBTree) { k, ok = first(idx) })
+	for ok {
+		if v, found := s.Get(k); found {
+			return k, v, true
+		}
+		s.withIndex(func(idx *RBTree) { k, ok = step(idx, k) })
+	}
+	return 0, nil, false
+}
+
+func lfIndexNext(idx *RBTree, key int) (int, bool) {
+	k, _, ok := idx.Next(key)
+	return k, ok
+}
+
+func lfIndexPrev(idx *RBTree, key int) (int, bool) {
+	k, _, ok := idx.Prev(key)
+	return k, ok
+}
+
+// 获取最小 key
+func (s *ShardedRBTreeLF) Min() (int, interface{}, bool) {
+	return s.seek(func(idx *RBTree) (int, bool) {
+		k, _, ok := idx.Min()
+		return k, ok
+	}, lfIndexNext)
+}
+
+// 获取最大 key
+func (s *ShardedRBTreeLF) Max() (int, interface{}, bool) {
+	return s.seek(func(idx *RBTree) (int, bool) {
+		k, _, ok := idx.Max()
+		return k, ok
+	}, lfIndexPrev)
+}
+
+// 获取 key 的前驱（小于 key 的最大 key）
+func (s *ShardedRBTreeLF) Prev(key int) (int, interface{}, bool) {
+	return s.seek(func(idx *RBTree) (int, bool) { return lfIndexPrev(idx, key) }, lfIndexPrev)
+}
+
+// 获取 key 的后继（大于 key 的最小 key）
+func (s *ShardedRBTreeLF) Next(key int) (int, interface{}, bool) {
+	return s.seek(func(idx *RBTree) (int, bool) { return lfIndexNext(idx, key) }, lfIndexNext)
+}
+
+// 在锁内取出索引中 [start, end] 的 key（reverse 为 true 时降序）
+func (s *ShardedRBTreeLF) rangeKeys(start, end int, reverse bool) []int {
+	var keys []int
+	s.withIndex(func(idx *RBTree) {
+		collect := func(k int, _ interface{}) bool {
+			keys = append(keys, k)
+			return true
+		}
+		if reverse {
+			idx.RangeReverse(start, end, collect)
+		} else {
+			idx.Range(start, end, collect)
+		}
+	})
+	return keys
+}
+
+// 按升序遍历 [start, end]，fn 返回 false 时停止
+func (s *ShardedRBTreeLF) Range(start, end int, fn func(key int, value interface{}) bool) {
+	for _, k := range s.rangeKeys(start, end, false) {
+		if v, ok := s.Get(k); ok && !fn(k, v) {
+			return
+		}
+	}
+}
+
+// 按降序遍历 [start, end]，fn 返回 false 时停止
+func (s *ShardedRBTreeLF) RangeReverse(start, end int, fn func(key int, value interface{}) bool) {
+	for _, k := range s.rangeKeys(start, end, true) {
+		if v, ok := s.Get(k); ok && !fn(k, v) {
+			return
+		}
+	}
 }
 
 // 4. Optimized 分片
 type shard struct {
 	tree *RBTree
 	mu   sync.RWMutex
+	// 锁竞争统计，未开启时为 nil
+	stats *contentionCounters
+	// Reshard 把分片换下后为 true，只在持有该分片写锁时修改；
+	// 加锁后发现分片已退役的操作需要到新的分片数组上重试
+	retired bool
+}
+
+// 单个分片的锁竞争计数
+type contentionCounters struct {
+	acquisitions atomic.Int64
+	contended    atomic.Int64
+}
+
+// 加写锁；开启统计时先 TryLock，失败记为一次竞争再阻塞等待
+func (sh *shard) lock() {
+	if sh.stats == nil {
+		sh.mu.Lock()
+		return
+	}
+	if !sh.mu.TryLock() {
+		sh.stats.contended.Add(1)
+		sh.mu.Lock()
+	}
+	sh.stats.acquisitions.Add(1)
+}
+
+// 加读锁；开启统计时先 TryRLock，失败记为一次竞争再阻塞等待
+func (sh *shard) rlock() {
+	if sh.stats == nil {
+		sh.mu.RLock()
+		return
+	}
+	if !sh.mu.TryRLock() {
+		sh.stats.contended.Add(1)
+		sh.mu.RLock()
+	}
+	sh.stats.acquisitions.Add(1)
+}
+
+// 单个分片的锁竞争统计
+type ContentionStat struct {
+	Shard        int
+	Acquisitions int64 // 加锁总次数
+	Contended    int64 // 需要等待的加锁次数
 }
 
 type ShardedRBTreeOpt struct {
-	shards []*shard
-	arena  *arena
+	// 当前的分片数组，经由 shards() 读取；Reshard 会整体替换它
+	table atomic.Pointer[[]*shard]
+	// 分片前对 key 做归一化，只影响分片位置，不影响存储的 key 和顺序
+	normalize func(key int) int
+	// 非 nil 时按 hash(key) 取模选择分片，否则直接对 key 取模
+	hash func(key int) uint64
+}
+
+// ShardedRBTreeOpt 构造选项
+type ShardOption func(*ShardedRBTreeOpt)
+
+// 开启分片锁竞争统计，通过 ContentionStats 查看。未开启时没有额外开销。
+func WithContentionStats() ShardOption {
+	return func(s *ShardedRBTreeOpt) {
+		for _, sh := range s.shards() {
+			sh.stats = &contentionCounters{}
+		}
+	}
+}
+
+// 在计算分片前对 key 做归一化（例如屏蔽编码元数据的低位），使相关的 key 落到同一分片。
+// 归一化只影响分片位置：存储的 key、查找和排序都仍使用原始 key。
+func WithKeyNormalizer(normalize func(key int) int) ShardOption {
+	return func(s *ShardedRBTreeOpt) {
+		s.normalize = normalize
+	}
 }
 
-func NewShardedRBTreeOpt(shardsNum int) *ShardedRBTreeOpt {
+func NewShardedRBTreeOpt(shardsNum int, opts ...ShardOption) *ShardedRBTreeOpt {
 	if shardsNum <= 0 {
 		shardsNum = runtime.NumCPU() * 8
 	}
-	a := newArena()
+	// 每个分片使用独立的 arena，避免所有分片争用同一个 sync.Pool；
+	// 删除时节点经由分片树自身的 arena 归还
 	shards := make([]*shard, shardsNum)
 	for i := range shards {
-		shards[i] = &shard{tree: NewRBTree(a)}
+		shards[i] = &shard{tree: NewRBTree(newArena())}
+	}
+	s := &ShardedRBTreeOpt{}
+	s.table.Store(&shards)
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// 与 NewShardedRBTreeOpt 相同，但按 hash(key) % shardsNum 选择分片，
+// 适用于 key 有公共步长（例如都是 64 的倍数）、直接取模会集中到少数分片的场景。
+// hash 为 nil 时使用默认的 MixKey。
+func NewShardedRBTreeOptFunc(shardsNum int, hash func(key int) uint64, opts ...ShardOption) *ShardedRBTreeOpt {
+	s := NewShardedRBTreeOpt(shardsNum, opts...)
+	if hash == nil {
+		hash = MixKey
+	}
+	s.hash = hash
+	return s
+}
+
+// MixKey 是 splitmix64 的终结混合函数：key 的每一位都会影响结果的所有位，
+// 有公共步长的 key 也能均匀分布到各分片。负数 key 按补码参与混合。
+func MixKey(key int) uint64 {
+	x := uint64(key)
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// 返回每个分片的锁竞争统计，未开启统计时返回 nil
+func (s *ShardedRBTreeOpt) ContentionStats() []ContentionStat {
+	shards := s.shards()
+	if len(shards) == 0 || shards[0].stats == nil {
+		return nil
+	}
+	stats := make([]ContentionStat, len(shards))
+	for i, sh := range shards {
+		stats[i] = ContentionStat{
+			Shard:        i,
+			Acquisitions: sh.stats.acquisitions.Load(),
+			Contended:    sh.stats.contended.Load(),
+		}
+	}
+	return stats
+}
+
+// 分片函数在样本上的分布评估结果
+type ShardBalanceReport struct {
+	Counts      []int   // 每个分片分到的样本数
+	Invalid     int     // 返回值不在 [0, n) 内的样本数
+	ChiSquare   float64 // 相对均匀分布的卡方统计量
+	MaxMinRatio float64 // 最多与最少分片的样本数之比，有空分片时为 +Inf
+	Imbalanced  bool    // 卡方超过自由度的约 3 个标准差，或存在非法返回值
+}
+
+// 用样本 key 评估分片函数的均衡性，便于上线前检查自定义分片函数。
+// 卡方统计量在均匀分布下约等于 n-1，明显偏大说明分片不均。
+func EvaluateShardFn(shardFn func(key, n int) int, sampleKeys []int, n int) ShardBalanceReport {
+	if n <= 0 {
+		return ShardBalanceReport{}
+	}
+	r := ShardBalanceReport{Counts: make([]int, n)}
+	valid := 0
+	for _, k := range sampleKeys {
+		idx := shardFn(k, n)
+		if idx < 0 || idx >= n {
+			r.Invalid++
+			continue
+		}
+		r.Counts[idx]++
+		valid++
+	}
+	if valid == 0 {
+		r.Imbalanced = r.Invalid > 0
+		return r
+	}
+	expected := float64(valid) / float64(n)
+	minC, maxC := r.Counts[0], r.Counts[0]
+	for _, c := range r.Counts {
+		d := float64(c) - expected
+		r.ChiSquare += d * d / expected
+		minC = min(minC, c)
+		maxC = max(maxC, c)
+	}
+	if minC == 0 {
+		r.MaxMinRatio = math.Inf(1)
+	} else {
+		r.MaxMinRatio = float64(maxC) / float64(minC)
 	}
-	return &ShardedRBTreeOpt{shards: shards, arena: a}
+	df := float64(n - 1)
+	r.Imbalanced = r.Invalid > 0 || r.ChiSquare > df+3*math.Sqrt(2*df)
+	return r
+}
+
+// 当前的分片数组。持有其中任一分片的锁且该分片未退役时，数组不会被替换
+func (s *ShardedRBTreeOpt) shards() []*shard {
+	return *s.table.Load()
 }
 
 func (s *ShardedRBTreeOpt) getShard(key int) *shard {
-	idx := key % len(s.shards)
+	shards := s.shards()
+	return shards[s.shardIndex(key, len(shards))]
+}
+
+// key 在 n 个分片中的下标
+func (s *ShardedRBTreeOpt) shardIndex(key, n int) int {
+	if s.normalize != nil {
+		key = s.normalize(key)
+	}
+	if s.hash != nil {
+		return int(s.hash(key) % uint64(n))
+	}
+	idx := key % n
 	if idx < 0 {
-		idx += len(s.shards)
+		idx += n
+	}
+	return idx
+}
+
+// 返回 key 所在的分片并加写锁。取分片与加锁之间可能发生 Reshard，
+// 加锁后发现分片已退役就释放它，到新的分片数组上重试
+func (s *ShardedRBTreeOpt) lockShard(key int) *shard {
+	for {
+		sh := s.getShard(key)
+		sh.lock()
+		if !sh.retired {
+			return sh
+		}
+		sh.mu.Unlock()
+	}
+}
+
+// 同 lockShard，加读锁
+func (s *ShardedRBTreeOpt) rlockShard(key int) *shard {
+	for {
+		sh := s.getShard(key)
+		sh.rlock()
+		if !sh.retired {
+			return sh
+		}
+		sh.mu.RUnlock()
 	}
-	return s.shards[idx]
 }
 
 func (s *ShardedRBTreeOpt) Insert(key int, value interface{}) {
-	sh := s.getShard(key)
-	sh.mu.Lock()
+	sh := s.lockShard(key)
 	defer sh.mu.Unlock()
 	sh.tree.Insert(key, value)
 }
 func (s *ShardedRBTreeOpt) Get(key int) (interface{}, bool) {
-	sh := s.getShard(key)
-	sh.mu.RLock()
+	sh := s.rlockShard(key)
 	defer sh.mu.RUnlock()
 	return sh.tree.Get(key)
 }
-func (s *ShardedRBTreeOpt) Delete(key int) {
-	sh := s.getShard(key)
-	sh.mu.Lock()
-	defer sh.mu.Unlock()
-	sh.tree.Delete(key)
+func (s *ShardedRBTreeOpt) Delete(key int) {
+	sh := s.lockShard(key)
+	defer sh.mu.Unlock()
+	sh.tree.Delete(key)
+}
+
+// 在分片写锁下删除并返回旧值，语义同 RBTree.DeleteAndReport
+func (s *ShardedRBTreeOpt) DeleteAndReport(key int) (interface{}, bool) {
+	sh := s.lockShard(key)
+	defer sh.mu.Unlock()
+	return sh.tree.DeleteAndReport(key)
+}
+
+// 依次在各分片写锁下清空分片，节点归还给 arena
+func (s *ShardedRBTreeOpt) Clear() {
+	for _, sh := range s.shards() {
+		sh.lock()
+		retired := sh.retired
+		if !retired {
+			sh.tree.Clear()
+		}
+		sh.mu.Unlock()
+		if retired {
+			// 中途发生了 Reshard，已清空分片中的条目不会被带到新数组，在新数组上重来即可
+			s.Clear()
+			return
+		}
+	}
+}
+
+// 各分片元素个数之和。分片依次加锁统计，并发写入时结果不是某一时刻的精确快照（需要时用 Summary）
+func (s *ShardedRBTreeOpt) Len() int {
+	total := 0
+	for _, sh := range s.shards() {
+		sh.rlock()
+		total += sh.tree.Len()
+		sh.mu.RUnlock()
+	}
+	return total
+}
+
+// 在分片写锁下原子地查询或插入，语义同 RBTree.GetOrInsert
+func (s *ShardedRBTreeOpt) GetOrInsert(key int, value interface{}) (interface{}, bool) {
+	sh := s.lockShard(key)
+	defer sh.mu.Unlock()
+	return sh.tree.GetOrInsert(key, value)
+}
+
+// 在分片写锁下原子地检查并插入，语义同 RBTree.InsertIfAbsent
+func (s *ShardedRBTreeOpt) InsertIfAbsent(key int, value interface{}) bool {
+	sh := s.lockShard(key)
+	defer sh.mu.Unlock()
+	return sh.tree.InsertIfAbsent(key, value)
+}
+
+// 在分片写锁下存入 value 并返回旧值，语义同 RBTree.Replace
+func (s *ShardedRBTreeOpt) Replace(key int, value interface{}) (interface{}, bool) {
+	sh := s.lockShard(key)
+	defer sh.mu.Unlock()
+	return sh.tree.Replace(key, value)
+}
+
+// 在分片写锁下执行 Update，同一 key 上的并发 Update 串行执行，语义同 RBTree.Update
+func (s *ShardedRBTreeOpt) Update(key int, fn func(old interface{}, found bool) (interface{}, bool)) {
+	sh := s.lockShard(key)
+	defer sh.mu.Unlock()
+	sh.tree.Update(key, fn)
+}
+
+// 在分片写锁下原子地比较并替换，语义同 RBTree.CompareAndSwap
+func (s *ShardedRBTreeOpt) CompareAndSwap(key int, old, newVal interface{}, eq func(a, b interface{}) bool) bool {
+	sh := s.lockShard(key)
+	defer sh.mu.Unlock()
+	return sh.tree.CompareAndSwap(key, old, newVal, eq)
+}
+
+// 在分片写锁下原子地把 key 上的整数值加上 delta，返回新值，语义同 RBTree.Add
+func (s *ShardedRBTreeOpt) Add(key int, delta int64) int64 {
+	sh := s.lockShard(key)
+	defer sh.mu.Unlock()
+	return sh.tree.Add(key, delta)
+}
+
+// 在分片写锁下执行 RBTree.TryAdd
+func (s *ShardedRBTreeOpt) TryAdd(key int, delta int64) (int64, error) {
+	sh := s.lockShard(key)
+	defer sh.mu.Unlock()
+	return sh.tree.TryAdd(key, delta)
+}
+
+// 原子地删除并返回全局最小的 n 个条目（升序）。
+// 持有所有分片的写锁，先从每个分片取出至多 n 个最小条目做归并，再从各自分片删除选中的条目。
+func (s *ShardedRBTreeOpt) PopMinN(n int) []Entry {
+	if n <= 0 {
+		return nil
+	}
+	var out []Entry
+	s.withAllShardsLocked(func() {
+		type candidate struct {
+			n  *node
+			sh *shard
+		}
+		var cands []candidate
+		for _, sh := range s.shards() {
+			it := sh.tree.Iterator()
+			for i := 0; i < n && it.Next(); i++ {
+				cands = append(cands, candidate{n: it.cur, sh: sh})
+			}
+		}
+		sort.Slice(cands, func(i, j int) bool { return cands[i].n.key < cands[j].n.key })
+		if len(cands) > n {
+			cands = cands[:n]
+		}
+		out = make([]Entry, len(cands))
+		for i, c := range cands {
+			out[i] = Entry{Key: c.n.key, Value: c.n.value}
+		}
+		for _, c := range cands {
+			c.sh.tree.deleteNode(c.n)
+		}
+	})
+	return out
+}
+
+// 删除并返回全局最小的条目。一次调用内持有所有分片写锁，并发调用不会弹出同一元素
+func (s *ShardedRBTreeOpt) PopMin() (int, interface{}, bool) {
+	return s.popExtreme(false)
+}
+
+// 删除并返回全局最大的条目，加锁方式同 PopMin
+func (s *ShardedRBTreeOpt) PopMax() (int, interface{}, bool) {
+	return s.popExtreme(true)
+}
+
+func (s *ShardedRBTreeOpt) popExtreme(largest bool) (key int, value interface{}, ok bool) {
+	s.withAllShardsLocked(func() {
+		var best *node
+		var owner *shard
+		for _, sh := range s.shards() {
+			if sh.tree.root == nil {
+				continue
+			}
+			var n *node
+			if largest {
+				n = sh.tree.maximum(sh.tree.root)
+			} else {
+				n = sh.tree.minimum(sh.tree.root)
+			}
+			if best == nil || (largest && n.key > best.key) || (!largest && n.key < best.key) {
+				best, owner = n, sh
+			}
+		}
+		if best != nil {
+			key, value, ok = owner.tree.pop(best)
+		}
+	})
+	return key, value, ok
+}
+
+// Collapse 把所有分片的条目合并为一棵直接构建的平衡 RBTree，适用于数据冻结后的只读服务阶段：
+// 单棵树对缓存更友好，且之后的读取不再需要任何锁。原分片树保持不变。
+// 收集条目时同时持有所有分片的读锁，结果是同一时刻的一致视图。
+func (s *ShardedRBTreeOpt) Collapse() *RBTree {
+	var entries []Entry
+	s.withAllShardsRLocked(func() {
+		for _, sh := range s.shards() {
+			sh.tree.forEach(func(k int, v interface{}) bool {
+				entries = append(entries, Entry{Key: k, Value: v})
+				return true
+			})
+		}
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return buildBalanced(newArena(), entries)
+}
+
+// Summary 在同时持有所有分片读锁的情况下统计全局最小 key、最大 key 和元素个数，
+// 三者来自同一时刻的一致视图。期间所有写入都会被短暂阻塞。
+func (s *ShardedRBTreeOpt) Summary() (minK, maxK, count int, ok bool) {
+	s.withAllShardsRLocked(func() {
+		for _, sh := range s.shards() {
+			if sh.tree.root == nil {
+				continue
+			}
+			lo := sh.tree.minimum(sh.tree.root).key
+			hi := sh.tree.maximum(sh.tree.root).key
+			if !ok || lo < minK {
+				minK = lo
+			}
+			if !ok || hi > maxK {
+				maxK = hi
+			}
+			count += sh.tree.size
+			ok = true
+		}
+	})
+	return minK, maxK, count, ok
+}
+
+// 需要同时锁住所有分片的操作一律经由 withAllShardsRLocked / withAllShardsLocked：
+// 总是按分片下标升序加锁、逆序释放，多个全分片操作并发执行时不会因加锁顺序不同而死锁。
+// fn panic 时锁同样会被释放；fn 执行期间分片数组不会被 Reshard 替换，fn 内的 s.shards() 即为加锁的那一组。
+
+// 持有所有分片的读锁执行 fn
+func (s *ShardedRBTreeOpt) withAllShardsRLocked(fn func()) {
+	shards := s.shards()
+	for _, sh := range shards {
+		sh.rlock()
+	}
+	// 加锁前发生了 Reshard：所有旧分片一起退役，释放后在新数组上重来
+	if shards[0].retired {
+		for i := len(shards) - 1; i >= 0; i-- {
+			shards[i].mu.RUnlock()
+		}
+		s.withAllShardsRLocked(fn)
+		return
+	}
+	defer func() {
+		for i := len(shards) - 1; i >= 0; i-- {
+			shards[i].mu.RUnlock()
+		}
+	}()
+	fn()
+}
+
+// 持有所有分片的写锁执行 fn
+func (s *ShardedRBTreeOpt) withAllShardsLocked(fn func()) {
+	shards := s.shards()
+	for _, sh := range shards {
+		sh.lock()
+	}
+	if shards[0].retired {
+		for i := len(shards) - 1; i >= 0; i-- {
+			shards[i].mu.Unlock()
+		}
+		s.withAllShardsLocked(fn)
+		return
+	}
+	defer func() {
+		for i := len(shards) - 1; i >= 0; i-- {
+			shards[i].mu.Unlock()
+		}
+	}()
+	fn()
+}
+
+// Reshard 把分片数调整为 newCount：在持有全部分片写锁的情况下，把所有条目按新的分片数
+// 重新分配到新建的分片中，再整体替换分片数组。替换对其他操作是原子的：单 key 操作和全分片操作
+// 要么在替换前完成，要么在新分片上重试，不会丢失写入。旧分片的内容保持不变，
+// 逐分片依次加锁的只读操作（Len、Min 等）在替换瞬间可能读到旧分片，一致性与平时相同。
+// 开启了锁竞争统计时新分片同样开启，计数从零开始。newCount <= 0 时返回错误
+func (s *ShardedRBTreeOpt) Reshard(newCount int) error {
+	if newCount <= 0 {
+		return fmt.Errorf("rbtree: Reshard to %d shards", newCount)
+	}
+	s.withAllShardsLocked(func() {
+		old := s.shards()
+		shards := make([]*shard, newCount)
+		for i := range shards {
+			shards[i] = &shard{tree: NewRBTree(newArena())}
+			if old[0].stats != nil {
+				shards[i].stats = &contentionCounters{}
+			}
+		}
+		for _, sh := range old {
+			sh.tree.forEach(func(k int, v interface{}) bool {
+				shards[s.shardIndex(k, newCount)].tree.Insert(k, v)
+				return true
+			})
+			sh.retired = true
+		}
+		s.table.Store(&shards)
+	})
+	return nil
+}
+
+// 按分片分组批量应用一组插入和删除，每个分片只加一次写锁。
+// 同一分片内先应用 inserts 再应用 deletes，因此同时出现在两者中的 key 最终被删除。
+func (s *ShardedRBTreeOpt) ApplyDelta(inserts map[int]interface{}, deletes []int) {
+	type shardOps struct {
+		keys    []int
+		values  []interface{}
+		deletes []int
+	}
+	ops := make(map[*shard]*shardOps)
+	get := func(sh *shard) *shardOps {
+		o, ok := ops[sh]
+		if !ok {
+			o = &shardOps{}
+			ops[sh] = o
+		}
+		return o
+	}
+	for k, v := range inserts {
+		o := get(s.getShard(k))
+		o.keys = append(o.keys, k)
+		o.values = append(o.values, v)
+	}
+	for _, k := range deletes {
+		o := get(s.getShard(k))
+		o.deletes = append(o.deletes, k)
+	}
+	for sh, o := range ops {
+		sh.lock()
+		if sh.retired {
+			// 分组之后发生了 Reshard：这一组改为逐个应用到新的分片
+			sh.mu.Unlock()
+			for i, k := range o.keys {
+				s.Insert(k, o.values[i])
+			}
+			for _, k := range o.deletes {
+				s.Delete(k)
+			}
+			continue
+		}
+		for i, k := range o.keys {
+			sh.tree.Insert(k, o.values[i])
+		}
+		for _, k := range o.deletes {
+			sh.tree.Delete(k)
+		}
+		sh.mu.Unlock()
+	}
 }
 
 // ...existing code...
@@ -485,6 +1775,36 @@ func (t *RBTree) Prev(key int) (int, interface{}, bool) {
 	return 0, nil, false
 }
 
+// 返回 key >= 给定 key 的最小节点
+func (t *RBTree) ceiling(key int) *node {
+	x := t.root
+	var c *node
+	for x != nil {
+		if x.key >= key {
+			c = x
+			x = x.left
+		} else {
+			x = x.right
+		}
+	}
+	return c
+}
+
+// 返回 key <= 给定 key 的最大节点
+func (t *RBTree) floor(key int) *node {
+	x := t.root
+	var f *node
+	for x != nil {
+		if x.key <= key {
+			f = x
+			x = x.right
+		} else {
+			x = x.left
+		}
+	}
+	return f
+}
+
 // 获取 key 的后继（大于 key 的最小 key）
 func (t *RBTree) Next(key int) (int, interface{}, bool) {
 	x := t.root
@@ -503,24 +1823,425 @@ func (t *RBTree) Next(key int) (int, interface{}, bool) {
 	return 0, nil, false
 }
 
-// 区间遍历 [start, end]，闭区间
+// 获取 <= key 的最大 key
+func (t *RBTree) Floor(key int) (int, interface{}, bool) {
+	if f := t.floor(key); f != nil {
+		return f.key, f.value, true
+	}
+	return 0, nil, false
+}
+
+// 获取 >= key 的最小 key
+func (t *RBTree) Ceiling(key int) (int, interface{}, bool) {
+	if c := t.ceiling(key); c != nil {
+		return c.key, c.value, true
+	}
+	return 0, nil, false
+}
+
+// 获取与 key 差的绝对值最小的 key，两侧距离相同时取较小的一侧；树为空时返回 false。
+// 距离按无符号数计算，key 接近 int 边界时也不会溢出
+func (t *RBTree) Nearest(key int) (int, interface{}, bool) {
+	f, c := t.floor(key), t.ceiling(key)
+	switch {
+	case f == nil && c == nil:
+		return 0, nil, false
+	case c == nil:
+		return f.key, f.value, true
+	case f == nil:
+		return c.key, c.value, true
+	}
+	if uint(key)-uint(f.key) <= uint(c.key)-uint(key) {
+		return f.key, f.value, true
+	}
+	return c.key, c.value, true
+}
+
+// 区间遍历 [start, end]，闭区间；fn 返回 false 时立即停止整个遍历
 func (t *RBTree) Range(start, end int, fn func(key int, value interface{}) bool) {
-	var walk func(n *node)
-	walk = func(n *node) {
+	var walk func(n *node) bool
+	walk = func(n *node) bool {
 		if n == nil {
+			return true
+		}
+		if n.key > start && !walk(n.left) {
+			return false
+		}
+		if n.key >= start && n.key <= end {
+			if !fn(n.key, n.value) {
+				return false
+			}
+		}
+		if n.key < end {
+			return walk(n.right)
+		}
+		return true
+	}
+	walk(t.root)
+}
+
+// 从第一个 >= start 的 key 起按升序访问，直到 cond(key) 不成立或 fn 返回 false。
+// 沿后继逐个前进，只触及实际访问的 key 和第一个使 cond 失败的 key
+func (t *RBTree) RangeWhile(start int, cond func(key int) bool, fn func(k int, v interface{}) bool) {
+	for n := t.ceiling(start); n != nil && cond(n.key); n = successor(n) {
+		if !fn(n.key, n.value) {
+			return
+		}
+	}
+}
+
+// 同 Range，额外传入每个 key 的重数（见 DupCount），每个 key 只访问一次
+func (t *RBTree) RangeCounts(start, end int, fn func(key int, value interface{}, count int) bool) {
+	if start > end {
+		return
+	}
+	for n := t.ceiling(start); n != nil && n.key <= end; n = successor(n) {
+		if !fn(n.key, n.value, n.count) {
 			return
 		}
+	}
+}
+
+// RangeContext 同 Range，但每访问 ctxCheckInterval 个条目检查一次 ctx，
+// ctx 取消时停止遍历并返回 ctx.Err()；ctx 一开始就已取消时不访问任何条目。
+// fn 主动返回 false 或遍历完成时返回 nil
+func (t *RBTree) RangeContext(ctx context.Context, start, end int, fn func(key int, value interface{}) bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var err error
+	t.Range(start, end, withContext(ctx, &err, fn))
+	return err
+}
+
+// RangeContext 检查 ctx 的间隔（访问的条目数）
+const ctxCheckInterval = 1024
+
+// 包装区间遍历的回调：每 ctxCheckInterval 次调用检查一次 ctx，已取消时把错误写入 *err 并停止遍历
+func withContext(ctx context.Context, err *error, fn func(key int, value interface{}) bool) func(key int, value interface{}) bool {
+	visited := 0
+	return func(key int, value interface{}) bool {
+		visited++
+		if visited%ctxCheckInterval == 0 {
+			if *err = ctx.Err(); *err != nil {
+				return false
+			}
+		}
+		return fn(key, value)
+	}
+}
+
+// 返回 [start, end] 内所有值经 extract 转换后的和。extract 由调用方决定，
+// 无法预先缓存子树和，因此是只访问区间内节点的剪枝遍历，O(log n + k)
+func (t *RBTree) SumRange(start, end int, extract func(v interface{}) int64) int64 {
+	var sum int64
+	t.Range(start, end, func(_ int, v interface{}) bool {
+		sum += extract(v)
+		return true
+	})
+	return sum
+}
+
+// 按升序返回所有 key
+func (t *RBTree) Keys() []int {
+	keys := make([]int, 0, t.size)
+	t.forEach(func(k int, _ interface{}) bool {
+		keys = append(keys, k)
+		return true
+	})
+	return keys
+}
+
+// 按 key 升序返回所有 value
+func (t *RBTree) Values() []interface{} {
+	values := make([]interface{}, 0, t.size)
+	t.forEach(func(_ int, v interface{}) bool {
+		values = append(values, v)
+		return true
+	})
+	return values
+}
+
+// 按升序返回 [start, end] 内的 key，容量由 CountRange 精确预分配
+func (t *RBTree) KeysRange(start, end int) []int {
+	keys := make([]int, 0, t.CountRange(start, end))
+	t.Range(start, end, func(k int, _ interface{}) bool {
+		keys = append(keys, k)
+		return true
+	})
+	return keys
+}
+
+// 按降序遍历 [start, end]，闭区间；fn 返回 false 时立即停止，与 Range 的提前终止语义一致
+func (t *RBTree) RangeReverse(start, end int, fn func(key int, value interface{}) bool) {
+	var walk func(n *node) bool
+	walk = func(n *node) bool {
+		if n == nil {
+			return true
+		}
+		if n.key < end && !walk(n.right) {
+			return false
+		}
+		if n.key >= start && n.key <= end {
+			if !fn(n.key, n.value) {
+				return false
+			}
+		}
 		if n.key > start {
-			walk(n.left)
+			return walk(n.left)
+		}
+		return true
+	}
+	walk(t.root)
+}
+
+// 按升序访问 [center-radius, center+radius] 内的 key，越过 int 表示范围时截断到 math.MinInt/math.MaxInt。
+// radius 为负时不访问任何 key。
+func (t *RBTree) WithinDistance(center, radius int, fn func(key int, value interface{}) bool) {
+	if radius < 0 {
+		return
+	}
+	start, end := math.MinInt, math.MaxInt
+	if center >= math.MinInt+radius {
+		start = center - radius
+	}
+	if center <= math.MaxInt-radius {
+		end = center + radius
+	}
+	t.Range(start, end, fn)
+}
+
+// RangeWithBudget 每访问多少个节点检查一次时钟
+const rangeBudgetCheckEvery = 64
+
+// 带时间预算的区间遍历 [start, end]，超出 budget 时中止扫描。
+// 只有因超时中止时返回 false；正常遍历完或 fn 返回 false 都视为完成。
+// 为避免每个节点都调用 time.Now，每访问 rangeBudgetCheckEvery 个节点检查一次时钟。
+func (t *RBTree) RangeWithBudget(start, end int, budget time.Duration, fn func(key int, value interface{}) bool) (completed bool) {
+	deadline := time.Now().Add(budget)
+	visited := 0
+	timedOut := false
+	var walk func(n *node) bool
+	walk = func(n *node) bool {
+		if n == nil {
+			return true
+		}
+		visited++
+		if visited%rangeBudgetCheckEvery == 0 && time.Now().After(deadline) {
+			timedOut = true
+			return false
+		}
+		if n.key > start && !walk(n.left) {
+			return false
 		}
 		if n.key >= start && n.key <= end {
 			if !fn(n.key, n.value) {
-				return
+				return false
 			}
 		}
 		if n.key < end {
-			walk(n.right)
+			return walk(n.right)
+		}
+		return true
+	}
+	walk(t.root)
+	return !timedOut
+}
+
+// 按升序遍历 [start, end]，每一步同时给出区间内的前一个、当前和后一个条目，
+// 便于计算相邻条目的差值。区间边界处缺失的 prev/next 为 nil；fn 返回 false 时停止。
+func (t *RBTree) RangeWindows(start, end int, fn func(prev, cur, next *Entry) bool) {
+	if start > end {
+		return
+	}
+	it := t.Iterator()
+	it.Seek(start)
+	read := func() *Entry {
+		if !it.Next() || it.Key() > end {
+			return nil
+		}
+		return &Entry{Key: it.Key(), Value: it.Value()}
+	}
+	var prev *Entry
+	cur := read()
+	for cur != nil {
+		next := read()
+		if !fn(prev, cur, next) {
+			return
+		}
+		prev, cur = cur, next
+	}
+}
+
+// 判断 [start, end] 内是否存在 key，沿树向区间下降，命中即返回，复杂度 O(log n)
+func (t *RBTree) HasKeyInRange(start, end int) bool {
+	ok, _ := t.hasKeyInRange(start, end)
+	return ok
+}
+
+// 同 HasKeyInRange，额外返回访问的节点数
+func (t *RBTree) hasKeyInRange(start, end int) (bool, int) {
+	visited := 0
+	x := t.root
+	for x != nil && start <= end {
+		visited++
+		if x.key < start {
+			x = x.right
+		} else if x.key > end {
+			x = x.left
+		} else {
+			return true, visited
+		}
+	}
+	return false, visited
+}
+
+// 返回中序排名为 i（0 起始）的节点，越界时返回 nil
+func (t *RBTree) nodeAt(i int) *node {
+	if i < 0 || i >= getSize(t.root) {
+		return nil
+	}
+	x := t.root
+	for x != nil {
+		l := getSize(x.left)
+		if i < l {
+			x = x.left
+		} else if i > l {
+			i -= l + 1
+			x = x.right
+		} else {
+			return x
+		}
+	}
+	return nil
+}
+
+// Rank 返回严格小于 key 的元素个数（即 key 的 0 起始排名），以及 key 是否存在，O(log n)
+func (t *RBTree) Rank(key int) (int, bool) {
+	smaller, _, exists := t.SurroundingCounts(key)
+	return smaller, exists
+}
+
+// CountRange 返回 [start, end] 内的 key 个数，基于子树大小 O(log n)，不访问区间内的元素。
+// 用 Rank 计算而不是 Rank(end+1)，避免 end 为 math.MaxInt 时溢出
+func (t *RBTree) CountRange(start, end int) int {
+	if start > end {
+		return 0
+	}
+	lo, _ := t.Rank(start)
+	hi, exists := t.Rank(end)
+	if exists {
+		hi++
+	}
+	return hi - lo
+}
+
+// 分页遍历 [start, end]：跳过区间内前 offset 个条目，再按升序访问至多 limit 个，fn 返回 false 时提前停止。
+// 借助子树大小直接定位到第 offset 个条目，跳过的部分不逐个访问，总代价 O(log n + limit)
+func (t *RBTree) RangePage(start, end, offset, limit int, fn func(k int, v interface{}) bool) {
+	if start > end || limit <= 0 {
+		return
+	}
+	lo, _ := t.Rank(start)
+	for n := t.nodeAt(lo + max(offset, 0)); n != nil && n.key <= end && limit > 0; n = successor(n) {
+		if !fn(n.key, n.value) {
+			return
+		}
+		limit--
+	}
+}
+
+// Select 返回第 i 小（0 起始）的元素，i 越界时返回 false，O(log n)
+func (t *RBTree) Select(i int) (int, interface{}, bool) {
+	n := t.nodeAt(i)
+	if n == nil {
+		return 0, nil, false
+	}
+	return n.key, n.value, true
+}
+
+// 一次下降返回严格小于 key 与严格大于 key 的元素个数，以及 key 是否存在，
+// 可直接换算为 key 的百分位位置
+func (t *RBTree) SurroundingCounts(key int) (smaller int, larger int, exists bool) {
+	x := t.root
+	for x != nil {
+		if key < x.key {
+			x = x.left
+		} else if key > x.key {
+			smaller += getSize(x.left) + 1
+			x = x.right
+		} else {
+			smaller += getSize(x.left)
+			exists = true
+			break
+		}
+	}
+	larger = getSize(t.root) - smaller
+	if exists {
+		larger--
+	}
+	return smaller, larger, exists
+}
+
+// CompressRuns 按 key 升序扫描，把与前一个 key 的值相等（由 eq 判断）的值替换为前一个值的同一实例，
+// 使连续相等的一段值共享同一份数据、旧的重复实例可被 GC 回收。树结构不变，返回被替换的值的个数。
+func (t *RBTree) CompressRuns(eq func(a, b interface{}) bool) int {
+	replaced := 0
+	var prev *node
+	it := t.Iterator()
+	for it.Next() {
+		n := it.cur
+		if prev != nil && eq(prev.value, n.value) {
+			n.value = prev.value
+			replaced++
+		}
+		prev = n
+	}
+	return replaced
+}
+
+// DiffMap 对比树与 map：返回只在树中的 key、只在 map 中的 key，以及两边都有但值不同（由 eq 判断）的 key。
+// 按序遍历树并探测 map，整体 O(n+m)（只在 map 中的 key 另需排序）；三个结果都按 key 升序排列。
+func (t *RBTree) DiffMap(m map[int]interface{}, eq func(a, b interface{}) bool) (onlyInTree, onlyInMap []int, different []int) {
+	// 记录两边都有的 key，随后扫描 map 时用来找出只在 map 中的 key
+	matched := make(map[int]struct{}, min(len(m), t.size))
+	t.forEach(func(k int, v interface{}) bool {
+		mv, ok := m[k]
+		if !ok {
+			onlyInTree = append(onlyInTree, k)
+			return true
+		}
+		matched[k] = struct{}{}
+		if !eq(v, mv) {
+			different = append(different, k)
+		}
+		return true
+	})
+	if len(matched) < len(m) {
+		for k := range m {
+			if _, ok := matched[k]; !ok {
+				onlyInMap = append(onlyInMap, k)
+			}
 		}
+		sort.Ints(onlyInMap)
+	}
+	return onlyInTree, onlyInMap, different
+}
+
+// 按 key 升序遍历整棵树，fn 返回 false 时停止
+func (t *RBTree) forEach(fn func(key int, value interface{}) bool) {
+	var walk func(n *node) bool
+	walk = func(n *node) bool {
+		if n == nil {
+			return true
+		}
+		if !walk(n.left) {
+			return false
+		}
+		if !fn(n.key, n.value) {
+			return false
+		}
+		return walk(n.right)
 	}
 	walk(t.root)
 }
@@ -532,8 +2253,8 @@ func (s *ShardedRBTreeOpt) Min() (int, interface{}, bool) {
 	minKey := 0
 	var minVal interface{}
 	found := false
-	for _, sh := range s.shards {
-		sh.mu.RLock()
+	for _, sh := range s.shards() {
+		sh.rlock()
 		k, v, ok := sh.tree.Min()
 		sh.mu.RUnlock()
 		if ok && (!found || k < minKey) {
@@ -548,8 +2269,8 @@ func (s *ShardedRBTreeOpt) Max() (int, interface{}, bool) {
 	maxKey := 0
 	var maxVal interface{}
 	found := false
-	for _, sh := range s.shards {
-		sh.mu.RLock()
+	for _, sh := range s.shards() {
+		sh.rlock()
 		k, v, ok := sh.tree.Max()
 		sh.mu.RUnlock()
 		if ok && (!found || k > maxKey) {
@@ -559,13 +2280,141 @@ func (s *ShardedRBTreeOpt) Max() (int, interface{}, bool) {
 	return maxKey, maxVal, found
 }
 
-// 区间遍历（所有分片）
+// 按全局升序遍历 [start, end]：持有所有分片读锁，对各分片的中序游标做多路归并，
+// fn 返回 false 时立即停止并释放所有锁
 func (s *ShardedRBTreeOpt) Range(start, end int, fn func(key int, value interface{}) bool) {
-	for _, sh := range s.shards {
-		sh.mu.RLock()
-		sh.tree.Range(start, end, fn)
+	s.mergeRange(start, end, false, fn)
+}
+
+// SnapshotKeys 返回某一时刻所有 key 的全局升序列表：按下标顺序获取全部分片的读锁，
+// 归并各分片的中序序列后再一起释放。代价为 O(n log S)（S 为分片数），
+// 期间所有写入都会被阻塞，不适合在大树上频繁调用
+func (s *ShardedRBTreeOpt) SnapshotKeys() []int {
+	keys := make([]int, 0, s.Len())
+	s.mergeRange(math.MinInt, math.MaxInt, false, func(k int, _ interface{}) bool {
+		keys = append(keys, k)
+		return true
+	})
+	return keys
+}
+
+// 按全局升序返回所有 key（跨分片归并）
+func (s *ShardedRBTreeOpt) Keys() []int {
+	return s.KeysRange(math.MinInt, math.MaxInt)
+}
+
+// 按 key 的全局升序返回所有 value（跨分片归并）
+func (s *ShardedRBTreeOpt) Values() []interface{} {
+	var values []interface{}
+	s.Range(math.MinInt, math.MaxInt, func(_ int, v interface{}) bool {
+		values = append(values, v)
+		return true
+	})
+	return values
+}
+
+// 按全局升序返回 [start, end] 内的 key（跨分片归并）
+func (s *ShardedRBTreeOpt) KeysRange(start, end int) []int {
+	var keys []int
+	s.Range(start, end, func(k int, _ interface{}) bool {
+		keys = append(keys, k)
+		return true
+	})
+	return keys
+}
+
+// 同 Range，ctx 取消时停止多路归并、立即释放所有分片的读锁并返回 ctx.Err()
+func (s *ShardedRBTreeOpt) RangeContext(ctx context.Context, start, end int, fn func(key int, value interface{}) bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var err error
+	s.mergeRange(start, end, false, withContext(ctx, &err, fn))
+	return err
+}
+
+// 按全局降序遍历 [start, end]：持有所有分片读锁，对各分片的逆序游标做多路归并，
+// fn 返回 false 时立即停止并释放所有锁
+func (s *ShardedRBTreeOpt) RangeReverse(start, end int, fn func(key int, value interface{}) bool) {
+	s.mergeRange(start, end, true, fn)
+}
+
+// 对各分片 [start, end] 内的游标做多路归并，desc 为 true 时按降序输出
+func (s *ShardedRBTreeOpt) mergeRange(start, end int, desc bool, fn func(key int, value interface{}) bool) {
+	if start > end {
+		return
+	}
+	s.withAllShardsRLocked(func() {
+		h := &cursorHeap{desc: desc}
+		for _, sh := range s.shards() {
+			var n *node
+			if desc {
+				n = sh.tree.floor(end)
+			} else {
+				n = sh.tree.ceiling(start)
+			}
+			if n != nil && n.key >= start && n.key <= end {
+				h.nodes = append(h.nodes, n)
+			}
+		}
+		heap.Init(h)
+		for len(h.nodes) > 0 {
+			n := h.nodes[0]
+			if !fn(n.key, n.value) {
+				return
+			}
+			var nx *node
+			if desc {
+				nx = predecessor(n)
+			} else {
+				nx = successor(n)
+			}
+			if nx != nil && nx.key >= start && nx.key <= end {
+				h.nodes[0] = nx
+				heap.Fix(h, 0)
+			} else {
+				heap.Pop(h)
+			}
+		}
+	})
+}
+
+// 多路归并用的游标堆，堆顶为下一个输出的节点
+type cursorHeap struct {
+	nodes []*node
+	desc  bool
+}
+
+func (h *cursorHeap) Len() int { return len(h.nodes) }
+func (h *cursorHeap) Less(i, j int) bool {
+	if h.desc {
+		return h.nodes[i].key > h.nodes[j].key
+	}
+	return h.nodes[i].key < h.nodes[j].key
+}
+func (h *cursorHeap) Swap(i, j int)      { h.nodes[i], h.nodes[j] = h.nodes[j], h.nodes[i] }
+func (h *cursorHeap) Push(x interface{}) { h.nodes = append(h.nodes, x.(*node)) }
+func (h *cursorHeap) Pop() interface{} {
+	n := h.nodes[len(h.nodes)-1]
+	h.nodes = h.nodes[:len(h.nodes)-1]
+	return n
+}
+
+// 统计含有 [start, end] 内 key 的分片数，可用于在串行和并行区间查询间做选择
+func (s *ShardedRBTreeOpt) ShardsInRange(start, end int) int {
+	if start > end {
+		return 0
+	}
+	count := 0
+	for _, sh := range s.shards() {
+		sh.rlock()
+		n := sh.tree.ceiling(start)
 		sh.mu.RUnlock()
+		if n != nil && n.key <= end {
+			count++
+		}
 	}
+	return count
 }
 
 // ...existing code...
@@ -605,6 +2454,36 @@ func (s *ShardedRBTreeRW) Range(start, end int, fn func(key int, value interface
 	s.tree.Range(start, end, fn)
 }
 
+// RangeSnapshot 在读锁内把 [start, end] 内的条目复制到切片，释放锁后再依次调用 fn。
+// fn 看到的是加锁那一刻的一致快照，执行期间不阻塞写者，写者最多等待复制区间内条目的时间；
+// 代价是额外一份区间大小的内存。需要实时语义（或区间很大）时用 Range
+func (s *ShardedRBTreeRW) RangeSnapshot(start, end int, fn func(key int, value interface{}) bool) {
+	s.mu.RLock()
+	entries := make([]Entry, 0, s.tree.CountRange(start, end))
+	s.tree.Range(start, end, func(k int, v interface{}) bool {
+		entries = append(entries, Entry{Key: k, Value: v})
+		return true
+	})
+	s.mu.RUnlock()
+	for _, e := range entries {
+		if !fn(e.Key, e.Value) {
+			return
+		}
+	}
+}
+
+func (s *ShardedRBTreeRW) RangeContext(ctx context.Context, start, end int, fn func(key int, value interface{}) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.RangeContext(ctx, start, end, fn)
+}
+
+func (s *ShardedRBTreeRW) RangeReverse(start, end int, fn func(key int, value interface{}) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.tree.RangeReverse(start, end, fn)
+}
+
 // PathLock 版本
 func (s *ShardedRBTreePath) Min() (int, interface{}, bool) {
 	minKey := 0
@@ -637,3 +2516,15 @@ func (s *ShardedRBTreePath) Range(start, end int, fn func(key int, value interfa
 	defer s.mu.Unlock()
 	s.tree.Range(start, end, fn)
 }
+
+func (s *ShardedRBTreePath) RangeContext(ctx context.Context, start, end int, fn func(key int, value interface{}) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.RangeContext(ctx, start, end, fn)
+}
+
+func (s *ShardedRBTreePath) RangeReverse(start, end int, fn func(key int, value interface{}) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tree.RangeReverse(start, end, fn)
+}
@@ -1,10 +1,14 @@
 package rbtree
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"math/rand"
 	"runtime"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -160,6 +164,23 @@ func TestRBTreeCorrectness(t *testing.T) {
 	}
 	// 最后一次红黑性质检查
 	checkRBProperties(t, tree.root)
+	// 子树大小在旋转和删除修复后仍然正确
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("Validate after random ops: %v", err)
+	}
+	remaining := make([]int, 0, len(inserted))
+	for k := range inserted {
+		remaining = append(remaining, k)
+	}
+	sort.Ints(remaining)
+	for i, k := range remaining {
+		if r, ok := tree.Rank(k); !ok || r != i {
+			t.Fatalf("after random ops: Rank(%d) = (%d, %v), want (%d, true)", k, r, ok, i)
+		}
+		if sk, sv, ok := tree.Select(i); !ok || sk != k || sv.(int) != inserted[k] {
+			t.Fatalf("after random ops: Select(%d) = (%d, %v, %v), want key %d", i, sk, sv, ok, k)
+		}
+	}
 }
 
 // ----------------- 有序/区间操作功能测试 -----------------
@@ -247,6 +268,213 @@ func TestShardedRBTreeOptOrderOps(t *testing.T) {
 	}
 }
 
+// 单个写者按升序插入 key：任一时刻的一致快照都必须是 0..m 的连续前缀
+func TestShardedRBTreeOptSnapshotKeys(t *testing.T) {
+	tree := NewShardedRBTreeOpt(16)
+	const N = 20000
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < N; i++ {
+			tree.Insert(i, i)
+		}
+	}()
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		keys := tree.SnapshotKeys()
+		for i, k := range keys {
+			if k != i {
+				t.Fatalf("snapshot of %d keys is not a prefix: position %d holds %d", len(keys), i, k)
+			}
+		}
+		if finished && len(keys) != N {
+			t.Fatalf("final snapshot has %d keys, want %d", len(keys), N)
+		}
+		runtime.Gosched()
+	}
+}
+
+func TestShardedRBTreeOptAllShardOpsNoDeadlock(t *testing.T) {
+	tree := NewShardedRBTreeOpt(8)
+	for i := 0; i < 2000; i++ {
+		tree.Insert(i, i)
+	}
+	ops := []func(i int){
+		func(int) { tree.SnapshotKeys() },
+		func(int) { tree.Summary() },
+		func(int) { tree.PopMinN(3) },
+		func(int) { tree.PopMax() },
+		func(i int) { tree.Insert(i, i); tree.Insert(-i, i) },
+	}
+	var wg sync.WaitGroup
+	for _, op := range ops {
+		wg.Add(1)
+		go func(op func(int)) {
+			defer wg.Done()
+			for i := 0; i < 300; i++ {
+				op(i)
+			}
+		}(op)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("concurrent all-shard operations deadlocked")
+	}
+	if err := tree.ValidateParallel(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShardedRBTreeOptReshard(t *testing.T) {
+	tree := NewShardedRBTreeOpt(8, WithContentionStats())
+	if err := tree.Reshard(0); err == nil {
+		t.Fatalf("Reshard(0) should fail")
+	}
+	const N = 4000
+	for i := 0; i < N/2; i++ {
+		tree.Insert(i, i)
+	}
+	// 写者、单 key 读者和全分片操作与 Reshard 并发进行
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := N / 2; i < N; i++ {
+			tree.Insert(i, i)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < N/2; i++ {
+			if v, ok := tree.Get(i); !ok || v.(int) != i {
+				t.Errorf("Get(%d) during Reshard: got (%v, %v)", i, v, ok)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			tree.Summary()
+			tree.SnapshotKeys()
+		}
+	}()
+	if err := tree.Reshard(32); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if n := len(tree.shards()); n != 32 {
+		t.Fatalf("shard count after Reshard: got %d, want 32", n)
+	}
+	if len(tree.ContentionStats()) != 32 {
+		t.Fatalf("contention stats should stay enabled after Reshard")
+	}
+	check := func() {
+		t.Helper()
+		if tree.Len() != N {
+			t.Fatalf("Len: got %d, want %d", tree.Len(), N)
+		}
+		for i := 0; i < N; i++ {
+			if v, ok := tree.Get(i); !ok || v.(int) != i {
+				t.Fatalf("Get(%d) after Reshard: got (%v, %v)", i, v, ok)
+			}
+		}
+		for i, sh := range tree.shards() {
+			sh.tree.forEach(func(k int, _ interface{}) bool {
+				if tree.shardIndex(k, len(tree.shards())) != i {
+					t.Fatalf("key %d left in shard %d", k, i)
+				}
+				return true
+			})
+		}
+		if err := tree.ValidateParallel(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check()
+	if err := tree.Reshard(3); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+// Range 的回调应按全局升序收到 key，而不是按分片顺序
+func TestShardedRBTreeOptRangeGlobalOrder(t *testing.T) {
+	tree := NewShardedRBTreeOpt(16)
+	r := rand.New(rand.NewSource(3))
+	for _, k := range r.Perm(10000) {
+		tree.Insert(k, k)
+	}
+	prev, count := math.MinInt, 0
+	tree.Range(math.MinInt, math.MaxInt, func(k int, v interface{}) bool {
+		if k <= prev {
+			t.Fatalf("Range not strictly increasing: %d after %d", k, prev)
+		}
+		prev = k
+		count++
+		return true
+	})
+	if count != 10000 {
+		t.Fatalf("Range visited %d keys, want 10000", count)
+	}
+
+	// 提前终止：只收到最小的几个 key，且所有分片锁已释放
+	var first []int
+	tree.Range(0, 10000, func(k int, _ interface{}) bool {
+		first = append(first, k)
+		return len(first) < 4
+	})
+	if fmt.Sprint(first) != "[0 1 2 3]" {
+		t.Fatalf("Range with early stop: got %v, want [0 1 2 3]", first)
+	}
+	tree.Insert(10000, 10000)
+	tree.Delete(10000)
+}
+
+func TestShardedRBTreeRWRangeSnapshot(t *testing.T) {
+	s := &ShardedRBTreeRW{tree: NewRBTree(newArena())}
+	for i := 0; i < 100; i++ {
+		s.Insert(i, i)
+	}
+	// 回调在锁外执行：在回调里写同一棵树不会死锁，且写入对本次遍历不可见
+	var got []int
+	s.RangeSnapshot(40, 59, func(k int, v interface{}) bool {
+		if k == 40 {
+			s.Delete(50)
+			s.Insert(45, "new")
+		}
+		if k == 45 && v != 45 {
+			t.Fatalf("snapshot should hold the old value for 45, got %v", v)
+		}
+		got = append(got, k)
+		return true
+	})
+	if len(got) != 20 || got[0] != 40 || got[10] != 50 || got[19] != 59 {
+		t.Fatalf("RangeSnapshot visited %v", got)
+	}
+	if _, ok := s.Get(50); ok {
+		t.Fatalf("write made inside the callback was lost")
+	}
+	n := 0
+	s.RangeSnapshot(0, 99, func(int, interface{}) bool {
+		n++
+		return n < 5
+	})
+	if n != 5 {
+		t.Fatalf("RangeSnapshot should stop when fn returns false, visited %d", n)
+	}
+}
+
 func TestShardedRBTreeRWOrderOps(t *testing.T) {
 	tree := &ShardedRBTreeRW{tree: NewRBTree(newArena())}
 	N := 1000
@@ -326,6 +554,9 @@ func BenchmarkTrees(b *testing.B) {
 		"Optimized": func(shards int) Tree {
 			return NewShardedRBTreeOpt(shards)
 		},
+		"NodeLock": func(_ int) Tree {
+			return NewConcurrentRBTree()
+		},
 	}
 
 	numCPU := runtime.NumCPU()
@@ -382,6 +613,120 @@ func BenchmarkTrees(b *testing.B) {
 	}
 }
 
+// ----------------- 混合负载基准测试 -----------------
+
+// RunMixedBenchmark 按给定比例并发执行混合操作：readPct% Get、writePct% Insert，其余为 Delete。
+// 树在计时前预先填充一半的 key 空间，使三种操作都有实际命中。
+func RunMixedBenchmark(b *testing.B, ctor func() Tree, readPct, writePct int) {
+	if readPct < 0 || writePct < 0 || readPct+writePct > 100 {
+		b.Fatalf("invalid mix: read=%d%% write=%d%%", readPct, writePct)
+	}
+	const keySpace = 1 << 16
+	tree := ctor()
+	for k := 0; k < keySpace; k += 2 {
+		tree.Insert(k, &Value{})
+	}
+	var seed atomic.Int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(seed.Add(1)))
+		for pb.Next() {
+			k := r.Intn(keySpace)
+			op := r.Intn(100)
+			switch {
+			case op < readPct:
+				tree.Get(k)
+			case op < readPct+writePct:
+				tree.Insert(k, &Value{})
+			default:
+				tree.Delete(k)
+			}
+		}
+	})
+}
+
+func BenchmarkMixedWorkloads(b *testing.B) {
+	impls := []struct {
+		name string
+		ctor func() Tree
+	}{
+		{"RWLock", func() Tree { return &ShardedRBTreeRW{tree: NewRBTree(newArena())} }},
+		{"PathLock", func() Tree { return &ShardedRBTreePath{tree: NewRBTree(newArena())} }},
+		{"LockFree", func() Tree { return &ShardedRBTreeLF{} }},
+		{"Optimized", func() Tree { return NewShardedRBTreeOpt(0) }},
+		{"NodeLock", func() Tree { return NewConcurrentRBTree() }},
+	}
+	mixes := []struct {
+		name            string
+		readPct, wrtPct int
+	}{
+		{"ReadHeavy-90-5-5", 90, 5},
+		{"Balanced-50-25-25", 50, 25},
+		{"WriteHeavy-10-45-45", 10, 45},
+	}
+	for _, mix := range mixes {
+		for _, impl := range impls {
+			b.Run(mix.name+"/"+impl.name, func(b *testing.B) {
+				RunMixedBenchmark(b, impl.ctor, mix.readPct, mix.wrtPct)
+			})
+		}
+	}
+}
+
+// 分片共享一个 arena 与每个分片独立 arena 的对比，写入方为 8×GOMAXPROCS 个 goroutine
+func BenchmarkShardArena(b *testing.B) {
+	shared := func() Tree {
+		s := NewShardedRBTreeOpt(0)
+		a := newArena()
+		for _, sh := range s.shards() {
+			sh.tree = NewRBTree(a)
+		}
+		return s
+	}
+	perShard := func() Tree { return NewShardedRBTreeOpt(0) }
+	for _, c := range []struct {
+		name string
+		ctor func() Tree
+	}{{"Shared", shared}, {"PerShard", perShard}} {
+		b.Run(c.name, func(b *testing.B) {
+			tree := c.ctor()
+			var seed atomic.Int64
+			b.ReportAllocs()
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(seed.Add(1)))
+				for pb.Next() {
+					k := r.Intn(1 << 16)
+					tree.Insert(k, k)
+					tree.Delete(k)
+				}
+			})
+		})
+	}
+}
+
+func TestShardedRBTreeOptPerShardArena(t *testing.T) {
+	s := NewShardedRBTreeOpt(4)
+	for i := 0; i < 400; i++ {
+		s.Insert(i, i)
+	}
+	seen := make(map[*arena]bool)
+	for i, sh := range s.shards() {
+		if seen[sh.tree.arena] {
+			t.Fatalf("shard %d shares its arena with another shard", i)
+		}
+		seen[sh.tree.arena] = true
+		// 删除的节点回到所属分片的 arena
+		k, _, _ := sh.tree.Min()
+		s.Delete(k)
+		if sh.tree.arena.pooled.Load() != 1 {
+			t.Fatalf("shard %d arena pooled %d nodes after one delete, want 1", i, sh.tree.arena.pooled.Load())
+		}
+	}
+}
+
 // ----------------- 区间遍历基准测试 -----------------
 func BenchmarkRangeOps(b *testing.B) {
 	tree := NewShardedRBTreeOpt(0)
@@ -409,3 +754,2598 @@ func BenchmarkRangeOps(b *testing.B) {
 		}
 	})
 }
+
+// ----------------- Arena 命中率统计测试 -----------------
+func TestArenaStats(t *testing.T) {
+	a := newArena()
+	tree := NewRBTree(a)
+	if alloc, reuses, _ := a.Stats(); alloc != 0 || reuses != 0 {
+		t.Fatalf("Stats on fresh arena: got (%d, %d), want (0, 0)", alloc, reuses)
+	}
+	for i := 0; i < 1000; i++ {
+		tree.Insert(i, i)
+	}
+	alloc, before, _ := a.Stats()
+	if alloc != 1000 {
+		t.Fatalf("allocated after 1000 inserts: got %d, want 1000", alloc)
+	}
+	// 插入/删除交替，删除释放的节点应被随后的插入复用
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 1000; i++ {
+			tree.Delete(i)
+		}
+		for i := 0; i < 1000; i++ {
+			tree.Insert(i, i)
+		}
+	}
+	alloc, after, freed := a.Stats()
+	if alloc != 11000 {
+		t.Fatalf("allocated after churn: got %d, want 11000", alloc)
+	}
+	if after <= before {
+		t.Fatalf("pooledReuses did not grow during churn: before %d, after %d", before, after)
+	}
+	if after > alloc {
+		t.Fatalf("pooledReuses %d exceeds allocated %d", after, alloc)
+	}
+	if freed != 10000 {
+		t.Fatalf("freed after churn: got %d, want 10000", freed)
+	}
+}
+
+// ----------------- Arena 收缩测试 -----------------
+func TestRBTreeMaybeCompact(t *testing.T) {
+	a := newArena()
+	tree := NewRBTree(a, WithCompactRatio(2))
+	N := 1000
+	for i := 0; i < N; i++ {
+		tree.Insert(i, i)
+	}
+	// 规模较大时不应收缩
+	if tree.MaybeCompact() {
+		t.Fatalf("MaybeCompact should not shrink a live tree")
+	}
+
+	// 永久性缩小到 10 个节点
+	freed := make(map[*node]bool)
+	for i := 10; i < N; i++ {
+		z := tree.root
+		for z.key != i {
+			if i < z.key {
+				z = z.left
+			} else {
+				z = z.right
+			}
+		}
+		freed[z] = true
+		tree.Delete(i)
+	}
+	if a.pooled.Load() == 0 {
+		t.Fatalf("expected freed nodes to be pooled")
+	}
+	if !tree.MaybeCompact() {
+		t.Fatalf("MaybeCompact should shrink after permanent shrink (pooled=%d, live=%d)", a.pooled.Load(), tree.size)
+	}
+	if a.pooled.Load() != 0 {
+		t.Fatalf("pooled count after shrink: got %d, want 0", a.pooled.Load())
+	}
+	// 收缩后的新池不再持有旧节点
+	for i := 0; i < 100; i++ {
+		n := a.newNode(N+i, nil)
+		if freed[n] {
+			t.Fatalf("node freed before shrink was reused after shrink")
+		}
+	}
+	// 剩余数据不受影响
+	for i := 0; i < 10; i++ {
+		if v, ok := tree.Get(i); !ok || v.(int) != i {
+			t.Fatalf("expected key %d->%d after compact, got %v (ok=%v)", i, i, v, ok)
+		}
+	}
+	checkRBProperties(t, tree.root)
+}
+
+// ----------------- 可取消的区间遍历测试 -----------------
+func TestRangeContext(t *testing.T) {
+	const N = 20000
+	trees := map[string]interface {
+		Tree
+		RangeContext(ctx context.Context, start, end int, fn func(key int, value interface{}) bool) error
+	}{
+		"RBTree":    NewRBTree(newArena()),
+		"RWLock":    &ShardedRBTreeRW{tree: NewRBTree(newArena())},
+		"PathLock":  &ShardedRBTreePath{tree: NewRBTree(newArena())},
+		"Optimized": NewShardedRBTreeOpt(8),
+	}
+	for name, tree := range trees {
+		for i := 0; i < N; i++ {
+			tree.Insert(i, i)
+		}
+		// 未取消时完整遍历，结果与 Range 一致
+		visited, prev := 0, -1
+		err := tree.RangeContext(context.Background(), 0, N-1, func(k int, _ interface{}) bool {
+			if k <= prev {
+				t.Fatalf("%s RangeContext out of order: %d after %d", name, k, prev)
+			}
+			prev = k
+			visited++
+			return true
+		})
+		if err != nil || visited != N {
+			t.Fatalf("%s RangeContext: visited %d (err=%v), want %d", name, visited, err, N)
+		}
+
+		// 遍历中途取消：在下一次检查时停止
+		ctx, cancel := context.WithCancel(context.Background())
+		visited = 0
+		err = tree.RangeContext(ctx, 0, N-1, func(k int, _ interface{}) bool {
+			visited++
+			if visited == 100 {
+				cancel()
+			}
+			return true
+		})
+		if err != context.Canceled {
+			t.Fatalf("%s RangeContext after cancel: err=%v, want context.Canceled", name, err)
+		}
+		if visited > ctxCheckInterval {
+			t.Fatalf("%s RangeContext visited %d entries after cancel, want at most %d", name, visited, ctxCheckInterval)
+		}
+		// 取消后锁已释放，写入不会阻塞
+		tree.Insert(N, N)
+		tree.Delete(N)
+
+		// 已取消的 ctx 不访问任何条目
+		visited = 0
+		if err := tree.RangeContext(ctx, 0, N-1, func(int, interface{}) bool { visited++; return true }); err != context.Canceled || visited != 0 {
+			t.Fatalf("%s RangeContext with cancelled ctx: visited %d, err=%v", name, visited, err)
+		}
+	}
+}
+
+// ----------------- 带时间预算的区间遍历测试 -----------------
+func TestRBTreeRangeWithBudget(t *testing.T) {
+	tree := NewRBTree(newArena())
+	N := 10000
+	for i := 0; i < N; i++ {
+		tree.Insert(i, i)
+	}
+
+	// 预算充足时完整遍历
+	count := 0
+	if !tree.RangeWithBudget(0, N-1, time.Minute, func(k int, v interface{}) bool {
+		count++
+		return true
+	}) {
+		t.Fatalf("RangeWithBudget with ample budget should complete")
+	}
+	if count != N {
+		t.Fatalf("RangeWithBudget visited %d, want %d", count, N)
+	}
+
+	// 慢回调 + 极小预算
+	count = 0
+	last := -1
+	completed := tree.RangeWithBudget(0, N-1, time.Millisecond, func(k int, v interface{}) bool {
+		if k <= last {
+			t.Fatalf("RangeWithBudget not ascending: %d after %d", k, last)
+		}
+		last = k
+		count++
+		time.Sleep(100 * time.Microsecond)
+		return true
+	})
+	if completed {
+		t.Fatalf("RangeWithBudget with tiny budget should not complete")
+	}
+	if count == 0 || count >= N {
+		t.Fatalf("RangeWithBudget should stop early, visited %d of %d", count, N)
+	}
+}
+
+// ----------------- 分片批量变更测试 -----------------
+func TestShardedRBTreeOptApplyDelta(t *testing.T) {
+	batch := NewShardedRBTreeOpt(8)
+	single := NewShardedRBTreeOpt(8)
+	for i := 0; i < 200; i++ {
+		batch.Insert(i, i)
+		single.Insert(i, i)
+	}
+
+	inserts := make(map[int]interface{})
+	for i := 150; i < 300; i++ {
+		inserts[i] = i * 2
+	}
+	var deletes []int
+	for i := 0; i < 100; i += 3 {
+		deletes = append(deletes, i)
+	}
+	// 同时插入又删除的 key 最终应被删除
+	deletes = append(deletes, 299)
+
+	batch.ApplyDelta(inserts, deletes)
+	for k, v := range inserts {
+		single.Insert(k, v)
+	}
+	for _, k := range deletes {
+		single.Delete(k)
+	}
+
+	for i := 0; i < 400; i++ {
+		bv, bok := batch.Get(i)
+		sv, sok := single.Get(i)
+		if bok != sok || bv != sv {
+			t.Fatalf("ApplyDelta key %d: got %v (ok=%v), want %v (ok=%v)", i, bv, bok, sv, sok)
+		}
+	}
+	if _, ok := batch.Get(299); ok {
+		t.Fatalf("key 299 in both inserts and deletes should be deleted")
+	}
+	for _, sh := range batch.shards() {
+		checkRBProperties(t, sh.tree.root)
+	}
+}
+
+// ----------------- 距离查询测试 -----------------
+func TestRBTreeWithinDistance(t *testing.T) {
+	tree := NewRBTree(newArena())
+	for i := 0; i < 100; i += 5 {
+		tree.Insert(i, i)
+	}
+	collect := func(center, radius int) []int {
+		var keys []int
+		tree.WithinDistance(center, radius, func(k int, v interface{}) bool {
+			keys = append(keys, k)
+			return true
+		})
+		return keys
+	}
+	if got := collect(50, 7); fmt.Sprint(got) != "[45 50 55]" {
+		t.Fatalf("WithinDistance(50, 7): got %v", got)
+	}
+	if got := collect(52, 1); len(got) != 0 {
+		t.Fatalf("WithinDistance(52, 1): expected empty, got %v", got)
+	}
+	if got := collect(50, -1); len(got) != 0 {
+		t.Fatalf("WithinDistance with negative radius: expected empty, got %v", got)
+	}
+
+	// int 边界附近不应溢出
+	tree.Insert(math.MaxInt, "max")
+	tree.Insert(math.MaxInt-1, "max-1")
+	tree.Insert(math.MinInt, "min")
+	tree.Insert(math.MinInt+1, "min+1")
+	if got := collect(math.MaxInt-1, 10); fmt.Sprint(got) != fmt.Sprint([]int{math.MaxInt - 1, math.MaxInt}) {
+		t.Fatalf("WithinDistance near MaxInt: got %v", got)
+	}
+	if got := collect(math.MinInt+1, 10); fmt.Sprint(got) != fmt.Sprint([]int{math.MinInt, math.MinInt + 1}) {
+		t.Fatalf("WithinDistance near MinInt: got %v", got)
+	}
+	if got := collect(0, math.MaxInt); len(got) != 20+3 {
+		t.Fatalf("WithinDistance(0, MaxInt): got %d keys, want %d", len(got), 23)
+	}
+	if got := collect(math.MaxInt, math.MaxInt); len(got) != 20+2 {
+		t.Fatalf("WithinDistance(MaxInt, MaxInt): got %d keys, want %d", len(got), 22)
+	}
+}
+
+// ----------------- 区间跨分片数测试 -----------------
+func TestShardedRBTreeOptShardsInRange(t *testing.T) {
+	tree := NewShardedRBTreeOpt(16)
+	for i := 0; i < 1000; i += 3 {
+		tree.Insert(i, i)
+	}
+	// 实际含有区间内 key 的分片
+	expect := func(start, end int) int {
+		hit := make(map[*shard]bool)
+		for k := start; k <= end; k++ {
+			if _, ok := tree.Get(k); ok {
+				hit[tree.getShard(k)] = true
+			}
+		}
+		return len(hit)
+	}
+	cases := [][2]int{{0, 0}, {1, 2}, {0, 10}, {100, 130}, {0, 999}, {-50, -1}, {990, 2000}, {10, 5}}
+	for _, c := range cases {
+		got := tree.ShardsInRange(c[0], c[1])
+		want := 0
+		if c[0] <= c[1] {
+			want = expect(c[0], c[1])
+		}
+		if got != want {
+			t.Fatalf("ShardsInRange(%d, %d): got %d, want %d", c[0], c[1], got, want)
+		}
+	}
+	if got := tree.ShardsInRange(0, 999); got != 16 {
+		t.Fatalf("ShardsInRange over whole domain: got %d, want 16", got)
+	}
+}
+
+// ----------------- 阈值批量删除测试 -----------------
+func TestRBTreeDeleteBelowAbove(t *testing.T) {
+	tree := NewRBTree(newArena())
+	N := 1000
+	for i := 0; i < N; i++ {
+		tree.Insert(i, i)
+	}
+
+	if n := tree.DeleteBelow(300); n != 300 {
+		t.Fatalf("DeleteBelow(300): removed %d, want 300", n)
+	}
+	checkRBProperties(t, tree.root)
+	if n := tree.DeleteAbove(699); n != 300 {
+		t.Fatalf("DeleteAbove(699): removed %d, want 300", n)
+	}
+	checkRBProperties(t, tree.root)
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("Validate after prune: %v", err)
+	}
+
+	for i := 0; i < N; i++ {
+		_, ok := tree.Get(i)
+		if want := i >= 300 && i <= 699; ok != want {
+			t.Fatalf("key %d present=%v, want %v", i, ok, want)
+		}
+	}
+	var keys []int
+	inorder(tree.root, &keys)
+	if len(keys) != 400 || !isSorted(keys) {
+		t.Fatalf("after prune: got %d keys (sorted=%v), want 400", len(keys), isSorted(keys))
+	}
+
+	// 阈值超出范围时不删除或全部删除
+	if n := tree.DeleteBelow(-5); n != 0 {
+		t.Fatalf("DeleteBelow(-5): removed %d, want 0", n)
+	}
+	if n := tree.DeleteAbove(N); n != 0 {
+		t.Fatalf("DeleteAbove(N): removed %d, want 0", n)
+	}
+	if n := tree.DeleteAbove(-1); n != 400 || tree.root != nil {
+		t.Fatalf("DeleteAbove(-1): removed %d (root=%v), want 400 and empty tree", n, tree.root)
+	}
+
+	// 阈值高于最大值时 DeleteBelow 删除全部，低于最小值时 DeleteAbove 删除全部
+	for i := 0; i < N; i++ {
+		tree.Insert(i, i)
+	}
+	if n := tree.DeleteBelow(N + 10); n != N || tree.Len() != 0 {
+		t.Fatalf("DeleteBelow above max: removed %d, Len=%d, want %d and 0", n, tree.Len(), N)
+	}
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("Validate after DeleteBelow above max: %v", err)
+	}
+	for i := 0; i < N; i++ {
+		tree.Insert(i, i)
+	}
+	if n := tree.DeleteAbove(-10); n != N || tree.Len() != 0 {
+		t.Fatalf("DeleteAbove below min: removed %d, Len=%d, want %d and 0", n, tree.Len(), N)
+	}
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("Validate after DeleteAbove below min: %v", err)
+	}
+}
+
+// 随机树与随机阈值：覆盖 split 与逐个删除两条路径，剩余部分保持红黑性质与子树大小
+func TestRBTreeDeleteBelowAboveRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(216))
+	for round := 0; round < 200; round++ {
+		tree := NewRBTree(newArena(), WithDupPolicy(DupCount))
+		ref := make(map[int]int)
+		for i, n := 0, r.Intn(2000); i < n; i++ {
+			k := r.Intn(3000)
+			tree.Insert(k, k)
+			ref[k]++
+		}
+		lo, hi := r.Intn(3200)-100, r.Intn(3200)-100
+		wantRemoved := 0
+		for k := range ref {
+			if k < lo || k > hi {
+				wantRemoved++
+				delete(ref, k)
+			}
+		}
+		removed := tree.DeleteBelow(lo) + tree.DeleteAbove(hi)
+		if removed != wantRemoved {
+			t.Fatalf("round %d: removed %d, want %d", round, removed, wantRemoved)
+		}
+		if err := tree.Validate(); err != nil {
+			t.Fatalf("round %d: Validate after prune [%d, %d]: %v", round, lo, hi, err)
+		}
+		checkRBProperties(t, tree.root)
+		want := 0
+		for k, c := range ref {
+			want += c
+			if n := tree.Count(k); n != c {
+				t.Fatalf("round %d: Count(%d) = %d, want %d", round, k, n, c)
+			}
+		}
+		if tree.Len() != want {
+			t.Fatalf("round %d: Len = %d, want %d", round, tree.Len(), want)
+		}
+	}
+}
+
+func TestRBTreeDeleteRange(t *testing.T) {
+	a := newArena()
+	tree := NewRBTree(a)
+	ref := make(map[int]bool)
+	r := rand.New(rand.NewSource(9))
+	for i := 0; i < 5000; i++ {
+		k := r.Intn(10000)
+		tree.Insert(k, k)
+		ref[k] = true
+	}
+	for _, iv := range [][2]int{{2000, 3999}, {-50, 100}, {9900, 20000}, {5000, 5000}, {7000, 6000}} {
+		want := 0
+		for k := range ref {
+			if k >= iv[0] && k <= iv[1] {
+				want++
+				delete(ref, k)
+			}
+		}
+		if n := tree.DeleteRange(iv[0], iv[1]); n != want {
+			t.Fatalf("DeleteRange(%d, %d): removed %d, want %d", iv[0], iv[1], n, want)
+		}
+		checkRBProperties(t, tree.root)
+		if err := tree.Validate(); err != nil {
+			t.Fatalf("Validate after DeleteRange(%d, %d): %v", iv[0], iv[1], err)
+		}
+		if tree.Len() != len(ref) {
+			t.Fatalf("Len after DeleteRange(%d, %d): got %d, want %d", iv[0], iv[1], tree.Len(), len(ref))
+		}
+	}
+	for k := range ref {
+		if _, ok := tree.Get(k); !ok {
+			t.Fatalf("key %d outside deleted ranges is missing", k)
+		}
+	}
+	if tree.HasKeyInRange(2000, 3999) {
+		t.Fatalf("keys remain in deleted range")
+	}
+	// 删除的节点归还给 arena
+	if a.pooled.Load() == 0 {
+		t.Fatalf("DeleteRange should free nodes back to the arena")
+	}
+	if n := tree.DeleteRange(math.MinInt, math.MaxInt); n != len(ref) || tree.root != nil {
+		t.Fatalf("DeleteRange over everything: removed %d, want %d and empty tree", n, len(ref))
+	}
+}
+
+func TestRBTreeClear(t *testing.T) {
+	a := newArena()
+	tree := NewRBTree(a)
+	for i := 0; i < 1000; i++ {
+		tree.Insert(i, i)
+	}
+	pooled := a.pooled.Load()
+	tree.Clear()
+	if tree.root != nil || !tree.IsEmpty() {
+		t.Fatalf("Clear: root=%v Len=%d, want empty tree", tree.root, tree.Len())
+	}
+	if got := a.pooled.Load() - pooled; got != 1000 {
+		t.Fatalf("Clear returned %d nodes to the arena, want 1000", got)
+	}
+	// 清空后可继续使用，并复用池中的节点
+	_, reusesBefore, _ := a.Stats()
+	for i := 0; i < 100; i++ {
+		tree.Insert(i, -i)
+	}
+	if _, reuses, _ := a.Stats(); reuses <= reusesBefore {
+		t.Fatalf("inserts after Clear did not reuse pooled nodes")
+	}
+	if v, ok := tree.Get(50); !ok || v.(int) != -50 || tree.Len() != 100 {
+		t.Fatalf("tree after Clear + insert: Get(50)=%v (ok=%v) Len=%d", v, ok, tree.Len())
+	}
+	checkRBProperties(t, tree.root)
+
+	wrappers := map[string]interface {
+		Tree
+		Len() int
+		Clear()
+	}{
+		"RWLock":    &ShardedRBTreeRW{tree: NewRBTree(newArena())},
+		"PathLock":  &ShardedRBTreePath{tree: NewRBTree(newArena())},
+		"LockFree":  &ShardedRBTreeLF{},
+		"Optimized": NewShardedRBTreeOpt(8),
+	}
+	for name, w := range wrappers {
+		for i := 0; i < 500; i++ {
+			w.Insert(i, i)
+		}
+		w.Clear()
+		if w.Len() != 0 {
+			t.Fatalf("%s Len after Clear: got %d, want 0", name, w.Len())
+		}
+		if _, ok := w.Get(7); ok {
+			t.Fatalf("%s Get after Clear should miss", name)
+		}
+		w.Insert(7, 7)
+		if w.Len() != 1 {
+			t.Fatalf("%s Len after Clear + insert: got %d, want 1", name, w.Len())
+		}
+	}
+}
+
+func TestRBTreeClone(t *testing.T) {
+	tree := NewRBTree(newArena())
+	for _, k := range rand.New(rand.NewSource(3)).Perm(2000) {
+		tree.Insert(k, k)
+	}
+	c := tree.Clone()
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Validate clone: %v", err)
+	}
+	if c.Len() != tree.Len() {
+		t.Fatalf("clone Len: got %d, want %d", c.Len(), tree.Len())
+	}
+	// 修改原树不影响副本，反之亦然
+	tree.DeleteRange(0, 999)
+	c.Insert(5000, 5000)
+	if v, ok := c.Get(10); !ok || v.(int) != 10 || c.Len() != 2001 {
+		t.Fatalf("clone after source delete: Get(10)=%v (ok=%v) Len=%d", v, ok, c.Len())
+	}
+	if _, ok := tree.Get(5000); ok || tree.Len() != 1000 {
+		t.Fatalf("source sees clone insert or wrong Len %d", tree.Len())
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Validate clone after mutation: %v", err)
+	}
+	checkRBProperties(t, tree.root)
+}
+
+func TestRBTreeDeleteMinMax(t *testing.T) {
+	tree := NewRBTree(newArena())
+	tree.DeleteMin()
+	tree.DeleteMax()
+	rng := rand.New(rand.NewSource(9))
+	ref := make(map[int]bool)
+	for i := 0; i < 1000; i++ {
+		k := rng.Intn(1 << 20)
+		tree.Insert(k, k)
+		ref[k] = true
+	}
+	// 10k 次 DeleteMin/DeleteMax 与 Insert 交替
+	for i := 0; i < 10000; i++ {
+		if i%2 == 0 {
+			k, _, _ := tree.Min()
+			if i%4 == 0 {
+				tree.DeleteMin()
+			} else {
+				k, _, _ = tree.Max()
+				tree.DeleteMax()
+			}
+			delete(ref, k)
+		} else {
+			k := rng.Intn(1 << 20)
+			tree.Insert(k, k)
+			ref[k] = true
+		}
+	}
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("Validate after DeleteMin/DeleteMax: %v", err)
+	}
+	if tree.Len() != len(ref) {
+		t.Fatalf("Len: got %d, want %d", tree.Len(), len(ref))
+	}
+	for k := range ref {
+		if _, ok := tree.Get(k); !ok {
+			t.Fatalf("key %d missing", k)
+		}
+	}
+}
+
+func BenchmarkDeleteMin(b *testing.B) {
+	const N = 100_000
+	fill := func(tree *RBTree) {
+		for i := 0; i < N; i++ {
+			tree.Insert(i, i)
+		}
+	}
+	b.Run("DeleteMin", func(b *testing.B) {
+		tree := NewRBTree(newArena())
+		for i := 0; i < b.N; i++ {
+			if tree.root == nil {
+				b.StopTimer()
+				fill(tree)
+				b.StartTimer()
+			}
+			tree.DeleteMin()
+		}
+	})
+	b.Run("MinThenDelete", func(b *testing.B) {
+		tree := NewRBTree(newArena())
+		for i := 0; i < b.N; i++ {
+			if tree.root == nil {
+				b.StopTimer()
+				fill(tree)
+				b.StartTimer()
+			}
+			k, _, _ := tree.Min()
+			tree.Delete(k)
+		}
+	})
+}
+
+// 删除有两个孩子且后继较深的节点：后继被整体移接到 z 的位置，z 本身完全脱离树后才归还 arena。
+// 随后的插入复用被归还的节点，不能留下指向它的旧指针
+func TestRBTreeDeleteTwoChildReuse(t *testing.T) {
+	a := newArena()
+	tree := NewRBTree(a)
+	ref := make(map[int]int)
+	for _, k := range rand.New(rand.NewSource(11)).Perm(4096) {
+		tree.Insert(k*2, k)
+		ref[k*2] = k
+	}
+	depth := func(n *node) int {
+		d := 0
+		for ; n.parent != nil; n = n.parent {
+			d++
+		}
+		return d
+	}
+	// 找后继比自身深至少 3 层的双孩子节点
+	var z *node
+	for n := tree.minimum(tree.root); n != nil; n = successor(n) {
+		if n.left != nil && n.right != nil && depth(tree.minimum(n.right))-depth(n) >= 3 {
+			z = n
+			break
+		}
+	}
+	if z == nil {
+		t.Fatalf("no two-child node with a deep successor")
+	}
+	zKey, succ := z.key, tree.minimum(z.right)
+	tree.Delete(zKey)
+	delete(ref, zKey)
+	if z.parent != nil || z.left != nil || z.right != nil {
+		t.Fatalf("freed node still linked: parent=%p left=%p right=%p", z.parent, z.left, z.right)
+	}
+	find := func(key int) *node {
+		n := tree.root
+		for n != nil && n.key != key {
+			if key < n.key {
+				n = n.left
+			} else {
+				n = n.right
+			}
+		}
+		return n
+	}
+	if n := find(succ.key); n != succ {
+		t.Fatalf("successor %d should be relinked in place, not copied", succ.key)
+	}
+
+	// 紧接着插入新 key，迫使 arena 复用刚归还的节点
+	for i := 0; i < 1000; i++ {
+		k := i*2 + 1
+		tree.Insert(k, -k)
+		ref[k] = -k
+	}
+	// 被复用时，z 只能作为某个新 key 的节点出现在树中
+	if z.key != zKey || z.parent != nil || z == tree.root {
+		if find(z.key) != z || ref[z.key] != z.value.(int) {
+			t.Fatalf("reused node %d is not consistent with the tree", z.key)
+		}
+	}
+	checkRBProperties(t, tree.root)
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("Validate after reuse: %v", err)
+	}
+	if tree.Len() != len(ref) {
+		t.Fatalf("Len: got %d, want %d", tree.Len(), len(ref))
+	}
+	count, prev := 0, math.MinInt
+	tree.Range(math.MinInt, math.MaxInt, func(k int, v interface{}) bool {
+		if k <= prev {
+			t.Fatalf("scan out of order: %d after %d", k, prev)
+		}
+		if want, ok := ref[k]; !ok || v.(int) != want {
+			t.Fatalf("scan: key %d -> %v, want %d (present=%v)", k, v, want, ok)
+		}
+		prev = k
+		count++
+		return true
+	})
+	if count != len(ref) {
+		t.Fatalf("scan visited %d keys, want %d", count, len(ref))
+	}
+}
+
+func TestRBTreeInsertMany(t *testing.T) {
+	tree := NewRBTree(newArena())
+	if err := tree.InsertMany([]int{1, 2}, []interface{}{1}); err == nil {
+		t.Fatalf("InsertMany with mismatched lengths should fail")
+	}
+	if tree.Len() != 0 {
+		t.Fatalf("failed InsertMany modified the tree: Len=%d", tree.Len())
+	}
+
+	// 有序输入走平衡构建
+	keys := make([]int, 1000)
+	values := make([]interface{}, 1000)
+	for i := range keys {
+		keys[i], values[i] = i*2, i
+	}
+	if err := tree.InsertMany(keys, values); err != nil {
+		t.Fatalf("InsertMany: %v", err)
+	}
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("Validate after sorted InsertMany: %v", err)
+	}
+	// 有序输入并入非空树，与已有 key 冲突时以新值为准
+	more := make([]Entry, 500)
+	for i := range more {
+		more[i] = Entry{Key: i * 3, Value: -i}
+	}
+	tree.InsertEntries(more)
+	// 无序且含重复 key 的输入，后出现的值生效
+	tree.InsertEntries([]Entry{{Key: 5001, Value: "a"}, {Key: -1, Value: "b"}, {Key: 5001, Value: "c"}})
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("Validate after InsertEntries: %v", err)
+	}
+
+	ref := make(map[int]interface{})
+	for i := range keys {
+		ref[keys[i]] = values[i]
+	}
+	for _, e := range more {
+		ref[e.Key] = e.Value
+	}
+	ref[5001], ref[-1] = "c", "b"
+	if tree.Len() != len(ref) {
+		t.Fatalf("Len: got %d, want %d", tree.Len(), len(ref))
+	}
+	for k, want := range ref {
+		if v, ok := tree.Get(k); !ok || v != want {
+			t.Fatalf("Get(%d): got %v (ok=%v), want %v", k, v, ok, want)
+		}
+	}
+
+	// 只有一个条目时同样遵守操作日志与重复 key 策略
+	logged := NewRBTree(newArena())
+	logged.EnableOpLog()
+	logged.InsertEntries([]Entry{{Key: 7, Value: "x"}})
+	if ops := logged.OpLog(); len(ops) != 1 || ops[0] != (Op{Kind: OpInsert, Key: 7}) {
+		t.Fatalf("single-entry InsertEntries op log: %v", ops)
+	}
+	want, _ := logged.StructureJSON()
+	got, _ := ReplayOps(newArena(), logged.OpLog()).StructureJSON()
+	if string(got) != string(want) {
+		t.Fatalf("replayed single-entry InsertEntries differs from the original")
+	}
+	reject := NewRBTree(newArena(), WithDupPolicy(DupReject))
+	reject.Insert(7, "old")
+	reject.InsertEntries([]Entry{{Key: 7, Value: "new"}})
+	if v, _ := reject.Get(7); v != "old" {
+		t.Fatalf("single-entry InsertEntries under DupReject: got %v, want old", v)
+	}
+}
+
+// ----------------- 区间存在性测试 -----------------
+func TestRBTreeHasKeyInRange(t *testing.T) {
+	tree := NewRBTree(newArena())
+	N := 100000
+	// 稀疏：每 1000 一个 key
+	for i := 0; i < N; i++ {
+		tree.Insert(i*1000, i)
+	}
+	if !tree.HasKeyInRange(0, 0) || !tree.HasKeyInRange(500, 1500) || !tree.HasKeyInRange(-10, 10) {
+		t.Fatalf("HasKeyInRange should find keys in ranges containing one")
+	}
+	if tree.HasKeyInRange(1, 999) || tree.HasKeyInRange(-100, -1) || tree.HasKeyInRange(N*1000, N*2000) {
+		t.Fatalf("HasKeyInRange should be false for empty gaps")
+	}
+	if tree.HasKeyInRange(2000, 1000) {
+		t.Fatalf("HasKeyInRange should be false when start > end")
+	}
+	if !tree.HasKeyInRange(math.MinInt, math.MaxInt) {
+		t.Fatalf("HasKeyInRange over the whole int domain should be true")
+	}
+
+	// 访问节点数不超过树高上界 2*log2(n+1)
+	bound := int(2 * math.Log2(float64(N+1)))
+	for _, r := range [][2]int{{1, 999}, {12345001, 12345999}, {99999001, 100000000}, {-5, -1}, {50000000, 50000000}} {
+		_, visited := tree.hasKeyInRange(r[0], r[1])
+		if visited > bound {
+			t.Fatalf("hasKeyInRange(%d, %d) visited %d nodes, want <= %d", r[0], r[1], visited, bound)
+		}
+	}
+}
+
+// ----------------- 分片 key 归一化测试 -----------------
+func TestShardedRBTreeOptKeyNormalizer(t *testing.T) {
+	// 低 4 位是元数据，屏蔽后同一 ID 的 key 落到同一分片
+	tree := NewShardedRBTreeOpt(8, WithKeyNormalizer(func(key int) int { return key >> 4 }))
+	for id := 0; id < 50; id++ {
+		for meta := 0; meta < 16; meta++ {
+			tree.Insert(id<<4|meta, id*100+meta)
+		}
+	}
+	for id := 0; id < 50; id++ {
+		sh := tree.getShard(id << 4)
+		for meta := 0; meta < 16; meta++ {
+			k := id<<4 | meta
+			if tree.getShard(k) != sh {
+				t.Fatalf("key %d not co-located with key %d", k, id<<4)
+			}
+			// 仍按原始 key 查找
+			if v, ok := tree.Get(k); !ok || v.(int) != id*100+meta {
+				t.Fatalf("Get(%d): got %v (ok=%v), want %d", k, v, ok, id*100+meta)
+			}
+			sh.mu.RLock()
+			_, ok := sh.tree.Get(k)
+			sh.mu.RUnlock()
+			if !ok {
+				t.Fatalf("key %d not stored in its normalized shard", k)
+			}
+		}
+	}
+	// 排序不受影响
+	minK, _, _ := tree.Min()
+	maxK, _, _ := tree.Max()
+	if minK != 0 || maxK != 49<<4|15 {
+		t.Fatalf("Min/Max with normalizer: got %d/%d", minK, maxK)
+	}
+	tree.Delete(3<<4 | 5)
+	if _, ok := tree.Get(3<<4 | 5); ok {
+		t.Fatalf("Delete with normalizer failed")
+	}
+}
+
+// ----------------- 弹出最小/最大值测试 -----------------
+func TestRBTreePopMinMax(t *testing.T) {
+	tree := NewRBTree(newArena())
+	if _, _, ok := tree.PopMin(); ok {
+		t.Fatalf("PopMin on empty tree should return false")
+	}
+	if _, _, ok := tree.PopMax(); ok {
+		t.Fatalf("PopMax on empty tree should return false")
+	}
+	for _, k := range rand.New(rand.NewSource(5)).Perm(200) {
+		tree.Insert(k, k*10)
+	}
+	for i := 0; i < 50; i++ {
+		k, v, ok := tree.PopMin()
+		if !ok || k != i || v.(int) != i*10 {
+			t.Fatalf("PopMin #%d: got (%d, %v, %v), want %d", i, k, v, ok, i)
+		}
+		k, v, ok = tree.PopMax()
+		if !ok || k != 199-i || v.(int) != (199-i)*10 {
+			t.Fatalf("PopMax #%d: got (%d, %v, %v), want %d", i, k, v, ok, 199-i)
+		}
+	}
+	if tree.Len() != 100 {
+		t.Fatalf("Len after pops: got %d, want 100", tree.Len())
+	}
+	checkRBProperties(t, tree.root)
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("Validate after pops: %v", err)
+	}
+}
+
+// 并发弹出时每个元素恰好被弹出一次
+func TestShardedPopMinMaxConcurrent(t *testing.T) {
+	const N = 4000
+	trees := map[string]interface {
+		Insert(int, interface{})
+		PopMin() (int, interface{}, bool)
+		PopMax() (int, interface{}, bool)
+	}{
+		"RWLock":    &ShardedRBTreeRW{tree: NewRBTree(newArena())},
+		"PathLock":  &ShardedRBTreePath{tree: NewRBTree(newArena())},
+		"Optimized": NewShardedRBTreeOpt(8),
+	}
+	for name, tree := range trees {
+		for i := 0; i < N; i++ {
+			tree.Insert(i, i)
+		}
+		var mu sync.Mutex
+		seen := make(map[int]int)
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				pop := tree.PopMin
+				if g%2 == 1 {
+					pop = tree.PopMax
+				}
+				for {
+					k, _, ok := pop()
+					if !ok {
+						return
+					}
+					mu.Lock()
+					seen[k]++
+					mu.Unlock()
+				}
+			}(g)
+		}
+		wg.Wait()
+		if len(seen) != N {
+			t.Fatalf("%s: popped %d distinct keys, want %d", name, len(seen), N)
+		}
+		for k, c := range seen {
+			if c != 1 {
+				t.Fatalf("%s: key %d popped %d times", name, k, c)
+			}
+		}
+	}
+
+	opt := NewShardedRBTreeOpt(4)
+	for _, k := range []int{17, -3, 42, 8} {
+		opt.Insert(k, k)
+	}
+	if k, _, _ := opt.PopMin(); k != -3 {
+		t.Fatalf("Opt PopMin: got %d, want -3", k)
+	}
+	if k, _, _ := opt.PopMax(); k != 42 {
+		t.Fatalf("Opt PopMax: got %d, want 42", k)
+	}
+}
+
+// ----------------- 批量弹出最小值测试 -----------------
+func TestPopMinN(t *testing.T) {
+	tree := NewRBTree(newArena())
+	sharded := NewShardedRBTreeOpt(8)
+	r := rand.New(rand.NewSource(2))
+	keys := r.Perm(500)
+	for _, k := range keys {
+		tree.Insert(k, k*10)
+		sharded.Insert(k, k*10)
+	}
+
+	for name, pop := range map[string]func(int) []Entry{
+		"RBTree":    tree.PopMinN,
+		"Optimized": sharded.PopMinN,
+	} {
+		batch := pop(100)
+		if len(batch) != 100 {
+			t.Fatalf("%s: PopMinN(100) returned %d entries", name, len(batch))
+		}
+		for i, e := range batch {
+			if e.Key != i || e.Value.(int) != i*10 {
+				t.Fatalf("%s: entry %d: got %d->%v, want %d->%d", name, i, e.Key, e.Value, i, i*10)
+			}
+		}
+		batch = pop(50)
+		if len(batch) != 50 || batch[0].Key != 100 || batch[49].Key != 149 {
+			t.Fatalf("%s: second PopMinN(50) got %d entries starting at %v", name, len(batch), batch)
+		}
+		// n 超过剩余个数时返回全部
+		batch = pop(1000)
+		if len(batch) != 350 || batch[0].Key != 150 || batch[349].Key != 499 {
+			t.Fatalf("%s: PopMinN(1000) returned %d entries", name, len(batch))
+		}
+		if batch := pop(10); len(batch) != 0 {
+			t.Fatalf("%s: PopMinN on empty tree returned %d entries", name, len(batch))
+		}
+	}
+	if tree.root != nil {
+		t.Fatalf("tree should be empty after popping everything")
+	}
+	for _, sh := range sharded.shards() {
+		if sh.tree.root != nil {
+			t.Fatalf("sharded tree should be empty after popping everything")
+		}
+	}
+}
+
+// ----------------- 分片锁竞争统计测试 -----------------
+func TestShardedRBTreeOptContentionStats(t *testing.T) {
+	if NewShardedRBTreeOpt(4).ContentionStats() != nil {
+		t.Fatalf("ContentionStats should be nil when disabled")
+	}
+
+	tree := NewShardedRBTreeOpt(4, WithContentionStats())
+	// 并发写同一个分片（key 都是 4 的倍数 -> 分片 0）；
+	// 先占住该分片的锁，保证即使只有单核也会出现竞争
+	hotShard := tree.shards()[0]
+	hotShard.mu.Lock()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				tree.Insert((g*2000+i)*4, i)
+			}
+		}(g)
+	}
+	time.Sleep(20 * time.Millisecond)
+	hotShard.mu.Unlock()
+	// 冷分片只有少量串行访问
+	tree.Insert(1, 1)
+	tree.Get(1)
+	wg.Wait()
+
+	stats := tree.ContentionStats()
+	if len(stats) != 4 {
+		t.Fatalf("ContentionStats returned %d entries, want 4", len(stats))
+	}
+	hot, cold := stats[0], stats[1]
+	if hot.Acquisitions != 8*2000 || cold.Acquisitions != 2 {
+		t.Fatalf("acquisitions: hot=%d cold=%d, want %d and 2", hot.Acquisitions, cold.Acquisitions, 8*2000)
+	}
+	if cold.Contended != 0 {
+		t.Fatalf("cold shard contended %d times, want 0", cold.Contended)
+	}
+	if hot.Contended <= cold.Contended {
+		t.Fatalf("hot shard contention %d should exceed cold shard %d", hot.Contended, cold.Contended)
+	}
+}
+
+// ----------------- 原子累加测试 -----------------
+func TestAdd(t *testing.T) {
+	tree := NewRBTree(newArena())
+	if v := tree.Add(1, 5); v != 5 {
+		t.Fatalf("Add on missing key: got %d, want 5", v)
+	}
+	if v := tree.Add(1, -2); v != 3 {
+		t.Fatalf("Add: got %d, want 3", v)
+	}
+	tree.Insert(2, 10)
+	if v := tree.Add(2, 1); v != 11 {
+		t.Fatalf("Add on int value: got %d, want 11", v)
+	}
+	if v, _ := tree.Get(2); v.(int64) != 11 {
+		t.Fatalf("Add should store int64, got %T", v)
+	}
+	if v, err := tree.TryAdd(2, 4); err != nil || v != 15 {
+		t.Fatalf("TryAdd: got (%d, %v), want 15", v, err)
+	}
+	// 非整数值保持不变：Add 返回 0，TryAdd 返回 ErrNotInteger
+	tree.Insert(3, "x")
+	if v := tree.Add(3, 1); v != 0 {
+		t.Fatalf("Add on string value: got %d, want 0", v)
+	}
+	if _, err := tree.TryAdd(3, 1); err != ErrNotInteger {
+		t.Fatalf("TryAdd on string value: got %v, want ErrNotInteger", err)
+	}
+	if v, _ := tree.Get(3); v != "x" {
+		t.Fatalf("Add on string value overwrote it with %v", v)
+	}
+	checkRBProperties(t, tree.root)
+
+	sharded := NewShardedRBTreeOpt(8)
+	var wg sync.WaitGroup
+	G, M := 16, 1000
+	for g := 0; g < G; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < M; i++ {
+				sharded.Add(42, int64(g+1))
+			}
+		}(g)
+	}
+	wg.Wait()
+	want := int64(M * G * (G + 1) / 2)
+	if v, ok := sharded.Get(42); !ok || v.(int64) != want {
+		t.Fatalf("concurrent Add: got %v (ok=%v), want %d", v, ok, want)
+	}
+	sharded.Insert(7, "x")
+	if _, err := sharded.TryAdd(7, 1); err != ErrNotInteger {
+		t.Fatalf("sharded TryAdd on string value: got %v, want ErrNotInteger", err)
+	}
+}
+
+// ----------------- 顺序统计测试 -----------------
+func TestRBTreeSurroundingCounts(t *testing.T) {
+	tree := NewRBTree(newArena())
+	ref := make(map[int]bool)
+	r := rand.New(rand.NewSource(4))
+	for i := 0; i < 20000; i++ {
+		k := r.Intn(3000)
+		if r.Intn(3) == 0 {
+			tree.Delete(k)
+			delete(ref, k)
+		} else {
+			tree.Insert(k, k)
+			ref[k] = true
+		}
+	}
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("Validate after random ops: %v", err)
+	}
+	checkRBProperties(t, tree.root)
+
+	for key := -5; key < 3005; key += 7 {
+		smaller, larger, exists := tree.SurroundingCounts(key)
+		wantSmaller, wantLarger := 0, 0
+		for k := range ref {
+			if k < key {
+				wantSmaller++
+			} else if k > key {
+				wantLarger++
+			}
+		}
+		if smaller != wantSmaller || larger != wantLarger || exists != ref[key] {
+			t.Fatalf("SurroundingCounts(%d): got (%d, %d, %v), want (%d, %d, %v)",
+				key, smaller, larger, exists, wantSmaller, wantLarger, ref[key])
+		}
+		total := smaller + larger
+		if exists {
+			total++
+		}
+		if total != len(ref) {
+			t.Fatalf("SurroundingCounts(%d): counts sum to %d, want %d", key, total, len(ref))
+		}
+	}
+}
+
+func TestRBTreeRankSelect(t *testing.T) {
+	tree := NewRBTree(newArena())
+	if _, _, ok := tree.Select(0); ok {
+		t.Fatalf("Select(0) on empty tree should return false")
+	}
+	if r, ok := tree.Rank(5); r != 0 || ok {
+		t.Fatalf("Rank on empty tree: got (%d, %v), want (0, false)", r, ok)
+	}
+	// 排行榜：分数 10, 20, ..., 1000
+	for i := 100; i >= 1; i-- {
+		tree.Insert(i*10, i)
+	}
+	if r, ok := tree.Rank(10); r != 0 || !ok {
+		t.Fatalf("Rank(10): got (%d, %v), want (0, true)", r, ok)
+	}
+	if r, ok := tree.Rank(555); r != 55 || ok {
+		t.Fatalf("Rank(555): got (%d, %v), want (55, false)", r, ok)
+	}
+	if r, _ := tree.Rank(5000); r != 100 {
+		t.Fatalf("Rank(5000): got %d, want 100", r)
+	}
+	for i := 0; i < 100; i++ {
+		k, v, ok := tree.Select(i)
+		if !ok || k != (i+1)*10 || v.(int) != i+1 {
+			t.Fatalf("Select(%d): got (%d, %v, %v)", i, k, v, ok)
+		}
+		if r, _ := tree.Rank(k); r != i {
+			t.Fatalf("Rank(Select(%d)) = %d", i, r)
+		}
+	}
+	for _, i := range []int{-1, 100, 1000} {
+		if _, _, ok := tree.Select(i); ok {
+			t.Fatalf("Select(%d) out of range should return false", i)
+		}
+	}
+}
+
+func TestRBTreeDupPolicy(t *testing.T) {
+	over := NewRBTree(newArena())
+	if !over.TryInsert(1, "a") || !over.TryInsert(1, "b") {
+		t.Fatalf("DupOverwrite: TryInsert should always store")
+	}
+	if v, _ := over.Get(1); v != "b" || over.Len() != 1 || over.Count(1) != 1 {
+		t.Fatalf("DupOverwrite: Get(1)=%v Len=%d Count=%d", v, over.Len(), over.Count(1))
+	}
+
+	rej := NewRBTree(newArena(), WithDupPolicy(DupReject))
+	if !rej.TryInsert(1, "a") {
+		t.Fatalf("DupReject: first TryInsert should store")
+	}
+	if rej.TryInsert(1, "b") {
+		t.Fatalf("DupReject: TryInsert on existing key should return false")
+	}
+	rej.Insert(1, "c")
+	if v, _ := rej.Get(1); v != "a" || rej.Len() != 1 {
+		t.Fatalf("DupReject: Get(1)=%v Len=%d, want a and 1", v, rej.Len())
+	}
+
+	cnt := NewRBTree(newArena(), WithDupPolicy(DupCount))
+	for i := 0; i < 3; i++ {
+		cnt.Insert(5, i)
+	}
+	cnt.Insert(7, "x")
+	if cnt.Len() != 4 || cnt.Count(5) != 3 || cnt.Count(7) != 1 || cnt.Count(6) != 0 {
+		t.Fatalf("DupCount: Len=%d Count(5)=%d Count(7)=%d", cnt.Len(), cnt.Count(5), cnt.Count(7))
+	}
+	visits := 0
+	cnt.RangeCounts(math.MinInt, math.MaxInt, func(k int, v interface{}, c int) bool {
+		visits++
+		if k == 5 && (c != 3 || v != 2) {
+			t.Fatalf("RangeCounts(5): value %v count %d, want 2 and 3", v, c)
+		}
+		return true
+	})
+	if visits != 2 {
+		t.Fatalf("RangeCounts visited %d keys, want 2", visits)
+	}
+	clone := cnt.Clone()
+	cnt.Delete(5)
+	if _, ok := cnt.Get(5); !ok || cnt.Count(5) != 2 || cnt.Len() != 3 {
+		t.Fatalf("DupCount: Delete should decrement, Count(5)=%d Len=%d", cnt.Count(5), cnt.Len())
+	}
+	if v, ok := cnt.DeleteAndReport(5); !ok || v != 2 || cnt.Count(5) != 1 {
+		t.Fatalf("DupCount: DeleteAndReport(5) = (%v, %v), Count=%d", v, ok, cnt.Count(5))
+	}
+	cnt.Delete(5)
+	if _, ok := cnt.Get(5); ok || cnt.Len() != 1 {
+		t.Fatalf("DupCount: key 5 should be gone at zero, Len=%d", cnt.Len())
+	}
+	if err := cnt.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	// 整个节点被摘除时扣掉它全部的重数
+	if clone.Len() != 4 || clone.Count(5) != 3 {
+		t.Fatalf("Clone should keep counts: Len=%d Count(5)=%d", clone.Len(), clone.Count(5))
+	}
+	clone.DeleteRange(5, 5)
+	if clone.Len() != 1 {
+		t.Fatalf("DeleteRange should drop the whole multiplicity: Len=%d", clone.Len())
+	}
+	clone.Merge(cnt)
+	if clone.Count(7) != 2 || clone.Len() != 2 {
+		t.Fatalf("Merge into DupCount tree: Count(7)=%d Len=%d", clone.Count(7), clone.Len())
+	}
+}
+
+func TestRBTreeRangeWhile(t *testing.T) {
+	tree := NewRBTree(newArena())
+	for i := 0; i < 100; i++ {
+		tree.Insert(i*10, i)
+	}
+	var got []int
+	var checked []int
+	tree.RangeWhile(95, func(k int) bool {
+		checked = append(checked, k)
+		return k < 140
+	}, func(k int, v interface{}) bool {
+		got = append(got, k)
+		return true
+	})
+	if fmt.Sprint(got) != "[100 110 120 130]" {
+		t.Fatalf("RangeWhile visited %v", got)
+	}
+	// cond 只对访问过的 key 和第一个失败的 key 调用
+	if fmt.Sprint(checked) != "[100 110 120 130 140]" {
+		t.Fatalf("cond called on %v", checked)
+	}
+	got = got[:0]
+	tree.RangeWhile(math.MinInt, func(int) bool { return true }, func(k int, _ interface{}) bool {
+		got = append(got, k)
+		return len(got) < 3
+	})
+	if fmt.Sprint(got) != "[0 10 20]" {
+		t.Fatalf("RangeWhile should stop when fn returns false: %v", got)
+	}
+	tree.RangeWhile(991, func(int) bool { return true }, func(k int, _ interface{}) bool {
+		t.Fatalf("RangeWhile past Max visited %d", k)
+		return true
+	})
+}
+
+func TestRBTreeRangePage(t *testing.T) {
+	tree := NewRBTree(newArena())
+	r := rand.New(rand.NewSource(11))
+	for i := 0; i < 2000; i++ {
+		k := r.Intn(5000)
+		tree.Insert(k, k)
+	}
+	keys := tree.Keys()
+	for round := 0; round < 500; round++ {
+		start, end := r.Intn(5200)-100, r.Intn(5200)-100
+		offset, limit := r.Intn(300)-10, r.Intn(100)-5
+		var want []int
+		for _, k := range keys {
+			if k >= start && k <= end {
+				want = append(want, k)
+			}
+		}
+		if start > end || limit <= 0 || max(offset, 0) >= len(want) {
+			want = nil
+		} else {
+			want = want[max(offset, 0):min(max(offset, 0)+limit, len(want))]
+		}
+		var got []int
+		tree.RangePage(start, end, offset, limit, func(k int, v interface{}) bool {
+			if v.(int) != k {
+				t.Fatalf("RangePage value for %d: %v", k, v)
+			}
+			got = append(got, k)
+			return true
+		})
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("RangePage(%d, %d, %d, %d): got %v, want %v", start, end, offset, limit, got, want)
+		}
+	}
+	// fn 返回 false 时提前停止
+	n := 0
+	tree.RangePage(math.MinInt, math.MaxInt, 10, 50, func(int, interface{}) bool {
+		n++
+		return n < 3
+	})
+	if n != 3 {
+		t.Fatalf("RangePage visited %d entries after fn returned false, want 3", n)
+	}
+}
+
+func TestRBTreeCountRange(t *testing.T) {
+	tree := NewRBTree(newArena())
+	if n := tree.CountRange(math.MinInt, math.MaxInt); n != 0 {
+		t.Fatalf("CountRange on empty tree: got %d, want 0", n)
+	}
+	for i := 0; i < 500; i++ {
+		tree.Insert(i*3, i)
+	}
+	cases := []struct{ start, end, want int }{
+		{0, 0, 1},
+		{1, 2, 0},       // 区间内没有 key
+		{10, 5, 0},      // start > end
+		{-100, 8, 3},    // 越过 Min
+		{1490, 5000, 3}, // 越过 Max
+		{math.MinInt, math.MaxInt, 500},
+		{300, 600, 101},
+		{301, 599, 99},
+	}
+	for _, c := range cases {
+		if n := tree.CountRange(c.start, c.end); n != c.want {
+			t.Fatalf("CountRange(%d, %d): got %d, want %d", c.start, c.end, n, c.want)
+		}
+		walked := 0
+		if c.start <= c.end {
+			tree.Range(c.start, c.end, func(int, interface{}) bool {
+				walked++
+				return true
+			})
+		}
+		if walked != c.want {
+			t.Fatalf("Range(%d, %d) visited %d keys, CountRange expects %d", c.start, c.end, walked, c.want)
+		}
+	}
+}
+
+// ----------------- 分片合并测试 -----------------
+func TestShardedRBTreeOptCollapse(t *testing.T) {
+	if c := NewShardedRBTreeOpt(4).Collapse(); c.root != nil {
+		t.Fatalf("Collapse of empty tree should be empty")
+	}
+	for _, N := range []int{1, 2, 3, 7, 8, 100, 1023, 1024, 5000} {
+		tree := NewShardedRBTreeOpt(16)
+		for i := 0; i < N; i++ {
+			tree.Insert(i*2, i)
+		}
+		c := tree.Collapse()
+		checkRBProperties(t, c.root)
+		if err := c.Validate(); err != nil {
+			t.Fatalf("N=%d: Validate after Collapse: %v", N, err)
+		}
+		var keys []int
+		inorder(c.root, &keys)
+		if len(keys) != N || !isSorted(keys) {
+			t.Fatalf("N=%d: Collapse has %d keys (sorted=%v)", N, len(keys), isSorted(keys))
+		}
+		for i := 0; i < N; i++ {
+			if v, ok := c.Get(i * 2); !ok || v.(int) != i {
+				t.Fatalf("N=%d: Get(%d) after Collapse: got %v (ok=%v)", N, i*2, v, ok)
+			}
+		}
+		// 完美平衡：高度为 ceil(log2(N+1))
+		_, height := c.PathExtremes()
+		if want := int(math.Ceil(math.Log2(float64(N + 1)))); height != want {
+			t.Fatalf("N=%d: Collapse height %d, want %d", N, height, want)
+		}
+		// 合并后的树仍可正常修改
+		c.Insert(-1, -1)
+		c.Delete(0)
+		checkRBProperties(t, c.root)
+		if err := c.Validate(); err != nil {
+			t.Fatalf("N=%d: Validate after modifying collapsed tree: %v", N, err)
+		}
+	}
+}
+
+// Collapse 与整树导出在并发的跨分片事务下应看到一致的快照
+func TestShardedRBTreeOptCollapseConsistent(t *testing.T) {
+	tree := NewShardedRBTreeOpt(8)
+	a, b := 0, 1
+	for tree.getShard(b) == tree.getShard(a) {
+		b++
+	}
+	// 填充条目拉长遍历时间，让事务更容易落在两个分片之间
+	for k := 100; k < 5100; k++ {
+		tree.Insert(k, k)
+	}
+	tree.Insert(a, "token")
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		from, to := a, b
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			tree.Txn(func(tx *Txn) {
+				tx.Delete(from)
+				tx.Insert(to, "token")
+			})
+			from, to = to, from
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+	isToken := func(v interface{}) bool { s, ok := v.(string); return ok && s == "token" }
+	for i := 0; i < 200; i++ {
+		n := 0
+		tree.Collapse().forEach(func(_ int, v interface{}) bool {
+			if isToken(v) {
+				n++
+			}
+			return true
+		})
+		if n != 1 {
+			t.Fatalf("Collapse saw %d tokens, want 1", n)
+		}
+		n = 0
+		forEachEntry(tree, func(_ int, v interface{}) bool {
+			if isToken(v) {
+				n++
+			}
+			return true
+		})
+		if n != 1 {
+			t.Fatalf("forEachEntry saw %d tokens, want 1", n)
+		}
+		n = 0
+		withTrees(tree, func(rt *RBTree) {
+			rt.forEach(func(_ int, v interface{}) bool {
+				if isToken(v) {
+					n++
+				}
+				return true
+			})
+		})
+		if n != 1 {
+			t.Fatalf("withTrees saw %d tokens, want 1", n)
+		}
+	}
+}
+
+// ----------------- 一致性摘要测试 -----------------
+func TestShardedRBTreeOptSummary(t *testing.T) {
+	tree := NewShardedRBTreeOpt(8)
+	if _, _, _, ok := tree.Summary(); ok {
+		t.Fatalf("Summary of empty tree should report ok=false")
+	}
+
+	// 写入者按升序插入 key，并把已完成的个数记录下来
+	N := 20000
+	var written atomic.Int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < N; i++ {
+			tree.Insert(i, i)
+			written.Store(int64(i + 1))
+		}
+	}()
+	for {
+		select {
+		case <-done:
+		default:
+			before := int(written.Load())
+			minK, maxK, count, ok := tree.Summary()
+			after := int(written.Load())
+			if !ok {
+				if before > 0 {
+					t.Fatalf("Summary reported empty after %d writes", before)
+				}
+				continue
+			}
+			// key 为 0..k 的连续前缀：min 必为 0，count 必为 max+1，且落在观察窗口内
+			if minK != 0 || maxK < minK || count != maxK+1 || count < before || count > after+1 {
+				t.Fatalf("inconsistent Summary: min=%d max=%d count=%d (written %d..%d)", minK, maxK, count, before, after)
+			}
+			continue
+		}
+		break
+	}
+	minK, maxK, count, ok := tree.Summary()
+	if !ok || minK != 0 || maxK != N-1 || count != N {
+		t.Fatalf("final Summary: got (%d, %d, %d, %v), want (0, %d, %d, true)", minK, maxK, count, ok, N-1, N)
+	}
+}
+
+// ----------------- 连续相等值去重测试 -----------------
+func TestRBTreeCompressRuns(t *testing.T) {
+	tree := NewRBTree(newArena())
+	// 三段连续相等的值，每个值都是独立分配的实例
+	for i := 0; i < 300; i++ {
+		tree.Insert(i, &Value{Payload: [1]byte{byte(i / 100)}})
+	}
+	eq := func(a, b interface{}) bool { return *a.(*Value) == *b.(*Value) }
+
+	if n := tree.CompressRuns(eq); n != 297 {
+		t.Fatalf("CompressRuns replaced %d values, want 297", n)
+	}
+	distinct := make(map[*Value]bool)
+	for i := 0; i < 300; i++ {
+		v, ok := tree.Get(i)
+		if !ok || v.(*Value).Payload[0] != byte(i/100) {
+			t.Fatalf("Get(%d) after compress: got %v (ok=%v)", i, v, ok)
+		}
+		distinct[v.(*Value)] = true
+	}
+	if len(distinct) != 3 {
+		t.Fatalf("after compress: %d distinct value instances, want 3", len(distinct))
+	}
+	first, _ := tree.Get(0)
+	last, _ := tree.Get(99)
+	if first.(*Value) != last.(*Value) {
+		t.Fatalf("values in the same run should share one instance")
+	}
+	if n := tree.CompressRuns(eq); n != 297 {
+		t.Fatalf("second CompressRuns replaced %d values, want 297", n)
+	}
+	checkRBProperties(t, tree.root)
+}
+
+// ----------------- 分片函数均衡性评估测试 -----------------
+func TestEvaluateShardFn(t *testing.T) {
+	const n = 16
+	keys := make([]int, 10000)
+	for i := range keys {
+		keys[i] = i * 7
+	}
+
+	good := EvaluateShardFn(func(key, n int) int { return key % n }, keys, n)
+	if good.Imbalanced {
+		t.Fatalf("modulo shard function flagged as imbalanced: %+v", good)
+	}
+	total := 0
+	for _, c := range good.Counts {
+		total += c
+	}
+	if len(good.Counts) != n || total != len(keys) || good.Invalid != 0 {
+		t.Fatalf("modulo report: %d shards, %d samples, %d invalid", len(good.Counts), total, good.Invalid)
+	}
+	if good.MaxMinRatio > 1.01 {
+		t.Fatalf("modulo MaxMinRatio = %v, want ~1", good.MaxMinRatio)
+	}
+
+	bad := EvaluateShardFn(func(key, n int) int { return 3 }, keys, n)
+	if !bad.Imbalanced {
+		t.Fatalf("constant shard function not flagged as imbalanced: %+v", bad)
+	}
+	if bad.Counts[3] != len(keys) || !math.IsInf(bad.MaxMinRatio, 1) {
+		t.Fatalf("constant report: Counts[3]=%d MaxMinRatio=%v", bad.Counts[3], bad.MaxMinRatio)
+	}
+
+	outOfRange := EvaluateShardFn(func(key, n int) int { return key }, keys, n)
+	if !outOfRange.Imbalanced || outOfRange.Invalid == 0 {
+		t.Fatalf("out-of-range shard function should be flagged: %+v", outOfRange)
+	}
+}
+
+// ----------------- 与 map 对比测试 -----------------
+func TestRBTreeDiffMap(t *testing.T) {
+	tree := NewRBTree(newArena())
+	for i := 0; i < 20; i++ {
+		tree.Insert(i, i)
+	}
+	m := make(map[int]interface{})
+	for i := 10; i < 30; i++ {
+		m[i] = i
+	}
+	// 两边都有但值不同
+	m[12], m[15], m[19] = -12, -15, -19
+	eq := func(a, b interface{}) bool { return a.(int) == b.(int) }
+
+	onlyTree, onlyMap, diff := tree.DiffMap(m, eq)
+	seq := func(from, to int) []int {
+		var s []int
+		for i := from; i < to; i++ {
+			s = append(s, i)
+		}
+		return s
+	}
+	if fmt.Sprint(onlyTree) != fmt.Sprint(seq(0, 10)) {
+		t.Fatalf("onlyInTree: got %v, want %v", onlyTree, seq(0, 10))
+	}
+	if fmt.Sprint(onlyMap) != fmt.Sprint(seq(20, 30)) {
+		t.Fatalf("onlyInMap: got %v, want %v", onlyMap, seq(20, 30))
+	}
+	if fmt.Sprint(diff) != "[12 15 19]" {
+		t.Fatalf("different: got %v, want [12 15 19]", diff)
+	}
+
+	// 完全一致时三个结果都为空
+	same := make(map[int]interface{})
+	for i := 0; i < 20; i++ {
+		same[i] = i
+	}
+	if a, b, c := tree.DiffMap(same, eq); len(a)+len(b)+len(c) != 0 {
+		t.Fatalf("identical map: got %v %v %v, want all empty", a, b, c)
+	}
+	// 空 map：全部只在树中
+	if a, b, c := tree.DiffMap(nil, eq); len(a) != 20 || len(b)+len(c) != 0 {
+		t.Fatalf("nil map: got %v %v %v", a, b, c)
+	}
+}
+
+// ----------------- 元素个数测试 -----------------
+func TestRBTreeLen(t *testing.T) {
+	tree := NewRBTree(newArena())
+	if !tree.IsEmpty() || tree.Len() != 0 {
+		t.Fatalf("new tree: Len=%d IsEmpty=%v", tree.Len(), tree.IsEmpty())
+	}
+	for i := 0; i < 100; i++ {
+		tree.Insert(i, i)
+	}
+	// 覆盖写不改变元素个数
+	for i := 0; i < 100; i += 2 {
+		tree.Insert(i, -i)
+	}
+	if tree.Len() != 100 {
+		t.Fatalf("Len after updates: got %d, want 100", tree.Len())
+	}
+	// 删除不存在的 key 不改变元素个数
+	tree.Delete(1000)
+	// 删除有两个孩子的节点（根）会拼接其中序后继
+	root := tree.root.key
+	if tree.root.left == nil || tree.root.right == nil {
+		t.Fatalf("root should have two children")
+	}
+	tree.Delete(root)
+	tree.Delete(root)
+	if tree.Len() != 99 {
+		t.Fatalf("Len after deleting the root twice: got %d, want 99", tree.Len())
+	}
+	for i := 0; i < 100; i++ {
+		tree.Delete(i)
+	}
+	if !tree.IsEmpty() || tree.Len() != 0 {
+		t.Fatalf("after deleting everything: Len=%d IsEmpty=%v", tree.Len(), tree.IsEmpty())
+	}
+
+	wrappers := map[string]interface {
+		Tree
+		Len() int
+	}{
+		"RWLock":    &ShardedRBTreeRW{tree: NewRBTree(newArena())},
+		"PathLock":  &ShardedRBTreePath{tree: NewRBTree(newArena())},
+		"LockFree":  &ShardedRBTreeLF{},
+		"Optimized": NewShardedRBTreeOpt(8),
+	}
+	for name, w := range wrappers {
+		for i := 0; i < 500; i++ {
+			w.Insert(i, i)
+		}
+		for i := 0; i < 500; i += 5 {
+			w.Insert(i, -i)
+		}
+		for i := 0; i < 500; i += 4 {
+			w.Delete(i)
+			w.Delete(i)
+		}
+		w.Delete(-1)
+		if w.Len() != 375 {
+			t.Fatalf("%s Len: got %d, want 375", name, w.Len())
+		}
+	}
+}
+
+// ----------------- 逆序区间遍历测试 -----------------
+func TestRBTreeRangeReverse(t *testing.T) {
+	tree := NewRBTree(newArena())
+	for i := 0; i < 1000; i++ {
+		tree.Insert(i*2, i)
+	}
+	var fwd, rev []int
+	tree.Range(101, 399, func(k int, _ interface{}) bool {
+		fwd = append(fwd, k)
+		return true
+	})
+	tree.RangeReverse(101, 399, func(k int, _ interface{}) bool {
+		rev = append(rev, k)
+		return true
+	})
+	if len(rev) != len(fwd) || len(rev) != 149 {
+		t.Fatalf("RangeReverse visited %d keys, Range %d, want 149", len(rev), len(fwd))
+	}
+	for i := range rev {
+		if rev[i] != fwd[len(fwd)-1-i] {
+			t.Fatalf("RangeReverse position %d: got %d, want %d", i, rev[i], fwd[len(fwd)-1-i])
+		}
+	}
+
+	// 提前终止：Range 与 RangeReverse 都在 fn 返回 false 后立即停止
+	for name, walk := range map[string]func(int, int, func(int, interface{}) bool){
+		"Range":        tree.Range,
+		"RangeReverse": tree.RangeReverse,
+	} {
+		calls := 0
+		walk(0, 2000, func(int, interface{}) bool {
+			calls++
+			return calls < 10
+		})
+		if calls != 10 {
+			t.Fatalf("%s early stop: got %d calls, want 10", name, calls)
+		}
+	}
+
+	// 最近的 5 条记录
+	var recent []int
+	tree.RangeReverse(math.MinInt, math.MaxInt, func(k int, _ interface{}) bool {
+		recent = append(recent, k)
+		return len(recent) < 5
+	})
+	if fmt.Sprint(recent) != "[1998 1996 1994 1992 1990]" {
+		t.Fatalf("RangeReverse latest 5: got %v", recent)
+	}
+}
+
+func TestShardedRangeReverse(t *testing.T) {
+	trees := map[string]interface {
+		Insert(int, interface{})
+		RangeReverse(start, end int, fn func(key int, value interface{}) bool)
+	}{
+		"RWLock":    &ShardedRBTreeRW{tree: NewRBTree(newArena())},
+		"PathLock":  &ShardedRBTreePath{tree: NewRBTree(newArena())},
+		"Optimized": NewShardedRBTreeOpt(7),
+	}
+	for name, tree := range trees {
+		for i := 0; i < 10000; i++ {
+			tree.Insert(i, i)
+		}
+		var keys []int
+		tree.RangeReverse(100, 8999, func(k int, v interface{}) bool {
+			if v.(int) != k {
+				t.Fatalf("%s: key %d has value %v", name, k, v)
+			}
+			keys = append(keys, k)
+			return true
+		})
+		if len(keys) != 8900 || keys[0] != 8999 || keys[len(keys)-1] != 100 {
+			t.Fatalf("%s RangeReverse: got %d keys", name, len(keys))
+		}
+		for i := 1; i < len(keys); i++ {
+			if keys[i] >= keys[i-1] {
+				t.Fatalf("%s RangeReverse not strictly descending at %d: %d after %d", name, i, keys[i], keys[i-1])
+			}
+		}
+		calls := 0
+		tree.RangeReverse(0, 10000, func(int, interface{}) bool {
+			calls++
+			return calls < 3
+		})
+		if calls != 3 {
+			t.Fatalf("%s RangeReverse early stop: got %d calls, want 3", name, calls)
+		}
+		tree.RangeReverse(10, 5, func(int, interface{}) bool {
+			t.Fatalf("%s RangeReverse with start > end should not call fn", name)
+			return true
+		})
+	}
+
+	// 提前终止后所有分片锁都已释放
+	opt := trees["Optimized"].(*ShardedRBTreeOpt)
+	opt.RangeReverse(0, 10000, func(int, interface{}) bool { return false })
+	opt.Insert(-1, -1)
+}
+
+// ----------------- 查询或插入测试 -----------------
+func TestGetOrInsert(t *testing.T) {
+	tree := NewRBTree(newArena())
+	if v, loaded := tree.GetOrInsert(1, "a"); loaded || v != "a" {
+		t.Fatalf("GetOrInsert on missing key: got (%v, %v), want (a, false)", v, loaded)
+	}
+	if v, loaded := tree.GetOrInsert(1, "b"); !loaded || v != "a" {
+		t.Fatalf("GetOrInsert on existing key: got (%v, %v), want (a, true)", v, loaded)
+	}
+	if v, _ := tree.Get(1); v != "a" || tree.Len() != 1 {
+		t.Fatalf("GetOrInsert must not overwrite: Get(1)=%v Len=%d", v, tree.Len())
+	}
+
+	// 并发对同一 key 调用时只有一个调用方插入成功，其余都拿到同一个值
+	trees := map[string]interface {
+		GetOrInsert(int, interface{}) (interface{}, bool)
+		Len() int
+	}{
+		"RWLock":    &ShardedRBTreeRW{tree: NewRBTree(newArena())},
+		"PathLock":  &ShardedRBTreePath{tree: NewRBTree(newArena())},
+		"LockFree":  &ShardedRBTreeLF{},
+		"Optimized": NewShardedRBTreeOpt(8),
+	}
+	for name, tree := range trees {
+		var wg sync.WaitGroup
+		var inserted atomic.Int64
+		results := make([]interface{}, 16)
+		for g := range results {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				v, loaded := tree.GetOrInsert(7, g)
+				if !loaded {
+					inserted.Add(1)
+				}
+				results[g] = v
+			}(g)
+		}
+		wg.Wait()
+		if inserted.Load() != 1 {
+			t.Fatalf("%s: %d goroutines inserted, want 1", name, inserted.Load())
+		}
+		for g, v := range results {
+			if v != results[0] {
+				t.Fatalf("%s: goroutine %d saw %v, goroutine 0 saw %v", name, g, v, results[0])
+			}
+		}
+		if tree.Len() != 1 {
+			t.Fatalf("%s Len: got %d, want 1", name, tree.Len())
+		}
+	}
+}
+
+func TestInsertIfAbsent(t *testing.T) {
+	tree := NewRBTree(newArena())
+	if !tree.InsertIfAbsent(1, "a") {
+		t.Fatalf("InsertIfAbsent on missing key should insert")
+	}
+	if tree.InsertIfAbsent(1, "b") {
+		t.Fatalf("InsertIfAbsent on existing key should not insert")
+	}
+	if v, _ := tree.Get(1); v != "a" || tree.Len() != 1 {
+		t.Fatalf("InsertIfAbsent must keep the old value: Get(1)=%v Len=%d", v, tree.Len())
+	}
+
+	// 多个 goroutine 竞争插入同一个 key，恰好一个返回 true，且保存的正是它的值
+	trees := map[string]interface {
+		Tree
+		InsertIfAbsent(int, interface{}) bool
+		Len() int
+	}{
+		"RWLock":    &ShardedRBTreeRW{tree: NewRBTree(newArena())},
+		"PathLock":  &ShardedRBTreePath{tree: NewRBTree(newArena())},
+		"LockFree":  &ShardedRBTreeLF{},
+		"Optimized": NewShardedRBTreeOpt(8),
+	}
+	for name, tree := range trees {
+		var wg sync.WaitGroup
+		var winners atomic.Int64
+		winner := -1
+		for g := 0; g < 32; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				if tree.InsertIfAbsent(7, g) {
+					winners.Add(1)
+					winner = g
+				}
+			}(g)
+		}
+		wg.Wait()
+		if winners.Load() != 1 {
+			t.Fatalf("%s: %d goroutines got true, want 1", name, winners.Load())
+		}
+		if v, ok := tree.Get(7); !ok || v.(int) != winner {
+			t.Fatalf("%s: stored %v, want the winner's value %d", name, v, winner)
+		}
+		if tree.Len() != 1 {
+			t.Fatalf("%s Len: got %d, want 1", name, tree.Len())
+		}
+	}
+}
+
+func TestReplace(t *testing.T) {
+	tree := NewRBTree(newArena())
+	if old, existed := tree.Replace(1, "a"); existed || old != nil {
+		t.Fatalf("Replace on missing key: got (%v, %v), want (nil, false)", old, existed)
+	}
+	if old, existed := tree.Replace(1, "b"); !existed || old != "a" {
+		t.Fatalf("Replace on existing key: got (%v, %v), want (a, true)", old, existed)
+	}
+	if v, _ := tree.Get(1); v != "b" || tree.Len() != 1 {
+		t.Fatalf("after Replace: Get(1)=%v Len=%d", v, tree.Len())
+	}
+
+	// 并发替换同一个 key：每个写入的值恰好被换出一次（最后留在树里的除外），不会丢失或重复
+	trees := map[string]interface {
+		Tree
+		Replace(int, interface{}) (interface{}, bool)
+		Len() int
+	}{
+		"RWLock":    &ShardedRBTreeRW{tree: NewRBTree(newArena())},
+		"PathLock":  &ShardedRBTreePath{tree: NewRBTree(newArena())},
+		"LockFree":  &ShardedRBTreeLF{},
+		"Optimized": NewShardedRBTreeOpt(8),
+	}
+	for name, tree := range trees {
+		const G, N = 8, 200
+		displaced := make([][]int, G)
+		var inserts atomic.Int64
+		var wg sync.WaitGroup
+		for g := 0; g < G; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < N; i++ {
+					old, existed := tree.Replace(3, g*N+i)
+					if existed {
+						displaced[g] = append(displaced[g], old.(int))
+					} else {
+						inserts.Add(1)
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+		if inserts.Load() != 1 || tree.Len() != 1 {
+			t.Fatalf("%s: %d Replace calls inserted, Len=%d, want 1 and 1", name, inserts.Load(), tree.Len())
+		}
+		seen := make(map[int]bool)
+		last, _ := tree.Get(3)
+		seen[last.(int)] = true
+		for _, vs := range displaced {
+			for _, v := range vs {
+				if seen[v] {
+					t.Fatalf("%s: value %d displaced twice", name, v)
+				}
+				seen[v] = true
+			}
+		}
+		if len(seen) != G*N {
+			t.Fatalf("%s: accounted for %d values, want %d", name, len(seen), G*N)
+		}
+	}
+}
+
+func TestDeleteAndReport(t *testing.T) {
+	tree := NewRBTree(newArena())
+	for i := 0; i < 100; i++ {
+		tree.Insert(i*2, i)
+	}
+	before := tree.Keys()
+	if v, deleted := tree.DeleteAndReport(7); deleted || v != nil {
+		t.Fatalf("DeleteAndReport on missing key: got (%v, %v), want (nil, false)", v, deleted)
+	}
+	if tree.Len() != 100 || fmt.Sprint(tree.Keys()) != fmt.Sprint(before) || tree.arena.pooled.Load() != 0 {
+		t.Fatalf("DeleteAndReport on missing key mutated the tree")
+	}
+	if v, deleted := tree.DeleteAndReport(10); !deleted || v != 5 {
+		t.Fatalf("DeleteAndReport(10): got (%v, %v), want (5, true)", v, deleted)
+	}
+	if _, ok := tree.Get(10); ok || tree.Len() != 99 {
+		t.Fatalf("key 10 should be gone: Len=%d", tree.Len())
+	}
+	if err := tree.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if p := tree.arena.pooled.Load(); p != 1 {
+		t.Fatalf("deleted node should be returned to the arena: pooled=%d, want 1", p)
+	}
+
+	// 并发删除同一批 key：每个 key 恰好被一个调用报告为删除
+	trees := map[string]interface {
+		Tree
+		DeleteAndReport(int) (interface{}, bool)
+		Len() int
+	}{
+		"RWLock":    &ShardedRBTreeRW{tree: NewRBTree(newArena())},
+		"PathLock":  &ShardedRBTreePath{tree: NewRBTree(newArena())},
+		"LockFree":  &ShardedRBTreeLF{},
+		"Optimized": NewShardedRBTreeOpt(8),
+	}
+	for name, tree := range trees {
+		const N = 1000
+		for i := 0; i < N; i++ {
+			tree.Insert(i, i)
+		}
+		var deleted atomic.Int64
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < N; i++ {
+					if v, ok := tree.DeleteAndReport(i); ok {
+						if v.(int) != i {
+							t.Errorf("%s: DeleteAndReport(%d) returned %v", name, i, v)
+						}
+						deleted.Add(1)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if deleted.Load() != N || tree.Len() != 0 {
+			t.Fatalf("%s: %d deletions reported, Len=%d, want %d and 0", name, deleted.Load(), tree.Len(), N)
+		}
+	}
+}
+
+func TestNearest(t *testing.T) {
+	tree := NewRBTree(newArena())
+	if _, _, ok := tree.Nearest(5); ok {
+		t.Fatalf("Nearest on empty tree should fail")
+	}
+	for _, k := range []int{10, 20, 30, 45} {
+		tree.Insert(k, k*10)
+	}
+	cases := []struct{ key, want int }{
+		{20, 20},   // 精确命中
+		{-100, 10}, // 小于最小 key，只有 ceiling
+		{100, 45},  // 大于最大 key，只有 floor
+		{14, 10},
+		{16, 20},
+		{15, 10}, // 两侧等距取较小的 key
+		{25, 20},
+		{37, 30},
+		{38, 45},
+	}
+	for _, c := range cases {
+		k, v, ok := tree.Nearest(c.key)
+		if !ok || k != c.want || v != c.want*10 {
+			t.Fatalf("Nearest(%d): got (%d, %v, %v), want (%d, %d, true)", c.key, k, v, ok, c.want, c.want*10)
+		}
+	}
+	if k, _, _ := tree.Floor(29); k != 20 {
+		t.Fatalf("Floor(29) = %d, want 20", k)
+	}
+	if k, _, _ := tree.Ceiling(21); k != 30 {
+		t.Fatalf("Ceiling(21) = %d, want 30", k)
+	}
+	if _, _, ok := tree.Floor(9); ok {
+		t.Fatalf("Floor below min should fail")
+	}
+	if _, _, ok := tree.Ceiling(46); ok {
+		t.Fatalf("Ceiling above max should fail")
+	}
+
+	// 跨越整个 int 范围的距离不能溢出
+	edge := NewRBTree(newArena())
+	edge.Insert(math.MinInt, "min")
+	edge.Insert(math.MaxInt, "max")
+	if k, _, _ := edge.Nearest(1); k != math.MaxInt {
+		t.Fatalf("Nearest(1) between int bounds = %d, want MaxInt", k)
+	}
+	if k, _, _ := edge.Nearest(-1); k != math.MinInt {
+		t.Fatalf("Nearest(-1) between int bounds = %d, want MinInt", k)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	tree := NewRBTree(newArena())
+	if tree.CompareAndSwap(1, nil, "x", nil) {
+		t.Fatalf("CompareAndSwap on missing key should fail")
+	}
+	if _, ok := tree.Get(1); ok {
+		t.Fatalf("CompareAndSwap must not insert a missing key")
+	}
+	tree.Insert(1, "a")
+	if tree.CompareAndSwap(1, "b", "c", nil) {
+		t.Fatalf("CompareAndSwap with stale old value should fail")
+	}
+	if !tree.CompareAndSwap(1, "a", "c", nil) {
+		t.Fatalf("CompareAndSwap with current value should succeed")
+	}
+	// 自定义比较：按切片内容比较，不可比较的值也能使用
+	tree.Insert(2, []int{1, 2})
+	sliceEq := func(a, b interface{}) bool { return fmt.Sprint(a) == fmt.Sprint(b) }
+	if !tree.CompareAndSwap(2, []int{1, 2}, []int{3}, sliceEq) {
+		t.Fatalf("CompareAndSwap with custom eq should succeed")
+	}
+	if v, _ := tree.Get(2); fmt.Sprint(v) != "[3]" {
+		t.Fatalf("Get(2) after CompareAndSwap: %v", v)
+	}
+
+	// 乐观并发计数：每个 goroutine 读取后 CAS 递增，失败则重读重试，最终计数不丢失
+	trees := map[string]interface {
+		Tree
+		CompareAndSwap(key int, old, newVal interface{}, eq func(a, b interface{}) bool) bool
+	}{
+		"RWLock":    &ShardedRBTreeRW{tree: NewRBTree(newArena())},
+		"PathLock":  &ShardedRBTreePath{tree: NewRBTree(newArena())},
+		"LockFree":  &ShardedRBTreeLF{},
+		"Optimized": NewShardedRBTreeOpt(8),
+	}
+	for name, tree := range trees {
+		tree.Insert(0, 0)
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 500; i++ {
+					for {
+						v, _ := tree.Get(0)
+						if tree.CompareAndSwap(0, v, v.(int)+1, nil) {
+							break
+						}
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if v, _ := tree.Get(0); v.(int) != 4000 {
+			t.Fatalf("%s: counter = %v, want 4000", name, v)
+		}
+		if tree.CompareAndSwap(1, nil, 1, nil) {
+			t.Fatalf("%s: CompareAndSwap on missing key should fail", name)
+		}
+		// 自定义比较时存放不可比较的值也不会 panic
+		tree.Insert(2, []int{1, 2})
+		if tree.CompareAndSwap(2, []int{9}, []int{3}, sliceEq) {
+			t.Fatalf("%s: CompareAndSwap with a different slice should fail", name)
+		}
+		if !tree.CompareAndSwap(2, []int{1, 2}, []int{3}, sliceEq) {
+			t.Fatalf("%s: CompareAndSwap with custom eq should succeed", name)
+		}
+		if v, _ := tree.Get(2); fmt.Sprint(v) != "[3]" {
+			t.Fatalf("%s: Get(2) after CompareAndSwap: %v", name, v)
+		}
+	}
+
+	// LockFree 的 Update 同样支持不可比较的值
+	lf := trees["LockFree"].(*ShardedRBTreeLF)
+	lf.Update(2, func(old interface{}, found bool) (interface{}, bool) {
+		return append(old.([]int), 4), true
+	})
+	if v, _ := lf.Get(2); fmt.Sprint(v) != "[3 4]" {
+		t.Fatalf("LockFree Update on a slice value: %v", v)
+	}
+	lf.Update(2, func(interface{}, bool) (interface{}, bool) { return nil, false })
+	if _, ok := lf.Get(2); ok || lf.Len() != 1 {
+		t.Fatalf("LockFree Update should delete the slice value: Len=%d", lf.Len())
+	}
+}
+
+func TestShardedRBTreeLFOrderedOps(t *testing.T) {
+	lf := &ShardedRBTreeLF{}
+	ref := NewRBTree(newArena())
+	if _, _, ok := lf.Min(); ok {
+		t.Fatalf("Min on empty tree should fail")
+	}
+	rng := rand.New(rand.NewSource(5))
+	check := func(round int) {
+		t.Helper()
+		k1, _, ok1 := lf.Min()
+		k2, _, ok2 := ref.Min()
+		if k1 != k2 || ok1 != ok2 {
+			t.Fatalf("round %d Min: got (%d, %v), want (%d, %v)", round, k1, ok1, k2, ok2)
+		}
+		k1, _, ok1 = lf.Max()
+		k2, _, ok2 = ref.Max()
+		if k1 != k2 || ok1 != ok2 {
+			t.Fatalf("round %d Max: got (%d, %v), want (%d, %v)", round, k1, ok1, k2, ok2)
+		}
+		for i := 0; i < 20; i++ {
+			q := rng.Intn(1200) - 100
+			k1, v1, ok1 := lf.Prev(q)
+			k2, v2, ok2 := ref.Prev(q)
+			if k1 != k2 || ok1 != ok2 || v1 != v2 {
+				t.Fatalf("round %d Prev(%d): got (%d, %v, %v), want (%d, %v, %v)", round, q, k1, v1, ok1, k2, v2, ok2)
+			}
+			k1, v1, ok1 = lf.Next(q)
+			k2, v2, ok2 = ref.Next(q)
+			if k1 != k2 || ok1 != ok2 || v1 != v2 {
+				t.Fatalf("round %d Next(%d): got (%d, %v, %v), want (%d, %v, %v)", round, q, k1, v1, ok1, k2, v2, ok2)
+			}
+		}
+		start := rng.Intn(1000)
+		end := start + rng.Intn(300)
+		var got, want []int
+		lf.Range(start, end, func(k int, _ interface{}) bool { got = append(got, k); return true })
+		ref.Range(start, end, func(k int, _ interface{}) bool { want = append(want, k); return true })
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("round %d Range(%d, %d): got %v, want %v", round, start, end, got, want)
+		}
+		got = got[:0]
+		lf.RangeReverse(start, end, func(k int, _ interface{}) bool { got = append(got, k); return true })
+		for i, j := 0, len(want)-1; i < j; i, j = i+1, j-1 {
+			want[i], want[j] = want[j], want[i]
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("round %d RangeReverse(%d, %d): got %v, want %v", round, start, end, got, want)
+		}
+	}
+	// 每轮修改后索引都必须反映之前完成的插入和删除
+	for round := 0; round < 50; round++ {
+		for i := 0; i < 40; i++ {
+			k := rng.Intn(1000)
+			if rng.Intn(3) == 0 {
+				lf.Delete(k)
+				ref.Delete(k)
+			} else {
+				lf.Insert(k, k+round)
+				ref.Insert(k, k+round)
+			}
+		}
+		check(round)
+	}
+
+	// 并发写入与有序读取交错：读到的区间始终有序
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			lf.Insert(i%2000, i)
+			lf.Delete((i + 1000) % 2000)
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		prev := math.MinInt
+		lf.Range(math.MinInt, math.MaxInt, func(k int, _ interface{}) bool {
+			if k <= prev {
+				t.Errorf("concurrent Range out of order: %d after %d", k, prev)
+				return false
+			}
+			prev = k
+			return true
+		})
+	}
+	close(stop)
+	wg.Wait()
+	lf.Insert(-5, -5)
+	if k, _, _ := lf.Min(); k != -5 {
+		t.Fatalf("Min after concurrent phase: got %d, want -5", k)
+	}
+}
+
+// 写入之后的有序操作只把变化的 key 并入索引，不重建整个索引
+func TestShardedRBTreeLFIndexIncremental(t *testing.T) {
+	lf := &ShardedRBTreeLF{}
+	for i := 0; i < 10000; i++ {
+		lf.Insert(i*2, i)
+	}
+	if k, _, ok := lf.Min(); !ok || k != 0 {
+		t.Fatalf("Min: got %d (ok=%v)", k, ok)
+	}
+	before, _, _ := lf.idx.arena.Stats()
+	lf.Insert(-1, "new")
+	lf.Delete(0)
+	lf.Insert(4, "update") // 只更新值，key 集合不变
+	if k, v, ok := lf.Min(); !ok || k != -1 || v != "new" {
+		t.Fatalf("Min after writes: got (%d, %v, %v)", k, v, ok)
+	}
+	if k, _, ok := lf.Next(-1); !ok || k != 2 {
+		t.Fatalf("Next(-1) after deleting 0: got %d (ok=%v)", k, ok)
+	}
+	after, _, _ := lf.idx.arena.Stats()
+	if after-before != 1 {
+		t.Fatalf("index allocated %d nodes for one new key, want 1", after-before)
+	}
+	if lf.idx.Len() != lf.Len() {
+		t.Fatalf("index holds %d keys, tree holds %d", lf.idx.Len(), lf.Len())
+	}
+}
+
+// ----------------- 原子更新测试 -----------------
+func TestUpdate(t *testing.T) {
+	tree := NewRBTree(newArena())
+	incr := func(old interface{}, found bool) (interface{}, bool) {
+		if !found {
+			return 1, true
+		}
+		return old.(int) + 1, true
+	}
+	tree.Update(5, incr)
+	tree.Update(5, incr)
+	if v, ok := tree.Get(5); !ok || v.(int) != 2 {
+		t.Fatalf("Update increment: got %v (ok=%v), want 2", v, ok)
+	}
+	// keep 为 false 时删除；key 不存在时不插入
+	drop := func(interface{}, bool) (interface{}, bool) { return nil, false }
+	tree.Update(5, drop)
+	tree.Update(6, drop)
+	if tree.Len() != 0 {
+		t.Fatalf("Update with keep=false: Len=%d, want 0", tree.Len())
+	}
+	for i := 0; i < 100; i++ {
+		tree.Insert(i, i)
+	}
+	for i := 0; i < 100; i += 2 {
+		tree.Update(i, drop)
+	}
+	checkRBProperties(t, tree.root)
+	if err := tree.Validate(); err != nil || tree.Len() != 50 {
+		t.Fatalf("after Update deletes: Len=%d Validate=%v", tree.Len(), err)
+	}
+
+	trees := map[string]interface {
+		Get(int) (interface{}, bool)
+		Update(int, func(interface{}, bool) (interface{}, bool))
+		Len() int
+	}{
+		"RWLock":    &ShardedRBTreeRW{tree: NewRBTree(newArena())},
+		"PathLock":  &ShardedRBTreePath{tree: NewRBTree(newArena())},
+		"LockFree":  &ShardedRBTreeLF{},
+		"Optimized": NewShardedRBTreeOpt(8),
+	}
+	for name, tree := range trees {
+		var wg sync.WaitGroup
+		G, M := 8, 500
+		for g := 0; g < G; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < M; i++ {
+					tree.Update(1, incr)
+				}
+			}()
+		}
+		wg.Wait()
+		if v, ok := tree.Get(1); !ok || v.(int) != G*M {
+			t.Fatalf("%s concurrent Update: got %v (ok=%v), want %d", name, v, ok, G*M)
+		}
+		tree.Update(1, drop)
+		if _, ok := tree.Get(1); ok || tree.Len() != 0 {
+			t.Fatalf("%s Update delete: key still present (Len=%d)", name, tree.Len())
+		}
+	}
+}
+
+// ----------------- Keys/Values 测试 -----------------
+func TestKeysValues(t *testing.T) {
+	tree := NewRBTree(newArena())
+	if len(tree.Keys()) != 0 || len(tree.Values()) != 0 || len(tree.KeysRange(0, 10)) != 0 {
+		t.Fatalf("Keys/Values on empty tree should be empty")
+	}
+	opt := NewShardedRBTreeOpt(8)
+	perm := rand.New(rand.NewSource(12)).Perm(1000)
+	for _, k := range perm {
+		tree.Insert(k, k*2)
+		opt.Insert(k, k*2)
+	}
+
+	for name, keys := range map[string][]int{"RBTree": tree.Keys(), "Optimized": opt.Keys()} {
+		if len(keys) != 1000 {
+			t.Fatalf("%s Keys: got %d keys, want 1000", name, len(keys))
+		}
+		for i, k := range keys {
+			if k != i {
+				t.Fatalf("%s Keys not globally sorted at %d: got %d", name, i, k)
+			}
+		}
+	}
+	for name, values := range map[string][]interface{}{"RBTree": tree.Values(), "Optimized": opt.Values()} {
+		if len(values) != 1000 {
+			t.Fatalf("%s Values: got %d values, want 1000", name, len(values))
+		}
+		for i, v := range values {
+			if v.(int) != i*2 {
+				t.Fatalf("%s Values[%d]: got %v, want %d", name, i, v, i*2)
+			}
+		}
+	}
+	for name, keys := range map[string][]int{"RBTree": tree.KeysRange(95, 104), "Optimized": opt.KeysRange(95, 104)} {
+		if fmt.Sprint(keys) != "[95 96 97 98 99 100 101 102 103 104]" {
+			t.Fatalf("%s KeysRange(95, 104): got %v", name, keys)
+		}
+	}
+	if keys := tree.KeysRange(10, 5); len(keys) != 0 {
+		t.Fatalf("KeysRange with start > end: got %v", keys)
+	}
+	if keys := tree.KeysRange(990, math.MaxInt); cap(keys) != 10 || len(keys) != 10 {
+		t.Fatalf("KeysRange past Max: len=%d cap=%d, want 10", len(keys), cap(keys))
+	}
+}
+
+// ----------------- 自定义分片函数测试 -----------------
+func TestNewShardedRBTreeOptFunc(t *testing.T) {
+	const shards = 16
+	// 0, 64, 128, ... 直接取模只会落到 0 号分片
+	keys := make([]int, 4096)
+	for i := range keys {
+		keys[i] = i * 64
+	}
+	counts := func(s *ShardedRBTreeOpt) []int {
+		c := make([]int, len(s.shards()))
+		for i, sh := range s.shards() {
+			c[i] = sh.tree.Len()
+		}
+		return c
+	}
+	modulo := NewShardedRBTreeOpt(shards)
+	mixed := NewShardedRBTreeOptFunc(shards, nil)
+	for _, k := range keys {
+		modulo.Insert(k, k)
+		mixed.Insert(k, k)
+	}
+	if c := counts(modulo); c[0] != len(keys) {
+		t.Fatalf("modulo sharding: shard 0 has %d keys, want all %d", c[0], len(keys))
+	}
+	c := counts(mixed)
+	minC, maxC := c[0], c[0]
+	for _, n := range c {
+		minC, maxC = min(minC, n), max(maxC, n)
+	}
+	// 期望每个分片 256 个
+	if minC < 180 || maxC > 340 {
+		t.Fatalf("mixed sharding is uneven: min %d, max %d (%v)", minC, maxC, c)
+	}
+	rep := EvaluateShardFn(func(key, n int) int { return int(MixKey(key) % uint64(n)) }, keys, shards)
+	if rep.Imbalanced {
+		t.Fatalf("MixKey flagged as imbalanced: %+v", rep)
+	}
+
+	// 负数 key 与有序操作照常工作
+	mixed.Insert(-64, "neg")
+	if v, ok := mixed.Get(-64); !ok || v != "neg" {
+		t.Fatalf("Get(-64): got %v (ok=%v)", v, ok)
+	}
+	if k, _, _ := mixed.Min(); k != -64 {
+		t.Fatalf("Min: got %d, want -64", k)
+	}
+
+	// 自定义 hash
+	custom := NewShardedRBTreeOptFunc(4, func(key int) uint64 { return uint64(key / 100) })
+	for i := 0; i < 400; i++ {
+		custom.Insert(i, i)
+	}
+	for i, n := range counts(custom) {
+		if n != 100 {
+			t.Fatalf("custom hash: shard %d has %d keys, want 100", i, n)
+		}
+	}
+}
+
+// ----------------- 批量构建测试 -----------------
+func TestBulkLoad(t *testing.T) {
+	for _, N := range []int{0, 1, 2, 3, 7, 8, 100, 1023, 1024, 100000} {
+		keys := make([]int, N)
+		values := make([]interface{}, N)
+		for i := range keys {
+			keys[i] = i * 3
+			values[i] = i
+		}
+		tree := BulkLoad(newArena(), keys, values)
+		checkRBProperties(t, tree.root)
+		if err := tree.Validate(); err != nil {
+			t.Fatalf("N=%d: Validate after BulkLoad: %v", N, err)
+		}
+		if tree.Len() != N {
+			t.Fatalf("N=%d: Len %d", N, tree.Len())
+		}
+		for i := 0; i < N; i += 1 + N/50 {
+			if v, ok := tree.Get(i * 3); !ok || v.(int) != i {
+				t.Fatalf("N=%d: Get(%d) got %v (ok=%v)", N, i*3, v, ok)
+			}
+		}
+		// 构建后仍可正常插入删除
+		tree.Insert(-1, nil)
+		tree.Delete(0)
+		checkRBProperties(t, tree.root)
+	}
+
+	// 无序且有重复的输入：排序去重，重复 key 以最后一次的值为准
+	tree := BulkLoad(newArena(), []int{5, 1, 9, 1, 3, 5, 7}, []interface{}{"a", "b", "c", "d", "e", "f"})
+	checkRBProperties(t, tree.root)
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("Validate after unsorted BulkLoad: %v", err)
+	}
+	if fmt.Sprint(tree.Keys()) != "[1 3 5 7 9]" {
+		t.Fatalf("unsorted BulkLoad keys: got %v", tree.Keys())
+	}
+	if fmt.Sprint(tree.Values()) != "[d e f <nil> c]" {
+		t.Fatalf("unsorted BulkLoad values: got %v", tree.Values())
+	}
+}
+
+// ----------------- 合并测试 -----------------
+func TestRBTreeMerge(t *testing.T) {
+	// 覆盖逐个插入（other 较小）与归并重建（other 较大）两条路径
+	for _, sizes := range [][2]int{{1000, 5}, {1000, 1000}, {10, 1000}, {0, 50}, {50, 0}} {
+		tree, other := NewRBTree(newArena()), NewRBTree(newArena())
+		ref := make(map[int]interface{})
+		r := rand.New(rand.NewSource(int64(sizes[0]*7 + sizes[1])))
+		for i := 0; i < sizes[0]; i++ {
+			k := r.Intn(3000)
+			tree.Insert(k, "t")
+			ref[k] = "t"
+		}
+		var otherKeys []int
+		for i := 0; i < sizes[1]; i++ {
+			k := r.Intn(3000)
+			other.Insert(k, "o")
+			ref[k] = "o"
+		}
+		otherKeys = other.Keys()
+
+		tree.Merge(other)
+		checkRBProperties(t, tree.root)
+		if err := tree.Validate(); err != nil {
+			t.Fatalf("sizes %v: Validate after Merge: %v", sizes, err)
+		}
+		if tree.Len() != len(ref) {
+			t.Fatalf("sizes %v: Len after Merge %d, want %d", sizes, tree.Len(), len(ref))
+		}
+		for k, want := range ref {
+			if v, ok := tree.Get(k); !ok || v != want {
+				t.Fatalf("sizes %v: Get(%d) got %v (ok=%v), want %v", sizes, k, v, ok, want)
+			}
+		}
+		// other 保持不变
+		if fmt.Sprint(other.Keys()) != fmt.Sprint(otherKeys) {
+			t.Fatalf("sizes %v: Merge modified other", sizes)
+		}
+		if err := other.Validate(); err != nil {
+			t.Fatalf("sizes %v: other invalid after Merge: %v", sizes, err)
+		}
+	}
+
+	self := NewRBTree(newArena())
+	self.Insert(1, 1)
+	self.Merge(self)
+	if self.Len() != 1 {
+		t.Fatalf("Merge with itself: Len %d, want 1", self.Len())
+	}
+}
+
+// ----------------- 集合运算测试 -----------------
+func TestRBTreeSetOps(t *testing.T) {
+	build := func(keys ...int) *RBTree {
+		tree := NewRBTree(newArena())
+		for _, k := range keys {
+			tree.Insert(k, nil)
+		}
+		return tree
+	}
+	seq := func(from, to, step int) []int {
+		var s []int
+		for i := from; i < to; i += step {
+			s = append(s, i)
+		}
+		return s
+	}
+	evens, threes := build(seq(0, 30, 2)...), build(seq(0, 30, 3)...)
+	empty := build()
+	low, high := build(seq(0, 10, 1)...), build(seq(100, 110, 1)...)
+
+	cases := []struct {
+		name       string
+		a, b       *RBTree
+		inter, dif string
+	}{
+		{"partial overlap", evens, threes, "[0 6 12 18 24]", "[2 4 8 10 14 16 20 22 26 28]"},
+		{"empty left", empty, evens, "[]", "[]"},
+		{"empty right", evens, empty, "[]", fmt.Sprint(seq(0, 30, 2))},
+		{"disjoint", low, high, "[]", fmt.Sprint(seq(0, 10, 1))},
+		{"disjoint reversed", high, low, "[]", fmt.Sprint(seq(100, 110, 1))},
+		{"identical", evens, build(seq(0, 30, 2)...), fmt.Sprint(seq(0, 30, 2)), "[]"},
+	}
+	for _, c := range cases {
+		if got := fmt.Sprint(c.a.IntersectKeys(c.b)); got != c.inter {
+			t.Fatalf("%s IntersectKeys: got %s, want %s", c.name, got, c.inter)
+		}
+		if got := fmt.Sprint(c.a.DifferenceKeys(c.b)); got != c.dif {
+			t.Fatalf("%s DifferenceKeys: got %s, want %s", c.name, got, c.dif)
+		}
+	}
+}
+
+// ----------------- 区间求和测试 -----------------
+func TestRBTreeSumRange(t *testing.T) {
+	tree := NewRBTree(newArena())
+	values := make(map[int]int)
+	r := rand.New(rand.NewSource(21))
+	for len(values) < 1000 {
+		k, v := r.Intn(5000), r.Intn(2000)-1000
+		tree.Insert(k, v)
+		values[k] = v
+	}
+	extract := func(v interface{}) int64 { return int64(v.(int)) }
+	for _, iv := range [][2]int{{0, 4999}, {100, 200}, {-10, 10}, {4990, 6000}, {300, 300}, {50, 40}, {math.MinInt, math.MaxInt}} {
+		var want int64
+		for k, v := range values {
+			if k >= iv[0] && k <= iv[1] {
+				want += int64(v)
+			}
+		}
+		if got := tree.SumRange(iv[0], iv[1], extract); got != want {
+			t.Fatalf("SumRange(%d, %d): got %d, want %d", iv[0], iv[1], got, want)
+		}
+	}
+}
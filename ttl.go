@@ -0,0 +1,196 @@
+package rbtree
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// ================= 带过期时间的树 =================
+
+// 默认的后台清理间隔
+const defaultSweepInterval = time.Second
+
+// TTLTree 的条目：expireAt 为零值表示永不过期
+type ttlEntry struct {
+	key      int
+	value    interface{}
+	expireAt time.Time
+	// 在过期堆中的下标，不在堆中（永不过期或已移出）时为 -1
+	index int
+}
+
+func (e *ttlEntry) expired(now time.Time) bool {
+	return !e.expireAt.IsZero() && !now.Before(e.expireAt)
+}
+
+// 按过期时间排序的最小堆，只包含会过期的条目
+type ttlHeap []*ttlEntry
+
+func (h ttlHeap) Len() int           { return len(h) }
+func (h ttlHeap) Less(i, j int) bool { return h[i].expireAt.Before(h[j].expireAt) }
+func (h ttlHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *ttlHeap) Push(x interface{}) {
+	e := x.(*ttlEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *ttlHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	e.index = -1
+	*h = old[:len(old)-1]
+	return e
+}
+
+// TTLTree 为每个条目记录过期时间：后台 goroutine 按固定间隔删除已过期的条目，
+// 已过期但尚未被清理的条目在 Get 时视为不存在并被立即删除。用完后需调用 Close 停止后台清理。
+// 会过期的条目另外按过期时间放在一个堆中，清理时只弹出已过期的条目，不扫描整棵树。
+type TTLTree struct {
+	tree          *RBTree
+	expiry        ttlHeap
+	mu            sync.RWMutex
+	sweepInterval time.Duration
+	stop          chan struct{}
+	done          chan struct{}
+	closeOnce     sync.Once
+}
+
+// TTLTree 构造选项
+type TTLOption func(*TTLTree)
+
+// 设置后台清理间隔，d <= 0 时使用默认的 1s
+func WithSweepInterval(d time.Duration) TTLOption {
+	return func(t *TTLTree) {
+		if d > 0 {
+			t.sweepInterval = d
+		}
+	}
+}
+
+// 创建 TTLTree 并启动后台清理
+func NewTTLTree(opts ...TTLOption) *TTLTree {
+	t := &TTLTree{
+		tree:          NewRBTree(newArena()),
+		sweepInterval: defaultSweepInterval,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	go t.sweepLoop()
+	return t
+}
+
+func (t *TTLTree) sweepLoop() {
+	defer close(t.done)
+	ticker := time.NewTicker(t.sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+			t.Sweep()
+		}
+	}
+}
+
+// Sweep 立即删除所有已过期的条目，返回删除的个数。只访问已过期的条目，O(k log n)
+func (t *TTLTree) Sweep() int {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for len(t.expiry) > 0 && t.expiry[0].expired(now) {
+		e := heap.Pop(&t.expiry).(*ttlEntry)
+		t.tree.Delete(e.key)
+		n++
+	}
+	return n
+}
+
+// 存入新条目并把被替换的旧条目移出过期堆。调用方需持有 t.mu
+func (t *TTLTree) put(e *ttlEntry) {
+	e.index = -1
+	if old, ok := t.tree.Replace(e.key, e); ok {
+		t.unschedule(old.(*ttlEntry))
+	}
+	if !e.expireAt.IsZero() {
+		heap.Push(&t.expiry, e)
+	}
+}
+
+// 删除 key 并把其条目移出过期堆。调用方需持有 t.mu
+func (t *TTLTree) remove(key int) {
+	if old, ok := t.tree.DeleteAndReport(key); ok {
+		t.unschedule(old.(*ttlEntry))
+	}
+}
+
+func (t *TTLTree) unschedule(e *ttlEntry) {
+	if e.index >= 0 {
+		heap.Remove(&t.expiry, e.index)
+	}
+}
+
+// Close 停止后台清理并等待其退出，重复调用无副作用
+func (t *TTLTree) Close() {
+	t.closeOnce.Do(func() {
+		close(t.stop)
+		<-t.done
+	})
+}
+
+// 插入永不过期的条目
+func (t *TTLTree) Insert(key int, value interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.put(&ttlEntry{key: key, value: value})
+}
+
+// 插入在 ttl 之后过期的条目；ttl <= 0 的条目立即过期
+func (t *TTLTree) InsertWithTTL(key int, value interface{}, ttl time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.put(&ttlEntry{key: key, value: value, expireAt: time.Now().Add(ttl)})
+}
+
+// 查询 key，已过期的条目视为不存在，并在返回前删除
+func (t *TTLTree) Get(key int) (interface{}, bool) {
+	t.mu.RLock()
+	v, ok := t.tree.Get(key)
+	t.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	e := v.(*ttlEntry)
+	if !e.expired(time.Now()) {
+		return e.value, true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// 释放读锁期间条目可能已被替换，只删除仍是同一个已过期条目的情况
+	if cur, ok := t.tree.Get(key); ok && cur == v {
+		t.remove(key)
+	}
+	return nil, false
+}
+
+func (t *TTLTree) Delete(key int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.remove(key)
+}
+
+// 条目数，包括已过期但尚未清理的条目
+func (t *TTLTree) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.tree.size
+}
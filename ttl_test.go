@@ -0,0 +1,108 @@
+package rbtree
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLTreeLazyExpiry(t *testing.T) {
+	// 清理间隔很长，只验证 Get 的惰性过期
+	tree := NewTTLTree(WithSweepInterval(time.Hour))
+	defer tree.Close()
+	tree.Insert(1, "forever")
+	tree.InsertWithTTL(2, "short", 20*time.Millisecond)
+	tree.InsertWithTTL(3, "long", time.Hour)
+	if v, ok := tree.Get(2); !ok || v != "short" {
+		t.Fatalf("Get(2) before expiry: %v (ok=%v)", v, ok)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := tree.Get(2); ok {
+		t.Fatalf("Get(2) after expiry should miss")
+	}
+	if tree.Len() != 2 {
+		t.Fatalf("expired entry should be removed by Get: Len=%d, want 2", tree.Len())
+	}
+	if v, ok := tree.Get(1); !ok || v != "forever" {
+		t.Fatalf("Get(1): %v (ok=%v)", v, ok)
+	}
+	if v, ok := tree.Get(3); !ok || v != "long" {
+		t.Fatalf("Get(3): %v (ok=%v)", v, ok)
+	}
+	// 重新插入会刷新过期时间
+	tree.InsertWithTTL(2, "again", time.Hour)
+	if v, ok := tree.Get(2); !ok || v != "again" {
+		t.Fatalf("Get(2) after re-insert: %v (ok=%v)", v, ok)
+	}
+}
+
+func TestTTLTreeSweeper(t *testing.T) {
+	tree := NewTTLTree(WithSweepInterval(5 * time.Millisecond))
+	for i := 0; i < 100; i++ {
+		tree.InsertWithTTL(i, i, 10*time.Millisecond)
+	}
+	tree.Insert(1000, 1000)
+	deadline := time.Now().Add(2 * time.Second)
+	for tree.Len() != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if tree.Len() != 1 {
+		t.Fatalf("sweeper did not remove expired entries: Len=%d", tree.Len())
+	}
+	tree.Close()
+	tree.Close()
+
+	// 停止后不再清理
+	tree.InsertWithTTL(1, 1, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if tree.Len() != 2 {
+		t.Fatalf("sweeper still running after Close: Len=%d", tree.Len())
+	}
+}
+
+func TestTTLTreeExpiryIndex(t *testing.T) {
+	tree := NewTTLTree(WithSweepInterval(time.Hour))
+	defer tree.Close()
+	// 覆盖写、删除后旧条目必须移出过期堆，否则 Sweep 会删掉新写入的条目
+	for i := 0; i < 1000; i++ {
+		tree.InsertWithTTL(i, i, time.Millisecond)
+	}
+	for i := 0; i < 1000; i += 2 {
+		tree.InsertWithTTL(i, -i, time.Hour)
+	}
+	for i := 1; i < 1000; i += 4 {
+		tree.Insert(i, -i)
+	}
+	for i := 3; i < 1000; i += 4 {
+		tree.Delete(i)
+	}
+	if n := len(tree.expiry); n != 500 {
+		t.Fatalf("expiry heap holds %d entries, want 500", n)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if n := tree.Sweep(); n != 0 {
+		t.Fatalf("Sweep removed %d entries, want 0", n)
+	}
+	if tree.Len() != 750 {
+		t.Fatalf("Len after Sweep: got %d, want 750", tree.Len())
+	}
+
+	// 只有到期的条目被弹出，未到期的留在堆中
+	for i := 2000; i < 2100; i++ {
+		tree.InsertWithTTL(i, i, time.Millisecond)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if n := tree.Sweep(); n != 100 {
+		t.Fatalf("Sweep removed %d entries, want 100", n)
+	}
+	if n := len(tree.expiry); n != 500 {
+		t.Fatalf("expiry heap holds %d entries after Sweep, want 500", n)
+	}
+	for i, e := range tree.expiry {
+		if e.index != i {
+			t.Fatalf("heap entry %d records index %d", i, e.index)
+		}
+	}
+	if v, ok := tree.Get(1); !ok || v != -1 {
+		t.Fatalf("entry overwritten without TTL: got %v (ok=%v)", v, ok)
+	}
+}
@@ -0,0 +1,123 @@
+package rbtree
+
+// ================= 事务 =================
+
+// 事务中缓冲的一次写入
+type txnOp struct {
+	key    int
+	value  interface{}
+	delete bool
+}
+
+// Txn 缓冲一个事务内的插入和删除，事务函数正常返回后一次性提交。
+// 提交前树完全不被修改，因此 Abort 或 panic 的事务不会在树上留下任何痕迹（包括树的形状）。
+type Txn struct {
+	ops []txnOp
+	// key -> ops 中该 key 最后一次写入的下标，用于让 Get 看到本事务的写入
+	last    map[int]int
+	get     func(key int) (interface{}, bool)
+	aborted bool
+}
+
+// 在事务中插入 key；Abort 之后的写入被忽略
+func (tx *Txn) Insert(key int, value interface{}) {
+	tx.record(txnOp{key: key, value: value})
+}
+
+// 在事务中删除 key；Abort 之后的写入被忽略
+func (tx *Txn) Delete(key int) {
+	tx.record(txnOp{key: key, delete: true})
+}
+
+func (tx *Txn) record(op txnOp) {
+	if tx.aborted {
+		return
+	}
+	if tx.last == nil {
+		tx.last = make(map[int]int)
+	}
+	tx.last[op.key] = len(tx.ops)
+	tx.ops = append(tx.ops, op)
+}
+
+// 读取 key：优先返回本事务中最后一次写入的结果，否则读取树的当前值
+func (tx *Txn) Get(key int) (interface{}, bool) {
+	if i, ok := tx.last[key]; ok {
+		op := tx.ops[i]
+		return op.value, !op.delete
+	}
+	return tx.get(key)
+}
+
+// 放弃事务：丢弃已缓冲的写入，事务函数返回后不提交
+func (tx *Txn) Abort() {
+	tx.aborted = true
+	tx.ops, tx.last = nil, nil
+}
+
+// 运行事务函数并返回需要提交的写入。fn panic 时 panic 原样向上传播，缓冲的写入随之丢弃
+func runTxn(get func(key int) (interface{}, bool), fn func(tx *Txn)) []txnOp {
+	tx := &Txn{get: get}
+	fn(tx)
+	if tx.aborted {
+		return nil
+	}
+	return tx.ops
+}
+
+func (t *RBTree) applyTxn(ops []txnOp) {
+	for _, op := range ops {
+		if op.delete {
+			t.Delete(op.key)
+		} else {
+			t.Insert(op.key, op.value)
+		}
+	}
+}
+
+// Txn 以全有或全无的方式执行 fn 中的插入和删除：fn 调用 tx.Abort 或 panic 时树保持原样，
+// 否则 fn 返回后按调用顺序应用所有写入
+func (t *RBTree) Txn(fn func(tx *Txn)) {
+	t.applyTxn(runTxn(t.Get, fn))
+}
+
+// 并发封装的 Txn：fn 在锁外执行（可以调用树的其他方法），tx.Get 读到的是树的实时值；
+// 提交在一次写锁内完成，其他操作要么看不到事务的任何写入，要么看到全部写入。
+// 事务之间不做隔离，需要基于读取结果决定写入时自行保证没有并发修改同一批 key
+func (s *ShardedRBTreeRW) Txn(fn func(tx *Txn)) {
+	ops := runTxn(s.Get, fn)
+	if len(ops) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tree.applyTxn(ops)
+}
+
+func (s *ShardedRBTreePath) Txn(fn func(tx *Txn)) {
+	ops := runTxn(s.Get, fn)
+	if len(ops) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tree.applyTxn(ops)
+}
+
+// 语义同 ShardedRBTreeRW.Txn，提交时持有所有分片的写锁
+func (s *ShardedRBTreeOpt) Txn(fn func(tx *Txn)) {
+	ops := runTxn(s.Get, fn)
+	if len(ops) == 0 {
+		return
+	}
+	s.withAllShardsLocked(func() {
+		for _, op := range ops {
+			sh := s.getShard(op.key)
+			if op.delete {
+				sh.tree.Delete(op.key)
+			} else {
+				sh.tree.Insert(op.key, op.value)
+			}
+		}
+	})
+}
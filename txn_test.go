@@ -0,0 +1,139 @@
+package rbtree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestRBTreeTxn(t *testing.T) {
+	tree := NewRBTree(newArena())
+	r := rand.New(rand.NewSource(4))
+	for i := 0; i < 500; i++ {
+		tree.Insert(r.Intn(1000), i)
+	}
+	shape, _ := tree.StructureJSON()
+	keys := fmt.Sprint(tree.Keys())
+	unchanged := func(what string) {
+		t.Helper()
+		if err := tree.Validate(); err != nil {
+			t.Fatalf("%s: %v", what, err)
+		}
+		got, _ := tree.StructureJSON()
+		if !bytes.Equal(got, shape) || fmt.Sprint(tree.Keys()) != keys {
+			t.Fatalf("%s left the tree modified", what)
+		}
+	}
+	writes := func(tx *Txn) {
+		for i := 0; i < 100; i++ {
+			if i%3 == 0 {
+				tx.Delete(r.Intn(1000))
+			} else {
+				tx.Insert(r.Intn(2000), -i)
+			}
+		}
+	}
+
+	tree.Txn(func(tx *Txn) {
+		writes(tx)
+		tx.Abort()
+		// Abort 之后的写入同样被忽略
+		tx.Insert(5000, "late")
+	})
+	unchanged("aborted transaction")
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("panic inside Txn should propagate")
+			}
+		}()
+		tree.Txn(func(tx *Txn) {
+			writes(tx)
+			panic("boom")
+		})
+	}()
+	unchanged("panicking transaction")
+
+	// 提交的结果与按顺序直接执行相同；事务内的 Get 能看到本事务的写入
+	ref := tree.Clone()
+	tree.Txn(func(tx *Txn) {
+		tx.Insert(3000, "a")
+		ref.Insert(3000, "a")
+		if v, ok := tx.Get(3000); !ok || v != "a" {
+			t.Fatalf("tx.Get should see the pending insert, got (%v, %v)", v, ok)
+		}
+		if _, ok := tree.Get(3000); ok {
+			t.Fatalf("pending insert must not be visible in the tree before commit")
+		}
+		k, _, _ := tree.Min()
+		tx.Delete(k)
+		ref.Delete(k)
+		if _, ok := tx.Get(k); ok {
+			t.Fatalf("tx.Get should see the pending delete")
+		}
+		tx.Insert(3000, "b")
+		ref.Insert(3000, "b")
+	})
+	if err := tree.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(tree.Keys()) != fmt.Sprint(ref.Keys()) || fmt.Sprint(tree.Values()) != fmt.Sprint(ref.Values()) {
+		t.Fatalf("committed transaction differs from applying the same operations directly")
+	}
+}
+
+func TestShardedTxnAtomicCommit(t *testing.T) {
+	type txnTree interface {
+		Tree
+		Txn(fn func(tx *Txn))
+	}
+	// 读取元素个数的一致视图
+	counts := map[string]func(Tree) int{
+		"RWLock":    func(tr Tree) int { return tr.(*ShardedRBTreeRW).Len() },
+		"PathLock":  func(tr Tree) int { return tr.(*ShardedRBTreePath).Len() },
+		"Optimized": func(tr Tree) int { _, _, n, _ := tr.(*ShardedRBTreeOpt).Summary(); return n },
+	}
+	trees := map[string]txnTree{
+		"RWLock":    &ShardedRBTreeRW{tree: NewRBTree(newArena())},
+		"PathLock":  &ShardedRBTreePath{tree: NewRBTree(newArena())},
+		"Optimized": NewShardedRBTreeOpt(8),
+	}
+	for name, tree := range trees {
+		const batch, rounds = 50, 40
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if n := counts[name](tree); n%batch != 0 {
+					t.Errorf("%s: observed %d entries, a partially committed transaction", name, n)
+					return
+				}
+			}
+		}()
+		for round := 0; round < rounds; round++ {
+			tree.Txn(func(tx *Txn) {
+				for i := 0; i < batch; i++ {
+					tx.Insert(round*batch+i, i)
+				}
+				if round%4 == 3 {
+					tx.Abort()
+				}
+			})
+		}
+		close(done)
+		wg.Wait()
+		if n := counts[name](tree); n != batch*rounds*3/4 {
+			t.Fatalf("%s: %d entries after commits, want %d", name, n, batch*rounds*3/4)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package rbtree
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+// ================= 结构校验 =================
+
+// Validate 检查树的结构完整性和红黑性质（根为黑、红节点没有红孩子、各路径黑高相同），
+// 发现问题时返回说明违反了哪条性质、出现在哪个 key 的错误。树正常时不分配内存，可用作运行时自检。
+func (t *RBTree) Validate() error {
+	if err := t.checkParents(); err != nil {
+		return err
+	}
+	if err := t.checkSizes(); err != nil {
+		return err
+	}
+	return t.checkColors()
+}
+
+// ValidateParallel 用有界的 worker 池并发校验每个分片（各自持读锁），
+// 发现问题时返回带分片下标的错误；多个分片出错时返回下标最小的那个。
+func (s *ShardedRBTreeOpt) ValidateParallel() error {
+	shards := s.shards()
+	errs := make([]error, len(shards))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	workers := min(runtime.GOMAXPROCS(0), len(shards))
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				sh := shards[i]
+				sh.rlock()
+				errs[i] = sh.tree.Validate()
+				sh.mu.RUnlock()
+			}
+		}()
+	}
+	for i := range shards {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// checkSizes 检查每个节点记录的子树大小与实际一致，且与树的元素个数一致
+func (t *RBTree) checkSizes() error {
+	total, err := checkSizesFrom(t.root)
+	if err != nil {
+		return err
+	}
+	if total != t.size {
+		return fmt.Errorf("rbtree: tree size %d, want %d", t.size, total)
+	}
+	return nil
+}
+
+// 递归部分写成普通函数而不是闭包，避免闭包逃逸带来的分配
+func checkSizesFrom(n *node) (int, error) {
+	if n == nil {
+		return 0, nil
+	}
+	l, err := checkSizesFrom(n.left)
+	if err != nil {
+		return 0, err
+	}
+	r, err := checkSizesFrom(n.right)
+	if err != nil {
+		return 0, err
+	}
+	if n.size != l+r+1 {
+		return 0, fmt.Errorf("rbtree: node %d has size %d, want %d", n.key, n.size, l+r+1)
+	}
+	return n.size, nil
+}
+
+// checkColors 检查红黑性质：根为黑色、红节点的孩子都是黑色、从任一节点到其下所有空叶子的黑节点数相同
+func (t *RBTree) checkColors() error {
+	if t.root == nil {
+		return nil
+	}
+	if t.root.color == red {
+		return fmt.Errorf("rbtree: root %d is red", t.root.key)
+	}
+	_, err := blackHeightFrom(t.root)
+	return err
+}
+
+// 返回 n 的黑高（不含 n 本身以下的空叶子），途中发现违反红黑性质时返回错误
+func blackHeightFrom(n *node) (int, error) {
+	if n == nil {
+		return 1, nil
+	}
+	if n.color == red {
+		if c := n.left; c != nil && c.color == red {
+			return 0, fmt.Errorf("rbtree: red node %d has red left child %d", n.key, c.key)
+		}
+		if c := n.right; c != nil && c.color == red {
+			return 0, fmt.Errorf("rbtree: red node %d has red right child %d", n.key, c.key)
+		}
+	}
+	l, err := blackHeightFrom(n.left)
+	if err != nil {
+		return 0, err
+	}
+	r, err := blackHeightFrom(n.right)
+	if err != nil {
+		return 0, err
+	}
+	if l != r {
+		return 0, fmt.Errorf("rbtree: node %d has black height %d on the left and %d on the right", n.key, l, r)
+	}
+	if n.color == black {
+		l++
+	}
+	return l, nil
+}
+
+// checkParents 检查每个子节点的 parent 指针都指向其真实父节点，且根节点的 parent 为 nil。
+// 旋转和 transplant 会大量改写 parent 指针，而颜色/黑高检查只关注颜色和子节点，发现不了这类错误。
+func (t *RBTree) checkParents() error {
+	if t.root == nil {
+		return nil
+	}
+	if t.root.parent != nil {
+		return fmt.Errorf("rbtree: root %d has non-nil parent %d", t.root.key, t.root.parent.key)
+	}
+	return checkParentsFrom(t.root)
+}
+
+func checkParentsFrom(n *node) error {
+	for _, c := range [2]*node{n.left, n.right} {
+		if c == nil {
+			continue
+		}
+		if c.parent != n {
+			if c.parent == nil {
+				return fmt.Errorf("rbtree: node %d has nil parent, want %d", c.key, n.key)
+			}
+			return fmt.Errorf("rbtree: node %d has parent %d, want %d", c.key, c.parent.key, n.key)
+		}
+		if err := checkParentsFrom(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PathExtremes 返回从根到任意空叶子的路径上节点数的最小值与最大值，一次遍历同时计算。
+// 红黑树保证 longest <= 2*shortest，可用于监控平衡质量；空树返回 (0, 0)。
+func (t *RBTree) PathExtremes() (shortest, longest int) {
+	if t.root == nil {
+		return 0, 0
+	}
+	shortest = -1
+	var walk func(n *node, depth int)
+	walk = func(n *node, depth int) {
+		if n == nil {
+			if shortest < 0 || depth < shortest {
+				shortest = depth
+			}
+			if depth > longest {
+				longest = depth
+			}
+			return
+		}
+		walk(n.left, depth+1)
+		walk(n.right, depth+1)
+	}
+	walk(t.root, 0)
+	return shortest, longest
+}
+
+// ================= 平衡统计 =================
+
+// 树的形状统计
+type TreeStats struct {
+	Size        int
+	Height      int // 最长的根到叶路径上的节点数
+	HeightBound int // 红黑树的理论高度上界 floor(2*log2(n+1))
+	BlackHeight int // 根到任一空叶子路径上的黑节点数
+	MinKey      int // 空树时为 0
+	MaxKey      int // 空树时为 0
+}
+
+// Height 返回最长的根到叶路径上的节点数，空树为 0
+func (t *RBTree) Height() int {
+	return heightFrom(t.root)
+}
+
+func heightFrom(n *node) int {
+	if n == nil {
+		return 0
+	}
+	return 1 + max(heightFrom(n.left), heightFrom(n.right))
+}
+
+// BlackHeight 返回根到空叶子路径上的黑节点数（沿最左路径统计，树合法时与路径无关），空树为 0
+func (t *RBTree) BlackHeight() int {
+	h := 0
+	for n := t.root; n != nil; n = n.left {
+		if n.color == black {
+			h++
+		}
+	}
+	return h
+}
+
+// Stats 返回树的大小、高度、理论高度上界、黑高和最小/最大 key，只读
+func (t *RBTree) Stats() TreeStats {
+	st := TreeStats{
+		Size:        t.size,
+		Height:      t.Height(),
+		HeightBound: int(2 * math.Log2(float64(t.size+1))),
+		BlackHeight: t.BlackHeight(),
+	}
+	if t.root != nil {
+		st.MinKey = t.minimum(t.root).key
+		st.MaxKey = t.maximum(t.root).key
+	}
+	return st
+}
+
+// ApproxMemBytes 估算树占用的内存：节点数 * 节点大小，加上 valueSize 对每个 value 估算的字节数之和。
+// valueSize 为 nil 时只计节点本身（value 的 interface{} 头已含在节点大小中）；
+// DupCount 的重数不占额外节点，arena 池中缓存的空闲节点也不计入
+func (t *RBTree) ApproxMemBytes(valueSize func(v interface{}) int64) int64 {
+	total := int64(t.size) * int64(unsafe.Sizeof(node{}))
+	if valueSize != nil {
+		t.forEach(func(_ int, v interface{}) bool {
+			total += valueSize(v)
+			return true
+		})
+	}
+	return total
+}
+
+// 在读锁内返回底层树的形状统计
+func (s *ShardedRBTreeRW) Stats() TreeStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.Stats()
+}
+
+func (s *ShardedRBTreePath) Stats() TreeStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Stats()
+}
+
+// 逐分片在各自的读锁内返回形状统计，下标与分片下标一致
+func (s *ShardedRBTreeOpt) ShardStats() []TreeStats {
+	shards := s.shards()
+	stats := make([]TreeStats, len(shards))
+	for i, sh := range shards {
+		sh.rlock()
+		stats[i] = sh.tree.Stats()
+		sh.mu.RUnlock()
+	}
+	return stats
+}
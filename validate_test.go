@@ -0,0 +1,241 @@
+package rbtree
+
+import (
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+// ----------------- parent 指针校验测试 -----------------
+func TestRBTreeCheckParents(t *testing.T) {
+	tree := NewRBTree(newArena())
+	N := 1000
+	for i := 0; i < N; i++ {
+		tree.Insert(i, i)
+	}
+	for i := 0; i < N; i += 3 {
+		tree.Delete(i)
+	}
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("Validate on healthy tree: %v", err)
+	}
+
+	// 人为破坏一个深层节点的 parent 指针
+	n := tree.root
+	for n.left != nil && n.left.left != nil {
+		n = n.left
+	}
+	child := n.left
+	child.parent = tree.root
+	if err := tree.checkParents(); err == nil {
+		t.Fatalf("checkParents should report corrupted parent of key %d", child.key)
+	}
+	if err := tree.Validate(); err == nil {
+		t.Fatalf("Validate should report corrupted parent of key %d", child.key)
+	}
+	child.parent = n
+
+	// 根节点的 parent 必须为 nil
+	tree.root.parent = n
+	if err := tree.checkParents(); err == nil {
+		t.Fatalf("checkParents should report non-nil root parent")
+	}
+	tree.root.parent = nil
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("Validate after repair: %v", err)
+	}
+}
+
+// ----------------- 红黑性质校验测试 -----------------
+func TestRBTreeValidateColors(t *testing.T) {
+	tree := NewRBTree(newArena())
+	for i := 0; i < 1000; i++ {
+		tree.Insert(i, i)
+	}
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("Validate on healthy tree: %v", err)
+	}
+	if allocs := testing.AllocsPerRun(10, func() { tree.Validate() }); allocs != 0 {
+		t.Fatalf("Validate on healthy tree allocated %v times, want 0", allocs)
+	}
+
+	expect := func(what, substr string) {
+		t.Helper()
+		err := tree.Validate()
+		if err == nil || !strings.Contains(err.Error(), substr) {
+			t.Fatalf("%s: got %v, want error containing %q", what, err, substr)
+		}
+	}
+
+	// 根为红色
+	tree.root.color = red
+	expect("red root", "root")
+	tree.root.color = black
+
+	// 红节点有红孩子：找一个黑节点下的红孩子，把它的孩子也染红
+	var parent *node
+	for n := tree.minimum(tree.root); n != nil; n = successor(n) {
+		if n.color == red && n.left != nil {
+			parent = n
+			break
+		}
+	}
+	if parent == nil {
+		t.Fatalf("no red node with a child")
+	}
+	child := parent.left
+	child.color = red
+	expect("red-red", fmt.Sprintf("red node %d", parent.key))
+	child.color = black
+
+	// 黑高不一致：把一个黑色叶子染红
+	var leaf *node
+	for n := tree.minimum(tree.root); n != nil; n = successor(n) {
+		if n.color == black && n.left == nil && n.right == nil {
+			leaf = n
+			break
+		}
+	}
+	if leaf == nil {
+		t.Fatalf("no black leaf")
+	}
+	leaf.color = red
+	expect("black height", "black height")
+	leaf.color = black
+
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("Validate after repair: %v", err)
+	}
+}
+
+// ----------------- 路径长度极值测试 -----------------
+func TestRBTreePathExtremes(t *testing.T) {
+	tree := NewRBTree(newArena())
+	if s, l := tree.PathExtremes(); s != 0 || l != 0 {
+		t.Fatalf("PathExtremes on empty tree: got (%d, %d), want (0, 0)", s, l)
+	}
+
+	tree.Insert(1, 1)
+	if s, l := tree.PathExtremes(); s != 1 || l != 1 {
+		t.Fatalf("PathExtremes on single node: got (%d, %d), want (1, 1)", s, l)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		k := r.Intn(50000)
+		if r.Intn(4) == 0 {
+			tree.Delete(k)
+		} else {
+			tree.Insert(k, k)
+		}
+	}
+	s, l := tree.PathExtremes()
+	if s <= 0 || l < s {
+		t.Fatalf("PathExtremes: invalid (%d, %d)", s, l)
+	}
+	if l > 2*s {
+		t.Fatalf("PathExtremes: longest %d exceeds 2*shortest %d", l, 2*s)
+	}
+}
+
+// ----------------- 平衡统计测试 -----------------
+func TestRBTreeStats(t *testing.T) {
+	tree := NewRBTree(newArena())
+	if st := tree.Stats(); st != (TreeStats{}) {
+		t.Fatalf("Stats on empty tree: %+v", st)
+	}
+	tree.Insert(7, 7)
+	if st := tree.Stats(); st.Size != 1 || st.Height != 1 || st.BlackHeight != 1 || st.MinKey != 7 || st.MaxKey != 7 {
+		t.Fatalf("Stats on single node: %+v", st)
+	}
+	// 顺序插入是最容易退化的情况
+	for i := 0; i < 100000; i++ {
+		tree.Insert(i, i)
+	}
+	st := tree.Stats()
+	if st.Size != 100000 || st.MinKey != 0 || st.MaxKey != 99999 {
+		t.Fatalf("Stats: %+v", st)
+	}
+	if st.Height > st.HeightBound || st.Height < bits.Len(uint(st.Size)) {
+		t.Fatalf("Height %d outside [%d, %d]", st.Height, bits.Len(uint(st.Size)), st.HeightBound)
+	}
+	_, longest := tree.PathExtremes()
+	if st.Height != longest {
+		t.Fatalf("Height %d, PathExtremes longest %d", st.Height, longest)
+	}
+	// 黑高至少是高度的一半
+	if st.BlackHeight <= 0 || 2*st.BlackHeight < st.Height {
+		t.Fatalf("BlackHeight %d inconsistent with Height %d", st.BlackHeight, st.Height)
+	}
+
+	rw := &ShardedRBTreeRW{tree: tree}
+	if got := rw.Stats(); got != st {
+		t.Fatalf("RWLock Stats: got %+v, want %+v", got, st)
+	}
+	opt := NewShardedRBTreeOpt(4)
+	for i := 0; i < 1000; i++ {
+		opt.Insert(i, i)
+	}
+	total := 0
+	for i, s := range opt.ShardStats() {
+		if s.Size > 0 && s.Height > s.HeightBound {
+			t.Fatalf("shard %d: Height %d exceeds bound %d", i, s.Height, s.HeightBound)
+		}
+		total += s.Size
+	}
+	if total != 1000 {
+		t.Fatalf("ShardStats sizes sum to %d, want 1000", total)
+	}
+}
+
+// ----------------- 分片并行校验测试 -----------------
+func TestShardedRBTreeOptValidateParallel(t *testing.T) {
+	tree := NewShardedRBTreeOpt(8)
+	for i := 0; i < 4000; i++ {
+		tree.Insert(i, i)
+	}
+	if err := tree.ValidateParallel(); err != nil {
+		t.Fatalf("ValidateParallel on healthy tree: %v", err)
+	}
+
+	// 破坏 5 号分片中一个节点的子树大小
+	bad := tree.shards()[5].tree
+	bad.root.left.size++
+	err := tree.ValidateParallel()
+	if err == nil {
+		t.Fatalf("ValidateParallel should report the corrupted shard")
+	}
+	if !strings.Contains(err.Error(), "shard 5:") {
+		t.Fatalf("ValidateParallel error should name shard 5, got %q", err)
+	}
+	bad.root.left.size--
+	if err := tree.ValidateParallel(); err != nil {
+		t.Fatalf("ValidateParallel after repair: %v", err)
+	}
+
+	if err := NewShardedRBTreeOpt(3).ValidateParallel(); err != nil {
+		t.Fatalf("ValidateParallel on empty tree: %v", err)
+	}
+}
+
+func TestRBTreeApproxMemBytes(t *testing.T) {
+	tree := NewRBTree(newArena())
+	if n := tree.ApproxMemBytes(nil); n != 0 {
+		t.Fatalf("ApproxMemBytes on empty tree = %d, want 0", n)
+	}
+	for i := 0; i < 100; i++ {
+		tree.Insert(i, make([]byte, i))
+	}
+	nodeBytes := int64(100 * unsafe.Sizeof(node{}))
+	if n := tree.ApproxMemBytes(nil); n != nodeBytes {
+		t.Fatalf("ApproxMemBytes(nil) = %d, want %d", n, nodeBytes)
+	}
+	// 0 + 1 + ... + 99
+	n := tree.ApproxMemBytes(func(v interface{}) int64 { return int64(cap(v.([]byte))) })
+	if n != nodeBytes+4950 {
+		t.Fatalf("ApproxMemBytes with value sizes = %d, want %d", n, nodeBytes+4950)
+	}
+}
@@ -0,0 +1,54 @@
+package rbtree
+
+// ================= 区间视图 =================
+
+// RangeView 是限定在 [start, end] 内的只读视图，直接读取底层树（不复制），
+// 树的后续修改对视图立即可见。视图本身不加锁，并发使用时由调用方保证同步。
+type RangeView struct {
+	tree       *RBTree
+	start, end int
+}
+
+// 返回限定在 [start, end] 内的只读视图，用于把调用方隔离在自己的分区内。start > end 时视图为空。
+func (t *RBTree) SubView(start, end int) *RangeView {
+	return &RangeView{tree: t, start: start, end: end}
+}
+
+func (v *RangeView) contains(key int) bool {
+	return key >= v.start && key <= v.end
+}
+
+// 查询 key，区间外的 key 一律视为不存在
+func (v *RangeView) Get(key int) (interface{}, bool) {
+	if !v.contains(key) {
+		return nil, false
+	}
+	return v.tree.Get(key)
+}
+
+// 区间内的最小 key
+func (v *RangeView) Min() (int, interface{}, bool) {
+	n := v.tree.ceiling(v.start)
+	if n == nil || !v.contains(n.key) {
+		return 0, nil, false
+	}
+	return n.key, n.value, true
+}
+
+// 区间内的最大 key
+func (v *RangeView) Max() (int, interface{}, bool) {
+	n := v.tree.floor(v.end)
+	if n == nil || !v.contains(n.key) {
+		return 0, nil, false
+	}
+	return n.key, n.value, true
+}
+
+// 按升序访问 [start, end] 与视图区间的交集
+func (v *RangeView) Range(start, end int, fn func(key int, value interface{}) bool) {
+	start, end = max(start, v.start), min(end, v.end)
+	if start > end {
+		return
+	}
+	v.tree.Range(start, end, fn)
+}
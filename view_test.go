@@ -0,0 +1,63 @@
+package rbtree
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRBTreeSubView(t *testing.T) {
+	tree := NewRBTree(newArena())
+	for i := 0; i < 100; i++ {
+		tree.Insert(i*2, i)
+	}
+	view := tree.SubView(21, 60)
+
+	if _, ok := view.Get(10); ok {
+		t.Fatalf("Get(10) outside the view should return false")
+	}
+	if _, ok := view.Get(100); ok {
+		t.Fatalf("Get(100) outside the view should return false")
+	}
+	if v, ok := view.Get(40); !ok || v.(int) != 20 {
+		t.Fatalf("Get(40): got %v (ok=%v), want 20", v, ok)
+	}
+
+	if k, _, ok := view.Min(); !ok || k != 22 {
+		t.Fatalf("Min: got %d (ok=%v), want 22", k, ok)
+	}
+	if k, _, ok := view.Max(); !ok || k != 60 {
+		t.Fatalf("Max: got %d (ok=%v), want 60", k, ok)
+	}
+
+	var keys []int
+	view.Range(0, 30, func(k int, _ interface{}) bool {
+		keys = append(keys, k)
+		return true
+	})
+	if fmt.Sprint(keys) != "[22 24 26 28 30]" {
+		t.Fatalf("Range(0, 30): got %v", keys)
+	}
+	count := 0
+	view.Range(-1000, 1000, func(int, interface{}) bool {
+		count++
+		return true
+	})
+	if count != 20 {
+		t.Fatalf("Range over the whole view visited %d keys, want 20", count)
+	}
+
+	// 视图是实时的，不是副本
+	tree.Insert(21, "new")
+	if k, _, ok := view.Min(); !ok || k != 21 {
+		t.Fatalf("Min after insert: got %d (ok=%v), want 21", k, ok)
+	}
+
+	// 区间内没有 key 的视图
+	empty := tree.SubView(1001, 2000)
+	if _, _, ok := empty.Min(); ok {
+		t.Fatalf("Min of an empty view should return false")
+	}
+	if _, _, ok := empty.Max(); ok {
+		t.Fatalf("Max of an empty view should return false")
+	}
+}